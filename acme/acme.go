@@ -1,6 +1,7 @@
 package acme
 
 import (
+	"bytes"
 	"context"
 	"crypto"
 	"crypto/ecdsa"
@@ -10,12 +11,14 @@ import (
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-acme/lego/v4/certcrypto"
@@ -27,11 +30,43 @@ import (
 	"github.com/go-acme/lego/v4/registration"
 )
 
+const (
+	defaultRenewalCheckInterval    = time.Hour * 12
+	defaultRenewalFailureThreshold = 3
+	defaultExpiringCertThreshold   = time.Hour * 24
+	defaultCacheCleanupInterval    = time.Hour * 6
+	renewalAlertTimeout            = time.Second * 10
+)
+
+var ErrCertExpiring = errors.New("certificate is expired or about to expire")
+
+// ExpiringCertPolicy decides what happens to TLS handshakes if the only certificate for the server name
+// is expired or about to expire, which usually means renewals keep failing
+type ExpiringCertPolicy string
+
+const (
+	// ExpiringCertPolicyServe serves the certificate anyway and logs a warning
+	ExpiringCertPolicyServe ExpiringCertPolicy = "serve"
+	// ExpiringCertPolicyReject fails the handshake instead of serving the certificate
+	ExpiringCertPolicyReject ExpiringCertPolicy = "reject"
+)
+
+func (p ExpiringCertPolicy) IsValid() error {
+	switch p {
+	case "", ExpiringCertPolicyServe, ExpiringCertPolicyReject:
+		return nil
+	default:
+		return fmt.Errorf("invalid expiring certificate policy '%s'", p)
+	}
+}
+
 const (
 	userFile             = "user.json"
 	domainPrivateKeyFile = "private.key.pem"
 	certCacheFile        = "certs.json"
 	pemTypeEcPrivateKey  = "EC PRIVATE KEY"
+	pemTypeRsaPrivateKey = "RSA PRIVATE KEY"
+	pemTypePrivateKey    = "PRIVATE KEY"
 )
 
 type DNS01Config struct {
@@ -41,13 +76,38 @@ type DNS01Config struct {
 }
 
 type Config struct {
-	Dir             string        `mapstructure:"dir"`
-	Email           string        `mapstructure:"email"`
-	CAUrl           string        `mapstructure:"caUrl"`
-	RenewalInterval time.Duration `mapstructure:"renewalInterval"`
-	AutomaticRenew  bool          `mapstructure:"automaticRenew"`
-	DNS01           *DNS01Config  `mapstructure:"dns01"`
-	DefaultHostname string        `mapstructure:"defaultHostname"`
+	Dir                  string        `mapstructure:"dir"`
+	Email                string        `mapstructure:"email"`
+	CAUrl                string        `mapstructure:"caUrl"`
+	RenewalInterval      time.Duration `mapstructure:"renewalInterval"`
+	RenewalCheckInterval time.Duration `mapstructure:"renewalCheckInterval"`
+	CacheLockTimeout     time.Duration `mapstructure:"cacheLockTimeout"`
+	AutomaticRenew       bool          `mapstructure:"automaticRenew"`
+	DNS01                *DNS01Config  `mapstructure:"dns01"`
+	DefaultHostname      string        `mapstructure:"defaultHostname"`
+	PerDomainFallback    bool          `mapstructure:"perDomainFallback"`
+
+	// External account binding credentials, required by CAs like ZeroSSL or Google to link the ACME account
+	// to an existing account at the CA. The HMAC key is base64url encoded as handed out by the CA.
+	EABKeyID   string `mapstructure:"eabKeyId"`
+	EABHMACKey string `mapstructure:"eabHmacKey" secret:"true"`
+
+	// The directory and the keys, user data and certificates in it are created with these permissions
+	// and, if set, owned by Owner (user:group by name or id), so a process with dropped privileges can use them
+	DirMode  os.FileMode `mapstructure:"dirMode"`
+	FileMode os.FileMode `mapstructure:"fileMode"`
+	Owner    string      `mapstructure:"owner"`
+
+	// After this many consecutive failed renewal checks an alert is logged and sent to the alert webhook
+	RenewalFailureThreshold int    `mapstructure:"renewalFailureThreshold"`
+	RenewalAlertWebhook     string `mapstructure:"renewalAlertWebhook" secret:"url"`
+
+	// Certificates expiring within the threshold are handled according to the ExpiringCertPolicy
+	ExpiringCertPolicy    ExpiringCertPolicy `mapstructure:"expiringCertPolicy"`
+	ExpiringCertThreshold time.Duration      `mapstructure:"expiringCertThreshold"`
+
+	// How often expired certificates are removed from the certificate cache
+	CacheCleanupInterval time.Duration `mapstructure:"cacheCleanupInterval"`
 
 	dns01Provider challenge.Provider
 	httpClient    *http.Client // Set custom http client for testing
@@ -63,6 +123,15 @@ func (c *Config) IsValid() error {
 	if c.DNS01.ProviderName == "" {
 		return fmt.Errorf("you need to specify a DNS-01 provider name, see https://go-acme.github.io/lego/dns/index.html")
 	}
+	if err := c.ExpiringCertPolicy.IsValid(); err != nil {
+		return err
+	}
+	if (c.EABKeyID == "") != (c.EABHMACKey == "") {
+		return fmt.Errorf("external account binding requires both a key id and a HMAC key")
+	}
+	if _, _, err := parseOwner(c.Owner); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -73,7 +142,12 @@ type AcmeTls struct {
 	acmeClient       *lego.Client
 	domainPrivateKey *ecdsa.PrivateKey
 
-	logger *slog.Logger
+	// renewalLock serializes renewals, reloads and the removal of expired certificates
+	renewalLock     sync.Mutex
+	renewalFailures int
+
+	metrics *acmeMetrics
+	logger  *slog.Logger
 }
 
 type acmeUser struct {
@@ -101,13 +175,35 @@ func NewAcme(ctx context.Context, logger *slog.Logger, cfg *Config) (*AcmeTls, e
 	if cfg.CAUrl == "" {
 		cfg.CAUrl = "https://acme-v02.api.letsencrypt.org/directory"
 	}
-	if err := os.MkdirAll(cfg.Dir, 0770); err != nil {
-		return nil, fmt.Errorf("failed to ensure acme directory %s exists: %w", cfg.Dir, err)
+	if cfg.RenewalCheckInterval <= 0 {
+		cfg.RenewalCheckInterval = defaultRenewalCheckInterval
+	}
+	if cfg.RenewalFailureThreshold <= 0 {
+		cfg.RenewalFailureThreshold = defaultRenewalFailureThreshold
+	}
+	if cfg.ExpiringCertPolicy == "" {
+		cfg.ExpiringCertPolicy = ExpiringCertPolicyServe
+	}
+	if cfg.ExpiringCertThreshold <= 0 {
+		cfg.ExpiringCertThreshold = defaultExpiringCertThreshold
+	}
+	if cfg.CacheCleanupInterval <= 0 {
+		cfg.CacheCleanupInterval = defaultCacheCleanupInterval
+	}
+	if cfg.DirMode == 0 {
+		cfg.DirMode = defaultDirMode
+	}
+	if cfg.FileMode == 0 {
+		cfg.FileMode = defaultFileMode
 	}
 
 	a := &AcmeTls{
-		cfg:    cfg,
-		logger: logger,
+		cfg:     cfg,
+		metrics: newAcmeMetrics(),
+		logger:  logger,
+	}
+	if err := a.prepareDir(); err != nil {
+		return nil, err
 	}
 	domainPrivateKey, err := a.loadDomainPrivateKey()
 	if err != nil {
@@ -115,7 +211,8 @@ func NewAcme(ctx context.Context, logger *slog.Logger, cfg *Config) (*AcmeTls, e
 	}
 	a.domainPrivateKey = domainPrivateKey
 
-	a.ModifiableCertCache, err = NewFileBackedCache(filepath.Join(a.cfg.Dir, certCacheFile))
+	a.ModifiableCertCache, err = NewFileBackedCache(filepath.Join(a.cfg.Dir, certCacheFile),
+		WithLockTimeout(a.cfg.CacheLockTimeout), WithFileMode(a.cfg.FileMode), WithOwner(a.cfg.Owner))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create certificate cache: %w", err)
 	}
@@ -166,15 +263,26 @@ func NewAcme(ctx context.Context, logger *slog.Logger, cfg *Config) (*AcmeTls, e
 	if cfg.AutomaticRenew {
 		go a.goCheckRenew(ctx)
 	}
+	go a.goCleanupExpired(ctx)
 	return a, nil
 }
 
 func (a *AcmeTls) ensureRegistration(user *acmeUser) error {
 	if user.Registration == nil {
 		// Register new user
-		reg, err := a.acmeClient.Registration.Register(registration.RegisterOptions{
-			TermsOfServiceAgreed: true,
-		})
+		var reg *registration.Resource
+		var err error
+		if a.cfg.EABKeyID != "" {
+			reg, err = a.acmeClient.Registration.RegisterWithExternalAccountBinding(registration.RegisterEABOptions{
+				TermsOfServiceAgreed: true,
+				Kid:                  a.cfg.EABKeyID,
+				HmacEncoded:          a.cfg.EABHMACKey,
+			})
+		} else {
+			reg, err = a.acmeClient.Registration.Register(registration.RegisterOptions{
+				TermsOfServiceAgreed: true,
+			})
+		}
 		if err != nil {
 			return fmt.Errorf("failed to register acme user %s: %w", a.cfg.Email, err)
 		}
@@ -193,37 +301,165 @@ func (a *AcmeTls) CheckRenew() (err error) {
 		return fmt.Errorf("failed to query expiring domains: %w", err)
 	}
 	for _, domains := range renewDomains {
-		if err := a.requestCertificate(domains...); err != nil {
+		if err := a.renewCertificate(domains...); err != nil {
 			return fmt.Errorf("failed to renew domains [%s]: %w", strings.Join(domains, ","), err)
 		}
 	}
 	return nil
 }
 
+// renewCertificate requests a new certificate for domains and records failures per domain
+func (a *AcmeTls) renewCertificate(domains ...string) error {
+	err := a.requestCertificate(domains...)
+	if err == nil {
+		return nil
+	}
+	for _, domain := range domains {
+		a.metrics.renewalFailures.WithLabelValues(domain).Inc()
+		a.logger.Error("failed to renew certificate", "domain", domain, "legoErr", err)
+	}
+	return err
+}
+
 func (a *AcmeTls) goCheckRenew(ctx context.Context) {
 	logger := a.logger.With("component", "acme.goCheckRenew")
-	cctx, cancel := context.WithCancel(ctx)
-	tick := time.NewTicker(time.Hour * 12)
-	defer cancel()
-	if err := a.CheckRenew(); err != nil {
-		logger.Error("failed to automatically renew certificates", "err", err)
+	tick := time.NewTicker(a.cfg.RenewalCheckInterval)
+	defer tick.Stop()
+	a.checkRenewAndAlert(ctx, logger)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			a.checkRenewAndAlert(ctx, logger)
+		}
 	}
+}
+
+// checkRenewAndAlert runs CheckRenew and escalates once renewals failed too many times in a row,
+// so operators can intervene before the certificates expire
+func (a *AcmeTls) checkRenewAndAlert(ctx context.Context, logger *slog.Logger) {
+	a.renewalLock.Lock()
+	defer a.renewalLock.Unlock()
+	err := a.CheckRenew()
+	if err == nil {
+		a.renewalFailures = 0
+		return
+	}
+	a.renewalFailures++
+	logger.Error("failed to automatically renew certificates", "err", err, "consecutiveFailures", a.renewalFailures)
+	if a.renewalFailures < a.cfg.RenewalFailureThreshold {
+		return
+	}
+	logger.Error("certificate renewal keeps failing, manual intervention required", "err", err,
+		"consecutiveFailures", a.renewalFailures, "alert", true)
+	if a.cfg.RenewalAlertWebhook != "" {
+		if err := a.sendRenewalAlert(ctx, a.renewalFailures, err); err != nil {
+			logger.Error("failed to send renewal alert", "err", err, "webhook", a.cfg.RenewalAlertWebhook)
+		}
+	}
+}
+
+// expiredCertCleaner is implemented by certificate caches which can remove their expired certificates
+type expiredCertCleaner interface {
+	CleanupExpired() error
+}
+
+func (a *AcmeTls) goCleanupExpired(ctx context.Context) {
+	logger := a.logger.With("component", "acme.goCleanupExpired")
+	tick := time.NewTicker(a.cfg.CacheCleanupInterval)
+	defer tick.Stop()
 	for {
 		select {
-		case <-cctx.Done():
-			tick.Stop()
+		case <-ctx.Done():
 			return
 		case <-tick.C:
-			if err := a.CheckRenew(); err != nil {
-				logger.Error("failed to automatically renew certificates", "err", err)
+			if err := a.cleanupExpired(); err != nil {
+				logger.Error("failed to remove expired certificates", "err", err)
 			}
-		default:
-			// Sleep a bit to yield the goroutine
-			time.Sleep(time.Second * 10)
 		}
 	}
 }
 
+// reloadableCertCache is implemented by certificate caches which can read their certificates again from storage
+type reloadableCertCache interface {
+	Reload() error
+}
+
+// ReloadCertificates reads the certificates again from the certificate cache, so certificates which were
+// put into the cache by other processes are served without a restart.
+func (a *AcmeTls) ReloadCertificates() error {
+	reloader, ok := a.ModifiableCertCache.(reloadableCertCache)
+	if !ok {
+		return nil
+	}
+	a.renewalLock.Lock()
+	defer a.renewalLock.Unlock()
+	if err := reloader.Reload(); err != nil {
+		return fmt.Errorf("failed to reload certificate cache: %w", err)
+	}
+	return nil
+}
+
+// cleanupExpired removes expired certificates from the cache. An expired certificate is the only record
+// of the domains it needs to be renewed for, so with automatic renewal enabled expired certificates are
+// renewed first and nothing is removed if that fails.
+func (a *AcmeTls) cleanupExpired() error {
+	cleaner, ok := a.ModifiableCertCache.(expiredCertCleaner)
+	if !ok {
+		return nil
+	}
+	a.renewalLock.Lock()
+	defer a.renewalLock.Unlock()
+	if a.cfg.AutomaticRenew {
+		expiredDomains, err := a.ExpiringDomains(0)
+		if err != nil {
+			return fmt.Errorf("failed to query expired domains: %w", err)
+		}
+		for _, domains := range expiredDomains {
+			if err := a.renewCertificate(domains...); err != nil {
+				return fmt.Errorf("failed to renew expired domains [%s] before cleanup: %w", strings.Join(domains, ","), err)
+			}
+		}
+	}
+	return cleaner.CleanupExpired()
+}
+
+type renewalAlert struct {
+	Message             string    `json:"message"`
+	Error               string    `json:"error"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	Time                time.Time `json:"time"`
+}
+
+func (a *AcmeTls) sendRenewalAlert(ctx context.Context, failures int, renewErr error) error {
+	payload, err := json.Marshal(&renewalAlert{
+		Message:             "certificate renewal keeps failing, manual intervention required",
+		Error:               renewErr.Error(),
+		ConsecutiveFailures: failures,
+		Time:                time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal renewal alert: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, renewalAlertTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.cfg.RenewalAlertWebhook, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create renewal alert request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post renewal alert: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("renewal alert webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
 func (a *AcmeTls) requestCertificate(domains ...string) error {
 	logger := a.logger.With("requestingDomains", strings.Join(domains, ","))
 	logger.Info("requesting certificate for domains")
@@ -237,17 +473,37 @@ func (a *AcmeTls) requestCertificate(domains ...string) error {
 		logger.With("err", err).Error("failed to request certificates for domains")
 		return fmt.Errorf("failed to obtain certificate: %w", err)
 	}
-	return a.AddCertificate(certResource.Certificate, a.domainPrivateKey)
+	if err := a.AddCertificate(certResource.Certificate, a.domainPrivateKey); err != nil {
+		return err
+	}
+	for _, domain := range domains {
+		a.metrics.certificatesIssued.WithLabelValues(domain).Inc()
+	}
+	return nil
 }
 
-// ObtainCertificate obtains a certificate for every specified domain and puts it into the CertCache
+// ValidateDomain checks that a domain to obtain a certificate for is either a concrete domain or a
+// wildcard covering a single leftmost label like *.example.com
+func ValidateDomain(domain string) error {
+	if !strings.Contains(domain, "*") {
+		return nil
+	}
+	base, isWildcard := strings.CutPrefix(domain, "*.")
+	if !isWildcard || strings.Contains(base, "*") || !strings.Contains(base, ".") {
+		return fmt.Errorf("invalid wildcard domain '%s', only wildcards like *.example.com are supported", domain)
+	}
+	return nil
+}
+
+// ObtainCertificate obtains a certificate for every specified domain and puts it into the CertCache.
+// Wildcard domains like *.example.com are supported, their certificate is served for every direct subdomain.
 func (a *AcmeTls) ObtainCertificate(domains ...string) error {
 	domainsToObtain := []string{}
 	logger := a.logger.With("domains", strings.Join(domains, ","))
 
 	// Do not try to obtain certificates for domains we already have valid certs for
 	for _, domain := range domains {
-		cert, err := a.GetCertForDomain(domain)
+		cert, err := a.ModifiableCertCache.GetCertForDomain(domain)
 		if err != nil || a.isCertExpired(cert) {
 			logger.With("err", err, "domain", domain).Info("certificate for domain not in cache or expired")
 			domainsToObtain = append(domainsToObtain, domain)
@@ -259,7 +515,24 @@ func (a *AcmeTls) ObtainCertificate(domains ...string) error {
 		// Nothing to do we have all the domains already
 		return nil
 	}
-	return a.requestCertificate(domainsToObtain...)
+	err := a.requestCertificate(domainsToObtain...)
+	if err == nil || !a.cfg.PerDomainFallback || len(domainsToObtain) < 2 {
+		return err
+	}
+	logger.Warn("failed to obtain certificate for all domains, falling back to a certificate per domain", "err", err)
+	return a.requestCertificatePerDomain(domainsToObtain...)
+}
+
+// requestCertificatePerDomain requests a separate certificate for every domain, so a domain failing
+// validation doesn't prevent the other domains from getting a certificate
+func (a *AcmeTls) requestCertificatePerDomain(domains ...string) error {
+	errs := []error{}
+	for _, domain := range domains {
+		if err := a.requestCertificate(domain); err != nil {
+			errs = append(errs, fmt.Errorf("failed to obtain certificate for %s: %w", domain, err))
+		}
+	}
+	return errors.Join(errs...)
 }
 
 func (a *AcmeTls) isCertExpired(tlsCert *tls.Certificate) bool {
@@ -279,6 +552,43 @@ func (a *AcmeTls) isCertExpired(tlsCert *tls.Certificate) bool {
 	return false
 }
 
+// GetCertForDomain returns the cached certificate for the domain. Certificates which are expired or expire
+// within the ExpiringCertThreshold are served with a warning or rejected, depending on the ExpiringCertPolicy.
+func (a *AcmeTls) GetCertForDomain(domain string) (*tls.Certificate, error) {
+	tlsCert, err := a.ModifiableCertCache.GetCertForDomain(domain)
+	if err != nil {
+		return nil, err
+	}
+	notAfter, err := certNotAfter(tlsCert)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate for %s: %w", domain, err)
+	}
+	if time.Now().Add(a.cfg.ExpiringCertThreshold).Before(notAfter) {
+		return tlsCert, nil
+	}
+	logger := a.logger.With("domain", domain, "notAfter", notAfter)
+	if a.cfg.ExpiringCertPolicy == ExpiringCertPolicyReject {
+		logger.Error("refusing to serve certificate which is expired or about to expire")
+		return nil, fmt.Errorf("%w: certificate for %s is valid until %s", ErrCertExpiring, domain, notAfter)
+	}
+	logger.Warn("serving certificate which is expired or about to expire")
+	return tlsCert, nil
+}
+
+// certNotAfter returns the earliest expiry date of all certificates in the chain
+func certNotAfter(tlsCert *tls.Certificate) (notAfter time.Time, err error) {
+	for _, derBytes := range tlsCert.Certificate {
+		cert, err := x509.ParseCertificate(derBytes)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if notAfter.IsZero() || cert.NotAfter.Before(notAfter) {
+			notAfter = cert.NotAfter
+		}
+	}
+	return notAfter, nil
+}
+
 func (a *AcmeTls) loadDomainPrivateKey() (key *ecdsa.PrivateKey, err error) {
 	privKeyPath := filepath.Join(a.cfg.Dir, domainPrivateKeyFile)
 	pemData, err := os.ReadFile(privKeyPath)
@@ -297,16 +607,10 @@ func (a *AcmeTls) loadDomainPrivateKey() (key *ecdsa.PrivateKey, err error) {
 			Type:  pemTypeEcPrivateKey,
 			Bytes: derBytes,
 		}
-		privKeyFile, err := os.OpenFile(privKeyPath, os.O_CREATE|os.O_WRONLY, 0660)
-		if err != nil {
-			return nil, fmt.Errorf("failed to open private key file %s: %w", privKeyPath, err)
-		}
-		defer privKeyFile.Close()
-		err = pem.Encode(privKeyFile, pemBlock)
-		if err != nil {
+		if err := a.writeFile(privKeyPath, pem.EncodeToMemory(pemBlock)); err != nil {
 			return nil, fmt.Errorf("failed to write private key to file %s: %w", privKeyPath, err)
 		}
-		return key, err
+		return key, nil
 	}
 	block, _ := pem.Decode(pemData)
 	if block.Type != pemTypeEcPrivateKey {
@@ -331,7 +635,7 @@ func (a *AcmeTls) writeUser(user *acmeUser) error {
 	if err != nil {
 		return fmt.Errorf("failed to marshal userdata: %w", err)
 	}
-	err = os.WriteFile(userFile, userData, 0600)
+	err = a.writeFile(userFile, userData)
 	if err != nil {
 		return fmt.Errorf("failed to write user data to %s: %w", userFile, err)
 	}
@@ -4,17 +4,28 @@ package acme
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/go-acme/lego/v4/challenge"
 	"github.com/go-acme/lego/v4/challenge/dns01"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
-func TestRegisterAcmeAccountAndObtainCertficate(t *testing.T) {
+func newPebbleAcme(t *testing.T, wrapProvider func(challenge.Provider) challenge.Provider, cfgMods ...func(*Config)) *AcmeTls {
 	t.Setenv("LEGO_DEBUG_ACME_HTTP_CLIENT", "1")
 	ctx := context.Background()
 	pebbleChallengeCtr, err := SetupPebbleChallengeServer(ctx)
@@ -35,13 +46,15 @@ func TestRegisterAcmeAccountAndObtainCertficate(t *testing.T) {
 
 	challengeProvider, err := pebbleChallengeCtr.DNS01ChallengeProvider(ctx)
 	require.NoError(t, err)
+	if wrapProvider != nil {
+		challengeProvider = wrapProvider(challengeProvider)
+	}
 
 	err = dns01.AddRecursiveNameservers([]string{localDns})(nil)
 	require.NoError(t, err)
 
-	acmeDir := t.TempDir()
-	a, err := NewAcme(context.Background(), slog.Default(), &Config{
-		Dir:           acmeDir,
+	cfg := &Config{
+		Dir:           t.TempDir(),
 		Email:         "test@example.com",
 		CAUrl:         caUrl,
 		dns01Provider: challengeProvider,
@@ -51,11 +64,20 @@ func TestRegisterAcmeAccountAndObtainCertficate(t *testing.T) {
 			DontWaitForPropagation: true,
 			PropagationTimeout:     time.Second * 60,
 		},
-	})
+	}
+	for _, mod := range cfgMods {
+		mod(cfg)
+	}
+	a, err := NewAcme(context.Background(), slog.Default(), cfg)
 	require.NoError(t, err)
-	assert.NotNil(t, a)
+	require.NotNil(t, a)
+	return a
+}
+
+func TestRegisterAcmeAccountAndObtainCertficate(t *testing.T) {
+	a := newPebbleAcme(t, nil)
 
-	err = a.ObtainCertificate("example.com")
+	err := a.ObtainCertificate("example.com")
 	require.NoError(t, err)
 
 	cert, err := a.GetCertForDomain("example.com")
@@ -63,3 +85,411 @@ func TestRegisterAcmeAccountAndObtainCertficate(t *testing.T) {
 	assert.NotNil(t, cert)
 	assert.NotNil(t, cert.PrivateKey)
 }
+
+// failingDomainProvider fails the DNS-01 challenge for a single domain
+type failingDomainProvider struct {
+	challenge.Provider
+	failDomain string
+}
+
+func (f *failingDomainProvider) Present(domain, token, keyAuth string) error {
+	if domain == f.failDomain {
+		return fmt.Errorf("refusing to present challenge for %s", domain)
+	}
+	return f.Provider.Present(domain, token, keyAuth)
+}
+
+func TestObtainCertificatePerDomainFallback(t *testing.T) {
+	a := newPebbleAcme(t, func(p challenge.Provider) challenge.Provider {
+		return &failingDomainProvider{Provider: p, failDomain: "broken.example.com"}
+	}, func(cfg *Config) {
+		cfg.PerDomainFallback = true
+	})
+
+	err := a.ObtainCertificate("example.com", "broken.example.com", "other.example.com")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "broken.example.com")
+
+	for _, domain := range []string{"example.com", "other.example.com"} {
+		cert, err := a.GetCertForDomain(domain)
+		require.NoError(t, err, domain)
+		assert.NotNil(t, cert, domain)
+	}
+	_, err = a.GetCertForDomain("broken.example.com")
+	assert.Error(t, err)
+}
+
+type countingCertCache struct {
+	ModifiableCertCache
+	checks atomic.Int32
+}
+
+func (c *countingCertCache) ExpiringDomains(interval time.Duration) ([][]string, error) {
+	c.checks.Add(1)
+	return nil, nil
+}
+
+func TestGoCheckRenewRunsOnInterval(t *testing.T) {
+	cache := &countingCertCache{ModifiableCertCache: NewInMemoryCache()}
+	a := &AcmeTls{
+		ModifiableCertCache: cache,
+		cfg: &Config{
+			RenewalInterval:      time.Hour,
+			RenewalCheckInterval: time.Millisecond * 20,
+		},
+		logger: slog.Default(),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.goCheckRenew(ctx)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		return cache.checks.Load() >= 3
+	}, time.Second, time.Millisecond*5)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("renewal loop did not stop after context cancellation")
+	}
+	checks := cache.checks.Load()
+	time.Sleep(time.Millisecond * 60)
+	assert.Equal(t, checks, cache.checks.Load())
+}
+
+type failingCertCache struct {
+	ModifiableCertCache
+	fail atomic.Bool
+}
+
+func (f *failingCertCache) ExpiringDomains(interval time.Duration) ([][]string, error) {
+	if f.fail.Load() {
+		return nil, errors.New("renewal failed")
+	}
+	return nil, nil
+}
+
+func TestRenewalFailuresEscalate(t *testing.T) {
+	alerts := make(chan *renewalAlert, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		alert := &renewalAlert{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(alert))
+		alerts <- alert
+	}))
+	defer webhook.Close()
+
+	cache := &failingCertCache{ModifiableCertCache: NewInMemoryCache()}
+	cache.fail.Store(true)
+	a := &AcmeTls{
+		ModifiableCertCache: cache,
+		cfg: &Config{
+			RenewalInterval:         time.Hour,
+			RenewalFailureThreshold: 3,
+			RenewalAlertWebhook:     webhook.URL,
+		},
+		logger: slog.Default(),
+	}
+
+	ctx := context.Background()
+	a.checkRenewAndAlert(ctx, a.logger)
+	a.checkRenewAndAlert(ctx, a.logger)
+	assert.Len(t, alerts, 0)
+
+	a.checkRenewAndAlert(ctx, a.logger)
+	require.Len(t, alerts, 1)
+	alert := <-alerts
+	assert.Equal(t, 3, alert.ConsecutiveFailures)
+	assert.Equal(t, "failed to query expiring domains: renewal failed", alert.Error)
+
+	// A successful renewal check resets the escalation
+	cache.fail.Store(false)
+	a.checkRenewAndAlert(ctx, a.logger)
+	cache.fail.Store(true)
+	a.checkRenewAndAlert(ctx, a.logger)
+	a.checkRenewAndAlert(ctx, a.logger)
+	assert.Len(t, alerts, 0)
+}
+
+func TestExpiringCertPolicy(t *testing.T) {
+	privateKey, certPem, err := generateTestCertificate(func(c *x509.Certificate) {
+		c.NotAfter = time.Now().Add(time.Hour)
+	})
+	require.NoError(t, err)
+	cache := NewInMemoryCache()
+	require.NoError(t, cache.AddCertificate(certPem, privateKey))
+
+	a := &AcmeTls{
+		ModifiableCertCache: cache,
+		cfg: &Config{
+			ExpiringCertPolicy:    ExpiringCertPolicyServe,
+			ExpiringCertThreshold: time.Hour * 24,
+		},
+		logger: slog.Default(),
+	}
+	cert, err := a.GetCertForDomain("example.com")
+	require.NoError(t, err)
+	assert.NotNil(t, cert)
+
+	a.cfg.ExpiringCertPolicy = ExpiringCertPolicyReject
+	_, err = a.GetCertForDomain("example.com")
+	assert.ErrorIs(t, err, ErrCertExpiring)
+	_, err = a.NewTlsConfig().GetCertificate(&tls.ClientHelloInfo{ServerName: "sub.example.com"})
+	assert.ErrorIs(t, err, ErrCertExpiring)
+
+	// Certificates outside of the threshold are always served
+	a.cfg.ExpiringCertThreshold = time.Minute
+	cert, err = a.GetCertForDomain("example.com")
+	require.NoError(t, err)
+	assert.NotNil(t, cert)
+}
+
+func TestAcmeDirPermissions(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "acme")
+	// Existing directories with lax permissions are tightened
+	require.NoError(t, os.Mkdir(dir, 0777))
+	require.NoError(t, os.Chmod(dir, 0777))
+
+	a := &AcmeTls{
+		cfg: &Config{
+			Dir:      dir,
+			Email:    "test@example.com",
+			DirMode:  0750,
+			FileMode: 0640,
+		},
+		logger: slog.Default(),
+	}
+	require.NoError(t, a.prepareDir())
+	_, err := a.loadDomainPrivateKey()
+	require.NoError(t, err)
+	_, err = a.getUser()
+	require.NoError(t, err)
+
+	cache, err := NewFileBackedCache(filepath.Join(dir, certCacheFile), WithFileMode(a.cfg.FileMode))
+	require.NoError(t, err)
+	key, testCert, err := generateTestCertificate()
+	require.NoError(t, err)
+	require.NoError(t, cache.AddCertificate(testCert, key))
+
+	info, err := os.Stat(dir)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0750), info.Mode().Perm())
+	for _, file := range []string{domainPrivateKeyFile, userFile, certCacheFile, certCacheFile + ".lock"} {
+		info, err := os.Stat(filepath.Join(dir, file))
+		require.NoError(t, err, file)
+		assert.Equal(t, os.FileMode(0640), info.Mode().Perm(), file)
+	}
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	for _, entry := range entries {
+		assert.NotContains(t, entry.Name(), "write-probe")
+	}
+}
+
+func TestParseOwner(t *testing.T) {
+	uid, gid, err := parseOwner("")
+	require.NoError(t, err)
+	assert.Equal(t, -1, uid)
+	assert.Equal(t, -1, gid)
+
+	uid, gid, err = parseOwner("1000:1001")
+	require.NoError(t, err)
+	assert.Equal(t, 1000, uid)
+	assert.Equal(t, 1001, gid)
+
+	uid, gid, err = parseOwner(":1001")
+	require.NoError(t, err)
+	assert.Equal(t, -1, uid)
+	assert.Equal(t, 1001, gid)
+
+	_, _, err = parseOwner("no-such-user-smolmailer")
+	assert.Error(t, err)
+}
+
+func TestGoCleanupExpiredRemovesExpiredCerts(t *testing.T) {
+	privateKey, certPem, err := generateTestCertificate(func(c *x509.Certificate) {
+		c.NotAfter = time.Now().Add(time.Minute * -1)
+	})
+	require.NoError(t, err)
+	cache := NewInMemoryCache()
+	require.NoError(t, cache.AddCertificate(certPem, privateKey))
+
+	a := &AcmeTls{
+		ModifiableCertCache: cache,
+		cfg: &Config{
+			CacheCleanupInterval: time.Millisecond * 20,
+		},
+		logger: slog.Default(),
+	}
+	// Cleanup waits for a running renewal
+	a.renewalLock.Lock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.goCleanupExpired(ctx)
+
+	time.Sleep(time.Millisecond * 60)
+	_, err = cache.GetCertForDomain("example.com")
+	require.NoError(t, err)
+
+	a.renewalLock.Unlock()
+	assert.Eventually(t, func() bool {
+		_, err := cache.GetCertForDomain("example.com")
+		return err != nil
+	}, time.Second, time.Millisecond*5)
+}
+
+func TestObtainWildcardCertificate(t *testing.T) {
+	a := newPebbleAcme(t, nil)
+
+	err := a.ObtainCertificate("*.example.com")
+	require.NoError(t, err)
+
+	for _, serverName := range []string{"*.example.com", "mail.example.com", "smtp.example.com"} {
+		cert, err := a.NewTlsConfig().GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		require.NoError(t, err, serverName)
+		parsedCert, err := x509.ParseCertificate(cert.Certificate[0])
+		require.NoError(t, err)
+		assert.Contains(t, parsedCert.DNSNames, "*.example.com")
+	}
+
+	// A wildcard covers only a single label and not the domain itself
+	for _, serverName := range []string{"example.com", "a.mail.example.com"} {
+		_, err := a.GetCertForDomain(serverName)
+		assert.Error(t, err, serverName)
+	}
+}
+
+func TestValidateDomain(t *testing.T) {
+	for _, domain := range []string{"example.com", "mail.example.com", "*.example.com", "*.mail.example.com"} {
+		assert.NoError(t, ValidateDomain(domain), domain)
+	}
+	for _, domain := range []string{"*", "*.com", "mail.*.example.com", "*mail.example.com", "*.*.example.com"} {
+		assert.Error(t, ValidateDomain(domain), domain)
+	}
+}
+
+type noopProvider struct{}
+
+func (noopProvider) Present(domain, token, keyAuth string) error { return nil }
+func (noopProvider) CleanUp(domain, token, keyAuth string) error { return nil }
+
+func TestRegisterWithExternalAccountBinding(t *testing.T) {
+	ctx := context.Background()
+	pebbleCtr, err := SetupPebble(ctx, "127.0.0.1:53", WithPebbleEAB(map[string]string{
+		"kid-1": "zWNDZM6eQGHWpSRTPal5eIUYFTu7EajVIoguysqZ9wG44nMEtx3MUAsUDkMTQ12W",
+	}))
+	require.NoError(t, err)
+	httpClient, err := pebbleCtr.HttpClient(ctx)
+	require.NoError(t, err)
+	caUrl, err := pebbleCtr.AcmeUrl(ctx)
+	require.NoError(t, err)
+
+	newConfig := func(dir string) *Config {
+		return &Config{
+			Dir:           dir,
+			Email:         "test@example.com",
+			CAUrl:         caUrl,
+			dns01Provider: noopProvider{},
+			httpClient:    httpClient,
+			DNS01:         &DNS01Config{},
+		}
+	}
+
+	// Without EAB credentials the registration is refused
+	_, err = NewAcme(ctx, slog.Default(), newConfig(t.TempDir()))
+	require.Error(t, err)
+
+	dir := t.TempDir()
+	cfg := newConfig(dir)
+	cfg.EABKeyID = "kid-1"
+	cfg.EABHMACKey = "zWNDZM6eQGHWpSRTPal5eIUYFTu7EajVIoguysqZ9wG44nMEtx3MUAsUDkMTQ12W"
+	a, err := NewAcme(ctx, slog.Default(), cfg)
+	require.NoError(t, err)
+	require.NotNil(t, a)
+
+	user, err := a.getUser()
+	require.NoError(t, err)
+	require.NotNil(t, user.Registration)
+
+	// The persisted registration is reused, so EAB credentials are only needed once
+	_, err = NewAcme(ctx, slog.Default(), newConfig(dir))
+	require.NoError(t, err)
+}
+
+// gatherMetrics returns the value of every metric of the family by its domain label
+func gatherMetrics(t *testing.T, a *AcmeTls, family string) map[string]float64 {
+	registry := prometheus.NewRegistry()
+	require.NoError(t, registry.Register(a))
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	values := map[string]float64{}
+	for _, mf := range families {
+		if mf.GetName() != family {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			value := m.GetCounter().GetValue()
+			if m.GetGauge() != nil {
+				value = m.GetGauge().GetValue()
+			}
+			values[m.GetLabel()[0].GetValue()] = value
+		}
+	}
+	return values
+}
+
+func TestCertificateMetrics(t *testing.T) {
+	a := newPebbleAcme(t, nil)
+
+	require.NoError(t, a.ObtainCertificate("example.com"))
+
+	assert.Equal(t, map[string]float64{"example.com": 1}, gatherMetrics(t, a, "smolmailer_acme_certificates_issued_total"))
+	expiry := gatherMetrics(t, a, "smolmailer_acme_certificate_expiry_days")
+	require.Contains(t, expiry, "example.com")
+	assert.Greater(t, expiry["example.com"], 1.0)
+}
+
+func TestRenewalFailureMetrics(t *testing.T) {
+	domainPrivateKey, testCert, err := generateTestCertificate(func(cert *x509.Certificate) {
+		cert.NotAfter = time.Now().Add(time.Hour * 12)
+	})
+	require.NoError(t, err)
+	cache := NewInMemoryCache()
+	require.NoError(t, cache.AddCertificate(testCert, domainPrivateKey))
+
+	a := newPebbleAcme(t, func(challenge.Provider) challenge.Provider {
+		return &failingDomainProvider{Provider: noopProvider{}, failDomain: "example.com"}
+	})
+	a.ModifiableCertCache = cache
+	a.cfg.RenewalInterval = time.Hour * 24
+
+	assert.Error(t, a.CheckRenew())
+	assert.Equal(t, map[string]float64{"example.com": 1, "sub.example.com": 1}, gatherMetrics(t, a, "smolmailer_acme_renewal_failures_total"))
+}
+
+func TestCertificateExpiryMetric(t *testing.T) {
+	cache := NewInMemoryCache()
+	for _, notAfter := range []time.Time{time.Now().Add(time.Hour * 12), time.Now().Add(-time.Hour * 48)} {
+		domainPrivateKey, testCert, err := generateTestCertificate(func(cert *x509.Certificate) {
+			cert.NotBefore = notAfter.Add(-time.Hour * 24 * 90)
+			cert.NotAfter = notAfter
+			if notAfter.Before(time.Now()) {
+				cert.DNSNames = []string{"expired.example.com"}
+			}
+		})
+		require.NoError(t, err)
+		require.NoError(t, cache.AddCertificate(testCert, domainPrivateKey))
+	}
+	a := &AcmeTls{ModifiableCertCache: cache, metrics: newAcmeMetrics(), logger: slog.Default()}
+
+	expiry := gatherMetrics(t, a, "smolmailer_acme_certificate_expiry_days")
+	require.Len(t, expiry, 3)
+	assert.InDelta(t, 0.5, expiry["example.com"], 0.01)
+	assert.InDelta(t, 0.5, expiry["sub.example.com"], 0.01)
+	assert.InDelta(t, -2, expiry["expired.example.com"], 0.01)
+}
@@ -2,18 +2,24 @@ package acme
 
 import (
 	"bytes"
+	"context"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/gofrs/flock"
 )
 
 type inMemoryCertCache struct {
@@ -136,19 +142,61 @@ func (i *inMemoryCertCache) ExpiringDomains(interval time.Duration) (domains [][
 	return
 }
 
+const (
+	defaultCacheLockTimeout = time.Second * 30
+	cacheLockRetryDelay     = time.Millisecond * 100
+)
+
+type FileCacheOpt func(*fileBackedCache)
+
+// WithLockTimeout sets how long to wait for the cache file lock held by another process
+func WithLockTimeout(timeout time.Duration) FileCacheOpt {
+	return func(f *fileBackedCache) {
+		if timeout > 0 {
+			f.lockTimeout = timeout
+		}
+	}
+}
+
+// WithFileMode sets the permissions the cache file is written with
+func WithFileMode(mode os.FileMode) FileCacheOpt {
+	return func(f *fileBackedCache) {
+		if mode != 0 {
+			f.fileMode = mode
+		}
+	}
+}
+
+// WithOwner sets the owner (user:group by name or id) of the cache file
+func WithOwner(owner string) FileCacheOpt {
+	return func(f *fileBackedCache) {
+		f.owner = owner
+	}
+}
+
 type fileBackedCache struct {
 	inMemoryCertCache
 
-	fileLock *sync.Mutex
-	filePath string
+	fileLock    *sync.Mutex
+	flock       *flock.Flock
+	lockTimeout time.Duration
+	filePath    string
+	fileMode    os.FileMode
+	owner       string
 }
 
-func NewFileBackedCache(filePath string) (*fileBackedCache, error) {
+func NewFileBackedCache(filePath string, opts ...FileCacheOpt) (*fileBackedCache, error) {
 	fc := &fileBackedCache{
 		fileLock:          &sync.Mutex{},
+		lockTimeout:       defaultCacheLockTimeout,
 		filePath:          filePath,
+		fileMode:          defaultFileMode,
 		inMemoryCertCache: *NewInMemoryCache(),
 	}
+	for _, opt := range opts {
+		opt(fc)
+	}
+	fc.flock = flock.New(filePath+".lock", flock.SetPermissions(fc.fileMode))
 	if err := fc.Load(); err != nil {
 		return nil, err
 	}
@@ -160,21 +208,79 @@ type fileData struct {
 	Certificates map[string]string
 }
 
+func (f *fileBackedCache) tmpPath() string {
+	return f.filePath + ".tmp"
+}
+
+func (f *fileBackedCache) backupPath() string {
+	return f.filePath + ".bak"
+}
+
+// lock guards the cache file against concurrent access from this and other processes. The
+// cross process lock is an flock on a separate lock file, which the OS releases when the holding
+// process dies, so a crashed process never leaves a stale lock behind.
+func (f *fileBackedCache) lock() error {
+	f.fileLock.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), f.lockTimeout)
+	defer cancel()
+	locked, err := f.flock.TryLockContext(ctx, cacheLockRetryDelay)
+	if err == nil && !locked {
+		err = errors.New("lock is held by another process")
+	}
+	if err != nil {
+		f.fileLock.Unlock()
+		return fmt.Errorf("failed to lock certificate cache %s within %s: %w", f.filePath, f.lockTimeout, err)
+	}
+	if err := f.chown(f.flock.Path()); err != nil {
+		f.unlock()
+		return err
+	}
+	return nil
+}
+
+func (f *fileBackedCache) chown(path string) error {
+	if f.owner == "" {
+		return nil
+	}
+	uid, gid, err := parseOwner(f.owner)
+	if err != nil {
+		return err
+	}
+	if err := os.Chown(path, uid, gid); err != nil {
+		return fmt.Errorf("failed to change ownership of %s to %s: %w", path, f.owner, err)
+	}
+	return nil
+}
+
+func (f *fileBackedCache) unlock() {
+	// Unlocking only fails if the lock file handle is already gone, in which case the lock is released anyway
+	_ = f.flock.Unlock()
+	f.fileLock.Unlock()
+}
+
 func (f *fileBackedCache) GetCertForDomain(domain string) (*tls.Certificate, error) {
 	return f.inMemoryCertCache.GetCertForDomain(domain)
 }
 
+// AddCertificate adds the certificate and persists the cache. The cache file is rewritten completely, so
+// certificates added by other caches on the same file since it was loaded are merged first. Holding the
+// lock from reading to writing the file makes every cache on the file a serialized writer, so concurrent
+// additions never overwrite each other.
 func (f *fileBackedCache) AddCertificate(pemData []byte, privateKey crypto.PrivateKey) error {
-	err := f.inMemoryCertCache.AddCertificate(pemData, privateKey)
-	if err != nil {
+	if err := f.lock(); err != nil {
+		return err
+	}
+	defer f.unlock()
+	if err := f.loadFile(); err != nil {
+		return err
+	}
+	if err := f.inMemoryCertCache.AddCertificate(pemData, privateKey); err != nil {
 		return err
 	}
-	return f.store()
+	return f.writeCache()
 }
 
-func (f *fileBackedCache) store() (err error) {
-	f.fileLock.Lock()
-	defer f.fileLock.Unlock()
+func (f *fileBackedCache) writeCache() (err error) {
 	fData := &fileData{
 		Certificates: make(map[string]string),
 	}
@@ -182,18 +288,18 @@ func (f *fileBackedCache) store() (err error) {
 	f.inMemoryCertCache.certs.Range(func(key any, value any) bool {
 		tlsCert := value.(*tls.Certificate)
 		buf := bytes.NewBuffer([]byte{})
-		privKeyBytes, eerr := derEncodePrivateKey(tlsCert.PrivateKey)
+		pemType, privKeyBytes, eerr := derEncodePrivateKey(tlsCert.PrivateKey)
 		if eerr != nil {
-			err = fmt.Errorf("failed to der encode private key for certificate: %s: %w", key, err)
+			err = fmt.Errorf("failed to der encode private key for certificate: %s: %w", key, eerr)
 			// TODO log error
 			return false
 		}
 		err = pem.Encode(buf, &pem.Block{
-			Type:  pemTypeEcPrivateKey,
+			Type:  pemType,
 			Bytes: privKeyBytes,
 		})
 		if err != nil {
-			err = fmt.Errorf("failed to pem encode ec private key: %w", err)
+			err = fmt.Errorf("failed to pem encode private key: %w", err)
 			return false
 		}
 		for _, certBytes := range tlsCert.Certificate {
@@ -219,26 +325,124 @@ func (f *fileBackedCache) store() (err error) {
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(f.filePath, fDataBytes, 0600)
+	return f.writeFileAtomic(fDataBytes)
 }
 
-func (f *fileBackedCache) Load() error {
-	f.fileLock.Lock()
-	defer f.fileLock.Unlock()
-
-	if _, err := os.Stat(f.filePath); os.IsNotExist(err) {
-		// If the file does not exist subsequent operations will fail, but a non existant file shouldn't be a problem
-		return nil
+// writeFileAtomic writes the data to a temporary file first and renames it over the cache file
+// once it is completely written. The previous cache file is kept as backup, so an interrupted
+// write never leaves us without a complete cache file.
+func (f *fileBackedCache) writeFileAtomic(data []byte) error {
+	tmpFile, err := os.OpenFile(f.tmpPath(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.fileMode)
+	if err != nil {
+		return fmt.Errorf("failed to create temporary cache file %s: %w", f.tmpPath(), err)
+	}
+	if err := tmpFile.Chmod(f.fileMode); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to set permissions of temporary cache file %s: %w", f.tmpPath(), err)
+	}
+	if err := f.chown(f.tmpPath()); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to write temporary cache file %s: %w", f.tmpPath(), err)
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to sync temporary cache file %s: %w", f.tmpPath(), err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary cache file %s: %w", f.tmpPath(), err)
+	}
+	if err := os.Rename(f.filePath, f.backupPath()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to backup cache file %s: %w", f.filePath, err)
+	}
+	if err := os.Rename(f.tmpPath(), f.filePath); err != nil {
+		return fmt.Errorf("failed to replace cache file %s: %w", f.filePath, err)
 	}
+	return nil
+}
 
-	jsonBytes, err := os.ReadFile(f.filePath)
+func readFileData(filePath string) (*fileData, error) {
+	jsonBytes, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
 	if err != nil {
-		return fmt.Errorf("failed to read certificate data from %s: %w", f.filePath, err)
+		return nil, fmt.Errorf("failed to read certificate data from %s: %w", filePath, err)
 	}
 	fData := &fileData{}
 	err = json.Unmarshal(jsonBytes, fData)
 	if err != nil {
-		return fmt.Errorf("failed to unmarshal certificate data from %s: %w", f.filePath, err)
+		return nil, fmt.Errorf("failed to unmarshal certificate data from %s: %w", filePath, err)
+	}
+	return fData, nil
+}
+
+func (f *fileBackedCache) Load() error {
+	if err := f.lock(); err != nil {
+		return err
+	}
+	defer f.unlock()
+	return f.loadFile()
+}
+
+// Reload reads the cache file again and replaces the in memory certificates with its content, so
+// certificates written by other processes are served. Certificates are swapped one by one, a lookup
+// during the reload always finds either the old or the new certificate. The current certificates are
+// kept if the cache file can't be read.
+func (f *fileBackedCache) Reload() error {
+	if err := f.lock(); err != nil {
+		return err
+	}
+	defer f.unlock()
+	if _, err := os.Stat(f.filePath); os.IsNotExist(err) {
+		if _, err := os.Stat(f.backupPath()); os.IsNotExist(err) {
+			return fmt.Errorf("certificate cache %s doesn't exist", f.filePath)
+		}
+	}
+	loaded := NewInMemoryCache()
+	if err := f.loadFileInto(loaded); err != nil {
+		return err
+	}
+
+	f.inMemoryCertCache.lock.Lock()
+	defer f.inMemoryCertCache.lock.Unlock()
+	loaded.certs.Range(func(key any, value any) bool {
+		f.inMemoryCertCache.certs.Store(key, value)
+		return true
+	})
+	f.inMemoryCertCache.certs.Range(func(key any, _ any) bool {
+		if _, exists := loaded.certs.Load(key); !exists {
+			f.inMemoryCertCache.certs.Delete(key)
+		}
+		return true
+	})
+	return nil
+}
+
+// loadFile adds the certificates of the cache file to the in memory cache, the caller must hold the lock
+func (f *fileBackedCache) loadFile() error {
+	return f.loadFileInto(&f.inMemoryCertCache)
+}
+
+// loadFileInto adds the certificates of the cache file to the given in memory cache, the caller must hold the lock
+func (f *fileBackedCache) loadFileInto(cache *inMemoryCertCache) error {
+	// A left over temporary file is the result of an interrupted write and can't be trusted
+	if err := os.Remove(f.tmpPath()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove incomplete cache file %s: %w", f.tmpPath(), err)
+	}
+
+	fData, err := readFileData(f.filePath)
+	if err != nil || fData == nil {
+		// Fall back to the last complete state if the cache file is missing or damaged
+		backupData, backupErr := readFileData(f.backupPath())
+		if backupErr != nil || backupData == nil {
+			// If no file exists subsequent operations will fail, but a non existant file shouldn't be a problem
+			return err
+		}
+		fData = backupData
 	}
 
 	for domain, pemDataString := range fData.Certificates {
@@ -260,7 +464,7 @@ func (f *fileBackedCache) Load() error {
 				}
 			}
 		}
-		if err := f.inMemoryCertCache.AddCertificate(pemBuf.Bytes(), privateKey); err != nil {
+		if err := cache.AddCertificate(pemBuf.Bytes(), privateKey); err != nil {
 			return fmt.Errorf("failed to add certificate for domain %s: %w", f.filePath, err)
 		}
 	}
@@ -268,28 +472,41 @@ func (f *fileBackedCache) Load() error {
 }
 
 func (f *fileBackedCache) CleanupExpired() error {
-	f.fileLock.Lock()
-	defer f.fileLock.Unlock()
+	if err := f.lock(); err != nil {
+		return err
+	}
+	defer f.unlock()
 	if err := f.inMemoryCertCache.CleanupExpired(); err != nil {
 		return err
 	}
-	return f.store()
+	return f.writeCache()
 }
 
 func pemDecodePrivateKey(block *pem.Block) (privateKey crypto.PrivateKey, err error) {
 	switch block.Type {
 	case pemTypeEcPrivateKey:
 		return x509.ParseECPrivateKey(block.Bytes)
+	case pemTypeRsaPrivateKey:
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case pemTypePrivateKey:
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
 	default:
 		return nil, fmt.Errorf("unhandled PEM block type while parsing private key %s", block.Type)
 	}
 }
 
-func derEncodePrivateKey(privateKey crypto.PrivateKey) ([]byte, error) {
+// derEncodePrivateKey returns the DER encoded private key together with the PEM block type it
+// should be written with. EC keys keep their SEC 1 encoding so existing cache files stay readable,
+// every other key type is encoded as PKCS#8.
+func derEncodePrivateKey(privateKey crypto.PrivateKey) (string, []byte, error) {
 	switch k := privateKey.(type) {
 	case *ecdsa.PrivateKey:
-		return x509.MarshalECPrivateKey(k)
+		derBytes, err := x509.MarshalECPrivateKey(k)
+		return pemTypeEcPrivateKey, derBytes, err
+	case *rsa.PrivateKey, ed25519.PrivateKey:
+		derBytes, err := x509.MarshalPKCS8PrivateKey(k)
+		return pemTypePrivateKey, derBytes, err
 	default:
-		return nil, fmt.Errorf("unhandled private key type: %T", k)
+		return "", nil, fmt.Errorf("unhandled private key type: %T", k)
 	}
 }
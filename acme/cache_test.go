@@ -4,17 +4,23 @@ import (
 	"bytes"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"fmt"
 	"math/big"
+	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/gofrs/flock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -104,6 +110,10 @@ func generateTestCertificate(fTemplate ...func(*x509.Certificate)) (crypto.Priva
 	if err != nil {
 		return nil, nil, err
 	}
+	return generateTestCertificateWithKey(privateKey, fTemplate...)
+}
+
+func generateTestCertificateWithKey(privateKey crypto.Signer, fTemplate ...func(*x509.Certificate)) (crypto.PrivateKey, []byte, error) {
 	template := x509.Certificate{
 		SerialNumber:          big.NewInt(42),
 		Subject:               pkix.Name{CommonName: "example.com"},
@@ -158,3 +168,200 @@ func TestFilebackedCache(t *testing.T) {
 	require.NoError(t, err)
 	assert.NotEmpty(t, cert)
 }
+
+func TestFilebackedCachePersistsKeyTypes(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	for name, privateKey := range map[string]crypto.Signer{
+		"rsa":     rsaKey,
+		"ed25519": edKey,
+	} {
+		t.Run(name, func(t *testing.T) {
+			cacheFile := filepath.Join(t.TempDir(), "caches.json")
+			fc, err := NewFileBackedCache(cacheFile)
+			require.NoError(t, err)
+
+			key, testCert, err := generateTestCertificateWithKey(privateKey)
+			require.NoError(t, err)
+			err = fc.AddCertificate(testCert, key)
+			require.NoError(t, err)
+
+			fc2, err := NewFileBackedCache(cacheFile)
+			require.NoError(t, err)
+
+			cert, err := fc2.GetCertForDomain("example.com")
+			require.NoError(t, err)
+			require.NotNil(t, cert)
+			assert.Equal(t, privateKey, cert.PrivateKey)
+		})
+	}
+}
+
+func TestFilebackedCacheRecoversFromInterruptedWrite(t *testing.T) {
+	cacheFile := filepath.Join(t.TempDir(), "caches.json")
+	fc, err := NewFileBackedCache(cacheFile)
+	require.NoError(t, err)
+
+	key, testCert, err := generateTestCertificate()
+	require.NoError(t, err)
+	require.NoError(t, fc.AddCertificate(testCert, key))
+
+	key, otherCert, err := generateTestCertificate(func(c *x509.Certificate) {
+		c.SerialNumber = big.NewInt(43)
+		c.DNSNames = []string{"other.example.com"}
+	})
+	require.NoError(t, err)
+	require.NoError(t, fc.AddCertificate(otherCert, key))
+
+	goodData, err := os.ReadFile(cacheFile)
+	require.NoError(t, err)
+
+	t.Run("partial temporary file", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(cacheFile+".tmp", goodData[:len(goodData)/2], 0600))
+
+		fc2, err := NewFileBackedCache(cacheFile)
+		require.NoError(t, err)
+		cert, err := fc2.GetCertForDomain("other.example.com")
+		require.NoError(t, err)
+		assert.NotNil(t, cert)
+		assert.NoFileExists(t, cacheFile+".tmp")
+	})
+
+	t.Run("damaged cache file", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(cacheFile, goodData[:len(goodData)/2], 0600))
+
+		fc2, err := NewFileBackedCache(cacheFile)
+		require.NoError(t, err)
+		cert, err := fc2.GetCertForDomain("example.com")
+		require.NoError(t, err)
+		assert.NotNil(t, cert)
+	})
+
+	t.Run("missing cache file", func(t *testing.T) {
+		require.NoError(t, os.Remove(cacheFile))
+
+		fc2, err := NewFileBackedCache(cacheFile)
+		require.NoError(t, err)
+		cert, err := fc2.GetCertForDomain("example.com")
+		require.NoError(t, err)
+		assert.NotNil(t, cert)
+	})
+}
+
+func TestFilebackedCacheLockTimeout(t *testing.T) {
+	cacheFile := filepath.Join(t.TempDir(), "caches.json")
+	otherProcessLock := flock.New(cacheFile + ".lock")
+	locked, err := otherProcessLock.TryLock()
+	require.NoError(t, err)
+	require.True(t, locked)
+
+	_, err = NewFileBackedCache(cacheFile, WithLockTimeout(time.Millisecond*300))
+	require.Error(t, err)
+
+	require.NoError(t, otherProcessLock.Unlock())
+	_, err = NewFileBackedCache(cacheFile, WithLockTimeout(time.Millisecond*300))
+	require.NoError(t, err)
+}
+
+func TestFilebackedCacheConcurrentAddCertificate(t *testing.T) {
+	cacheFile := filepath.Join(t.TempDir(), "caches.json")
+	// Two caches on the same file, like two managers sharing the ACME directory
+	caches := make([]*fileBackedCache, 2)
+	for i := range caches {
+		fc, err := NewFileBackedCache(cacheFile)
+		require.NoError(t, err)
+		caches[i] = fc
+	}
+
+	domains := []string{}
+	wg := &sync.WaitGroup{}
+	for i := range 10 {
+		domain := fmt.Sprintf("domain%d.example.com", i)
+		domains = append(domains, domain)
+		key, testCert, err := generateTestCertificate(func(c *x509.Certificate) {
+			c.SerialNumber = big.NewInt(int64(100 + i))
+			c.DNSNames = []string{domain}
+		})
+		require.NoError(t, err)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, caches[i%len(caches)].AddCertificate(testCert, key))
+		}()
+	}
+	wg.Wait()
+
+	fc, err := NewFileBackedCache(cacheFile)
+	require.NoError(t, err)
+	for _, domain := range domains {
+		cert, err := fc.GetCertForDomain(domain)
+		require.NoError(t, err, domain)
+		assert.NotNil(t, cert, domain)
+	}
+}
+
+func TestFilebackedCacheReload(t *testing.T) {
+	cacheFile := filepath.Join(t.TempDir(), "caches.json")
+	fc, err := NewFileBackedCache(cacheFile)
+	require.NoError(t, err)
+	key, oldCert, err := generateTestCertificate()
+	require.NoError(t, err)
+	require.NoError(t, fc.AddCertificate(oldCert, key))
+
+	a := &AcmeTls{ModifiableCertCache: fc, cfg: &Config{}}
+	tlsConfig := a.NewTlsConfig()
+	servedSerial := func(serverName string) *big.Int {
+		cert, err := tlsConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		require.NoError(t, err)
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		require.NoError(t, err)
+		return parsed.SerialNumber
+	}
+	require.Equal(t, big.NewInt(42), servedSerial("example.com"))
+
+	t.Run("renewed by another process", func(t *testing.T) {
+		other, err := NewFileBackedCache(cacheFile)
+		require.NoError(t, err)
+		key, renewedCert, err := generateTestCertificate(func(c *x509.Certificate) {
+			c.SerialNumber = big.NewInt(43)
+		})
+		require.NoError(t, err)
+		require.NoError(t, other.AddCertificate(renewedCert, key))
+		assert.Equal(t, big.NewInt(42), servedSerial("example.com"), "the cache file is only read on reload")
+
+		require.NoError(t, a.ReloadCertificates())
+		assert.Equal(t, big.NewInt(43), servedSerial("example.com"))
+		assert.Equal(t, big.NewInt(43), servedSerial("sub.example.com"))
+	})
+
+	t.Run("replaced cache file", func(t *testing.T) {
+		replacementFile := filepath.Join(t.TempDir(), "caches.json")
+		replacement, err := NewFileBackedCache(replacementFile)
+		require.NoError(t, err)
+		key, otherCert, err := generateTestCertificate(func(c *x509.Certificate) {
+			c.SerialNumber = big.NewInt(44)
+			c.DNSNames = []string{"other.example.com"}
+		})
+		require.NoError(t, err)
+		require.NoError(t, replacement.AddCertificate(otherCert, key))
+		data, err := os.ReadFile(replacementFile)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(cacheFile, data, 0600))
+
+		require.NoError(t, a.ReloadCertificates())
+		assert.Equal(t, big.NewInt(44), servedSerial("other.example.com"))
+		_, err = fc.GetCertForDomain("example.com")
+		assert.Error(t, err, "certificates removed from the cache file are not served anymore")
+	})
+
+	t.Run("missing cache file", func(t *testing.T) {
+		require.NoError(t, os.Remove(cacheFile))
+		require.NoError(t, os.Remove(cacheFile+".bak"))
+
+		assert.Error(t, a.ReloadCertificates())
+		assert.Equal(t, big.NewInt(44), servedSerial("other.example.com"), "the current certificates are kept")
+	})
+}
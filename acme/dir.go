@@ -0,0 +1,99 @@
+package acme
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultDirMode  os.FileMode = 0700
+	defaultFileMode os.FileMode = 0600
+)
+
+// parseOwner parses an owner in the form user:group into numeric ids. Users and groups can be given by
+// name or id and both are optional, -1 is returned for every part which should be left unchanged.
+func parseOwner(owner string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if owner == "" {
+		return uid, gid, nil
+	}
+	userPart, groupPart, _ := strings.Cut(owner, ":")
+	if userPart != "" {
+		if uid, err = strconv.Atoi(userPart); err != nil {
+			u, err := user.Lookup(userPart)
+			if err != nil {
+				return -1, -1, fmt.Errorf("invalid owner '%s': %w", owner, err)
+			}
+			if uid, err = strconv.Atoi(u.Uid); err != nil {
+				return -1, -1, fmt.Errorf("invalid owner '%s', user id %s is not numeric: %w", owner, u.Uid, err)
+			}
+		}
+	}
+	if groupPart != "" {
+		if gid, err = strconv.Atoi(groupPart); err != nil {
+			g, err := user.LookupGroup(groupPart)
+			if err != nil {
+				return -1, -1, fmt.Errorf("invalid owner '%s': %w", owner, err)
+			}
+			if gid, err = strconv.Atoi(g.Gid); err != nil {
+				return -1, -1, fmt.Errorf("invalid owner '%s', group id %s is not numeric: %w", owner, g.Gid, err)
+			}
+		}
+	}
+	return uid, gid, nil
+}
+
+// prepareDir creates the ACME directory if necessary and enforces the configured permissions and ownership
+// on it. Issuance fails late and in confusing ways if we can't persist keys, so we verify that we can write
+// to the directory right away.
+func (a *AcmeTls) prepareDir() error {
+	if err := os.MkdirAll(a.cfg.Dir, a.cfg.DirMode); err != nil {
+		return fmt.Errorf("failed to ensure acme directory %s exists: %w", a.cfg.Dir, err)
+	}
+	// MkdirAll is subject to the umask and leaves existing directories untouched
+	if err := os.Chmod(a.cfg.Dir, a.cfg.DirMode); err != nil {
+		return fmt.Errorf("failed to set permissions of acme directory %s: %w", a.cfg.Dir, err)
+	}
+	if err := a.chown(a.cfg.Dir); err != nil {
+		return err
+	}
+
+	probe, err := os.CreateTemp(a.cfg.Dir, ".write-probe-*")
+	if err != nil {
+		return fmt.Errorf("acme directory %s is not writable: %w", a.cfg.Dir, err)
+	}
+	probe.Close()
+	if err := os.Remove(probe.Name()); err != nil {
+		return fmt.Errorf("failed to remove write probe from acme directory %s: %w", a.cfg.Dir, err)
+	}
+	return nil
+}
+
+// writeFile writes data to a file in the ACME directory with the configured permissions and ownership
+func (a *AcmeTls) writeFile(path string, data []byte) error {
+	if err := os.WriteFile(path, data, a.cfg.FileMode); err != nil {
+		return err
+	}
+	// WriteFile is subject to the umask and keeps the permissions of existing files
+	if err := os.Chmod(path, a.cfg.FileMode); err != nil {
+		return fmt.Errorf("failed to set permissions of %s: %w", path, err)
+	}
+	return a.chown(path)
+}
+
+func (a *AcmeTls) chown(path string) error {
+	if a.cfg.Owner == "" {
+		return nil
+	}
+	uid, gid, err := parseOwner(a.cfg.Owner)
+	if err != nil {
+		return err
+	}
+	if err := os.Chown(path, uid, gid); err != nil {
+		return fmt.Errorf("failed to change ownership of %s to %s: %w", path, a.cfg.Owner, err)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package acme
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "smolmailer"
+
+var certificateExpiryDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(metricsNamespace, "acme", "certificate_expiry_days"),
+	"Days until the cached certificate of the domain expires, negative once expired",
+	[]string{"domain"}, nil,
+)
+
+// certExpiryReporter is implemented by certificate caches which can list the expiry of their certificates
+type certExpiryReporter interface {
+	CertificateExpiry() map[string]time.Time
+}
+
+type acmeMetrics struct {
+	certificatesIssued *prometheus.CounterVec
+	renewalFailures    *prometheus.CounterVec
+}
+
+func newAcmeMetrics() *acmeMetrics {
+	return &acmeMetrics{
+		certificatesIssued: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "acme",
+			Name:      "certificates_issued_total",
+			Help:      "Certificates obtained from the ACME CA per domain",
+		}, []string{"domain"}),
+		renewalFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "acme",
+			Name:      "renewal_failures_total",
+			Help:      "Failed renewals of certificates per domain",
+		}, []string{"domain"}),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (a *AcmeTls) Describe(ch chan<- *prometheus.Desc) {
+	a.metrics.certificatesIssued.Describe(ch)
+	a.metrics.renewalFailures.Describe(ch)
+	ch <- certificateExpiryDesc
+}
+
+// Collect implements prometheus.Collector, the expiry of certificates is read from the CertCache
+func (a *AcmeTls) Collect(ch chan<- prometheus.Metric) {
+	a.metrics.certificatesIssued.Collect(ch)
+	a.metrics.renewalFailures.Collect(ch)
+	reporter, ok := a.ModifiableCertCache.(certExpiryReporter)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	for domain, notAfter := range reporter.CertificateExpiry() {
+		ch <- prometheus.MustNewConstMetric(certificateExpiryDesc, prometheus.GaugeValue,
+			notAfter.Sub(now).Hours()/24, domain)
+	}
+}
+
+// CertificateExpiry returns when the certificate of every cached domain expires, which is the earliest
+// expiry of the certificates in its chain
+func (i *inMemoryCertCache) CertificateExpiry() map[string]time.Time {
+	expiry := make(map[string]time.Time)
+	i.certs.Range(func(key any, val any) bool {
+		for _, derBytes := range val.(*tls.Certificate).Certificate {
+			cert, err := x509.ParseCertificate(derBytes)
+			if err != nil {
+				continue
+			}
+			if notAfter, exists := expiry[key.(string)]; !exists || cert.NotAfter.Before(notAfter) {
+				expiry[key.(string)] = cert.NotAfter
+			}
+		}
+		return true
+	})
+	return expiry
+}
@@ -21,13 +21,42 @@ type PebbleContainer struct {
 	testcontainers.Container
 }
 
-func SetupPebble(ctx context.Context, dnsServer string) (*PebbleContainer, error) {
+type PebbleOpt func(*testcontainers.ContainerRequest)
+
+// WithPebbleEAB makes pebble require external account binding with the given key ids and base64url encoded HMAC keys
+func WithPebbleEAB(macKeys map[string]string) PebbleOpt {
+	return func(req *testcontainers.ContainerRequest) {
+		pebbleCfg, _ := json.Marshal(map[string]any{
+			"pebble": map[string]any{
+				"listenAddress":                  "0.0.0.0:14000",
+				"managementListenAddress":        "0.0.0.0:15000",
+				"certificate":                    "test/certs/localhost/cert.pem",
+				"privateKey":                     "test/certs/localhost/key.pem",
+				"httpPort":                       5002,
+				"tlsPort":                        5001,
+				"externalAccountBindingRequired": true,
+				"externalAccountMACKeys":         macKeys,
+			},
+		})
+		req.Files = append(req.Files, testcontainers.ContainerFile{
+			Reader:            bytes.NewReader(pebbleCfg),
+			ContainerFilePath: "/test/config/pebble-eab-config.json",
+			FileMode:          0644,
+		})
+		req.Cmd = append(req.Cmd, "-config", "/test/config/pebble-eab-config.json")
+	}
+}
+
+func SetupPebble(ctx context.Context, dnsServer string, opts ...PebbleOpt) (*PebbleContainer, error) {
 	req := testcontainers.ContainerRequest{
 		Image:        "ghcr.io/letsencrypt/pebble:2.9.0",
 		ExposedPorts: []string{"14000/tcp", "15000/tcp"},
 		WaitingFor:   wait.ForLog("ACME directory available at: .*").AsRegexp(),
 		Cmd:          []string{"-dnsserver", dnsServer},
 	}
+	for _, opt := range opts {
+		opt(&req)
+	}
 	container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
 		ContainerRequest: req,
 		Started:          true,
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/dereulenspiegel/smolmailer/internal/config"
+	"github.com/dereulenspiegel/smolmailer/internal/dns"
+)
+
+func main() {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	cfg, err := config.LoadConfig(logger)
+	if err != nil {
+		logger.Error("failed to load config", "err", err)
+		os.Exit(1)
+	}
+
+	records, err := dns.RequiredRecords(cfg)
+	if err != nil {
+		logger.Error("failed to create DNS records", "err", err)
+		os.Exit(1)
+	}
+	for _, record := range records {
+		fmt.Println(record.ZoneString())
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/dereulenspiegel/liteq"
+	"github.com/dereulenspiegel/smolmailer/internal/config"
+	"github.com/dereulenspiegel/smolmailer/internal/queue"
+	"github.com/dereulenspiegel/smolmailer/internal/server"
+)
+
+// replay queues messages, which permanently failed to be delivered, for delivery again, e.g. after the
+// cause like a DNS outage was fixed
+func main() {
+	domain := flag.String("domain", "", "only replay messages to recipients in this domain")
+	maxAge := flag.Duration("max-age", 0, "only replay messages which failed within this duration, e.g. 12h")
+	flag.Parse()
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	cfg, err := config.LoadConfig(logger)
+	if err != nil {
+		logger.Error("failed to load config", "err", err)
+		os.Exit(1)
+	}
+
+	if cfg.QueueBackend == config.QueueBackendPostgres {
+		logger.Error("replaying failed messages is only supported by the sqlite queue backend")
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	db, err := queue.OpenDB(server.QueueDBPath(cfg))
+	if err != nil {
+		logger.Error("failed to open sqlite queue db", "err", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+	jq, err := liteq.New(db)
+	if err != nil {
+		logger.Error("failed to create sqlite based job queue", "err", err)
+		os.Exit(1)
+	}
+	deliveryTracker, err := queue.NewDeliveryTracker(db)
+	if err != nil {
+		logger.Error("failed to create delivery tracker", "err", err)
+		os.Exit(1)
+	}
+
+	filter := queue.ReplayFilter{RecipientDomain: *domain, MaxAge: *maxAge}
+	replayedCount := 0
+	for _, queueName := range server.SendQueueNames(cfg) {
+		sendQueue := queue.NewSQLiteWorkQueueOnJobQueue[*queue.QueuedMessage](db, jq, queueName)
+		replayed, err := queue.ReplayFailed(ctx, db, queueName, sendQueue, filter, liteq.Retries(cfg.DeliveryAttempts()))
+		for _, msg := range replayed {
+			if err := deliveryTracker.UpdateStatus(ctx, msg, queue.DeliveryStatusPending, nil); err != nil {
+				logger.Warn("failed to reset delivery status", "err", err, "msg", msg)
+			}
+			logger.Info("replayed message", "queue", queueName, "msg", msg)
+		}
+		replayedCount += len(replayed)
+		if err != nil {
+			logger.Error("failed to replay failed messages", "queue", queueName, "err", err)
+			os.Exit(1)
+		}
+	}
+	fmt.Printf("replayed %d messages\n", replayedCount)
+}
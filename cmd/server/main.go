@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log/slog"
 	"os"
 	"os/signal"
@@ -18,6 +19,9 @@ var (
 )
 
 func main() {
+	printConfig := flag.Bool("print-config", false, "print the effective config with secrets redacted and exit")
+	flag.Parse()
+
 	ctx := context.Background()
 
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
@@ -25,6 +29,20 @@ func main() {
 		AddSource: true,
 	}))
 
+	if *printConfig {
+		// Log to stderr, so the printed config can be piped
+		logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+		cfg, err := config.LoadConfig(logger)
+		if err != nil {
+			os.Exit(1)
+		}
+		if err := cfg.WriteRedacted(os.Stdout); err != nil {
+			logger.Error("failed to print config", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
@@ -54,6 +72,17 @@ func main() {
 		}
 	}()
 
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	go func() {
+		for range hups {
+			if srv != nil {
+				srv.ReloadUsers(ctx)
+				srv.ReloadCertificates()
+			}
+		}
+	}()
+
 	<-sigs
 	logger.Info("shutting down")
 	if err := srv.Shutdown(); err != nil {
@@ -0,0 +1,133 @@
+package backend
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/google/uuid"
+)
+
+// redacted replaces AUTH payloads in the audit log, since they carry credentials
+const redacted = "[redacted]"
+
+// WithAuditLog records every command of client sessions together with its reply in auditLogger
+func WithAuditLog(auditLogger *slog.Logger) BackendOpt {
+	return func(b *Backend) {
+		b.auditLogger = auditLogger
+	}
+}
+
+// auditSession records the commands of a session and their replies. The protocol debug output of the SMTP
+// server is shared by all connections and can't be attributed to a session, so the commands are recorded
+// where they are handled instead.
+type auditSession struct {
+	s      *Session
+	logger *slog.Logger
+}
+
+func newAuditSession(auditLogger *slog.Logger, s *Session, helo string) *auditSession {
+	a := &auditSession{
+		s:      s,
+		logger: auditLogger.With(slog.String("session", uuid.NewString()), slog.String("remoteAddr", s.remoteAddr.String())),
+	}
+	a.logger.Info("session started", slog.String("helo", helo), slog.Bool("tls", s.isTLS),
+		slog.String("username", s.authenticatedSubject))
+	return a
+}
+
+func (a *auditSession) record(cmd, args string, success int, err error, attrs ...slog.Attr) {
+	attrs = append([]slog.Attr{slog.String("cmd", cmd), slog.String("args", args)}, attrs...)
+	level := slog.LevelInfo
+	if err != nil {
+		level = slog.LevelWarn
+		attrs = append(attrs, slog.String("err", err.Error()))
+		var smtpErr *smtp.SMTPError
+		if errors.As(err, &smtpErr) {
+			attrs = append(attrs, slog.Int("reply", smtpErr.Code))
+		}
+	} else {
+		attrs = append(attrs, slog.Int("reply", success))
+	}
+	a.logger.LogAttrs(a.s.ctx, level, "smtp command", attrs...)
+}
+
+func (a *auditSession) Mail(from string, opts *smtp.MailOptions) error {
+	err := a.s.Mail(from, opts)
+	a.record("MAIL", "FROM:<"+from+">", 250, err)
+	return err
+}
+
+func (a *auditSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	err := a.s.Rcpt(to, opts)
+	a.record("RCPT", "TO:<"+to+">", 250, err)
+	return err
+}
+
+func (a *auditSession) Data(r io.Reader) error {
+	counter := &countingReader{r: r}
+	err := a.s.Data(counter)
+	a.record("DATA", "", 250, err, slog.Int64("bytes", counter.n))
+	return err
+}
+
+// Reset isn't recorded, go-smtp also resets the session after every transaction and not only on RSET
+func (a *auditSession) Reset() {
+	a.s.Reset()
+}
+
+func (a *auditSession) Logout() error {
+	err := a.s.Logout()
+	a.logger.Info("session ended")
+	return err
+}
+
+func (a *auditSession) AuthMechanisms() []string {
+	return a.s.AuthMechanisms()
+}
+
+func (a *auditSession) Auth(mech string) (sasl.Server, error) {
+	server, err := a.s.Auth(mech)
+	if err != nil {
+		a.record("AUTH", mech, 0, err)
+		return nil, err
+	}
+	return &auditSaslServer{Server: server, a: a, mech: mech}, nil
+}
+
+// auditSaslServer records every step of an AUTH exchange without the client responses
+type auditSaslServer struct {
+	sasl.Server
+	a    *auditSession
+	mech string
+}
+
+func (s *auditSaslServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	challenge, done, err = s.Server.Next(response)
+	args := s.mech
+	if len(response) > 0 {
+		args += " " + redacted
+	}
+	switch {
+	case err != nil:
+		s.a.record("AUTH", args, 0, err)
+	case done:
+		s.a.record("AUTH", args, 235, nil, slog.String("username", s.a.s.authenticatedSubject))
+	default:
+		s.a.record("AUTH", args, 334, nil)
+	}
+	return challenge, done, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
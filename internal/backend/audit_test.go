@@ -0,0 +1,135 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dereulenspiegel/smolmailer/internal/backend/backendmocks"
+	"github.com/dereulenspiegel/smolmailer/internal/config"
+	"github.com/dereulenspiegel/smolmailer/internal/queue/queuemocks"
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (l *lockedBuffer) Write(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.buf.Write(p)
+}
+
+func (l *lockedBuffer) String() string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.buf.String()
+}
+
+func startAuditedServer(t *testing.T, audit *lockedBuffer) string {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	q := queuemocks.NewGenericWorkQueueMock[*ReceivedMessage](t)
+	q.On("Queue", mock.Anything, mock.Anything, mock.Anything).Return(nil).Maybe()
+	usrSrv := backendmocks.NewUserServiceMock(t)
+	usrSrv.On("Authenticate", "user", "s3cr3t").Return(nil).Maybe()
+	usrSrv.On("Authenticate", "user", mock.Anything).Return(errors.New("invalid password")).Maybe()
+	usrSrv.On("IsValidSender", "user", "user@example.com").Return(true).Maybe()
+
+	be, err := NewBackend(ctx, slog.Default(), q, usrSrv, &config.Config{MailDomain: "example.com"},
+		WithAuditLog(slog.New(slog.NewJSONHandler(audit, nil))))
+	require.NoError(t, err)
+	smtpServer := smtp.NewServer(be)
+	smtpServer.Domain = "example.com"
+	smtpServer.AllowInsecureAuth = true
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go smtpServer.Serve(l)
+	t.Cleanup(func() { smtpServer.Close() })
+	return l.Addr().String()
+}
+
+func auditEntries(t *testing.T, audit string) []map[string]any {
+	entries := []map[string]any{}
+	for _, line := range strings.Split(strings.TrimSpace(audit), "\n") {
+		entry := map[string]any{}
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAuditLogRecordsCommands(t *testing.T) {
+	audit := &lockedBuffer{}
+	c, err := smtp.Dial(startAuditedServer(t, audit))
+	require.NoError(t, err)
+	require.NoError(t, c.Hello("client.example.com"))
+	require.NoError(t, c.Auth(sasl.NewPlainClient("", "user", "s3cr3t")))
+	require.NoError(t, c.SendMail("user@example.com", []string{"rcpt@example.org"}, strings.NewReader("Subject: Test\r\n\r\nHello\r\n")))
+	require.NoError(t, c.Quit())
+
+	require.Eventually(t, func() bool { return strings.Contains(audit.String(), "session ended") }, time.Second*5, time.Millisecond*10)
+	entries := auditEntries(t, audit.String())
+	commands := []string{}
+	for _, entry := range entries {
+		assert.Equal(t, entries[0]["session"], entry["session"])
+		assert.Equal(t, entries[0]["remoteAddr"], entry["remoteAddr"])
+		if cmd, ok := entry["cmd"].(string); ok {
+			commands = append(commands, cmd+" "+entry["args"].(string))
+		}
+	}
+	assert.NotEmpty(t, entries[0]["session"])
+	assert.Equal(t, "client.example.com", entries[0]["helo"])
+	assert.Equal(t, []string{
+		"AUTH PLAIN [redacted]",
+		"MAIL FROM:<user@example.com>",
+		"RCPT TO:<rcpt@example.org>",
+		"DATA ",
+	}, commands)
+}
+
+func TestAuditLogRedactsAuthPayloads(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		client sasl.Client
+	}{
+		{name: "plain", client: sasl.NewPlainClient("", "user", "s3cr3t")},
+		{name: "plain failure", client: sasl.NewPlainClient("", "user", "wr0ng")},
+		{name: "login", client: sasl.NewLoginClient("user", "s3cr3t")},
+		{name: "login failure", client: sasl.NewLoginClient("user", "wr0ng")},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			audit := &lockedBuffer{}
+			c, err := smtp.Dial(startAuditedServer(t, audit))
+			require.NoError(t, err)
+			defer c.Close()
+			require.NoError(t, c.Hello("client.example.com"))
+			_ = c.Auth(test.client)
+			require.NoError(t, c.Quit())
+
+			require.Eventually(t, func() bool { return strings.Contains(audit.String(), "session ended") }, time.Second*5, time.Millisecond*10)
+			output := audit.String()
+			assert.Contains(t, output, "[redacted]")
+			for _, secret := range []string{"s3cr3t", "wr0ng", "\x00user\x00"} {
+				assert.NotContains(t, output, secret)
+				assert.NotContains(t, output, base64.StdEncoding.EncodeToString([]byte(secret)))
+			}
+			assert.NotContains(t, output, base64.StdEncoding.EncodeToString([]byte("\x00user\x00s3cr3t")))
+			assert.NotContains(t, output, base64.StdEncoding.EncodeToString([]byte("\x00user\x00wr0ng")))
+		})
+	}
+}
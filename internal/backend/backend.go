@@ -2,27 +2,75 @@ package backend
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"net/http"
+	"net/mail"
 	"net/netip"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/asggo/spf"
 	"github.com/dereulenspiegel/liteq"
 	"github.com/dereulenspiegel/smolmailer/internal/config"
+	"github.com/dereulenspiegel/smolmailer/internal/dns"
 	"github.com/dereulenspiegel/smolmailer/internal/queue"
+	"github.com/dereulenspiegel/smolmailer/internal/tracing"
+	"github.com/dereulenspiegel/smolmailer/internal/users"
+	"github.com/dereulenspiegel/smolmailer/internal/utils"
 	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var ErrStartTLSRequired = &smtp.SMTPError{
+	Code:         530,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+	Message:      "Must issue a STARTTLS command first",
+}
+
+// ErrAuthRequired rejects MAIL commands of sessions which did not authenticate (RFC 4954 section 6)
+var ErrAuthRequired = &smtp.SMTPError{
+	Code:         530,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+	Message:      "Authentication required",
+}
+
+// spoolDirName is the directory in the queue path large message bodies are spooled to
+const spoolDirName = "spool"
+
 type UserService interface {
 	Authenticate(username, password string) error
 	IsValidSender(username, from string) bool
 }
 
+// QuotaChecker enforces the daily sending quotas of users
+type QuotaChecker interface {
+	CheckMessage(ctx context.Context, username string) error
+	CheckRecipients(ctx context.Context, username string, recipients int) error
+	Record(ctx context.Context, username string, recipients int) error
+}
+
+// SPFChecker evaluates whether ip is permitted to send mail for domain
+type SPFChecker func(ip, domain string) spf.Result
+
+// DNSBLChecker returns the DNS blocklist zones ip is listed in
+type DNSBLChecker func(ip netip.Addr) ([]string, error)
+
+// SenderVerifier returns whether the envelope sender can receive bounces, errors mean it couldn't be verified
+type SenderVerifier func(ctx context.Context, sender string) (bool, error)
+
 type Backend struct {
 	q       queue.GenericWorkQueue[*ReceivedMessage]
 	cfg     *config.Config
@@ -30,7 +78,28 @@ type Backend struct {
 	ctx     context.Context
 	userSrv UserService
 
-	allowedIPNets []*net.IPNet
+	// allowedIPRanges restricts the clients of the listener this backend serves, all clients are accepted
+	// if it is empty. Entries can be URLs of lists of CIDRs which are refreshed periodically.
+	allowedIPRanges []string
+	// allowedIPNets are the static ranges merged with the ranges loaded from the sources
+	allowedIPNets     []*net.IPNet
+	allowedIPNetsLock sync.RWMutex
+	staticIPNets      []*net.IPNet
+	ipRangeSources    []string
+	// sourceIPNets are the ranges last loaded successfully per source
+	sourceIPNets           map[string][]*net.IPNet
+	ipRangeClient          *http.Client
+	ipRangeRefreshInterval time.Duration
+
+	tokenValidator TokenValidator
+	spoolDir       string
+	spfCheck       SPFChecker
+	dnsblCheck     DNSBLChecker
+	quotaChecker   QuotaChecker
+	senderVerifier SenderVerifier
+	auditLogger    *slog.Logger
+	// clientCertUsers maps lower case client certificate subjects to users
+	clientCertUsers map[string]string
 }
 
 func (b *Backend) NewSession(conn *smtp.Conn) (smtp.Session, error) {
@@ -38,11 +107,60 @@ func (b *Backend) NewSession(conn *smtp.Conn) (smtp.Session, error) {
 	if !b.isValidRemoteAddr(remoteAddr) {
 		return nil, fmt.Errorf("the client %s is not allowed to send messages", remoteAddr.String())
 	}
-	return NewSession(b.ctx, b.logger.With("session", true, "remoteAddr", conn.Conn().RemoteAddr().String()), b.q, b.userSrv, conn.Conn().RemoteAddr()), nil
+	if err := b.checkHelo(conn.Hostname(), remoteAddr); err != nil {
+		return nil, err
+	}
+	tlsState, isTLS := conn.TLSConnectionState()
+	opts := []SessionOpt{
+		WithMaxMessageBytes(b.cfg.MaxMessageBytes),
+		WithHeaderLimits(b.cfg.MaxHeaderBytes, b.cfg.MaxHeaderFields),
+		WithStartTLSRequired(b.cfg.ListenStartTls && !isTLS),
+		WithTLS(isTLS),
+		WithHelo(conn.Hostname()),
+		WithAuthenticatedTLSRequired(b.cfg.RequireAuthenticatedTls),
+		WithBareLfPolicy(b.cfg.BareLfPolicy),
+		WithRecipientDomainCheck(b.cfg.IsRecipientDomainAllowed),
+		WithSpool(b.spoolDir, b.cfg.SpoolThreshold),
+		WithDataTimeout(conn.Conn(), b.cfg.DataTimeout),
+		WithMaxDeliveryAttempts(b.cfg.DeliveryAttempts()),
+	}
+	clientCertAuthenticated := false
+	if isTLS {
+		opts = append(opts, WithTLSConnectionState(tlsState))
+		if user, ok := b.clientCertUser(tlsState); ok {
+			opts = append(opts, WithClientCertUser(user))
+			clientCertAuthenticated = true
+		}
+	}
+	// Listed clients are only rejected in MAIL, since they may still authenticate
+	if listedIn := b.checkDNSBL(remoteAddr, clientCertAuthenticated); len(listedIn) > 0 {
+		opts = append(opts, WithDNSBLListings(listedIn, b.cfg.DNSBL.Action != config.DNSBLActionTag))
+	}
+	if b.cfg.AuthRequired != nil {
+		opts = append(opts, WithAuthRequiredReply(b.cfg.AuthRequired.Code, b.cfg.AuthRequired.Message))
+	}
+	if b.tokenValidator != nil {
+		opts = append(opts, WithTokenValidator(b.tokenValidator))
+	}
+	if b.spfCheck != nil {
+		opts = append(opts, WithSPFCheck(b.spfCheck, b.cfg.SpfPolicy == config.SpfPolicyReject))
+	}
+	if b.quotaChecker != nil {
+		opts = append(opts, WithQuotaChecker(b.quotaChecker))
+	}
+	if b.senderVerifier != nil {
+		opts = append(opts, WithSenderVerifier(b.senderVerifier))
+	}
+	session := NewSession(b.ctx, b.logger.With("session", true, "remoteAddr", conn.Conn().RemoteAddr().String()), b.q, b.userSrv, conn.Conn().RemoteAddr(),
+		opts...)
+	if b.auditLogger != nil {
+		return newAuditSession(b.auditLogger, session, conn.Hostname()), nil
+	}
+	return session, nil
 }
 
 func (b *Backend) isValidRemoteAddr(remoteAddr net.Addr) bool {
-	if len(b.allowedIPNets) == 0 {
+	if !b.ipRangesRestricted() {
 		return true
 	}
 	addPrt, err := netip.ParseAddrPort(remoteAddr.String())
@@ -50,6 +168,8 @@ func (b *Backend) isValidRemoteAddr(remoteAddr net.Addr) bool {
 		return false
 	}
 	rmtAddr := net.IP(addPrt.Addr().AsSlice())
+	b.allowedIPNetsLock.RLock()
+	defer b.allowedIPNetsLock.RUnlock()
 	for _, ipNet := range b.allowedIPNets {
 		if ipNet.Contains(rmtAddr) {
 			return true
@@ -58,20 +178,178 @@ func (b *Backend) isValidRemoteAddr(remoteAddr net.Addr) bool {
 	return false
 }
 
-func NewBackend(ctx context.Context, logger *slog.Logger, q queue.GenericWorkQueue[*ReceivedMessage], userSrv UserService, cfg *config.Config) (*Backend, error) {
+// checkDNSBL looks up the client in the DNS blocklists and returns the zones listing it. Clients from the allowed
+// IP ranges and clients authenticated by their TLS client certificate are trusted and not looked up. Failed
+// lookups don't list the client, so an unreachable blocklist doesn't stop all submissions.
+func (b *Backend) checkDNSBL(remoteAddr net.Addr, trusted bool) []string {
+	if b.dnsblCheck == nil || trusted || b.ipRangesRestricted() {
+		return nil
+	}
+	addrPort, err := netip.ParseAddrPort(remoteAddr.String())
+	if err != nil {
+		return nil
+	}
+	logger := b.logger.With("remoteAddr", remoteAddr.String())
+	listedIn, err := b.dnsblCheck(addrPort.Addr())
+	if err != nil {
+		logger.Warn("failed to look up client in DNS blocklists", "err", err)
+	}
+	if len(listedIn) == 0 {
+		return nil
+	}
+	logger.Warn("client is listed in DNS blocklists", "dnsbl", strings.Join(listedIn, ","), "action", b.cfg.DNSBL.Action)
+	return listedIn
+}
+
+// checkHelo validates the HELO/EHLO hostname according to the configured HELO policy
+func (b *Backend) checkHelo(helo string, remoteAddr net.Addr) error {
+	switch b.cfg.HeloPolicy {
+	case config.HeloPolicyLog, config.HeloPolicyReject:
+	default:
+		return nil
+	}
+	err := validateHelo(helo, b.cfg.MailDomain, b.cfg.TlsDomain)
+	if err == nil {
+		return nil
+	}
+	logger := b.logger.With("helo", helo, "remoteAddr", remoteAddr.String(), "err", err)
+	if b.cfg.HeloPolicy == config.HeloPolicyLog {
+		logger.Warn("client sent invalid HELO hostname")
+		return nil
+	}
+	logger.Warn("rejecting client with invalid HELO hostname")
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      fmt.Sprintf("Invalid HELO hostname: %s", err),
+	}
+}
+
+// validateHelo checks that helo is either a bracketed address literal or a FQDN which does not
+// impersonate one of our own domains
+func validateHelo(helo string, ownDomains ...string) error {
+	if strings.HasPrefix(helo, "[") && strings.HasSuffix(helo, "]") {
+		addr := strings.TrimPrefix(strings.Trim(helo, "[]"), "IPv6:")
+		if _, err := netip.ParseAddr(addr); err != nil {
+			return fmt.Errorf("invalid address literal %s", helo)
+		}
+		return nil
+	}
+	if _, err := netip.ParseAddr(helo); err == nil {
+		return fmt.Errorf("address literal %s must be enclosed in brackets", helo)
+	}
+	hostname := strings.ToLower(strings.TrimSuffix(helo, "."))
+	labels := strings.Split(hostname, ".")
+	if len(labels) < 2 {
+		return fmt.Errorf("%s is not a fully qualified domain name", helo)
+	}
+	for _, label := range labels {
+		if !isValidHostnameLabel(label) {
+			return fmt.Errorf("%s is not a valid hostname", helo)
+		}
+	}
+	for _, ownDomain := range ownDomains {
+		if ownDomain != "" && hostname == strings.ToLower(strings.TrimSuffix(ownDomain, ".")) {
+			return fmt.Errorf("%s is our own domain", helo)
+		}
+	}
+	return nil
+}
+
+func isValidHostnameLabel(label string) bool {
+	if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	for _, c := range label {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+type BackendOpt func(*Backend)
+
+// WithAllowedIPRanges only accepts clients from the given CIDR ranges instead of the globally allowed IP
+// ranges, so every listener can have its own allow-list. No ranges accept all clients.
+func WithAllowedIPRanges(ipRanges ...string) BackendOpt {
+	return func(b *Backend) {
+		b.allowedIPRanges = ipRanges
+	}
+}
+
+// WithQuotas enforces the daily sending quotas of users in all sessions
+func WithQuotas(checker QuotaChecker) BackendOpt {
+	return func(b *Backend) {
+		b.quotaChecker = checker
+	}
+}
+
+// WithSenderVerification rejects envelope senders which the verifier finds can't receive bounces
+func WithSenderVerification(verifier SenderVerifier) BackendOpt {
+	return func(b *Backend) {
+		b.senderVerifier = verifier
+	}
+}
+
+func NewBackend(ctx context.Context, logger *slog.Logger, q queue.GenericWorkQueue[*ReceivedMessage], userSrv UserService, cfg *config.Config, opts ...BackendOpt) (*Backend, error) {
 	b := &Backend{
 		q:       q,
 		cfg:     cfg,
 		logger:  logger,
 		ctx:     ctx,
 		userSrv: userSrv,
+
+		allowedIPRanges: cfg.AllowedIPRanges,
 	}
-	for _, netString := range cfg.AllowedIPRanges {
-		_, ipNet, err := net.ParseCIDR(netString)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse CIDR %s: %w", netString, err)
+	for _, opt := range opts {
+		opt(b)
+	}
+	var staticIPRanges []string
+	for _, ipRange := range b.allowedIPRanges {
+		if isIPRangeSource(ipRange) {
+			b.ipRangeSources = append(b.ipRangeSources, ipRange)
+		} else {
+			staticIPRanges = append(staticIPRanges, ipRange)
+		}
+	}
+	staticIPNets, err := parseIPRanges(staticIPRanges)
+	if err != nil {
+		return nil, err
+	}
+	b.staticIPNets = staticIPNets
+	b.allowedIPNets = staticIPNets
+	if len(b.ipRangeSources) > 0 {
+		b.sourceIPNets = make(map[string][]*net.IPNet, len(b.ipRangeSources))
+		b.ipRangeClient = &http.Client{Timeout: ipRangeFetchTimeout}
+		b.ipRangeRefreshInterval = cfg.AllowedIPRangesRefreshInterval
+		b.refreshAllowedIPRanges(ctx)
+		if b.ipRangeRefreshInterval > 0 {
+			go b.goRefreshAllowedIPRanges(ctx)
+		}
+	}
+	if cfg.OAuth2IntrospectionEnabled() {
+		b.tokenValidator = NewIntrospectionValidator(cfg.OAuth2Introspection, nil)
+	}
+	if cfg.SpfPolicy.Enabled() {
+		b.spfCheck = dns.CheckSPF
+	}
+	if cfg.DNSBLEnabled() {
+		b.dnsblCheck = func(ip netip.Addr) ([]string, error) {
+			return dns.CheckDNSBL(ip, cfg.DNSBL.Zones...)
+		}
+	}
+	if cfg.ClientCertAuthEnabled() {
+		b.clientCertUsers = make(map[string]string, len(cfg.ClientCertAuth.Users))
+		for _, certUser := range cfg.ClientCertAuth.Users {
+			b.clientCertUsers[strings.ToLower(certUser.Subject)] = certUser.User
+		}
+	}
+	if cfg.SpoolThreshold > 0 && cfg.QueuePath != "" {
+		b.spoolDir = filepath.Join(cfg.QueuePath, spoolDirName)
+		if err := os.MkdirAll(b.spoolDir, 0770); err != nil {
+			return nil, fmt.Errorf("failed to create spool directory %s: %w", b.spoolDir, err)
 		}
-		b.allowedIPNets = append(b.allowedIPNets, ipNet)
 	}
 
 	return b, nil
@@ -86,11 +364,65 @@ func (r *Rcpt) String() string {
 	return r.To
 }
 
+// ReceivedInfo describes how a message was submitted, so it can be recorded in a Received header
+type ReceivedInfo struct {
+	Helo       string
+	RemoteAddr string
+	// Protocol is the protocol name defined by RFC 3848, e.g. ESMTPSA
+	Protocol   string
+	TLSVersion string
+	TLSCipher  string
+	Time       time.Time
+	// DNSBLListings are the DNS blocklist zones the client is listed in, if listed clients are tagged
+	DNSBLListings []string
+}
+
+// SPFResult is the result of checking the client address against the SPF record of the envelope sender domain
+type SPFResult struct {
+	Result   spf.Result
+	Domain   string
+	ClientIP string
+}
+
 type ReceivedMessage struct {
 	From     string
 	To       []*Rcpt
 	Body     []byte
 	MailOpts *smtp.MailOptions
+	// EnvelopeIDGenerated is set if the client didn't supply the envelope id in MailOpts and it was generated
+	EnvelopeIDGenerated bool
+
+	// AuthUser is the user the session was authenticated as
+	AuthUser string
+	// DeliverAt schedules the delivery to all recipients, they are delivered right away if zero
+	DeliverAt time.Time
+
+	// SubmissionID is assigned to all queued messages, a new one is generated if it is empty
+	SubmissionID string
+	Received     *ReceivedInfo
+	// BodyFile is the path of the file large bodies are spooled to, Body is empty until LoadBody is called
+	BodyFile string
+	// ContentHash is the SHA256 hash of the body as submitted by the client, before it is modified by processing
+	ContentHash []byte
+	// SPF is the result of the SPF check of the submission, nil if SPF is not checked
+	SPF *SPFResult
+
+	TraceContext tracing.TraceContext
+}
+
+// DeliverAtHeader schedules the delivery of a message, its value is a RFC 3339 or RFC 5322 date
+const DeliverAtHeader = "X-Smolmailer-Deliver-At"
+
+// ParseDeliverAt parses the value of the DeliverAtHeader
+func ParseDeliverAt(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	deliverAt, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		if deliverAt, err = mail.ParseDate(value); err != nil {
+			return time.Time{}, fmt.Errorf("invalid %s header '%s': %w", DeliverAtHeader, value, err)
+		}
+	}
+	return deliverAt, nil
 }
 
 func (m *ReceivedMessage) LogValue() slog.Value {
@@ -104,6 +436,7 @@ func (m *ReceivedMessage) LogValue() slog.Value {
 	}
 	return slog.GroupValue(
 		slog.String("from", m.From),
+		slog.String("authUser", m.AuthUser),
 		slog.String("envelopeId", envelopeID),
 		slog.String("recipients", strings.Join(recipients, ",")),
 	)
@@ -111,28 +444,103 @@ func (m *ReceivedMessage) LogValue() slog.Value {
 
 func (r *ReceivedMessage) QueuedMessages() (msgs []*queue.QueuedMessage) {
 	receivedAt := time.Now()
+	submissionID := r.SubmissionID
+	if submissionID == "" {
+		submissionID = uuid.NewString()
+	}
 	for _, to := range r.To {
 		msgs = append(msgs, &queue.QueuedMessage{
-			From:       r.From,
-			To:         to.To,
-			RcptOpt:    to.RcptOpts,
-			MailOpts:   r.MailOpts,
-			Body:       r.Body,
-			ReceivedAt: receivedAt,
-			ErrorCount: 0,
+			DedupKey:     r.dedupKey(to.To),
+			From:         r.From,
+			To:           to.To,
+			RcptOpt:      to.RcptOpts,
+			MailOpts:     r.MailOpts,
+			Body:         r.Body,
+			SubmissionID: submissionID,
+			TraceContext: r.TraceContext,
+			DeliverAt:    r.DeliverAt,
+			ReceivedAt:   receivedAt,
+			ErrorCount:   0,
 		})
 	}
 	return msgs
 }
 
+// LoadBody reads the body from the spool file, if it was spooled to disk
+func (r *ReceivedMessage) LoadBody() error {
+	if r.BodyFile == "" || r.Body != nil {
+		return nil
+	}
+	body, err := os.ReadFile(r.BodyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read spooled body: %w", err)
+	}
+	r.Body = body
+	return nil
+}
+
+// RemoveBodyFile deletes the spool file of the body, once the message does not need to be processed again
+func (r *ReceivedMessage) RemoveBodyFile() error {
+	if r.BodyFile == "" {
+		return nil
+	}
+	if err := os.Remove(r.BodyFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove spooled body: %w", err)
+	}
+	r.BodyFile = ""
+	return nil
+}
+
+// dedupKey identifies identical messages to the recipient, so retried submissions are only delivered once
+func (r *ReceivedMessage) dedupKey(to string) string {
+	if len(r.ContentHash) == 0 {
+		return ""
+	}
+	envelopeID := ""
+	if r.MailOpts != nil && !r.EnvelopeIDGenerated {
+		// Generated envelope ids differ between retried submissions of the same message
+		envelopeID = r.MailOpts.EnvelopeID
+	}
+	hash := sha256.New()
+	for _, part := range [][]byte{[]byte(r.From), []byte(to), []byte(envelopeID), r.ContentHash} {
+		hash.Write(part)
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
 type Session struct {
 	Msg              *ReceivedMessage
 	ExpectedBodySize int64
 
 	authenticatedSubject string
+	maxMessageBytes      int64
+	maxHeaderBytes       int64
+	maxHeaderFields      int
+	startTLSRequired     bool
+	isTLS                bool
+	tlsState             *tls.ConnectionState
+	helo                 string
+	authTLSRequired      bool
+	authRequiredErr      *smtp.SMTPError
+	bareLfPolicy         config.BareLfPolicy
+	recipientDomainCheck func(domain string) bool
+	spoolDir             string
+	spoolThreshold       int64
+	dataTimeout          time.Duration
+	conn                 net.Conn
+	spfCheck             SPFChecker
+	spfReject            bool
+	quotaChecker         QuotaChecker
+	senderVerifier       SenderVerifier
+	dnsblListings        []string
+	dnsblReject          bool
+	maxDeliveryAttempts  int
 
-	plainAuthServer sasl.Server
-	loginAuthServer sasl.Server
+	plainAuthServer   sasl.Server
+	loginAuthServer   sasl.Server
+	xoauth2AuthServer sasl.Server
+	tokenValidator    TokenValidator
 
 	q          queue.GenericWorkQueue[*ReceivedMessage]
 	userSrv    UserService
@@ -142,7 +550,157 @@ type Session struct {
 	remoteAddr net.Addr
 }
 
-func NewSession(ctx context.Context, logger *slog.Logger, q queue.GenericWorkQueue[*ReceivedMessage], userSrv UserService, remoteAddr net.Addr) *Session {
+type SessionOpt func(*Session)
+
+// WithMaxMessageBytes limits the size of accepted messages. A value of 0 or less disables the limit.
+func WithMaxMessageBytes(maxMessageBytes int64) SessionOpt {
+	return func(s *Session) {
+		s.maxMessageBytes = maxMessageBytes
+	}
+}
+
+// WithHeaderLimits limits the size and the number of fields of the header of accepted messages. Values of 0
+// or less disable the respective limit.
+func WithHeaderLimits(maxHeaderBytes int64, maxHeaderFields int) SessionOpt {
+	return func(s *Session) {
+		s.maxHeaderBytes = maxHeaderBytes
+		s.maxHeaderFields = maxHeaderFields
+	}
+}
+
+// WithStartTLSRequired rejects AUTH and MAIL commands until the client has issued STARTTLS.
+func WithStartTLSRequired(required bool) SessionOpt {
+	return func(s *Session) {
+		s.startTLSRequired = required
+	}
+}
+
+// WithTLS records whether the session is TLS encrypted
+func WithTLS(isTLS bool) SessionOpt {
+	return func(s *Session) {
+		s.isTLS = isTLS
+	}
+}
+
+// WithTLSConnectionState records the negotiated TLS parameters of the session
+func WithTLSConnectionState(state tls.ConnectionState) SessionOpt {
+	return func(s *Session) {
+		s.tlsState = &state
+	}
+}
+
+// WithHelo records the hostname the client sent with HELO/EHLO
+func WithHelo(helo string) SessionOpt {
+	return func(s *Session) {
+		s.helo = helo
+	}
+}
+
+// WithAuthenticatedTLSRequired only accepts messages from sessions which are authenticated and TLS encrypted.
+func WithAuthenticatedTLSRequired(required bool) SessionOpt {
+	return func(s *Session) {
+		s.authTLSRequired = required
+	}
+}
+
+// WithAuthRequiredReply replaces the reply to MAIL commands of sessions which did not authenticate. The
+// enhanced status code is x.7.0 matching the class of code.
+func WithAuthRequiredReply(code int, message string) SessionOpt {
+	return func(s *Session) {
+		s.authRequiredErr = &smtp.SMTPError{
+			Code:         code,
+			EnhancedCode: smtp.EnhancedCode{code / 100, 7, 0},
+			Message:      message,
+		}
+	}
+}
+
+// WithBareLfPolicy sets how messages containing line feeds without carriage return are handled
+func WithBareLfPolicy(policy config.BareLfPolicy) SessionOpt {
+	return func(s *Session) {
+		s.bareLfPolicy = policy
+	}
+}
+
+// WithRecipientDomainCheck rejects recipients whose domain is not allowed by the given check
+func WithRecipientDomainCheck(allowed func(domain string) bool) SessionOpt {
+	return func(s *Session) {
+		s.recipientDomainCheck = allowed
+	}
+}
+
+// WithSpool spools message bodies larger than threshold bytes to files in dir instead of keeping them in memory
+func WithSpool(dir string, threshold int64) SessionOpt {
+	return func(s *Session) {
+		s.spoolDir = dir
+		s.spoolThreshold = threshold
+	}
+}
+
+// WithDataTimeout limits the time the client may take to transmit the message data on conn. A value of 0
+// or less leaves the read timeout of the server in place.
+func WithDataTimeout(conn net.Conn, timeout time.Duration) SessionOpt {
+	return func(s *Session) {
+		s.conn = conn
+		s.dataTimeout = timeout
+	}
+}
+
+// WithTokenValidator allows clients to authenticate via XOAUTH2 with bearer tokens accepted by the validator
+func WithTokenValidator(validator TokenValidator) SessionOpt {
+	return func(s *Session) {
+		s.tokenValidator = validator
+	}
+}
+
+// WithSPFCheck checks the client address against the SPF record of the envelope sender domain. If reject is
+// set, senders failing SPF are rejected, otherwise the result is only recorded.
+func WithSPFCheck(check SPFChecker, reject bool) SessionOpt {
+	return func(s *Session) {
+		s.spfCheck = check
+		s.spfReject = reject
+	}
+}
+
+// WithQuotaChecker rejects messages and recipients exceeding the daily quota of the authenticated user
+func WithQuotaChecker(checker QuotaChecker) SessionOpt {
+	return func(s *Session) {
+		s.quotaChecker = checker
+	}
+}
+
+// WithSenderVerifier rejects envelope senders which can't receive bounces. Senders which couldn't be verified
+// are accepted.
+func WithSenderVerifier(verifier SenderVerifier) SessionOpt {
+	return func(s *Session) {
+		s.senderVerifier = verifier
+	}
+}
+
+// WithDNSBLListings records the DNS blocklist zones the client is listed in. If reject is set, the client is
+// rejected unless it authenticates, otherwise the zones are recorded with every received message.
+func WithDNSBLListings(listedIn []string, reject bool) SessionOpt {
+	return func(s *Session) {
+		s.dnsblListings = listedIn
+		s.dnsblReject = reject
+	}
+}
+
+// WithMaxDeliveryAttempts limits how often processing a received message is attempted
+func WithMaxDeliveryAttempts(attempts int) SessionOpt {
+	return func(s *Session) {
+		s.maxDeliveryAttempts = attempts
+	}
+}
+
+// WithClientCertUser authenticates the session as user, who was identified by the verified TLS client certificate
+func WithClientCertUser(user string) SessionOpt {
+	return func(s *Session) {
+		s.authenticatedSubject = user
+	}
+}
+
+func NewSession(ctx context.Context, logger *slog.Logger, q queue.GenericWorkQueue[*ReceivedMessage], userSrv UserService, remoteAddr net.Addr, opts ...SessionOpt) *Session {
 	logger.Info("Starting new session")
 	s := &Session{
 		Msg:        &ReceivedMessage{},
@@ -152,6 +710,15 @@ func NewSession(ctx context.Context, logger *slog.Logger, q queue.GenericWorkQue
 		ctx:        ctx,
 		remoteAddr: remoteAddr,
 		logVals:    []slog.Attr{slog.String("remoteAddr", remoteAddr.String())},
+
+		authRequiredErr:     ErrAuthRequired,
+		maxDeliveryAttempts: config.DefaultMaxDeliveryAttempts,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.authenticatedSubject != "" {
+		logger.Info("user authenticated by client certificate", slog.String("username", s.authenticatedSubject))
 	}
 
 	s.plainAuthServer = sasl.NewPlainServer(func(identity, username, password string) error {
@@ -182,31 +749,115 @@ func NewSession(ctx context.Context, logger *slog.Logger, q queue.GenericWorkQue
 		return nil
 	})
 
+	if s.tokenValidator != nil {
+		s.xoauth2AuthServer = NewXOAuth2Server(func(username, token string) error {
+			logger := logger.With(slog.String("username", username))
+			logger.Debug("authenticating user with access token")
+			if err := s.tokenValidator(s.ctx, username, token); err != nil {
+				logger.Error("failed to authenticate user", "err", err)
+				if errors.Is(err, ErrTokenInactive) || errors.Is(err, ErrTokenSubjectMismatch) {
+					return invalidCredentialsError()
+				}
+				return fmt.Errorf("failed to authenticate user %s: %w", username, err)
+			}
+			logger.Info("user authenticated successfully")
+			s.authenticatedSubject = username
+			return nil
+		})
+	}
+
 	return s
 }
 
 func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
+	if opts == nil {
+		opts = &smtp.MailOptions{}
+	}
+	envelopeIDGenerated := opts.EnvelopeID == ""
+	if envelopeIDGenerated {
+		// Every message gets an envelope id at receipt, so it can be followed from the logs of the session to the
+		// logs and the ENVID of its delivery
+		opts.EnvelopeID = uuid.NewString()
+	}
 	logger := s.logWithGroup("Mail", slog.String("from", from), slog.String("envelopeId", opts.EnvelopeID), slog.Bool("requireTLS", opts.RequireTLS))
 	logger.Info("Mail from")
+	if s.startTLSRequired {
+		logger.Warn("declining MAIL before STARTTLS")
+		return ErrStartTLSRequired
+	}
+	if s.authenticatedSubject == "" && s.dnsblReject && len(s.dnsblListings) > 0 {
+		logger.Warn("declining unauthenticated client listed in DNS blocklists", "dnsbl", strings.Join(s.dnsblListings, ","))
+		return dnsblListedError(s.remoteAddr, s.dnsblListings)
+	}
 	if s.authenticatedSubject == "" {
 		logger.Warn("declining unauthenticated session")
-		return fmt.Errorf("not authenticated")
+		return s.authRequiredErr
+	}
+	if s.authTLSRequired && !s.isTLS {
+		logger.Warn("declining authenticated session without TLS")
+		return ErrStartTLSRequired
 	}
-	if !s.userSrv.IsValidSender(s.authenticatedSubject, from) {
+	// The null sender is a valid reverse path, every other sender must be a mailbox
+	if from != "" && !isValidAddress(from) {
+		logger.Warn("declining malformed sender address")
+		return malformedSenderError(from)
+	}
+	// Every authenticated user may send with the null sender, e.g. to deliver bounces or automated
+	// notifications which must not be answered by bounces (RFC 5321 section 4.5.5)
+	if from != "" && !s.userSrv.IsValidSender(s.authenticatedSubject, from) {
 		logger.Warn("not a valid sender")
 		return fmt.Errorf("user %s is not allowed to send emails as %s", s.authenticatedSubject, s.Msg.From)
 	}
+	if opts != nil && s.maxMessageBytes > 0 && opts.Size > s.maxMessageBytes {
+		logger.Warn("declared message size exceeds maximum message size", "maxMessageBytes", s.maxMessageBytes)
+		return messageTooLargeError(opts.Size, s.maxMessageBytes)
+	}
+	if s.quotaChecker != nil {
+		if err := s.quotaChecker.CheckMessage(s.ctx, s.authenticatedSubject); err != nil {
+			logger.Warn("declining message exceeding the daily quota", "err", err)
+			return quotaError(err)
+		}
+	}
+	if s.spfCheck != nil {
+		if err := s.checkSPF(logger, from); err != nil {
+			return err
+		}
+	}
+	if s.senderVerifier != nil && from != "" {
+		if err := s.verifySender(logger, from); err != nil {
+			return err
+		}
+	}
 	s.Msg.From = from
 	if opts != nil {
 		s.ExpectedBodySize = opts.Size
 	}
 	s.Msg.MailOpts = opts
+	s.Msg.EnvelopeIDGenerated = envelopeIDGenerated
 	return nil
 }
 
 func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
 	logger := s.logWithGroup("Rcpt", slog.String("to", to))
 	logger.Info("Rcpt to")
+	if !isValidAddress(to) {
+		logger.Warn("declining malformed recipient address")
+		return malformedRecipientError(to)
+	}
+	if s.recipientDomainCheck != nil {
+		// Only the domain is normalized for the check, the recipient is transmitted as it was given
+		domain := utils.AddressDomain(to)
+		if !s.recipientDomainCheck(domain) {
+			logger.Warn("declining recipient in a domain we must not deliver to", "domain", domain)
+			return recipientDomainDeniedError(domain)
+		}
+	}
+	if s.quotaChecker != nil {
+		if err := s.quotaChecker.CheckRecipients(s.ctx, s.authenticatedSubject, len(s.Msg.To)+1); err != nil {
+			logger.Warn("declining recipient exceeding the daily quota", "err", err)
+			return quotaError(err)
+		}
+	}
 	s.Msg.To = append(s.Msg.To, &Rcpt{
 		To:       to,
 		RcptOpts: opts,
@@ -214,45 +865,381 @@ func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
 	return nil
 }
 
-const defaultRetryAttempts = 3
+// isValidAddress returns true if addr is a single mailbox without display name. Malformed addresses must be
+// rejected in the session, since everything after it relies on the domain of the addresses.
+func isValidAddress(addr string) bool {
+	// The angle brackets make sure addr is just the address and not a display name with an address
+	_, err := mail.ParseAddress("<" + addr + ">")
+	return err == nil
+}
+
+// checkSPF checks the client address against the SPF record of the sender domain. The HELO hostname is
+// checked for the null sender (RFC 7208 section 2.4).
+func (s *Session) checkSPF(logger *slog.Logger, from string) error {
+	domain := s.helo
+	if at := strings.LastIndex(from, "@"); at >= 0 {
+		domain = from[at+1:]
+	}
+	clientIP := ""
+	if s.remoteAddr != nil {
+		clientIP = s.remoteAddr.String()
+		if host, _, err := net.SplitHostPort(clientIP); err == nil {
+			clientIP = host
+		}
+	}
+	result := s.spfCheck(clientIP, domain)
+	s.Msg.SPF = &SPFResult{
+		Result:   result,
+		Domain:   domain,
+		ClientIP: clientIP,
+	}
+	logger = logger.With(slog.String("spfDomain", domain), slog.String("spfResult", string(result)))
+	if result == spf.Fail && s.spfReject {
+		logger.Warn("declining sender failing SPF")
+		return spfFailError(domain, clientIP)
+	}
+	logger.Info("checked SPF of sender")
+	return nil
+}
+
+// verifySender rejects senders the callout found undeliverable. Inconclusive callouts don't reject the sender,
+// so an unreachable MX of the sender domain doesn't stop its submissions.
+func (s *Session) verifySender(logger *slog.Logger, from string) error {
+	deliverable, err := s.senderVerifier(s.ctx, from)
+	if err != nil {
+		logger.Warn("failed to verify sender, accepting it", "err", err)
+		return nil
+	}
+	if !deliverable {
+		logger.Warn("declining undeliverable sender")
+		return undeliverableSenderError(from)
+	}
+	return nil
+}
 
 func (s *Session) Data(r io.Reader) (err error) {
+	ctx, span := tracing.Tracer().Start(s.ctx, "smtp.receive", trace.WithAttributes(
+		attribute.String("smtp.from", s.Msg.From),
+		attribute.Int("smtp.recipients", len(s.Msg.To)),
+	))
+	defer func() { tracing.End(span, err) }()
 	logger := s.logWithGroup("Data", slog.Int64("expectedBodySize", s.ExpectedBodySize))
 	logger.Info("Receiving data")
 	lr := r
 	if s.ExpectedBodySize > 0 {
-		lr = io.LimitReader(r, s.ExpectedBodySize)
+		// Read one byte more than announced so larger bodies are detected instead of being truncated
+		lr = io.LimitReader(r, s.ExpectedBodySize+1)
+	}
+	if s.maxMessageBytes > 0 {
+		// Read one byte more than allowed so we can detect oversized messages
+		lr = io.LimitReader(lr, s.maxMessageBytes+1)
+	}
+	if s.dataTimeout > 0 && s.conn != nil {
+		// Slow clients must not be able to hold the connection open for longer than the data timeout
+		if err := s.conn.SetReadDeadline(time.Now().Add(s.dataTimeout)); err != nil {
+			return fmt.Errorf("failed to set data timeout: %w", err)
+		}
+		defer s.conn.SetReadDeadline(time.Time{})
+	}
+
+	// Large bodies are spooled to disk while they are received, the hash covers the body after bare LFs are fixed
+	spool := newBodySpool(s.spoolDir, s.spoolThreshold)
+	hash := sha256.New()
+	headers := &headerScanner{}
+	lfWriter := newBareLfWriter(io.MultiWriter(spool, hash, headers), s.bareLfPolicy == config.BareLfPolicyFix)
+	n, err := io.Copy(lfWriter, lr)
+	if closeErr := spool.Close(); err == nil {
+		err = closeErr
+	}
+	queued := false
+	defer func() {
+		if !queued {
+			spool.Remove()
+		}
+	}()
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		logger.Warn("client exceeded the data timeout", slog.Int64("bodySize", n), slog.Duration("dataTimeout", s.dataTimeout))
+		// The rest of the message can't be consumed anymore, so the session can't continue
+		s.conn.Close()
+		return dataTimeoutError()
+	}
+	if errors.Is(err, smtp.ErrDataTooLarge) || (s.maxMessageBytes > 0 && n > s.maxMessageBytes) {
+		// Consume the rest of the message up to another maximum message size, so we can tell the client how
+		// large it actually was
+		remaining, drainErr := io.Copy(io.Discard, io.LimitReader(r, s.maxMessageBytes+1))
+		logger.Warn("message exceeds maximum message size", slog.Int64("bodySize", n+remaining), slog.Int64("maxMessageBytes", s.maxMessageBytes))
+		if drainErr != nil || remaining > s.maxMessageBytes {
+			// The rest of the message could be arbitrarily large, so the session can't continue
+			if s.conn != nil {
+				s.conn.Close()
+			}
+			return maxMessageSizeExceededError(s.maxMessageBytes)
+		}
+		return messageTooLargeError(n+remaining, s.maxMessageBytes)
 	}
-	s.Msg.Body, err = io.ReadAll(lr)
-	n := len(s.Msg.Body)
-	if s.ExpectedBodySize > 0 && int64(n) != s.ExpectedBodySize {
-		logger.Error("Invalid body size", slog.Int("bodySize", n))
-		return fmt.Errorf("read only %d body bytes, but expected %d bytes", n, s.ExpectedBodySize)
+	if s.ExpectedBodySize > 0 && n != s.ExpectedBodySize {
+		logger.Error("Invalid body size", slog.Int64("bodySize", n))
+		return fmt.Errorf("received %d body bytes, but expected %d bytes", n, s.ExpectedBodySize)
 	}
 	if err != nil {
 		logger.Error("failed to read message body", "err", err)
 		return fmt.Errorf("failed to read message body: %w", err)
 	}
-	if err := s.q.Queue(s.ctx, s.Msg, liteq.Retries(defaultRetryAttempts)); err != nil {
+	// The header is limited before signing, since the signer and every receiver have to process all of it
+	if s.maxHeaderBytes > 0 && headers.bytes > s.maxHeaderBytes {
+		logger.Warn("message header exceeds maximum header size", slog.Int64("headerBytes", headers.bytes), slog.Int64("maxHeaderBytes", s.maxHeaderBytes))
+		return headerTooLargeError(headers.bytes, s.maxHeaderBytes)
+	}
+	if s.maxHeaderFields > 0 && headers.fields > s.maxHeaderFields {
+		logger.Warn("message header exceeds maximum number of header fields", slog.Int("headerFields", headers.fields), slog.Int("maxHeaderFields", s.maxHeaderFields))
+		return tooManyHeaderFieldsError(headers.fields, s.maxHeaderFields)
+	}
+	if value, scanned := headers.Get(DeliverAtHeader); scanned && strings.TrimSpace(value) != "" {
+		// Messages with an invalid delivery time would fail after they were accepted
+		if _, err := ParseDeliverAt(value); err != nil {
+			logger.Warn("rejecting message with invalid delivery time", "err", err)
+			return invalidDeliverAtError(value)
+		}
+	}
+	if lfWriter.found {
+		switch s.bareLfPolicy {
+		case config.BareLfPolicyReject:
+			logger.Warn("rejecting message with bare LF line endings")
+			return bareLfError()
+		case config.BareLfPolicyFix:
+			logger.Info("converted bare LF line endings to CRLF")
+		case config.BareLfPolicyNormalize:
+			logger.Info("message with bare LF line endings will be normalized before signing")
+		}
+	}
+	s.Msg.Body, s.Msg.BodyFile = spool.Body()
+	if s.Msg.BodyFile != "" {
+		logger.Info("spooled large message body to disk", slog.Int64("bodySize", n), slog.String("bodyFile", s.Msg.BodyFile))
+	}
+	s.Msg.ContentHash = hash.Sum(nil)
+	s.Msg.TraceContext = tracing.Inject(ctx)
+	s.Msg.Received = s.receivedInfo()
+	s.Msg.AuthUser = s.authenticatedSubject
+	if err := s.q.Queue(s.ctx, s.Msg, liteq.Retries(s.maxDeliveryAttempts)); err != nil {
 		logger.Error("failed to queue received message", "err", err)
-		return fmt.Errorf("failed to queue received msg: %w", err)
+		// The failure is on our side, so the client should keep the message and try again later
+		return queueingFailedError()
+	}
+	queued = true
+	if s.quotaChecker != nil {
+		if err := s.quotaChecker.Record(s.ctx, s.authenticatedSubject, len(s.Msg.To)); err != nil {
+			// The message is queued already, rejecting it now would only lead to duplicates
+			logger.Error("failed to record quota usage", "err", err)
+		}
 	}
 
 	return nil
 }
 
+func (s *Session) receivedInfo() *ReceivedInfo {
+	info := &ReceivedInfo{
+		Helo:     s.helo,
+		Protocol: "ESMTPA",
+		Time:     time.Now(),
+	}
+	if !s.dnsblReject {
+		// Authenticated clients listed in rejecting blocklists are trusted, so their messages aren't tagged
+		info.DNSBLListings = s.dnsblListings
+	}
+	if s.remoteAddr != nil {
+		info.RemoteAddr = s.remoteAddr.String()
+		if host, _, err := net.SplitHostPort(info.RemoteAddr); err == nil {
+			info.RemoteAddr = host
+		}
+	}
+	if s.isTLS {
+		info.Protocol = "ESMTPSA"
+	}
+	if s.tlsState != nil {
+		info.TLSVersion = tls.VersionName(s.tlsState.Version)
+		info.TLSCipher = tls.CipherSuiteName(s.tlsState.CipherSuite)
+	}
+	return info
+}
+
+// quotaError tells the client to try again once the daily quota is reset. Failures to check the quota are
+// temporary as well.
+func quotaError(err error) *smtp.SMTPError {
+	switch {
+	case errors.Is(err, users.ErrMessageQuotaExceeded):
+		return &smtp.SMTPError{
+			Code:         450,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+			Message:      "Daily message quota exceeded, please try again tomorrow",
+		}
+	case errors.Is(err, users.ErrRecipientQuotaExceeded):
+		return &smtp.SMTPError{
+			Code:         452,
+			EnhancedCode: smtp.EnhancedCode{4, 5, 3},
+			Message:      "Daily recipient quota exceeded, please try again tomorrow",
+		}
+	default:
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "Quota could not be checked, please try again later",
+		}
+	}
+}
+
+func dnsblListedError(remoteAddr net.Addr, listedIn []string) *smtp.SMTPError {
+	client := ""
+	if remoteAddr != nil {
+		client = remoteAddr.String()
+		if host, _, err := net.SplitHostPort(client); err == nil {
+			client = host
+		}
+	}
+	return &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      fmt.Sprintf("Client host %s is listed in %s", client, strings.Join(listedIn, ", ")),
+	}
+}
+
+func dataTimeoutError() *smtp.SMTPError {
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 4, 2},
+		Message:      "Timeout while receiving message data",
+	}
+}
+
+func undeliverableSenderError(from string) *smtp.SMTPError {
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 7},
+		Message:      fmt.Sprintf("Sender address %s rejected: undeliverable address", from),
+	}
+}
+
+func spfFailError(domain, clientIP string) *smtp.SMTPError {
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 23},
+		Message:      fmt.Sprintf("SPF of %s does not permit %s to send mail", domain, clientIP),
+	}
+}
+
+func bareLfError() *smtp.SMTPError {
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+		Message:      "Message contains bare LF line endings, lines must end with CRLF",
+	}
+}
+
+func malformedSenderError(from string) *smtp.SMTPError {
+	return &smtp.SMTPError{
+		Code:         501,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 7},
+		Message:      fmt.Sprintf("Malformed sender address %q", from),
+	}
+}
+
+func malformedRecipientError(to string) *smtp.SMTPError {
+	return &smtp.SMTPError{
+		Code:         501,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 3},
+		Message:      fmt.Sprintf("Malformed recipient address %q", to),
+	}
+}
+
+func recipientDomainDeniedError(domain string) *smtp.SMTPError {
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      fmt.Sprintf("Delivery to the domain %s is not permitted", domain),
+	}
+}
+
+func invalidCredentialsError() *smtp.SMTPError {
+	return &smtp.SMTPError{
+		Code:         535,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 8},
+		Message:      "Authentication credentials invalid",
+	}
+}
+
+func queueingFailedError() *smtp.SMTPError {
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Message could not be queued, please try again later",
+	}
+}
+
+func messageTooLargeError(size, maxMessageBytes int64) *smtp.SMTPError {
+	return &smtp.SMTPError{
+		Code:         552,
+		EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+		Message:      fmt.Sprintf("Message size of %d bytes exceeds the maximum message size of %d bytes", size, maxMessageBytes),
+	}
+}
+
+// maxMessageSizeExceededError rejects messages which were too large to determine their size
+func maxMessageSizeExceededError(maxMessageBytes int64) *smtp.SMTPError {
+	return &smtp.SMTPError{
+		Code:         552,
+		EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+		Message:      fmt.Sprintf("Message exceeds the maximum message size of %d bytes", maxMessageBytes),
+	}
+}
+
+func invalidDeliverAtError(value string) *smtp.SMTPError {
+	return &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+		Message:      fmt.Sprintf("Invalid %s header '%s', expected a RFC 3339 or RFC 5322 date", DeliverAtHeader, strings.TrimSpace(value)),
+	}
+}
+
+func headerTooLargeError(size, maxHeaderBytes int64) *smtp.SMTPError {
+	return &smtp.SMTPError{
+		Code:         552,
+		EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+		Message:      fmt.Sprintf("Message header of %d bytes exceeds the maximum header size of %d bytes", size, maxHeaderBytes),
+	}
+}
+
+func tooManyHeaderFieldsError(fields, maxHeaderFields int) *smtp.SMTPError {
+	return &smtp.SMTPError{
+		Code:         552,
+		EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+		Message:      fmt.Sprintf("Message header has %d fields, at most %d are allowed", fields, maxHeaderFields),
+	}
+}
+
 func (s *Session) AuthMechanisms() []string {
+	if s.xoauth2AuthServer != nil {
+		return []string{sasl.Plain, sasl.Login, XOAuth2}
+	}
 	return []string{sasl.Plain, sasl.Login}
 }
 
 func (s *Session) Auth(mech string) (sasl.Server, error) {
 	logger := s.logWithGroup("Auth", slog.String("authMech", mech))
+	if s.startTLSRequired {
+		logger.Warn("declining AUTH before STARTTLS")
+		return nil, ErrStartTLSRequired
+	}
 
 	switch mech {
 	case sasl.Plain:
 		return s.plainAuthServer, nil
 	case sasl.Login:
 		return s.loginAuthServer, nil
+	case XOAuth2:
+		if s.xoauth2AuthServer != nil {
+			return s.xoauth2AuthServer, nil
+		}
+		logger.Error("XOAUTH2 is not enabled")
+		return nil, fmt.Errorf("unsupported auth method %s", mech)
 	default:
 		logger.Error("unsupported auth method")
 		return nil, fmt.Errorf("unsupported auth method %s", mech)
@@ -2,10 +2,23 @@ package backend
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math/big"
 	"net"
+	"net/textproto"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -14,6 +27,7 @@ import (
 	"github.com/dereulenspiegel/smolmailer/internal/queue/queuemocks"
 	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 )
@@ -73,3 +87,391 @@ func TestSendMail(t *testing.T) {
 	require.NoError(t, writer.Close())
 	require.NoError(t, client.Quit())
 }
+
+func TestStartTLSBeforeAuth(t *testing.T) {
+	ctx := context.Background()
+	q := queuemocks.NewGenericWorkQueueMock[*ReceivedMessage](t)
+	q.On("Queue", mock.AnythingOfType("context.backgroundCtx"), mock.IsType(&ReceivedMessage{}), mock.AnythingOfType("liteq.QueueOption")).Return(nil)
+
+	usrSrv := backendmocks.NewUserServiceMock(t)
+	usrSrv.On("Authenticate", "test", "example").Return(nil)
+	usrSrv.On("IsValidSender", "test", "from@example.com").Return(true)
+
+	cfg := &config.Config{
+		MailDomain:     "example.com",
+		ListenStartTls: true,
+	}
+	b, err := NewBackend(ctx, slog.Default(), q, usrSrv, cfg)
+	require.NoError(t, err)
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := smtp.NewServer(b)
+	s.Domain = cfg.MailDomain
+	s.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{generateSelfSignedCert(t, "localhost")},
+		MinVersion:   tls.VersionTLS12,
+	}
+	s.ErrorLog = &serverDebugLogger{}
+	defer s.Close()
+	go func() {
+		if err := s.Serve(tcpListener); err != nil && !errors.Is(err, smtp.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+
+	client, err := smtp.Dial(tcpListener.Addr().String())
+	require.NoError(t, err)
+	require.NoError(t, client.Hello("local.example.com"))
+	ok, _ := client.Extension("STARTTLS")
+	assert.True(t, ok)
+	ok, _ = client.Extension("AUTH")
+	assert.False(t, ok, "AUTH must not be advertised before STARTTLS")
+
+	err = client.Mail("from@example.com", &smtp.MailOptions{})
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, err, &smtpErr)
+	assert.Equal(t, 530, smtpErr.Code)
+	require.Error(t, client.Auth(sasl.NewPlainClient("test", "test", "example")))
+	require.NoError(t, client.Close())
+
+	client, err = smtp.DialStartTLS(tcpListener.Addr().String(), &tls.Config{InsecureSkipVerify: true}) //nolint:gosec
+	require.NoError(t, err)
+	require.NoError(t, client.Hello("local.example.com"))
+	require.NoError(t, client.Auth(sasl.NewPlainClient("test", "test", "example")))
+	require.NoError(t, client.Mail("from@example.com", &smtp.MailOptions{}))
+	require.NoError(t, client.Rcpt("to@remote.example.com", &smtp.RcptOptions{}))
+	writer, err := client.Data()
+	require.NoError(t, err)
+	_, err = writer.Write([]byte("mail body"))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	require.NoError(t, client.Quit())
+}
+
+func TestMailRequiresAuth(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		authRequired *config.AuthRequired
+		code         int
+		enhancedCode smtp.EnhancedCode
+		message      string
+	}{
+		{
+			name:         "default",
+			code:         530,
+			enhancedCode: smtp.EnhancedCode{5, 7, 0},
+			message:      "Authentication required",
+		},
+		{
+			name:         "custom",
+			authRequired: &config.AuthRequired{Code: 554, Message: "Submission requires an account, see https://example.com/smtp"},
+			code:         554,
+			enhancedCode: smtp.EnhancedCode{5, 7, 0},
+			message:      "Submission requires an account, see https://example.com/smtp",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			q := queuemocks.NewGenericWorkQueueMock[*ReceivedMessage](t)
+			usrSrv := backendmocks.NewUserServiceMock(t)
+			usrSrv.On("Authenticate", "test", "example").Return(nil)
+			usrSrv.On("IsValidSender", "test", "from@example.com").Return(true)
+
+			b, err := NewBackend(ctx, slog.Default(), q, usrSrv, &config.Config{
+				MailDomain:   "example.com",
+				AuthRequired: test.authRequired,
+			})
+			require.NoError(t, err)
+			tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			s := smtp.NewServer(b)
+			s.Domain = "example.com"
+			s.AllowInsecureAuth = true // Only for testing
+			defer s.Close()
+			go func() {
+				if err := s.Serve(tcpListener); err != nil && !errors.Is(err, smtp.ErrServerClosed) {
+					panic(err)
+				}
+			}()
+
+			client, err := smtp.Dial(tcpListener.Addr().String())
+			require.NoError(t, err)
+			defer client.Close()
+			require.NoError(t, client.Hello("local.example.com"))
+			ok, mechs := client.Extension("AUTH")
+			assert.True(t, ok, "the required authentication must be advertised")
+			assert.Contains(t, mechs, sasl.Plain)
+
+			err = client.Mail("from@example.com", &smtp.MailOptions{})
+			var smtpErr *smtp.SMTPError
+			require.ErrorAs(t, err, &smtpErr)
+			assert.Equal(t, test.code, smtpErr.Code)
+			assert.Equal(t, test.enhancedCode, smtpErr.EnhancedCode)
+			assert.Equal(t, test.message, smtpErr.Message)
+			// Without a sender there are no recipients
+			require.Error(t, client.Rcpt("to@remote.example.com", &smtp.RcptOptions{}))
+
+			require.NoError(t, client.Auth(sasl.NewPlainClient("test", "test", "example")))
+			require.NoError(t, client.Mail("from@example.com", &smtp.MailOptions{}))
+			require.NoError(t, client.Rcpt("to@remote.example.com", &smtp.RcptOptions{}))
+			require.NoError(t, client.Quit())
+			q.AssertNotCalled(t, "Queue", mock.Anything, mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func generateSelfSignedCert(t *testing.T, dnsNames ...string) tls.Certificate {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     dnsNames,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, privateKey.Public(), privateKey)
+	require.NoError(t, err)
+	return tls.Certificate{
+		Certificate: [][]byte{certDER},
+		PrivateKey:  privateKey,
+	}
+}
+
+// generateCA returns a CA certificate and a function issuing client certificates signed by it
+func generateCA(t *testing.T) (*x509.Certificate, func(commonName string) tls.Certificate) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	require.NoError(t, err)
+	caCert, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+
+	return caCert, func(commonName string) tls.Certificate {
+		privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: commonName},
+			NotBefore:    time.Now().Add(-time.Minute),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		certDER, err := x509.CreateCertificate(rand.Reader, template, caCert, privateKey.Public(), caKey)
+		require.NoError(t, err)
+		return tls.Certificate{
+			Certificate: [][]byte{certDER},
+			PrivateKey:  privateKey,
+		}
+	}
+}
+
+func TestClientCertificateAuthentication(t *testing.T) {
+	ctx := context.Background()
+	q := queuemocks.NewGenericWorkQueueMock[*ReceivedMessage](t)
+	q.On("Queue", mock.Anything, mock.IsType(&ReceivedMessage{}), mock.Anything).Return(nil)
+	usrSrv := backendmocks.NewUserServiceMock(t)
+	usrSrv.On("IsValidSender", "service", "from@example.com").Return(true)
+
+	caCert, issueCert := generateCA(t)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw}), 0600))
+
+	cfg := &config.Config{
+		MailDomain: "example.com",
+		ListenTls:  true,
+		ClientCertAuth: &config.ClientCertAuth{
+			CAFile: caFile,
+			Users:  []*config.ClientCertUser{{Subject: "Service.example.com", User: "service"}},
+		},
+	}
+	b, err := NewBackend(ctx, slog.Default(), q, usrSrv, cfg)
+	require.NoError(t, err)
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{generateSelfSignedCert(t, "localhost")},
+		MinVersion:   tls.VersionTLS12,
+	}
+	require.NoError(t, ConfigureClientCertAuth(tlsConfig, caFile))
+	tlsListener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	require.NoError(t, err)
+
+	s := smtp.NewServer(b)
+	s.Domain = cfg.MailDomain
+	s.TLSConfig = tlsConfig
+	s.ErrorLog = &serverDebugLogger{}
+	defer s.Close()
+	go func() {
+		if err := s.Serve(tlsListener); err != nil && !errors.Is(err, smtp.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+
+	dial := func(clientCerts ...tls.Certificate) (*smtp.Client, error) {
+		client, err := smtp.DialTLS(tlsListener.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true, //nolint:gosec
+			Certificates:       clientCerts,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := client.Hello("local.example.com"); err != nil {
+			client.Close()
+			return nil, err
+		}
+		return client, nil
+	}
+
+	t.Run("valid certificate", func(t *testing.T) {
+		client, err := dial(issueCert("service.example.com"))
+		require.NoError(t, err)
+		defer client.Close()
+		require.NoError(t, client.Mail("from@example.com", &smtp.MailOptions{}))
+		require.NoError(t, client.Rcpt("to@remote.example.com", &smtp.RcptOptions{}))
+		writer, err := client.Data()
+		require.NoError(t, err)
+		_, err = writer.Write([]byte("mail body"))
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+		require.NoError(t, client.Quit())
+	})
+
+	t.Run("unmapped certificate", func(t *testing.T) {
+		client, err := dial(issueCert("other.example.com"))
+		require.NoError(t, err)
+		defer client.Close()
+		require.Error(t, client.Mail("from@example.com", &smtp.MailOptions{}))
+	})
+
+	t.Run("untrusted certificate", func(t *testing.T) {
+		client, err := dial(generateSelfSignedCert(t, "service.example.com"))
+		if err == nil {
+			defer client.Close()
+			err = client.Mail("from@example.com", &smtp.MailOptions{})
+		}
+		require.Error(t, err)
+	})
+
+	t.Run("no certificate", func(t *testing.T) {
+		client, err := dial()
+		require.NoError(t, err)
+		defer client.Close()
+		require.Error(t, client.Mail("from@example.com", &smtp.MailOptions{}))
+	})
+}
+
+func TestChunkedSubmission(t *testing.T) {
+	body := "Subject: Test\r\n\r\n.leading dot\r\n.\r\nline without stuffing\r\n"
+	for _, test := range []struct {
+		name     string
+		size     int
+		chunks   []string
+		accepted bool
+	}{
+		{name: "single chunk", chunks: []string{body}, accepted: true},
+		{name: "several chunks", chunks: []string{body[:10], body[10:27], body[27:]}, accepted: true},
+		{name: "empty last chunk", chunks: []string{body[:20], body[20:], ""}, accepted: true},
+		{name: "announced size", size: len(body), chunks: []string{body[:20], body[20:]}, accepted: true},
+		{name: "larger than announced", size: len(body) - 5, chunks: []string{body[:20], body[20:]}},
+		{name: "smaller than announced", size: len(body) + 5, chunks: []string{body[:20], body[20:]}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			q := queuemocks.NewGenericWorkQueueMock[*ReceivedMessage](t)
+			received := make(chan *ReceivedMessage, 1)
+			q.On("Queue", mock.Anything, mock.IsType(&ReceivedMessage{}), mock.Anything).Run(func(args mock.Arguments) {
+				received <- args.Get(1).(*ReceivedMessage)
+			}).Return(nil).Maybe()
+			usrSrv := backendmocks.NewUserServiceMock(t)
+			usrSrv.On("Authenticate", "test", "example").Return(nil)
+			usrSrv.On("IsValidSender", "test", "from@example.com").Return(true)
+
+			b, err := NewBackend(ctx, slog.Default(), q, usrSrv, &config.Config{MailDomain: "example.com"})
+			require.NoError(t, err)
+			tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			s := smtp.NewServer(b)
+			s.Domain = "example.com"
+			s.AllowInsecureAuth = true // Only for testing
+			defer s.Close()
+			go s.Serve(tcpListener)
+
+			conn, err := textproto.Dial("tcp", tcpListener.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+			cmd := func(expectCode int, format string, args ...any) {
+				id, err := conn.Cmd(format, args...)
+				require.NoError(t, err)
+				conn.StartResponse(id)
+				defer conn.EndResponse(id)
+				_, _, err = conn.ReadResponse(expectCode)
+				require.NoError(t, err, format)
+			}
+			_, _, err = conn.ReadResponse(220)
+			require.NoError(t, err)
+			id, err := conn.Cmd("EHLO local.example.com")
+			require.NoError(t, err)
+			conn.StartResponse(id)
+			_, extensions, err := conn.ReadResponse(250)
+			conn.EndResponse(id)
+			require.NoError(t, err)
+			assert.Contains(t, strings.Split(extensions, "\n"), "CHUNKING")
+			cmd(235, "AUTH PLAIN %s", base64.StdEncoding.EncodeToString([]byte("\x00test\x00example")))
+			if test.size > 0 {
+				cmd(250, "MAIL FROM:<from@example.com> SIZE=%d", test.size)
+			} else {
+				cmd(250, "MAIL FROM:<from@example.com>")
+			}
+			cmd(250, "RCPT TO:<to@remote.example.com>")
+
+			for i, chunk := range test.chunks {
+				last := i == len(test.chunks)-1
+				cmdLine := fmt.Sprintf("BDAT %d", len(chunk))
+				if last {
+					cmdLine += " LAST"
+				}
+				_, err := conn.W.WriteString(cmdLine + "\r\n" + chunk)
+				require.NoError(t, err)
+				require.NoError(t, conn.W.Flush())
+				code, msg, err := conn.ReadResponse(0)
+				if !last {
+					require.NoError(t, err)
+					require.Equal(t, 250, code, msg)
+					continue
+				}
+				if test.accepted {
+					require.NoError(t, err)
+					assert.Equal(t, 250, code, msg)
+				} else {
+					assert.GreaterOrEqual(t, code, 400, msg)
+				}
+			}
+			cmd(221, "QUIT")
+
+			if !test.accepted {
+				q.AssertNotCalled(t, "Queue", mock.Anything, mock.Anything, mock.Anything)
+				return
+			}
+			select {
+			case msg := <-received:
+				assert.Equal(t, body, string(msg.Body))
+			case <-time.After(time.Second * 5):
+				t.Fatal("message was not queued")
+			}
+		})
+	}
+}
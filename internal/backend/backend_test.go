@@ -3,13 +3,29 @@ package backend
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/asggo/spf"
+	"github.com/dereulenspiegel/liteq"
 	"github.com/dereulenspiegel/smolmailer/internal/backend/backendmocks"
+	"github.com/dereulenspiegel/smolmailer/internal/config"
 	"github.com/dereulenspiegel/smolmailer/internal/queue/queuemocks"
+	"github.com/dereulenspiegel/smolmailer/internal/users"
 	"github.com/emersion/go-smtp"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -56,6 +72,86 @@ func TestValidateIPRange(t *testing.T) {
 
 }
 
+func TestAllowedIPRangesPerListener(t *testing.T) {
+	ctx := context.Background()
+	cfg := &config.Config{MailDomain: "example.com", AllowedIPRanges: []string{"172.7.0.0/24"}}
+	q := queuemocks.NewGenericWorkQueueMock[*ReceivedMessage](t)
+	usrSrv := backendmocks.NewUserServiceMock(t)
+
+	// An internal relay listener and a public submission listener, each with their own allow-list
+	relay, err := NewBackend(ctx, slog.Default(), q, usrSrv, cfg)
+	require.NoError(t, err)
+	submission, err := NewBackend(ctx, slog.Default(), q, usrSrv, cfg, WithAllowedIPRanges("fd38:0d92:4cd6::/48"))
+	require.NoError(t, err)
+	public, err := NewBackend(ctx, slog.Default(), q, usrSrv, cfg, WithAllowedIPRanges())
+	require.NoError(t, err)
+
+	internalClient := net.TCPAddrFromAddrPort(netip.MustParseAddrPort("172.7.0.12:50551"))
+	assert.True(t, relay.isValidRemoteAddr(internalClient))
+	assert.False(t, submission.isValidRemoteAddr(internalClient), "client allowed on the relay listener must be rejected")
+	assert.True(t, public.isValidRemoteAddr(internalClient))
+
+	v6Client := net.TCPAddrFromAddrPort(netip.MustParseAddrPort("[fd38:0d92:4cd6::1]:1234"))
+	assert.False(t, relay.isValidRemoteAddr(v6Client))
+	assert.True(t, submission.isValidRemoteAddr(v6Client))
+
+	_, err = NewBackend(ctx, slog.Default(), q, usrSrv, cfg, WithAllowedIPRanges("not-a-cidr"))
+	assert.Error(t, err)
+}
+
+func TestAllowedIPRangesFromURL(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var ipRanges atomic.Value
+	ipRanges.Store("# office\n198.51.100.0/24\n")
+	rangeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, ipRanges.Load().(string))
+	}))
+	defer rangeServer.Close()
+
+	cfg := &config.Config{
+		MailDomain:                     "example.com",
+		AllowedIPRanges:                []string{"172.7.0.0/24", rangeServer.URL},
+		AllowedIPRangesRefreshInterval: time.Millisecond * 20,
+	}
+	b, err := NewBackend(ctx, slog.Default(), queuemocks.NewGenericWorkQueueMock[*ReceivedMessage](t), backendmocks.NewUserServiceMock(t), cfg)
+	require.NoError(t, err)
+
+	staticClient := net.TCPAddrFromAddrPort(netip.MustParseAddrPort("172.7.0.12:50551"))
+	officeClient := net.TCPAddrFromAddrPort(netip.MustParseAddrPort("198.51.100.7:50551"))
+	newClient := net.TCPAddrFromAddrPort(netip.MustParseAddrPort("203.0.113.9:50551"))
+	assert.True(t, b.isValidRemoteAddr(staticClient))
+	assert.True(t, b.isValidRemoteAddr(officeClient))
+	assert.False(t, b.isValidRemoteAddr(newClient))
+
+	ipRanges.Store("198.51.100.0/24\n203.0.113.9\n")
+	assert.Eventually(t, func() bool {
+		return b.isValidRemoteAddr(newClient)
+	}, time.Second*5, time.Millisecond*10, "ranges added to the list are allowed after a refresh")
+	assert.True(t, b.isValidRemoteAddr(staticClient), "static ranges are kept")
+
+	// A broken list keeps the ranges loaded last
+	ipRanges.Store("not-a-cidr\n")
+	time.Sleep(time.Millisecond * 100)
+	assert.True(t, b.isValidRemoteAddr(newClient))
+
+	// Lists exceeding the maximum size are not truncated, but keep the ranges loaded last as well
+	ipRanges.Store("198.51.100.0/24\n" + strings.Repeat("#", maxIPRangeListBytes))
+	time.Sleep(time.Millisecond * 100)
+	assert.True(t, b.isValidRemoteAddr(newClient))
+}
+
+func TestUnreachableIPRangeSourceRestrictsClients(t *testing.T) {
+	rangeServer := httptest.NewServer(http.NotFoundHandler())
+	defer rangeServer.Close()
+
+	cfg := &config.Config{MailDomain: "example.com", AllowedIPRanges: []string{rangeServer.URL}}
+	b, err := NewBackend(context.Background(), slog.Default(), queuemocks.NewGenericWorkQueueMock[*ReceivedMessage](t), backendmocks.NewUserServiceMock(t), cfg)
+	require.NoError(t, err)
+	assert.False(t, b.isValidRemoteAddr(net.TCPAddrFromAddrPort(netip.MustParseAddrPort("203.0.113.9:50551"))),
+		"clients must not be accepted before the allowed ranges could be loaded")
+}
+
 func TestSessionQueuesSuccessfully(t *testing.T) {
 	ctx := context.Background()
 	q := queuemocks.NewGenericWorkQueueMock[*ReceivedMessage](t)
@@ -66,7 +162,8 @@ func TestSessionQueuesSuccessfully(t *testing.T) {
 	sess := NewSession(ctx, slog.Default(), q, usrSrv, net.TCPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:50000")))
 
 	q.On("Queue", mock.AnythingOfType("context.backgroundCtx"), mock.MatchedBy(func(msg *ReceivedMessage) bool {
-		return msg.From == "valid@example.com" && msg.To[0].To == "valid@example.com" && string(msg.Body) == "test"
+		return msg.From == "valid@example.com" && msg.To[0].To == "valid@example.com" && string(msg.Body) == "test" &&
+			msg.AuthUser == "validUser"
 	}), mock.AnythingOfType("liteq.QueueOption")).Return(nil)
 
 	sess.authenticatedSubject = "validUser" // Pretend we went through authentication
@@ -74,3 +171,815 @@ func TestSessionQueuesSuccessfully(t *testing.T) {
 	require.NoError(t, sess.Rcpt("valid@example.com", &smtp.RcptOptions{}))
 	require.NoError(t, sess.Data(bytes.NewBufferString("test")))
 }
+
+func TestSessionAcceptsNullSender(t *testing.T) {
+	ctx := context.Background()
+	q := queuemocks.NewGenericWorkQueueMock[*ReceivedMessage](t)
+	// The null sender is not the address of any user, so it must not be checked against the users
+	usrSrv := backendmocks.NewUserServiceMock(t)
+
+	q.On("Queue", mock.AnythingOfType("context.backgroundCtx"), mock.MatchedBy(func(msg *ReceivedMessage) bool {
+		return msg.From == "" && msg.To[0].To == "rcpt@example.org" && msg.AuthUser == "validUser"
+	}), mock.AnythingOfType("liteq.QueueOption")).Return(nil)
+
+	sess := NewSession(ctx, slog.Default(), q, usrSrv, net.TCPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:50000")))
+	assert.ErrorIs(t, sess.Mail("", &smtp.MailOptions{}), ErrAuthRequired, "only authenticated sessions may send bounces")
+
+	sess.authenticatedSubject = "validUser" // Pretend we went through authentication
+	require.NoError(t, sess.Mail("", &smtp.MailOptions{}))
+	require.NoError(t, sess.Rcpt("rcpt@example.org", &smtp.RcptOptions{}))
+	require.NoError(t, sess.Data(bytes.NewBufferString("Subject: Undelivered Mail\r\n\r\ntest")))
+}
+
+func TestSessionRejectsOversizedMessages(t *testing.T) {
+	ctx := context.Background()
+	q := queuemocks.NewGenericWorkQueueMock[*ReceivedMessage](t)
+	usrSrv := backendmocks.NewUserServiceMock(t)
+
+	usrSrv.On("IsValidSender", "validUser", "valid@example.com").Return(true)
+
+	sess := NewSession(ctx, slog.Default(), q, usrSrv, net.TCPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:50000")),
+		WithMaxMessageBytes(1024))
+	sess.authenticatedSubject = "validUser" // Pretend we went through authentication
+
+	err := sess.Mail("valid@example.com", &smtp.MailOptions{Size: 2048})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "2048 bytes")
+	assert.Contains(t, err.Error(), "1024 bytes")
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, err, &smtpErr)
+	assert.Equal(t, 552, smtpErr.Code)
+
+	require.NoError(t, sess.Mail("valid@example.com", &smtp.MailOptions{}))
+	require.NoError(t, sess.Rcpt("valid@example.com", &smtp.RcptOptions{}))
+	err = sess.Data(bytes.NewReader(make([]byte, 1500)))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "1500 bytes")
+	assert.Contains(t, err.Error(), "1024 bytes")
+
+	// The rest of much larger messages is not consumed, the connection is closed instead
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	WithDataTimeout(serverConn, 0)(sess)
+	require.NoError(t, sess.Mail("valid@example.com", &smtp.MailOptions{}))
+	require.NoError(t, sess.Rcpt("valid@example.com", &smtp.RcptOptions{}))
+	err = sess.Data(bytes.NewReader(make([]byte, 4096)))
+	require.ErrorAs(t, err, &smtpErr)
+	assert.Equal(t, 552, smtpErr.Code)
+	assert.Contains(t, err.Error(), "1024 bytes")
+	_, err = serverConn.Write([]byte("250 OK\r\n"))
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+	q.AssertNotCalled(t, "Queue", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestSessionRejectsOversizedHeaders(t *testing.T) {
+	ctx := context.Background()
+	q := queuemocks.NewGenericWorkQueueMock[*ReceivedMessage](t)
+	usrSrv := backendmocks.NewUserServiceMock(t)
+	usrSrv.On("IsValidSender", "validUser", "valid@example.com").Return(true)
+
+	newSession := func() *Session {
+		sess := NewSession(ctx, slog.Default(), q, usrSrv, net.TCPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:50000")),
+			WithMaxMessageBytes(1024*1024), WithHeaderLimits(1024, 10))
+		sess.authenticatedSubject = "validUser" // Pretend we went through authentication
+		require.NoError(t, sess.Mail("valid@example.com", &smtp.MailOptions{}))
+		require.NoError(t, sess.Rcpt("valid@example.com", &smtp.RcptOptions{}))
+		return sess
+	}
+	// A large body is fine as long as the header is small
+	largeBody := strings.Repeat("body line\r\n", 1000)
+
+	err := newSession().Data(strings.NewReader("Subject: " + strings.Repeat("x", 2000) + "\r\n\r\n" + largeBody))
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, err, &smtpErr)
+	assert.Equal(t, 552, smtpErr.Code)
+	assert.Contains(t, err.Error(), "maximum header size of 1024 bytes")
+
+	// Folded lines are part of the header too
+	err = newSession().Data(strings.NewReader("Subject: test\r\n" + strings.Repeat(" folded line\r\n", 100) + "\r\n" + largeBody))
+	require.ErrorAs(t, err, &smtpErr)
+	assert.Equal(t, 552, smtpErr.Code)
+
+	err = newSession().Data(strings.NewReader(strings.Repeat("X-Test: a\r\n", 11) + "\r\n" + largeBody))
+	require.ErrorAs(t, err, &smtpErr)
+	assert.Equal(t, 552, smtpErr.Code)
+	assert.Contains(t, err.Error(), "11 fields, at most 10")
+	q.AssertNotCalled(t, "Queue", mock.Anything, mock.Anything, mock.Anything)
+
+	q.On("Queue", mock.Anything, mock.Anything, mock.Anything).Return(nil).Once()
+	require.NoError(t, newSession().Data(strings.NewReader(strings.Repeat("X-Test: a\r\n", 10)+"\r\n"+largeBody)))
+}
+
+func TestSessionRequiresAuthenticatedTLS(t *testing.T) {
+	ctx := context.Background()
+	q := queuemocks.NewGenericWorkQueueMock[*ReceivedMessage](t)
+	usrSrv := backendmocks.NewUserServiceMock(t)
+	remoteAddr := net.TCPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:50000"))
+
+	usrSrv.On("IsValidSender", "validUser", "valid@example.com").Return(true)
+
+	sess := NewSession(ctx, slog.Default(), q, usrSrv, remoteAddr, WithTLS(false), WithAuthenticatedTLSRequired(true))
+	sess.authenticatedSubject = "validUser" // Pretend we went through authentication
+	err := sess.Mail("valid@example.com", &smtp.MailOptions{})
+	require.Error(t, err)
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, err, &smtpErr)
+	assert.Equal(t, 530, smtpErr.Code)
+
+	sess = NewSession(ctx, slog.Default(), q, usrSrv, remoteAddr, WithTLS(true), WithAuthenticatedTLSRequired(true))
+	require.Error(t, sess.Mail("valid@example.com", &smtp.MailOptions{}), "unauthenticated sessions must be rejected")
+	sess.authenticatedSubject = "validUser"
+	require.NoError(t, sess.Mail("valid@example.com", &smtp.MailOptions{}))
+
+	sess = NewSession(ctx, slog.Default(), q, usrSrv, remoteAddr, WithTLS(false))
+	sess.authenticatedSubject = "validUser"
+	require.NoError(t, sess.Mail("valid@example.com", &smtp.MailOptions{}))
+}
+
+func TestSessionRejectsDeniedRecipientDomains(t *testing.T) {
+	ctx := context.Background()
+	q := queuemocks.NewGenericWorkQueueMock[*ReceivedMessage](t)
+	usrSrv := backendmocks.NewUserServiceMock(t)
+	cfg := &config.Config{
+		AllowedRecipientDomains: []string{".example.com"},
+		DeniedRecipientDomains:  []string{"internal.example.com"},
+	}
+
+	sess := NewSession(ctx, slog.Default(), q, usrSrv, net.TCPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:50000")),
+		WithRecipientDomainCheck(cfg.IsRecipientDomainAllowed))
+	require.NoError(t, sess.Rcpt("one@example.com", &smtp.RcptOptions{}))
+	require.NoError(t, sess.Rcpt("two@mail.example.com", &smtp.RcptOptions{}))
+	require.NoError(t, sess.Rcpt("Five+Tag@Mail.Example.COM", &smtp.RcptOptions{}))
+	for _, rcpt := range []string{"three@internal.example.com", "four@example.org", "Six@INTERNAL.example.com"} {
+		err := sess.Rcpt(rcpt, &smtp.RcptOptions{})
+		var smtpErr *smtp.SMTPError
+		require.ErrorAs(t, err, &smtpErr, rcpt)
+		assert.Equal(t, 550, smtpErr.Code)
+	}
+	require.Len(t, sess.Msg.To, 3)
+	// Recipients are transmitted as they were given
+	assert.Equal(t, "Five+Tag@Mail.Example.COM", sess.Msg.To[2].To)
+}
+
+func TestSessionRejectsMalformedAddresses(t *testing.T) {
+	ctx := context.Background()
+	q := queuemocks.NewGenericWorkQueueMock[*ReceivedMessage](t)
+	usrSrv := backendmocks.NewUserServiceMock(t)
+	usrSrv.On("IsValidSender", "validUser", "valid@example.com").Return(true)
+
+	sess := NewSession(ctx, slog.Default(), q, usrSrv, net.TCPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:50000")))
+	sess.authenticatedSubject = "validUser" // Pretend we went through authentication
+	malformed := []string{"", "no-at-sign", "two@at@example.com", "@example.com", "local@", "Name <valid@example.com>"}
+	for _, from := range malformed[1:] {
+		err := sess.Mail(from, &smtp.MailOptions{})
+		var smtpErr *smtp.SMTPError
+		require.ErrorAs(t, err, &smtpErr, from)
+		assert.Equal(t, 501, smtpErr.Code, from)
+		assert.Equal(t, smtp.EnhancedCode{5, 1, 7}, smtpErr.EnhancedCode, from)
+	}
+	require.NoError(t, sess.Mail("valid@example.com", &smtp.MailOptions{}))
+
+	for _, rcpt := range malformed {
+		err := sess.Rcpt(rcpt, &smtp.RcptOptions{})
+		var smtpErr *smtp.SMTPError
+		require.ErrorAs(t, err, &smtpErr, rcpt)
+		assert.Equal(t, 501, smtpErr.Code, rcpt)
+		assert.Equal(t, smtp.EnhancedCode{5, 1, 3}, smtpErr.EnhancedCode, rcpt)
+	}
+	require.NoError(t, sess.Rcpt("valid@example.com", &smtp.RcptOptions{}))
+	require.NoError(t, sess.Rcpt(`"quoted local"@example.com`, &smtp.RcptOptions{}))
+	assert.Len(t, sess.Msg.To, 2, "malformed recipients must not be added to the message")
+}
+
+func TestValidateHelo(t *testing.T) {
+	for _, exp := range []struct {
+		helo  string
+		valid bool
+	}{
+		{helo: "mail.example.org", valid: true},
+		{helo: "mail.example.org.", valid: true},
+		{helo: "[192.0.2.1]", valid: true},
+		{helo: "[IPv6:2001:db8::1]", valid: true},
+		{helo: "localhost", valid: false},
+		{helo: "192.0.2.1", valid: false},
+		{helo: "2001:db8::1", valid: false},
+		{helo: "[not-an-ip]", valid: false},
+		{helo: "under_score.example.org", valid: false},
+		{helo: "example.com", valid: false},
+		{helo: "SMTP.example.com", valid: false},
+	} {
+		err := validateHelo(exp.helo, "example.com", "smtp.example.com")
+		if exp.valid {
+			assert.NoError(t, err, exp.helo)
+		} else {
+			assert.Error(t, err, exp.helo)
+		}
+	}
+}
+
+func TestCheckHeloPolicy(t *testing.T) {
+	remoteAddr := net.TCPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:50000"))
+	b := &Backend{
+		cfg:    &config.Config{MailDomain: "example.com"},
+		logger: slog.Default(),
+	}
+	assert.NoError(t, b.checkHelo("localhost", remoteAddr))
+
+	b.cfg.HeloPolicy = config.HeloPolicyLog
+	assert.NoError(t, b.checkHelo("localhost", remoteAddr))
+
+	b.cfg.HeloPolicy = config.HeloPolicyReject
+	err := b.checkHelo("localhost", remoteAddr)
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, err, &smtpErr)
+	assert.Equal(t, 550, smtpErr.Code)
+	assert.NoError(t, b.checkHelo("client.example.org", remoteAddr))
+}
+
+func TestCheckDNSBL(t *testing.T) {
+	listedAddr := net.TCPAddrFromAddrPort(netip.MustParseAddrPort("192.0.2.99:50000"))
+	cleanAddr := net.TCPAddrFromAddrPort(netip.MustParseAddrPort("192.0.2.10:50000"))
+	b := &Backend{
+		cfg:    &config.Config{DNSBL: &config.DNSBL{Zones: []string{"zen.example.org"}, Action: config.DNSBLActionReject}},
+		logger: slog.Default(),
+		dnsblCheck: func(ip netip.Addr) ([]string, error) {
+			if ip == netip.MustParseAddr("192.0.2.99") {
+				return []string{"zen.example.org"}, nil
+			}
+			return nil, nil
+		},
+	}
+
+	assert.Equal(t, []string{"zen.example.org"}, b.checkDNSBL(listedAddr, false))
+	assert.Empty(t, b.checkDNSBL(cleanAddr, false))
+
+	// Clients authenticated by their client certificate are trusted
+	assert.Empty(t, b.checkDNSBL(listedAddr, true))
+
+	// Clients from the allowed IP ranges are trusted
+	_, allowedNet, err := net.ParseCIDR("192.0.2.0/24")
+	require.NoError(t, err)
+	b.allowedIPNets = []*net.IPNet{allowedNet}
+	assert.Empty(t, b.checkDNSBL(listedAddr, false))
+
+	// Failed lookups don't list clients
+	b.allowedIPNets = nil
+	b.dnsblCheck = func(ip netip.Addr) ([]string, error) {
+		return nil, errors.New("blocklist unreachable")
+	}
+	assert.Empty(t, b.checkDNSBL(listedAddr, false))
+}
+
+func TestSessionRejectsUnauthenticatedDNSBLListedClients(t *testing.T) {
+	remoteAddr := net.TCPAddrFromAddrPort(netip.MustParseAddrPort("192.0.2.99:50000"))
+	userService := backendmocks.NewUserServiceMock(t)
+	userService.EXPECT().IsValidSender("validUser", "from@example.com").Return(true)
+	s := NewSession(context.Background(), slog.Default(), nil, userService, remoteAddr,
+		WithDNSBLListings([]string{"zen.example.org"}, true))
+
+	err := s.Mail("from@example.com", nil)
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, err, &smtpErr)
+	assert.Equal(t, 554, smtpErr.Code)
+	assert.Contains(t, smtpErr.Message, "192.0.2.99")
+	assert.Contains(t, smtpErr.Message, "zen.example.org")
+
+	// Listed clients may still submit after authenticating
+	s.authenticatedSubject = "validUser" // Pretend we went through authentication
+	require.NoError(t, s.Mail("from@example.com", nil))
+	assert.Empty(t, s.receivedInfo().DNSBLListings, "messages of authenticated clients are not tagged")
+
+	tagged := NewSession(context.Background(), slog.Default(), nil, userService, remoteAddr,
+		WithDNSBLListings([]string{"zen.example.org"}, false))
+	assert.Equal(t, []string{"zen.example.org"}, tagged.receivedInfo().DNSBLListings)
+}
+
+func TestQueuedMessagesShareSubmissionID(t *testing.T) {
+	msg := &ReceivedMessage{
+		From: "from@example.com",
+		To: []*Rcpt{
+			{To: "one@example.com"},
+			{To: "two@example.com"},
+			{To: "three@example.org"},
+		},
+		Body: []byte("test"),
+	}
+	queuedMsgs := msg.QueuedMessages()
+	require.Len(t, queuedMsgs, 3)
+	submissionID := queuedMsgs[0].SubmissionID
+	assert.NotEmpty(t, submissionID)
+	for _, queuedMsg := range queuedMsgs {
+		assert.Equal(t, submissionID, queuedMsg.SubmissionID)
+	}
+
+	assert.NotEqual(t, submissionID, msg.QueuedMessages()[0].SubmissionID)
+}
+
+func TestSessionDefersMessageIfQueueingFails(t *testing.T) {
+	ctx := context.Background()
+	q := queuemocks.NewGenericWorkQueueMock[*ReceivedMessage](t)
+	usrSrv := backendmocks.NewUserServiceMock(t)
+
+	usrSrv.On("IsValidSender", "validUser", "valid@example.com").Return(true)
+	q.On("Queue", mock.Anything, mock.Anything, mock.Anything).Return(errors.New("database is locked"))
+
+	sess := NewSession(ctx, slog.Default(), q, usrSrv, net.TCPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:50000")))
+	sess.authenticatedSubject = "validUser" // Pretend we went through authentication
+	require.NoError(t, sess.Mail("valid@example.com", &smtp.MailOptions{}))
+	require.NoError(t, sess.Rcpt("valid@example.com", &smtp.RcptOptions{}))
+	err := sess.Data(bytes.NewBufferString("test"))
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, err, &smtpErr)
+	assert.True(t, smtpErr.Temporary(), "the client must retry instead of dropping the message")
+}
+
+func TestSessionRecordsReceivedInfo(t *testing.T) {
+	for _, exp := range []struct {
+		name     string
+		opts     []SessionOpt
+		protocol string
+		version  string
+		cipher   string
+	}{
+		{
+			name: "tls",
+			opts: []SessionOpt{WithTLS(true), WithTLSConnectionState(tls.ConnectionState{
+				Version:     tls.VersionTLS13,
+				CipherSuite: tls.TLS_AES_128_GCM_SHA256,
+			})},
+			protocol: "ESMTPSA",
+			version:  "TLS 1.3",
+			cipher:   "TLS_AES_128_GCM_SHA256",
+		},
+		{
+			name:     "plaintext",
+			protocol: "ESMTPA",
+		},
+	} {
+		t.Run(exp.name, func(t *testing.T) {
+			q := queuemocks.NewGenericWorkQueueMock[*ReceivedMessage](t)
+			usrSrv := backendmocks.NewUserServiceMock(t)
+			usrSrv.On("IsValidSender", "validUser", "valid@example.com").Return(true)
+			q.On("Queue", mock.Anything, mock.MatchedBy(func(msg *ReceivedMessage) bool {
+				return msg.Received != nil && msg.Received.Helo == "client.example.org" && msg.Received.RemoteAddr == "127.0.0.1" &&
+					msg.Received.Protocol == exp.protocol && msg.Received.TLSVersion == exp.version && msg.Received.TLSCipher == exp.cipher
+			}), mock.Anything).Return(nil)
+
+			sess := NewSession(context.Background(), slog.Default(), q, usrSrv, net.TCPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:50000")),
+				append(exp.opts, WithHelo("client.example.org"))...)
+			sess.authenticatedSubject = "validUser" // Pretend we went through authentication
+			require.NoError(t, sess.Mail("valid@example.com", &smtp.MailOptions{}))
+			require.NoError(t, sess.Rcpt("valid@example.com", &smtp.RcptOptions{}))
+			require.NoError(t, sess.Data(bytes.NewBufferString("test")))
+		})
+	}
+}
+
+func TestSessionBareLfPolicy(t *testing.T) {
+	body := "Subject: Test\nFrom: valid@example.com\r\n\r\nline one\nline two\r\n"
+	for _, exp := range []struct {
+		policy       config.BareLfPolicy
+		rejected     bool
+		expectedBody string
+	}{
+		{policy: config.BareLfPolicyAllow, expectedBody: body},
+		{policy: config.BareLfPolicyFix, expectedBody: "Subject: Test\r\nFrom: valid@example.com\r\n\r\nline one\r\nline two\r\n"},
+		{policy: config.BareLfPolicyReject, rejected: true},
+		// Normalized by the message processing
+		{policy: config.BareLfPolicyNormalize, expectedBody: body},
+	} {
+		t.Run(string(exp.policy), func(t *testing.T) {
+			q := queuemocks.NewGenericWorkQueueMock[*ReceivedMessage](t)
+			usrSrv := backendmocks.NewUserServiceMock(t)
+			usrSrv.On("IsValidSender", "validUser", "valid@example.com").Return(true)
+			if !exp.rejected {
+				q.On("Queue", mock.Anything, mock.MatchedBy(func(msg *ReceivedMessage) bool {
+					return string(msg.Body) == exp.expectedBody
+				}), mock.Anything).Return(nil)
+			}
+
+			sess := NewSession(context.Background(), slog.Default(), q, usrSrv, net.TCPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:50000")),
+				WithBareLfPolicy(exp.policy))
+			sess.authenticatedSubject = "validUser" // Pretend we went through authentication
+			require.NoError(t, sess.Mail("valid@example.com", &smtp.MailOptions{}))
+			require.NoError(t, sess.Rcpt("valid@example.com", &smtp.RcptOptions{}))
+			err := sess.Data(bytes.NewBufferString(body))
+			if exp.rejected {
+				var smtpErr *smtp.SMTPError
+				require.ErrorAs(t, err, &smtpErr)
+				assert.Equal(t, 550, smtpErr.Code)
+				q.AssertNotCalled(t, "Queue", mock.Anything, mock.Anything, mock.Anything)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestHeaderScanner(t *testing.T) {
+	h := &headerScanner{}
+	for _, chunk := range []string{"From: a@example.com\r\nSubj", "ect: folded\r\n\tline\r", "\n\r", "\nBody: no header\r\n"} {
+		n, err := h.Write([]byte(chunk))
+		require.NoError(t, err)
+		require.Equal(t, len(chunk), n)
+	}
+	assert.True(t, h.done)
+	assert.Equal(t, 2, h.fields)
+	assert.Equal(t, int64(len("From: a@example.com\r\nSubject: folded\r\n\tline\r\n\r\n")), h.bytes)
+
+	h = &headerScanner{}
+	_, err := h.Write([]byte("A: b\n\nC: d\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, h.fields, "bare LF ends the header too")
+}
+
+func TestHeaderScannerGet(t *testing.T) {
+	h := &headerScanner{}
+	_, err := h.Write([]byte("From: a@example.com\r\nSubject: folded\r\n\tline\r\n\r\nSubject: body\r\n"))
+	require.NoError(t, err)
+	value, scanned := h.Get("subject")
+	assert.True(t, scanned)
+	assert.Equal(t, "folded line", value)
+
+	h = &headerScanner{}
+	_, err = h.Write([]byte("From: a@example.com\r\nX-Large: " + strings.Repeat("a", maxScannedHeaderBytes)))
+	require.NoError(t, err)
+	_, scanned = h.Get("From")
+	assert.False(t, scanned, "fields of header blocks exceeding the scanned size might be missing")
+}
+
+func TestSessionRejectsInvalidDeliverAt(t *testing.T) {
+	for _, exp := range []struct {
+		deliverAt string
+		rejected  bool
+	}{
+		{deliverAt: "2030-03-04T10:30:00Z"},
+		{deliverAt: "Mon, 04 Mar 2030 10:30:00 +0000"},
+		{deliverAt: "next tuesday", rejected: true},
+	} {
+		t.Run(exp.deliverAt, func(t *testing.T) {
+			q := queuemocks.NewGenericWorkQueueMock[*ReceivedMessage](t)
+			usrSrv := backendmocks.NewUserServiceMock(t)
+			usrSrv.On("IsValidSender", "validUser", "valid@example.com").Return(true)
+			if !exp.rejected {
+				q.On("Queue", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+			}
+
+			sess := NewSession(context.Background(), slog.Default(), q, usrSrv, net.TCPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:50000")))
+			sess.authenticatedSubject = "validUser" // Pretend we went through authentication
+			require.NoError(t, sess.Mail("valid@example.com", &smtp.MailOptions{}))
+			require.NoError(t, sess.Rcpt("valid@example.com", &smtp.RcptOptions{}))
+			err := sess.Data(bytes.NewBufferString("Subject: Test\r\nX-Smolmailer-Deliver-At: " + exp.deliverAt + "\r\n\r\nbody\r\n"))
+			if exp.rejected {
+				var smtpErr *smtp.SMTPError
+				require.ErrorAs(t, err, &smtpErr)
+				assert.Equal(t, 554, smtpErr.Code)
+				assert.Equal(t, smtp.EnhancedCode{5, 6, 0}, smtpErr.EnhancedCode)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestFixBareLf(t *testing.T) {
+	writeChunks := func(fix bool, chunks ...string) (*bareLfWriter, string) {
+		buf := &bytes.Buffer{}
+		w := newBareLfWriter(buf, fix)
+		for _, chunk := range chunks {
+			n, err := w.Write([]byte(chunk))
+			require.NoError(t, err)
+			require.Equal(t, len(chunk), n)
+		}
+		return w, buf.String()
+	}
+
+	w, body := writeChunks(false, "a\r\nb\r", "\n")
+	assert.False(t, w.found, "CRLF split across writes is not a bare LF")
+	assert.Equal(t, "a\r\nb\r\n", body)
+	w, _ = writeChunks(false, "\na")
+	assert.True(t, w.found)
+	w, body = writeChunks(true, "\na\r", "\nb\n", "\n")
+	assert.True(t, w.found)
+	assert.Equal(t, "\r\na\r\nb\r\n\r\n", body)
+}
+
+func TestSessionSpoolsLargeBodies(t *testing.T) {
+	spoolDir := t.TempDir()
+	body := strings.Repeat("0123456789abcdef\n", 1024)
+	fixedBody := strings.ReplaceAll(body, "\n", "\r\n")
+
+	q := queuemocks.NewGenericWorkQueueMock[*ReceivedMessage](t)
+	usrSrv := backendmocks.NewUserServiceMock(t)
+	usrSrv.On("IsValidSender", "validUser", "valid@example.com").Return(true)
+	var queuedMsg *ReceivedMessage
+	q.On("Queue", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		queuedMsg = args.Get(1).(*ReceivedMessage)
+	}).Return(nil).Once()
+	q.On("Queue", mock.Anything, mock.Anything, mock.Anything).Return(errors.New("database is locked")).Once()
+
+	sess := NewSession(context.Background(), slog.Default(), q, usrSrv, net.TCPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:50000")),
+		WithSpool(spoolDir, 1024), WithBareLfPolicy(config.BareLfPolicyFix))
+	sess.authenticatedSubject = "validUser" // Pretend we went through authentication
+	require.NoError(t, sess.Mail("valid@example.com", &smtp.MailOptions{}))
+	require.NoError(t, sess.Rcpt("valid@example.com", &smtp.RcptOptions{}))
+	require.NoError(t, sess.Data(bytes.NewBufferString(body)))
+
+	require.NotNil(t, queuedMsg)
+	assert.Nil(t, queuedMsg.Body, "large bodies must not be kept in memory")
+	assert.Equal(t, spoolDir, filepath.Dir(queuedMsg.BodyFile))
+	contentHash := sha256.Sum256([]byte(fixedBody))
+	assert.Equal(t, contentHash[:], queuedMsg.ContentHash)
+
+	require.NoError(t, queuedMsg.LoadBody())
+	assert.Equal(t, fixedBody, string(queuedMsg.Body))
+	require.NoError(t, queuedMsg.RemoveBodyFile())
+	assert.NoFileExists(t, filepath.Join(spoolDir, filepath.Base(queuedMsg.BodyFile)))
+
+	// Spool files of messages which could not be queued are removed
+	sess.Reset()
+	require.NoError(t, sess.Mail("valid@example.com", &smtp.MailOptions{}))
+	require.NoError(t, sess.Rcpt("valid@example.com", &smtp.RcptOptions{}))
+	require.Error(t, sess.Data(bytes.NewBufferString(body)))
+	entries, err := os.ReadDir(spoolDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestSessionKeepsSmallBodiesInMemory(t *testing.T) {
+	spoolDir := t.TempDir()
+	q := queuemocks.NewGenericWorkQueueMock[*ReceivedMessage](t)
+	usrSrv := backendmocks.NewUserServiceMock(t)
+	usrSrv.On("IsValidSender", "validUser", "valid@example.com").Return(true)
+	q.On("Queue", mock.Anything, mock.MatchedBy(func(msg *ReceivedMessage) bool {
+		return string(msg.Body) == "test" && msg.BodyFile == ""
+	}), mock.Anything).Return(nil)
+
+	sess := NewSession(context.Background(), slog.Default(), q, usrSrv, net.TCPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:50000")),
+		WithSpool(spoolDir, 1024))
+	sess.authenticatedSubject = "validUser" // Pretend we went through authentication
+	require.NoError(t, sess.Mail("valid@example.com", &smtp.MailOptions{}))
+	require.NoError(t, sess.Rcpt("valid@example.com", &smtp.RcptOptions{}))
+	require.NoError(t, sess.Data(bytes.NewBufferString("test")))
+	entries, err := os.ReadDir(spoolDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestSessionDataTimeout(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	q := queuemocks.NewGenericWorkQueueMock[*ReceivedMessage](t)
+	usrSrv := backendmocks.NewUserServiceMock(t)
+	usrSrv.On("IsValidSender", "validUser", "valid@example.com").Return(true)
+
+	sess := NewSession(context.Background(), slog.Default(), q, usrSrv, net.TCPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:50000")),
+		WithDataTimeout(serverConn, time.Millisecond*100))
+	sess.authenticatedSubject = "validUser" // Pretend we went through authentication
+	require.NoError(t, sess.Mail("valid@example.com", &smtp.MailOptions{}))
+	require.NoError(t, sess.Rcpt("valid@example.com", &smtp.RcptOptions{}))
+
+	go clientConn.Write([]byte("Subject: slow\r\n"))
+	started := time.Now()
+	// The client never finishes the message
+	err := sess.Data(serverConn)
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, err, &smtpErr)
+	assert.Equal(t, 451, smtpErr.Code)
+	assert.Less(t, time.Since(started), time.Second)
+	q.AssertNotCalled(t, "Queue", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestQueuedMessagesDedupKey(t *testing.T) {
+	msg := &ReceivedMessage{
+		From:     "from@example.com",
+		To:       []*Rcpt{{To: "one@example.com"}, {To: "two@example.com"}},
+		MailOpts: &smtp.MailOptions{EnvelopeID: "envelope"},
+		Body:     []byte("test"),
+	}
+	for _, queuedMsg := range msg.QueuedMessages() {
+		assert.Empty(t, queuedMsg.DedupKey, "messages without a content hash are not deduplicated")
+	}
+
+	msg.ContentHash = []byte("hash")
+	first := msg.QueuedMessages()
+	second := msg.QueuedMessages()
+	assert.NotEmpty(t, first[0].DedupKey)
+	assert.Equal(t, first[0].DedupKey, second[0].DedupKey)
+	assert.Equal(t, first[1].DedupKey, second[1].DedupKey)
+	assert.NotEqual(t, first[0].DedupKey, first[1].DedupKey)
+
+	msg.MailOpts.EnvelopeID = "other"
+	assert.NotEqual(t, first[0].DedupKey, msg.QueuedMessages()[0].DedupKey)
+	msg.MailOpts.EnvelopeID = "envelope"
+	msg.ContentHash = []byte("other")
+	assert.NotEqual(t, first[0].DedupKey, msg.QueuedMessages()[0].DedupKey)
+}
+
+func TestSessionGeneratesEnvelopeID(t *testing.T) {
+	q := queuemocks.NewGenericWorkQueueMock[*ReceivedMessage](t)
+	usrSrv := backendmocks.NewUserServiceMock(t)
+	usrSrv.On("IsValidSender", "validUser", "from@example.com").Return(true)
+	sess := NewSession(context.Background(), slog.Default(), q, usrSrv, net.TCPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:50000")))
+	sess.authenticatedSubject = "validUser" // Pretend we went through authentication
+
+	require.NoError(t, sess.Mail("from@example.com", &smtp.MailOptions{}))
+	require.NoError(t, sess.Rcpt("one@example.org", &smtp.RcptOptions{}))
+	require.NoError(t, sess.Rcpt("two@example.org", &smtp.RcptOptions{}))
+	envelopeID := sess.Msg.MailOpts.EnvelopeID
+	assert.NotEmpty(t, envelopeID)
+	assert.True(t, sess.Msg.EnvelopeIDGenerated)
+	sess.Msg.ContentHash = []byte("hash")
+	queued := sess.Msg.QueuedMessages()
+	require.Len(t, queued, 2)
+	for _, queuedMsg := range queued {
+		assert.Equal(t, envelopeID, queuedMsg.MailOpts.EnvelopeID)
+	}
+
+	// Retried submissions get a new envelope id, but must still be deduplicated
+	sess.Reset()
+	require.NoError(t, sess.Mail("from@example.com", nil))
+	require.NoError(t, sess.Rcpt("one@example.org", &smtp.RcptOptions{}))
+	assert.NotEqual(t, envelopeID, sess.Msg.MailOpts.EnvelopeID)
+	sess.Msg.ContentHash = []byte("hash")
+	assert.Equal(t, queued[0].DedupKey, sess.Msg.QueuedMessages()[0].DedupKey)
+
+	sess.Reset()
+	require.NoError(t, sess.Mail("from@example.com", &smtp.MailOptions{EnvelopeID: "client-envelope"}))
+	assert.Equal(t, "client-envelope", sess.Msg.MailOpts.EnvelopeID)
+	assert.False(t, sess.Msg.EnvelopeIDGenerated)
+}
+
+func TestSessionSPFCheck(t *testing.T) {
+	records := map[string]string{
+		"pass.example.com": "v=spf1 ip4:127.0.0.0/8 -all",
+		"fail.example.com": "v=spf1 ip4:192.0.2.0/24 -all",
+		"soft.example.com": "v=spf1 ip4:192.0.2.0/24 ~all",
+	}
+	stubSPF := func(ip, domain string) spf.Result {
+		record, err := spf.NewSPF(domain, records[domain], 0)
+		require.NoError(t, err)
+		return record.Test(ip)
+	}
+
+	for _, exp := range []struct {
+		from     string
+		reject   bool
+		result   spf.Result
+		rejected bool
+	}{
+		{from: "user@pass.example.com", reject: true, result: spf.Pass},
+		{from: "user@fail.example.com", reject: true, result: spf.Fail, rejected: true},
+		{from: "user@fail.example.com", reject: false, result: spf.Fail},
+		{from: "user@soft.example.com", reject: true, result: spf.SoftFail},
+	} {
+		t.Run(fmt.Sprintf("%s reject=%t", exp.from, exp.reject), func(t *testing.T) {
+			q := queuemocks.NewGenericWorkQueueMock[*ReceivedMessage](t)
+			usrSrv := backendmocks.NewUserServiceMock(t)
+			usrSrv.On("IsValidSender", "validUser", exp.from).Return(true)
+
+			sess := NewSession(context.Background(), slog.Default(), q, usrSrv, net.TCPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:50000")),
+				WithSPFCheck(stubSPF, exp.reject))
+			sess.authenticatedSubject = "validUser" // Pretend we went through authentication
+			err := sess.Mail(exp.from, &smtp.MailOptions{})
+			require.NotNil(t, sess.Msg.SPF)
+			assert.Equal(t, exp.result, sess.Msg.SPF.Result)
+			assert.Equal(t, "127.0.0.1", sess.Msg.SPF.ClientIP)
+			if !exp.rejected {
+				require.NoError(t, err)
+				return
+			}
+			var smtpErr *smtp.SMTPError
+			require.ErrorAs(t, err, &smtpErr)
+			assert.Equal(t, 550, smtpErr.Code)
+			assert.Equal(t, smtp.EnhancedCode{5, 7, 23}, smtpErr.EnhancedCode)
+		})
+	}
+}
+
+func TestSessionSenderVerification(t *testing.T) {
+	verifier := func(_ context.Context, sender string) (bool, error) {
+		switch sender {
+		case "valid@example.com":
+			return true, nil
+		case "invalid@example.com":
+			return false, nil
+		default:
+			return false, errors.New("mx unreachable")
+		}
+	}
+	for _, exp := range []struct {
+		from     string
+		rejected bool
+	}{
+		{from: "valid@example.com"},
+		{from: "invalid@example.com", rejected: true},
+		{from: "unreachable@example.com"},
+	} {
+		t.Run(exp.from, func(t *testing.T) {
+			q := queuemocks.NewGenericWorkQueueMock[*ReceivedMessage](t)
+			usrSrv := backendmocks.NewUserServiceMock(t)
+			usrSrv.On("IsValidSender", "validUser", exp.from).Return(true)
+
+			sess := NewSession(context.Background(), slog.Default(), q, usrSrv, net.TCPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:50000")),
+				WithSenderVerifier(verifier))
+			sess.authenticatedSubject = "validUser" // Pretend we went through authentication
+			err := sess.Mail(exp.from, &smtp.MailOptions{})
+			if !exp.rejected {
+				require.NoError(t, err)
+				assert.Equal(t, exp.from, sess.Msg.From)
+				return
+			}
+			var smtpErr *smtp.SMTPError
+			require.ErrorAs(t, err, &smtpErr)
+			assert.Equal(t, 550, smtpErr.Code)
+			assert.Equal(t, smtp.EnhancedCode{5, 1, 7}, smtpErr.EnhancedCode)
+		})
+	}
+}
+
+type stubQuotaChecker struct {
+	messages, recipients       int
+	maxMessages, maxRecipients int
+}
+
+func (s *stubQuotaChecker) CheckMessage(_ context.Context, _ string) error {
+	if s.messages >= s.maxMessages {
+		return users.ErrMessageQuotaExceeded
+	}
+	return nil
+}
+
+func (s *stubQuotaChecker) CheckRecipients(_ context.Context, _ string, recipients int) error {
+	if s.recipients+recipients > s.maxRecipients {
+		return users.ErrRecipientQuotaExceeded
+	}
+	return nil
+}
+
+func (s *stubQuotaChecker) Record(_ context.Context, _ string, recipients int) error {
+	s.messages++
+	s.recipients += recipients
+	return nil
+}
+
+func TestSessionEnforcesQuota(t *testing.T) {
+	q := queuemocks.NewGenericWorkQueueMock[*ReceivedMessage](t)
+	q.On("Queue", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	usrSrv := backendmocks.NewUserServiceMock(t)
+	usrSrv.On("IsValidSender", "validUser", "valid@example.com").Return(true)
+	quota := &stubQuotaChecker{maxMessages: 2, maxRecipients: 3}
+
+	sess := NewSession(context.Background(), slog.Default(), q, usrSrv, net.TCPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:50000")),
+		WithQuotaChecker(quota))
+	sess.authenticatedSubject = "validUser" // Pretend we went through authentication
+
+	require.NoError(t, sess.Mail("valid@example.com", &smtp.MailOptions{}))
+	require.NoError(t, sess.Rcpt("a@example.org", &smtp.RcptOptions{}))
+	require.NoError(t, sess.Rcpt("b@example.org", &smtp.RcptOptions{}))
+	require.NoError(t, sess.Data(strings.NewReader("test")))
+	assert.Equal(t, 1, quota.messages)
+	assert.Equal(t, 2, quota.recipients)
+
+	sess.Reset()
+	require.NoError(t, sess.Mail("valid@example.com", &smtp.MailOptions{}))
+	require.NoError(t, sess.Rcpt("c@example.org", &smtp.RcptOptions{}))
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, sess.Rcpt("d@example.org", &smtp.RcptOptions{}), &smtpErr)
+	assert.Equal(t, 452, smtpErr.Code)
+	require.NoError(t, sess.Data(strings.NewReader("test")))
+
+	sess.Reset()
+	require.ErrorAs(t, sess.Mail("valid@example.com", &smtp.MailOptions{}), &smtpErr)
+	assert.Equal(t, 450, smtpErr.Code)
+	assert.True(t, smtpErr.Temporary())
+}
+
+func TestSessionQueuesWithMaxDeliveryAttempts(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		opts     []SessionOpt
+		expected int64
+	}{
+		{name: "default", expected: config.DefaultMaxDeliveryAttempts},
+		{name: "configured", opts: []SessionOpt{WithMaxDeliveryAttempts(4)}, expected: 4},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			q := queuemocks.NewGenericWorkQueueMock[*ReceivedMessage](t)
+			usrSrv := backendmocks.NewUserServiceMock(t)
+			usrSrv.On("IsValidSender", "validUser", "valid@example.com").Return(true)
+			q.On("Queue", mock.Anything, mock.Anything, mock.MatchedBy(func(opt liteq.QueueOption) bool {
+				params := &liteq.QueueJobParams{}
+				opt(params)
+				return params.RemainingAttempts == test.expected
+			})).Return(nil)
+
+			sess := NewSession(context.Background(), slog.Default(), q, usrSrv, net.TCPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:50000")),
+				test.opts...)
+			sess.authenticatedSubject = "validUser" // Pretend we went through authentication
+			require.NoError(t, sess.Mail("valid@example.com", &smtp.MailOptions{}))
+			require.NoError(t, sess.Rcpt("valid@example.com", &smtp.RcptOptions{}))
+			require.NoError(t, sess.Data(bytes.NewBufferString("test")))
+		})
+	}
+}
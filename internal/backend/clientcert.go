@@ -0,0 +1,44 @@
+package backend
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ConfigureClientCertAuth requests client certificates issued by the CAs in caFile. Clients presenting a
+// certificate which can't be verified are rejected during the handshake, clients without a certificate can
+// still authenticate via SASL.
+func ConfigureClientCertAuth(tlsConfig *tls.Config, caFile string) error {
+	caPem, err := os.ReadFile(caFile)
+	if err != nil {
+		return fmt.Errorf("failed to read client CA file %s: %w", caFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPem) {
+		return errors.New("no client CA certificates found in " + caFile)
+	}
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	return nil
+}
+
+// clientCertUser returns the user the verified client certificate of the session is mapped to. The subject
+// common name, the DNS names and the email addresses of the certificate are matched in this order.
+func (b *Backend) clientCertUser(state tls.ConnectionState) (string, bool) {
+	if len(b.clientCertUsers) == 0 || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	leaf := state.VerifiedChains[0][0]
+	subjects := append([]string{leaf.Subject.CommonName}, leaf.DNSNames...)
+	subjects = append(subjects, leaf.EmailAddresses...)
+	for _, subject := range subjects {
+		if user, exists := b.clientCertUsers[strings.ToLower(subject)]; exists && subject != "" {
+			return user, true
+		}
+	}
+	return "", false
+}
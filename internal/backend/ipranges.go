@@ -0,0 +1,120 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+const (
+	// maxIPRangeListBytes limits the size of remote IP range lists
+	maxIPRangeListBytes = 1 << 20
+	// ipRangeFetchTimeout limits loading a remote IP range list
+	ipRangeFetchTimeout = time.Second * 30
+)
+
+// isIPRangeSource returns whether an allowed IP range is a URL to load the ranges from instead of a CIDR
+func isIPRangeSource(ipRange string) bool {
+	return strings.HasPrefix(ipRange, "http://") || strings.HasPrefix(ipRange, "https://")
+}
+
+// parseIPRanges parses CIDRs, single addresses are converted to ranges containing only them
+func parseIPRanges(ipRanges []string) ([]*net.IPNet, error) {
+	ipNets := make([]*net.IPNet, 0, len(ipRanges))
+	for _, netString := range ipRanges {
+		if addr, err := netip.ParseAddr(netString); err == nil {
+			netString = netip.PrefixFrom(addr, addr.BitLen()).String()
+		}
+		_, ipNet, err := net.ParseCIDR(netString)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CIDR %s: %w", netString, err)
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return ipNets, nil
+}
+
+// fetchIPRanges loads a list of CIDRs from source, one per line. Empty lines and lines starting with # are ignored.
+func fetchIPRanges(ctx context.Context, client *http.Client, source string) ([]*net.IPNet, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request for %s: %w", source, err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch IP ranges from %s: %w", source, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch IP ranges from %s: %s", source, resp.Status)
+	}
+	// Truncated lists would silently drop ranges, so lists exceeding the limit fail entirely
+	list, err := io.ReadAll(io.LimitReader(resp.Body, maxIPRangeListBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read IP ranges from %s: %w", source, err)
+	}
+	if len(list) > maxIPRangeListBytes {
+		return nil, fmt.Errorf("IP range list from %s exceeds the maximum size of %d bytes", source, maxIPRangeListBytes)
+	}
+	var ipRanges []string
+	scanner := bufio.NewScanner(bytes.NewReader(list))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ipRanges = append(ipRanges, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read IP ranges from %s: %w", source, err)
+	}
+	return parseIPRanges(ipRanges)
+}
+
+// refreshAllowedIPRanges loads the ranges of all remote sources and merges them with the static ranges. Sources
+// which fail keep the ranges they returned last, so an unreachable source doesn't lock out its clients.
+func (b *Backend) refreshAllowedIPRanges(ctx context.Context) {
+	ipNets := append([]*net.IPNet{}, b.staticIPNets...)
+	for _, source := range b.ipRangeSources {
+		sourceNets, err := fetchIPRanges(ctx, b.ipRangeClient, source)
+		if err != nil {
+			b.logger.Error("failed to refresh allowed IP ranges, keeping the previous ranges", "source", source, "err", err)
+			sourceNets = b.sourceIPNets[source]
+		} else {
+			b.sourceIPNets[source] = sourceNets
+		}
+		ipNets = append(ipNets, sourceNets...)
+	}
+
+	b.allowedIPNetsLock.Lock()
+	defer b.allowedIPNetsLock.Unlock()
+	b.allowedIPNets = ipNets
+}
+
+func (b *Backend) goRefreshAllowedIPRanges(ctx context.Context) {
+	tick := time.NewTicker(b.ipRangeRefreshInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			b.refreshAllowedIPRanges(ctx)
+		}
+	}
+}
+
+// ipRangesRestricted returns whether only clients from the allowed IP ranges are accepted. Clients are
+// restricted if remote sources are configured, even if they couldn't be loaded yet.
+func (b *Backend) ipRangesRestricted() bool {
+	b.allowedIPNetsLock.RLock()
+	defer b.allowedIPNetsLock.RUnlock()
+	return len(b.allowedIPNets) > 0 || len(b.ipRangeSources) > 0
+}
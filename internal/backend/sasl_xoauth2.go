@@ -0,0 +1,122 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dereulenspiegel/smolmailer/internal/config"
+	"github.com/emersion/go-sasl"
+)
+
+// XOAuth2 is the name of the XOAUTH2 SASL mechanism
+const XOAuth2 = "XOAUTH2"
+
+var (
+	ErrTokenInactive        = errors.New("access token is not active")
+	ErrTokenSubjectMismatch = errors.New("access token was not issued to the user")
+)
+
+type XOAuth2Authenticator func(username, token string) error
+
+type xoauth2Server struct {
+	started      bool
+	authenticate XOAuth2Authenticator
+}
+
+// A server implementation of the XOAUTH2 authentication mechanism, as described
+// in https://developers.google.com/workspace/gmail/imap/xoauth2-protocol.
+func NewXOAuth2Server(authenticator XOAuth2Authenticator) sasl.Server {
+	return &xoauth2Server{authenticate: authenticator}
+}
+
+func (a *xoauth2Server) Next(response []byte) (challenge []byte, done bool, err error) {
+	if response == nil && !a.started {
+		// The client did not send an initial response, ask for it with an empty challenge
+		a.started = true
+		return []byte{}, false, nil
+	}
+	username, token, err := parseXOAuth2Response(response)
+	if err != nil {
+		return nil, true, err
+	}
+	return nil, true, a.authenticate(username, token)
+}
+
+// parseXOAuth2Response parses responses of the form "user=<username>^Aauth=Bearer <token>^A^A"
+func parseXOAuth2Response(response []byte) (username, token string, err error) {
+	for field := range strings.SplitSeq(strings.TrimRight(string(response), "\x01"), "\x01") {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "user":
+			username = value
+		case "auth":
+			scheme, credentials, _ := strings.Cut(value, " ")
+			if !strings.EqualFold(scheme, "Bearer") {
+				return "", "", fmt.Errorf("unsupported XOAUTH2 auth scheme %s", scheme)
+			}
+			token = credentials
+		}
+	}
+	if username == "" || token == "" {
+		return "", "", sasl.ErrUnexpectedClientResponse
+	}
+	return username, token, nil
+}
+
+// TokenValidator verifies that the bearer token is valid and was issued to the user
+type TokenValidator func(ctx context.Context, username, token string) error
+
+const introspectionTimeout = time.Second * 10
+
+type introspectionResponse struct {
+	Active   bool   `json:"active"`
+	Username string `json:"username"`
+	Subject  string `json:"sub"`
+}
+
+// NewIntrospectionValidator validates bearer tokens at the OAuth2 token introspection endpoint (RFC 7662).
+// Tokens are valid if they are active and either their username or subject is the authenticating user.
+func NewIntrospectionValidator(cfg *config.OAuth2Introspection, client *http.Client) TokenValidator {
+	if client == nil {
+		client = &http.Client{Timeout: introspectionTimeout}
+	}
+	return func(ctx context.Context, username, token string) error {
+		form := url.Values{}
+		form.Set("token", token)
+		form.Set("token_type_hint", "access_token")
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.Url, strings.NewReader(form.Encode()))
+		if err != nil {
+			return fmt.Errorf("failed to create introspection request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "application/json")
+		if cfg.ClientId != "" {
+			req.SetBasicAuth(url.QueryEscape(cfg.ClientId), url.QueryEscape(cfg.ClientSecret))
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to introspect access token: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("token introspection failed with status %d", resp.StatusCode)
+		}
+		introspection := &introspectionResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(introspection); err != nil {
+			return fmt.Errorf("failed to decode introspection response: %w", err)
+		}
+		if !introspection.Active {
+			return ErrTokenInactive
+		}
+		if introspection.Username != username && introspection.Subject != username {
+			return fmt.Errorf("%w %s", ErrTokenSubjectMismatch, username)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,97 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/dereulenspiegel/smolmailer/internal/backend/backendmocks"
+	"github.com/dereulenspiegel/smolmailer/internal/config"
+	"github.com/dereulenspiegel/smolmailer/internal/queue/queuemocks"
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewXOAuth2Server(t *testing.T) {
+	var authenticated string
+	s := NewXOAuth2Server(func(username, token string) error {
+		assert.Equal(t, "token", token)
+		authenticated = username
+		return nil
+	})
+	challenge, done, err := s.Next(nil)
+	require.NoError(t, err)
+	assert.False(t, done)
+	assert.Empty(t, challenge)
+
+	_, done, err = s.Next([]byte("user=someone@example.com\x01auth=Bearer token\x01\x01"))
+	require.NoError(t, err)
+	assert.True(t, done)
+	assert.Equal(t, "someone@example.com", authenticated)
+
+	_, _, err = NewXOAuth2Server(nil).Next([]byte("user=someone@example.com\x01auth=Basic dXNlcjpwYXNz\x01\x01"))
+	assert.Error(t, err)
+	_, _, err = NewXOAuth2Server(nil).Next([]byte("user=someone@example.com\x01\x01"))
+	assert.Error(t, err)
+}
+
+func TestSessionXOAuth2WithIntrospection(t *testing.T) {
+	introspection := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientID, clientSecret, _ := r.BasicAuth()
+		if clientID != "smolmailer" || clientSecret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		resp := introspectionResponse{}
+		if r.FormValue("token") == "valid-token" {
+			resp = introspectionResponse{Active: true, Username: "validUser"}
+		}
+		assert.NoError(t, json.NewEncoder(w).Encode(resp))
+	}))
+	defer introspection.Close()
+	validator := NewIntrospectionValidator(&config.OAuth2Introspection{
+		Url:          introspection.URL,
+		ClientId:     "smolmailer",
+		ClientSecret: "secret",
+	}, nil)
+
+	newSession := func() *Session {
+		return NewSession(context.Background(), slog.Default(), queuemocks.NewGenericWorkQueueMock[*ReceivedMessage](t), backendmocks.NewUserServiceMock(t),
+			net.TCPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:50000")), WithTokenValidator(validator))
+	}
+
+	sess := newSession()
+	assert.Contains(t, sess.AuthMechanisms(), XOAuth2)
+	server, err := sess.Auth(XOAuth2)
+	require.NoError(t, err)
+	_, done, err := server.Next([]byte("user=validUser\x01auth=Bearer valid-token\x01\x01"))
+	require.NoError(t, err)
+	assert.True(t, done)
+	assert.Equal(t, "validUser", sess.authenticatedSubject)
+
+	for _, response := range []string{
+		"user=validUser\x01auth=Bearer expired-token\x01\x01",
+		"user=otherUser\x01auth=Bearer valid-token\x01\x01",
+	} {
+		sess := newSession()
+		server, err := sess.Auth(XOAuth2)
+		require.NoError(t, err)
+		_, _, err = server.Next([]byte(response))
+		var smtpErr *smtp.SMTPError
+		require.ErrorAs(t, err, &smtpErr)
+		assert.Equal(t, 535, smtpErr.Code)
+		assert.Empty(t, sess.authenticatedSubject)
+	}
+
+	sess = NewSession(context.Background(), slog.Default(), queuemocks.NewGenericWorkQueueMock[*ReceivedMessage](t), backendmocks.NewUserServiceMock(t),
+		net.TCPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:50000")))
+	assert.NotContains(t, sess.AuthMechanisms(), XOAuth2)
+	_, err = sess.Auth(XOAuth2)
+	assert.Error(t, err)
+}
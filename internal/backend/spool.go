@@ -0,0 +1,167 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+)
+
+// bodySpool buffers a message body in memory and moves it into a file in dir once it grows beyond
+// the threshold, so large messages are not kept in memory while they are received
+type bodySpool struct {
+	dir       string
+	threshold int64
+
+	buf  *bytes.Buffer
+	file *os.File
+}
+
+// newBodySpool returns a spool for a single message body. Bodies are never spooled to disk if dir
+// is empty or threshold is 0 or less.
+func newBodySpool(dir string, threshold int64) *bodySpool {
+	return &bodySpool{
+		dir:       dir,
+		threshold: threshold,
+		buf:       &bytes.Buffer{},
+	}
+}
+
+func (b *bodySpool) Write(p []byte) (int, error) {
+	if b.file == nil && b.dir != "" && b.threshold > 0 && int64(b.buf.Len()+len(p)) > b.threshold {
+		file, err := os.CreateTemp(b.dir, "body-*.eml")
+		if err != nil {
+			return 0, fmt.Errorf("failed to create spool file: %w", err)
+		}
+		b.file = file
+		if _, err := b.buf.WriteTo(file); err != nil {
+			return 0, fmt.Errorf("failed to write spool file: %w", err)
+		}
+	}
+	if b.file != nil {
+		return b.file.Write(p)
+	}
+	return b.buf.Write(p)
+}
+
+// Close flushes the spool file, if the body was spooled to disk
+func (b *bodySpool) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	if err := b.file.Sync(); err != nil {
+		b.file.Close()
+		return fmt.Errorf("failed to sync spool file: %w", err)
+	}
+	return b.file.Close()
+}
+
+// Remove deletes the spool file, if the body was spooled to disk
+func (b *bodySpool) Remove() {
+	if b.file != nil {
+		os.Remove(b.file.Name())
+	}
+}
+
+// Body returns either the body or the path of the file it was spooled to
+func (b *bodySpool) Body() (body []byte, bodyFile string) {
+	if b.file != nil {
+		return nil, b.file.Name()
+	}
+	return b.buf.Bytes(), ""
+}
+
+// bareLfWriter detects line feeds without carriage return in everything written to it and optionally
+// converts them to CRLF before passing it on
+type bareLfWriter struct {
+	w     io.Writer
+	fix   bool
+	prev  byte
+	found bool
+}
+
+func newBareLfWriter(w io.Writer, fix bool) *bareLfWriter {
+	return &bareLfWriter{w: w, fix: fix}
+}
+
+func (b *bareLfWriter) Write(p []byte) (int, error) {
+	prev := b.prev
+	fixed := p
+	if b.fix {
+		fixed = make([]byte, 0, len(p))
+	}
+	for _, c := range p {
+		if c == '\n' && prev != '\r' {
+			b.found = true
+			if b.fix {
+				fixed = append(fixed, '\r')
+			}
+		}
+		if b.fix {
+			fixed = append(fixed, c)
+		}
+		prev = c
+	}
+	if len(p) > 0 {
+		b.prev = p[len(p)-1]
+	}
+	if _, err := b.w.Write(fixed); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// maxScannedHeaderBytes limits how much of the header block the headerScanner keeps for inspection
+const maxScannedHeaderBytes = 1 << 16
+
+// headerScanner measures the header block of everything written to it, the header block ends with the
+// first empty line. The first maxScannedHeaderBytes of the header block are kept.
+type headerScanner struct {
+	bytes   int64
+	fields  int
+	lineLen int
+	done    bool
+	header  []byte
+}
+
+func (h *headerScanner) Write(p []byte) (int, error) {
+	for _, c := range p {
+		if h.done {
+			return len(p), nil
+		}
+		h.bytes++
+		if len(h.header) < maxScannedHeaderBytes {
+			h.header = append(h.header, c)
+		}
+		switch {
+		case c == '\n':
+			h.done = h.lineLen == 0
+			h.lineLen = 0
+		case c == '\r':
+		default:
+			// Folded lines start with white space and continue the previous field
+			if h.lineLen == 0 && c != ' ' && c != '\t' {
+				h.fields++
+			}
+			h.lineLen++
+		}
+	}
+	return len(p), nil
+}
+
+// Get returns the value of the first header field with the given name. ok is false if the header block
+// exceeded maxScannedHeaderBytes and the field might not have been scanned.
+func (h *headerScanner) Get(name string) (value string, ok bool) {
+	header := h.header
+	if !h.done {
+		if h.bytes > maxScannedHeaderBytes {
+			return "", false
+		}
+		header = append(header, "\r\n\r\n"...)
+	}
+	// Malformed header blocks are parsed up to the first malformed line
+	parsed, _ := textproto.NewReader(bufio.NewReader(bytes.NewReader(header))).ReadMIMEHeader()
+	return parsed.Get(name), true
+}
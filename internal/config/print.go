@@ -0,0 +1,116 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// redactedValue replaces secrets in the printed config
+const redactedValue = "REDACTED"
+
+// Fields tagged with secret:"true" are replaced completely when the config is printed, fields tagged with
+// secret:"url" only lose the password of the URL they contain
+const (
+	secretTag      = "secret"
+	secretTagValue = "true"
+	secretTagUrl   = "url"
+)
+
+// WriteRedacted writes the config as YAML with the same keys as the config file. Secrets like private keys,
+// passwords and client secrets are redacted.
+func (c *Config) WriteRedacted(w io.Writer) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(redactedSettings(reflect.ValueOf(c))); err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+	return encoder.Close()
+}
+
+// redactedSettings converts config values into maps keyed by their config keys, so they are printed like
+// they are configured
+func redactedSettings(v reflect.Value) any {
+	switch v.Type() {
+	case reflect.TypeFor[time.Duration]():
+		return time.Duration(v.Int()).String()
+	case reflect.TypeFor[os.FileMode]():
+		return fmt.Sprintf("%#o", v.Uint())
+	}
+	switch v.Kind() { //nolint:golint,exhaustive
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return redactedSettings(v.Elem())
+	case reflect.Struct:
+		settings := make(map[string]any)
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			// TestingOpts can't be configured
+			if !field.IsExported() || field.Type.Kind() == reflect.Func || field.Type == reflect.TypeFor[*TestingOpts]() {
+				continue
+			}
+			name := getConfigPathForField("", field)
+			switch field.Tag.Get(secretTag) {
+			case secretTagValue:
+				settings[name] = redactString(v.Field(i).String())
+			case secretTagUrl:
+				settings[name] = redactUrl(v.Field(i).String())
+			default:
+				settings[name] = redactedSettings(v.Field(i))
+			}
+		}
+		return settings
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		settings := make(map[string]any, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			settings[fmt.Sprint(iter.Key().Interface())] = redactedSettings(iter.Value())
+		}
+		return settings
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		settings := make([]any, v.Len())
+		for i := range settings {
+			settings[i] = redactedSettings(v.Index(i))
+		}
+		return settings
+	case reflect.Func, reflect.Chan:
+		return nil
+	default:
+		return v.Interface()
+	}
+}
+
+func redactString(value string) string {
+	if value == "" {
+		return ""
+	}
+	return redactedValue
+}
+
+// redactUrl removes the password from an URL, values which can't be parsed are redacted completely
+func redactUrl(value string) string {
+	if value == "" {
+		return ""
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return redactedValue
+	}
+	if _, hasPassword := u.User.Password(); hasPassword {
+		u.User = url.UserPassword(u.User.Username(), redactedValue)
+	}
+	return u.String()
+}
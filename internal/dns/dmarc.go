@@ -0,0 +1,185 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/publicsuffix"
+)
+
+var (
+	ErrNoDMARCRecord      = errors.New("no dmarc record found")
+	ErrInvalidDMARCRecord = errors.New("invalid DMARC record")
+	ErrDKIMNotAligned     = errors.New("DKIM signing domain does not align with the From domain")
+	ErrSPFNotAligned      = errors.New("envelope domain does not align with the From domain")
+)
+
+const (
+	AlignmentRelaxed = "r"
+	AlignmentStrict  = "s"
+)
+
+// DmarcPolicy is the parsed content of a DMARC TXT record
+type DmarcPolicy struct {
+	Domain          string
+	Policy          string
+	SubdomainPolicy string
+	DKIMAlignment   string
+	SPFAlignment    string
+}
+
+// parseDmarcRecord parses the tag list of a DMARC record as described in RFC 7489 section 6.3
+func parseDmarcRecord(domain, record string) (*DmarcPolicy, error) {
+	policy := &DmarcPolicy{
+		Domain:        domain,
+		DKIMAlignment: AlignmentRelaxed,
+		SPFAlignment:  AlignmentRelaxed,
+	}
+	for i, tag := range strings.Split(record, ";") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		key, value, found := strings.Cut(tag, "=")
+		if !found {
+			return nil, fmt.Errorf("%w: malformed tag %q", ErrInvalidDMARCRecord, tag)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if i == 0 {
+			if key != "v" || value != "DMARC1" {
+				return nil, fmt.Errorf("%w: record must start with v=DMARC1", ErrInvalidDMARCRecord)
+			}
+			continue
+		}
+		switch key {
+		case "p", "sp":
+			if value != "none" && value != "quarantine" && value != "reject" {
+				return nil, fmt.Errorf("%w: invalid policy %q", ErrInvalidDMARCRecord, value)
+			}
+			if key == "p" {
+				policy.Policy = value
+			} else {
+				policy.SubdomainPolicy = value
+			}
+		case "adkim", "aspf":
+			if value != AlignmentRelaxed && value != AlignmentStrict {
+				return nil, fmt.Errorf("%w: invalid alignment mode %q", ErrInvalidDMARCRecord, value)
+			}
+			if key == "adkim" {
+				policy.DKIMAlignment = value
+			} else {
+				policy.SPFAlignment = value
+			}
+		}
+	}
+	if policy.Policy == "" {
+		return nil, fmt.Errorf("%w: policy tag is missing", ErrInvalidDMARCRecord)
+	}
+	return policy, nil
+}
+
+// LookupDMARCPolicy resolves the DMARC policy of the domain. If the domain does not publish a policy
+// the policy of its organizational domain is used.
+func LookupDMARCPolicy(domain string) (*DmarcPolicy, error) {
+	policy, err := lookupDmarcRecord(domain)
+	if !errors.Is(err, ErrNoDMARCRecord) {
+		return policy, err
+	}
+	orgDomain := organizationalDomain(domain)
+	if orgDomain == strings.ToLower(strings.TrimSuffix(domain, ".")) {
+		return nil, err
+	}
+	return lookupDmarcRecord(orgDomain)
+}
+
+func lookupDmarcRecord(domain string) (*DmarcPolicy, error) {
+	dmarcDomain := "_dmarc." + domain
+	answer, err := resolve(dmarcDomain, dns.TypeTXT)
+	if err != nil {
+		if errors.Is(err, ErrRecordNotFound) {
+			return nil, ErrNoDMARCRecord
+		}
+		return nil, err
+	}
+	records := []string{}
+	for _, a := range answer {
+		if rrTxt, ok := a.(*dns.TXT); ok {
+			record := strings.Join(rrTxt.Txt, "")
+			if strings.HasPrefix(record, "v=DMARC1") {
+				records = append(records, record)
+			}
+		}
+	}
+	switch len(records) {
+	case 0:
+		return nil, ErrNoDMARCRecord
+	case 1:
+		return parseDmarcRecord(domain, records[0])
+	default:
+		// Receivers ignore DMARC if more than one record is published
+		return nil, fmt.Errorf("%w: %s publishes %d DMARC records", ErrInvalidDMARCRecord, dmarcDomain, len(records))
+	}
+}
+
+// CheckAlignment verifies that DKIM signatures of the signing domain and the envelope domain
+// pass the identifier alignment of the policy for mails from fromDomain
+func (p *DmarcPolicy) CheckAlignment(fromDomain, signingDomain, envelopeDomain string) error {
+	var errs []error
+	if !aligned(p.DKIMAlignment, fromDomain, signingDomain) {
+		errs = append(errs, fmt.Errorf("%w: d=%s, From %s, adkim=%s", ErrDKIMNotAligned, signingDomain, fromDomain, p.DKIMAlignment))
+	}
+	if !aligned(p.SPFAlignment, fromDomain, envelopeDomain) {
+		errs = append(errs, fmt.Errorf("%w: envelope %s, From %s, aspf=%s", ErrSPFNotAligned, envelopeDomain, fromDomain, p.SPFAlignment))
+	}
+	return errors.Join(errs...)
+}
+
+func aligned(mode, fromDomain, domain string) bool {
+	fromDomain = strings.ToLower(strings.TrimSuffix(fromDomain, "."))
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if mode == AlignmentStrict {
+		return fromDomain == domain
+	}
+	return organizationalDomain(fromDomain) == organizationalDomain(domain)
+}
+
+func organizationalDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	orgDomain, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return orgDomain
+}
+
+// SenderIdentity are the domains DMARC authenticates the messages of a sender with: the domain of the From
+// header, the DKIM signing domain (d=) and the domain of the envelope sender SPF is checked for
+type SenderIdentity struct {
+	FromDomain     string
+	SigningDomain  string
+	EnvelopeDomain string
+}
+
+// VerifyDMARCRecord checks that a DMARC policy exists for the mail domain and that mails signed by the
+// signing domain and sent with the envelope domain pass its alignment checks
+func VerifyDMARCRecord(mailDomain, signingDomain, envelopeDomain string) (*VerificationResult, error) {
+	result := newVerificarionResult()
+	policy, err := LookupDMARCPolicy(mailDomain)
+	if err != nil {
+		if errors.Is(err, ErrNoDMARCRecord) {
+			result.Create = append(result.Create, ResourceRecord{
+				Type:   "TXT",
+				Domain: "_dmarc." + mailDomain,
+				Record: recommendedDmarcRecord,
+			})
+			return result, nil
+		}
+		return nil, err
+	}
+	if err := policy.CheckAlignment(mailDomain, signingDomain, envelopeDomain); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,124 @@
+package dns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func dmarcResolver(records map[string][]string) func(string, uint16) ([]dns.RR, error) {
+	return func(domain string, rrType uint16) ([]dns.RR, error) {
+		values, exists := records[domain]
+		if !exists {
+			return nil, ErrRecordNotFound
+		}
+		answer := []dns.RR{}
+		for _, value := range values {
+			answer = append(answer, &dns.TXT{Txt: []string{value}})
+		}
+		return answer, nil
+	}
+}
+
+func TestParseDmarcRecord(t *testing.T) {
+	policy, err := parseDmarcRecord("example.com", "v=DMARC1; p=reject; sp=quarantine; adkim=s; aspf=r; rua=mailto:dmarc@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, &DmarcPolicy{
+		Domain:          "example.com",
+		Policy:          "reject",
+		SubdomainPolicy: "quarantine",
+		DKIMAlignment:   AlignmentStrict,
+		SPFAlignment:    AlignmentRelaxed,
+	}, policy)
+
+	policy, err = parseDmarcRecord("example.com", "v=DMARC1;p=none")
+	require.NoError(t, err)
+	assert.Equal(t, AlignmentRelaxed, policy.DKIMAlignment)
+	assert.Equal(t, AlignmentRelaxed, policy.SPFAlignment)
+
+	for _, invalid := range []string{
+		"p=reject; v=DMARC1",
+		"v=DMARC1; adkim=s",
+		"v=DMARC1; p=block",
+		"v=DMARC1; p=reject; aspf=x",
+		"v=DMARC1; p",
+	} {
+		_, err := parseDmarcRecord("example.com", invalid)
+		assert.ErrorIs(t, err, ErrInvalidDMARCRecord, invalid)
+	}
+}
+
+func TestVerifyDMARCRecord(t *testing.T) {
+	replaceResolveFunc(t, dmarcResolver(map[string][]string{
+		"_dmarc.example.com": {"v=DMARC1; p=quarantine; adkim=s; aspf=s"},
+	}))
+	result, err := VerifyDMARCRecord("example.com", "example.com", "example.com")
+	require.NoError(t, err)
+	assert.True(t, result.Success())
+
+	_, err = VerifyDMARCRecord("example.com", "mail.example.com", "example.com")
+	assert.ErrorIs(t, err, ErrDKIMNotAligned)
+	assert.NotErrorIs(t, err, ErrSPFNotAligned)
+
+	_, err = VerifyDMARCRecord("example.com", "example.com", "bounces.example.com")
+	assert.ErrorIs(t, err, ErrSPFNotAligned)
+}
+
+func TestVerifyDMARCRecordRelaxedAlignment(t *testing.T) {
+	replaceResolveFunc(t, dmarcResolver(map[string][]string{
+		"_dmarc.example.co.uk": {"v=spf1 -all", "v=DMARC1; p=reject"},
+	}))
+	// mail.example.co.uk has no record of its own and inherits the policy of example.co.uk
+	result, err := VerifyDMARCRecord("mail.example.co.uk", "example.co.uk", "bounces.example.co.uk")
+	require.NoError(t, err)
+	assert.True(t, result.Success())
+
+	_, err = VerifyDMARCRecord("mail.example.co.uk", "other.co.uk", "example.org")
+	assert.ErrorIs(t, err, ErrDKIMNotAligned)
+	assert.ErrorIs(t, err, ErrSPFNotAligned)
+}
+
+func TestVerifyDMARCRecordMissingOrInvalid(t *testing.T) {
+	replaceResolveFunc(t, dmarcResolver(map[string][]string{}))
+	result, err := VerifyDMARCRecord("example.com", "example.com", "example.com")
+	require.NoError(t, err)
+	require.Len(t, result.Create, 1)
+	assert.Equal(t, ResourceRecord{Type: "TXT", Domain: "_dmarc.example.com", Record: recommendedDmarcRecord}, result.Create[0])
+
+	replaceResolveFunc(t, dmarcResolver(map[string][]string{
+		"_dmarc.example.com": {"v=DMARC1; p=none", "v=DMARC1; p=reject"},
+	}))
+	_, err = VerifyDMARCRecord("example.com", "example.com", "example.com")
+	assert.ErrorIs(t, err, ErrInvalidDMARCRecord)
+
+	replaceResolveFunc(t, dmarcResolver(map[string][]string{
+		"_dmarc.example.com": {"v=DMARC1; p=drop"},
+	}))
+	_, err = VerifyDMARCRecord("example.com", "example.com", "example.com")
+	assert.ErrorIs(t, err, ErrInvalidDMARCRecord)
+}
+
+func TestVerifySenderDMARCRecords(t *testing.T) {
+	replaceResolveFunc(t, dmarcResolver(map[string][]string{
+		"_dmarc.example.com": {"v=DMARC1; p=reject; adkim=s"},
+	}))
+	result, err := verifySenderDMARCRecords("example.com", []SenderIdentity{
+		{FromDomain: "example.com", SigningDomain: "example.com", EnvelopeDomain: "example.com"},
+		{FromDomain: "example.org", SigningDomain: "example.org", EnvelopeDomain: "example.org"},
+		{FromDomain: "sub.example.org", SigningDomain: "sub.example.org", EnvelopeDomain: "sub.example.org"},
+	})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []ResourceRecord{
+		{Type: "TXT", Domain: "_dmarc.example.org", Record: recommendedDmarcRecord},
+		{Type: "TXT", Domain: "_dmarc.sub.example.org", Record: recommendedDmarcRecord},
+	}, result.Create)
+
+	// Users without their own DKIM domain are signed with the mail domain
+	_, err = verifySenderDMARCRecords("mail.example.com", []SenderIdentity{
+		{FromDomain: "example.com", SigningDomain: "mail.example.com", EnvelopeDomain: "example.com"},
+	})
+	assert.ErrorIs(t, err, ErrDKIMNotAligned)
+	assert.NotErrorIs(t, err, ErrSPFNotAligned)
+}
@@ -5,8 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"net"
-	"net/netip"
 	"strings"
+	"time"
 
 	"github.com/asggo/spf"
 	"github.com/dereulenspiegel/smolmailer/internal/config"
@@ -23,6 +23,44 @@ var (
 
 var resolve func(string, uint16) ([]dns.RR, error)
 
+// defaultDNSTimeout limits a single DNS query to a single server
+const defaultDNSTimeout = time.Second * 5
+
+// resolverServers are the DNS servers queried in order, the servers of /etc/resolv.conf are used if it is empty
+var (
+	resolverServers []string
+	resolverTimeout = defaultDNSTimeout
+)
+
+// ConfigureResolver sets the DNS servers used for all lookups and the timeout of a query to a single server.
+// Servers without a port use port 53. No servers use the servers of /etc/resolv.conf.
+func ConfigureResolver(servers []string, timeout time.Duration) {
+	resolverServers = make([]string, 0, len(servers))
+	for _, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		resolverServers = append(resolverServers, server)
+	}
+	resolverTimeout = defaultDNSTimeout
+	if timeout > 0 {
+		resolverTimeout = timeout
+	}
+}
+
+// systemResolverServers returns the DNS servers of /etc/resolv.conf
+func systemResolverServers() ([]string, error) {
+	config, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read resolver config: %w", err)
+	}
+	servers := make([]string, 0, len(config.Servers))
+	for _, server := range config.Servers {
+		servers = append(servers, net.JoinHostPort(server, config.Port))
+	}
+	return servers, nil
+}
+
 func init() {
 	resolve = defaultResolve
 }
@@ -113,24 +151,61 @@ func VerifyDKIMRecords(domain, value string) (*VerificationResult, error) {
 		return nil, err
 	}
 
-	compoundResource := ""
+	expectedTags := parseDkimTags(value)
+	dkimRecordFound := false
 	for _, a := range answer {
 		if rrTxt, ok := a.(*dns.TXT); ok {
-			for _, txtVal := range rrTxt.Txt {
-				compoundResource += txtVal
+			// Long records are split into multiple strings, which form a single record
+			tags := parseDkimTags(strings.Join(rrTxt.Txt, ""))
+			if dkimTagsMatch(expectedTags, tags) {
+				return result, nil
+			}
+			if _, hasKey := tags["p"]; hasKey {
+				dkimRecordFound = true
 			}
 		}
 	}
-	if compoundResource != value {
-		result.Create = append(result.Update, ResourceRecord{
-			Type:   "TXT",
-			Domain: domain,
-			Record: value,
-		})
+	expectedRecord := ResourceRecord{
+		Type:   "TXT",
+		Domain: domain,
+		Record: value,
+	}
+	if dkimRecordFound {
+		result.Update = append(result.Update, expectedRecord)
+	} else {
+		result.Create = append(result.Create, expectedRecord)
 	}
 	return result, nil
 }
 
+// parseDkimTags parses the tag list of a DKIM key record (RFC 6376 section 3.6.1). Whitespace is ignored,
+// so that keys split by the DNS provider are compared by their content.
+func parseDkimTags(record string) map[string]string {
+	tags := map[string]string{}
+	for _, tag := range strings.Split(record, ";") {
+		key, value, found := strings.Cut(tag, "=")
+		if !found {
+			continue
+		}
+		tags[strings.TrimSpace(key)] = strings.Join(strings.Fields(value), "")
+	}
+	return tags
+}
+
+// dkimTagsMatch returns true if the published record contains every expected tag with the same value,
+// regardless of their order. Additional tags in the published record, e.g. notes, are ignored.
+func dkimTagsMatch(expected, published map[string]string) bool {
+	if len(expected) == 0 {
+		return false
+	}
+	for key, value := range expected {
+		if publishedValue, exists := published[key]; !exists || publishedValue != value {
+			return false
+		}
+	}
+	return true
+}
+
 const defaultDNSQueryCount = 3
 
 func VerifySPFRecord(mailDomain, tlsdomain, sendAddr string) (*VerificationResult, error) {
@@ -173,39 +248,50 @@ func VerifySPFRecord(mailDomain, tlsdomain, sendAddr string) (*VerificationResul
 			}
 		}
 	}
-	senderIP, err := netip.ParseAddr(sendAddr)
+	spfValue, err := spfRecordValue(sendAddr, tlsdomain)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse sendAddr into IP: %w", err)
-	}
-	ipTypeStr := "ip4"
-	if senderIP.Is6() {
-		ipTypeStr = "ip6"
+		return nil, err
 	}
 	if !correctSPFFound {
 		result.Create = append(result.Create, ResourceRecord{
 			Type:   "TXT",
 			Domain: mailDomain,
-			Record: fmt.Sprintf("v=spf1 %s:%s -all", ipTypeStr, senderIP.String()),
+			Record: spfValue,
 		})
 	}
 	return result, nil
 }
 
+// defaultResolve queries the configured DNS servers in order until one of them answers
 func defaultResolve(rrDomain string, rrType uint16) ([]dns.RR, error) {
-	config, _ := dns.ClientConfigFromFile("/etc/resolv.conf")
-	c := new(dns.Client)
+	servers := resolverServers
+	if len(servers) == 0 {
+		var err error
+		if servers, err = systemResolverServers(); err != nil {
+			return nil, err
+		}
+	}
+	c := &dns.Client{Timeout: resolverTimeout}
 	m := new(dns.Msg)
 	if !strings.HasSuffix(rrDomain, ".") {
 		rrDomain = rrDomain + "."
 	}
 	m.SetQuestion(rrDomain, rrType)
 
-	r, _, err := c.Exchange(m, net.JoinHostPort(config.Servers[0], config.Port))
-	if err != nil {
-		return nil, fmt.Errorf("failed to contact DNS server: %w", err)
+	var errs []error
+	for _, server := range servers {
+		r, _, err := c.Exchange(m, server)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to contact DNS server %s: %w", server, err))
+			continue
+		}
+		if r.Rcode != dns.RcodeSuccess {
+			return nil, ErrRecordNotFound
+		}
+		return r.Answer, nil
 	}
-	if r.Rcode != dns.RcodeSuccess {
-		return nil, ErrRecordNotFound
+	if len(errs) == 0 {
+		return nil, errors.New("no DNS servers configured")
 	}
-	return r.Answer, nil
+	return nil, errors.Join(errs...)
 }
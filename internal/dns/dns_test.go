@@ -2,8 +2,11 @@ package dns
 
 import (
 	"math"
+	"net"
+	"net/netip"
 	"testing"
 
+	"github.com/asggo/spf"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -58,3 +61,164 @@ func TestVerifyRSADKIMRecord(t *testing.T) {
 	assert.False(t, result.Success())
 	assert.Len(t, result.Create, 1)
 }
+
+func TestVerifyDKIMRecordTagAware(t *testing.T) {
+	expectedRecord := "v=DKIM1;k=rsa;h=sha256;p=MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEAjYxlWHn3QaeDohpxWCivZyttc7iSx2UzPIoBeFlLX5SahWscfVRP09N"
+
+	for _, exp := range []struct {
+		name    string
+		answer  []dns.RR
+		success bool
+		update  bool
+	}{
+		{
+			name:    "reordered tags",
+			answer:  []dns.RR{&dns.TXT{Txt: []string{"p=MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEAjYxlWHn3QaeDohpxWCivZyttc7iSx2UzPIoBeFlLX5SahWscfVRP09N; h=sha256; k=rsa; v=DKIM1"}}},
+			success: true,
+		},
+		{
+			name: "chunked and reordered",
+			answer: []dns.RR{&dns.TXT{Txt: []string{
+				"v=DKIM1; k=rsa; p=MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEAjYxl",
+				"WHn3QaeDohpxWCivZyttc7iSx2UzPIoBeFlLX5SahWscfVRP09N; h=sha256",
+			}}},
+			success: true,
+		},
+		{
+			name:    "whitespace in key and additional tags",
+			answer:  []dns.RR{&dns.TXT{Txt: []string{"v=DKIM1; k=rsa; h=sha256; t=s; p=MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIB CgKCAQEAjYxlWHn3QaeDohpxWCivZyttc7iSx2UzPIoBeFlLX5SahWscfVRP09N"}}},
+			success: true,
+		},
+		{
+			name: "matching record among other TXT records",
+			answer: []dns.RR{
+				&dns.TXT{Txt: []string{"some-verification=foo"}},
+				&dns.TXT{Txt: []string{"k=rsa;v=DKIM1;h=sha256;", "p=MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEAjYxlWHn3QaeDohpxWCivZyttc7iSx2UzPIoBeFlLX5SahWscfVRP09N"}},
+			},
+			success: true,
+		},
+		{
+			name:   "different key",
+			answer: []dns.RR{&dns.TXT{Txt: []string{"v=DKIM1;k=rsa;h=sha256;p=MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEA"}}},
+			update: true,
+		},
+		{
+			name:   "missing tag",
+			answer: []dns.RR{&dns.TXT{Txt: []string{"v=DKIM1;k=rsa;p=MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEAjYxlWHn3QaeDohpxWCivZyttc7iSx2UzPIoBeFlLX5SahWscfVRP09N"}}},
+			update: true,
+		},
+	} {
+		replaceResolveFunc(t, func(string, uint16) ([]dns.RR, error) {
+			return exp.answer, nil
+		})
+		result, err := VerifyDKIMRecords("foo", expectedRecord)
+		require.NoError(t, err, exp.name)
+		assert.Equal(t, exp.success, result.Success(), exp.name)
+		if exp.update {
+			assert.Len(t, result.Update, 1, exp.name)
+			assert.Empty(t, result.Create, exp.name)
+		}
+	}
+}
+
+func TestCheckSPF(t *testing.T) {
+	records := map[string][]string{
+		"example.com":       {"v=spf1 ip4:192.0.2.0/24 -all"},
+		"soft.example.com":  {"v=spf1 ip4:192.0.2.0/24 ~all"},
+		"split.example.com": {"v=spf1 ip4:192.0.2.0/24", " -all"},
+		"twice.example.com": {"v=spf1 -all", "v=spf1 +all"},
+		"other.example.com": {"some-verification=foo"},
+	}
+	replaceResolveFunc(t, func(domain string, recordType uint16) ([]dns.RR, error) {
+		txts, exists := records[domain]
+		if !exists {
+			return nil, ErrRecordNotFound
+		}
+		if domain == "split.example.com" {
+			return []dns.RR{&dns.TXT{Txt: txts}}, nil
+		}
+		answer := []dns.RR{}
+		for _, txt := range txts {
+			answer = append(answer, &dns.TXT{Txt: []string{txt}})
+		}
+		return answer, nil
+	})
+
+	for _, exp := range []struct {
+		ip     string
+		domain string
+		result spf.Result
+	}{
+		{ip: "192.0.2.10", domain: "example.com", result: spf.Pass},
+		{ip: "198.51.100.1", domain: "example.com", result: spf.Fail},
+		{ip: "192.0.2.10", domain: "soft.example.com", result: spf.Pass},
+		{ip: "198.51.100.1", domain: "soft.example.com", result: spf.SoftFail},
+		{ip: "198.51.100.1", domain: "split.example.com", result: spf.Fail},
+		{ip: "192.0.2.10", domain: "twice.example.com", result: spf.PermError},
+		{ip: "192.0.2.10", domain: "other.example.com", result: spf.None},
+		{ip: "192.0.2.10", domain: "missing.example.com", result: spf.None},
+	} {
+		assert.Equal(t, exp.result, CheckSPF(exp.ip, exp.domain), "%s from %s", exp.domain, exp.ip)
+	}
+}
+
+func TestCheckDNSBL(t *testing.T) {
+	answers := map[string]string{
+		"99.2.0.192.zen.example.org.":  "127.0.0.2",
+		"99.2.0.192.bl.example.org.":   "127.0.0.4",
+		"99.2.0.192.busy.example.org.": "127.255.255.254",
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.zen.example.org.": "127.0.0.3",
+	}
+	replaceResolveFunc(t, func(domain string, recordType uint16) ([]dns.RR, error) {
+		assert.Equal(t, dns.TypeA, recordType)
+		answer, exists := answers[domain+"."]
+		if !exists {
+			return nil, ErrRecordNotFound
+		}
+		return []dns.RR{&dns.A{A: net.ParseIP(answer)}}, nil
+	})
+
+	listedIn, err := CheckDNSBL(netip.MustParseAddr("192.0.2.99"), "zen.example.org", "bl.example.org", "other.example.org")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"zen.example.org", "bl.example.org"}, listedIn)
+
+	listedIn, err = CheckDNSBL(netip.MustParseAddr("192.0.2.10"), "zen.example.org")
+	require.NoError(t, err)
+	assert.Empty(t, listedIn)
+
+	listedIn, err = CheckDNSBL(netip.MustParseAddr("2001:db8::1"), "zen.example.org")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"zen.example.org"}, listedIn)
+
+	// Refused queries are errors and not listings
+	listedIn, err = CheckDNSBL(netip.MustParseAddr("192.0.2.99"), "busy.example.org", "zen.example.org")
+	assert.Error(t, err)
+	assert.Equal(t, []string{"zen.example.org"}, listedIn)
+}
+
+func TestLookupMX(t *testing.T) {
+	replaceResolveFunc(t, func(domain string, recordType uint16) ([]dns.RR, error) {
+		assert.Equal(t, dns.TypeMX, recordType)
+		switch domain {
+		case "example.com":
+			return []dns.RR{
+				&dns.CNAME{Target: "mail.example.com."},
+				&dns.MX{Preference: 20, Mx: "mx2.example.com."},
+				&dns.MX{Preference: 10, Mx: "mx1.example.com."},
+			}, nil
+		case "empty.example.com":
+			return []dns.RR{}, nil
+		}
+		return nil, ErrRecordNotFound
+	})
+
+	mxRecords, err := LookupMX("example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []*net.MX{{Host: "mx2.example.com.", Pref: 20}, {Host: "mx1.example.com.", Pref: 10}}, mxRecords)
+
+	_, err = LookupMX("empty.example.com")
+	assert.ErrorIs(t, err, ErrRecordNotFound)
+
+	_, err = LookupMX("missing.example.com")
+	assert.ErrorIs(t, err, ErrRecordNotFound)
+}
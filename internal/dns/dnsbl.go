@@ -0,0 +1,80 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	dnsblListedPrefix  = netip.MustParsePrefix("127.0.0.0/8")
+	dnsblRefusedPrefix = netip.MustParsePrefix("127.255.255.0/24")
+)
+
+// CheckDNSBL looks up ip in the DNS blocklist zones and returns the zones listing it. Failed lookups are
+// returned as error and the ip is considered not listed by that zone.
+func CheckDNSBL(ip netip.Addr, zones ...string) (listedIn []string, err error) {
+	var errs []error
+	for _, zone := range zones {
+		listed, err := lookupDNSBL(ip, zone)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if listed {
+			listedIn = append(listedIn, zone)
+		}
+	}
+	return listedIn, errors.Join(errs...)
+}
+
+func lookupDNSBL(ip netip.Addr, zone string) (bool, error) {
+	answer, err := resolve(dnsblQueryName(ip, zone), dns.TypeA)
+	if errors.Is(err, ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to query DNS blocklist %s: %w", zone, err)
+	}
+	for _, a := range answer {
+		rrA, ok := a.(*dns.A)
+		if !ok {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(rrA.A)
+		if !ok {
+			continue
+		}
+		addr = addr.Unmap()
+		if dnsblRefusedPrefix.Contains(addr) {
+			// Blocklists like Spamhaus answer with these codes if they refuse to answer, e.g. queries via public resolvers
+			return false, fmt.Errorf("DNS blocklist %s refused the query with %s", zone, addr)
+		}
+		if dnsblListedPrefix.Contains(addr) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// dnsblQueryName returns the name to query for ip in zone, the octets of IPv4 and the nibbles of IPv6
+// addresses in reverse order (RFC 5782 section 2.1 and 2.4)
+func dnsblQueryName(ip netip.Addr, zone string) string {
+	ip = ip.Unmap()
+	labels := []string{}
+	if ip.Is4() {
+		octets := ip.As4()
+		for i := len(octets) - 1; i >= 0; i-- {
+			labels = append(labels, fmt.Sprint(octets[i]))
+		}
+	} else {
+		octets := ip.As16()
+		for i := len(octets) - 1; i >= 0; i-- {
+			labels = append(labels, fmt.Sprintf("%x", octets[i]&0x0f), fmt.Sprintf("%x", octets[i]>>4))
+		}
+	}
+	return strings.Join(labels, ".") + "." + strings.TrimSuffix(zone, ".")
+}
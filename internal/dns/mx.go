@@ -0,0 +1,27 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// LookupMX resolves the MX records of domain with the configured DNS servers. Domains without MX records
+// are reported as ErrRecordNotFound.
+func LookupMX(domain string) ([]*net.MX, error) {
+	answer, err := resolve(domain, dns.TypeMX)
+	if err != nil {
+		return nil, err
+	}
+	mxRecords := []*net.MX{}
+	for _, rr := range answer {
+		if mx, ok := rr.(*dns.MX); ok {
+			mxRecords = append(mxRecords, &net.MX{Host: mx.Mx, Pref: mx.Preference})
+		}
+	}
+	if len(mxRecords) == 0 {
+		return nil, fmt.Errorf("no mx records for %s: %w", domain, ErrRecordNotFound)
+	}
+	return mxRecords, nil
+}
@@ -0,0 +1,101 @@
+package dns
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/dereulenspiegel/smolmailer/internal/config"
+	"github.com/dereulenspiegel/smolmailer/internal/utils"
+)
+
+// maxTxtStringLength is the maximum length of a single character string in a TXT record
+const maxTxtStringLength = 255
+
+// recommendedDmarcRecord asks receivers to quarantine messages which fail DKIM and SPF alignment
+const recommendedDmarcRecord = "v=DMARC1; p=quarantine; adkim=s; aspf=s"
+
+// ZoneString formats the record as a line in a zone file. TXT values exceeding the length of a
+// single character string are split into multiple strings.
+func (rr ResourceRecord) ZoneString() string {
+	value := rr.Record
+	if rr.Type == "TXT" {
+		parts := []string{}
+		for chunk := range slices.Chunk([]byte(rr.Record), maxTxtStringLength) {
+			parts = append(parts, fmt.Sprintf("%q", string(chunk)))
+		}
+		value = strings.Join(parts, " ")
+	}
+	return fmt.Sprintf("%s.\tIN\t%s\t%s", strings.TrimSuffix(rr.Domain, "."), rr.Type, value)
+}
+
+// RequiredRecords returns the DKIM records for every configured signer, an SPF record permitting the
+// send address and the recommended DMARC record
+func RequiredRecords(cfg *config.Config) ([]ResourceRecord, error) {
+	records := []ResourceRecord{}
+
+	signerNames := []string{}
+	for name := range cfg.Dkim.Signer {
+		signerNames = append(signerNames, name)
+	}
+	slices.Sort(signerNames)
+	for _, name := range signerNames {
+		signingConfig := cfg.Dkim.Signer[name]
+		privKeyPem, err := signingConfig.PrivateKey.GetKey()
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve private key of DKIM signer %s: %w", name, err)
+		}
+		dkimPrivKey, err := utils.ParseDkimKey(privKeyPem)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse DKIM private key of signer %s: %w", name, err)
+		}
+		dkimRecordContent, err := utils.DkimTxtRecordContent(dkimPrivKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create DKIM record of signer %s: %w", name, err)
+		}
+		records = append(records, ResourceRecord{
+			Type:   "TXT",
+			Domain: utils.DkimDomain(signingConfig.Selector, cfg.MailDomain),
+			Record: dkimRecordContent,
+		})
+	}
+
+	spfValue, err := spfRecordValue(cfg.SendAddr, cfg.TlsDomain)
+	if err != nil {
+		return nil, err
+	}
+	records = append(records, ResourceRecord{
+		Type:   "TXT",
+		Domain: cfg.MailDomain,
+		Record: spfValue,
+	}, ResourceRecord{
+		Type:   "TXT",
+		Domain: "_dmarc." + cfg.MailDomain,
+		Record: recommendedDmarcRecord,
+	})
+	return records, nil
+}
+
+// spfRecordValue permits the send address to send mails. If no send address is configured, the addresses
+// of the TLS domain are permitted instead.
+func spfRecordValue(sendAddr, tlsDomain string) (string, error) {
+	if sendAddr == "" {
+		if tlsDomain == "" {
+			return "", fmt.Errorf("either a send address or a TLS domain is required to create an SPF record")
+		}
+		if strings.HasPrefix(tlsDomain, "*.") {
+			return "", fmt.Errorf("the wildcard TLS domain %s can't be used in an SPF record, please configure a send address", tlsDomain)
+		}
+		return fmt.Sprintf("v=spf1 a:%s -all", tlsDomain), nil
+	}
+	senderIP, err := netip.ParseAddr(sendAddr)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse sendAddr into IP: %w", err)
+	}
+	ipTypeStr := "ip4"
+	if senderIP.Is6() {
+		ipTypeStr = "ip6"
+	}
+	return fmt.Sprintf("v=spf1 %s:%s -all", ipTypeStr, senderIP.String()), nil
+}
@@ -0,0 +1,44 @@
+package dns
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/asggo/spf"
+	"github.com/miekg/dns"
+)
+
+// CheckSPF evaluates whether ip is permitted to send mail for domain by the SPF record of the domain
+func CheckSPF(ip, domain string) spf.Result {
+	answer, err := resolve(domain, dns.TypeTXT)
+	if errors.Is(err, ErrRecordNotFound) {
+		return spf.None
+	}
+	if err != nil {
+		return spf.TempError
+	}
+	records := []string{}
+	for _, a := range answer {
+		if rrTxt, ok := a.(*dns.TXT); ok {
+			// Long records are split into multiple strings which need to be concatenated
+			txtVal := strings.Join(rrTxt.Txt, "")
+			if txtVal == "v=spf1" || strings.HasPrefix(txtVal, "v=spf1 ") {
+				records = append(records, txtVal)
+			}
+		}
+	}
+	switch len(records) {
+	case 0:
+		return spf.None
+	case 1:
+	default:
+		// Multiple SPF records are an error (RFC 7208 section 4.5)
+		return spf.PermError
+	}
+	// The lookup limit of RFC 7208 section 4.6.4 is enforced by spf, we haven't used any lookups yet
+	spfValue, err := spf.NewSPF(domain, records[0], 0)
+	if err != nil {
+		return spf.PermError
+	}
+	return spfValue.Test(ip)
+}
@@ -0,0 +1,133 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/dereulenspiegel/smolmailer/internal/config"
+)
+
+var (
+	ErrRecordsInvalid = errors.New("DNS records are missing or incorrect")
+	// ErrCheckTimedOut is returned for checks which did not finish within the startup DNS check timeout
+	ErrCheckTimedOut = errors.New("DNS check timed out")
+)
+
+type checkOutcome struct {
+	result *VerificationResult
+	err    error
+}
+
+// startCheck runs check in the background, so the checks don't wait for each other
+func startCheck(check func() (*VerificationResult, error)) <-chan checkOutcome {
+	outcome := make(chan checkOutcome, 1)
+	go func() {
+		result, err := check()
+		outcome <- checkOutcome{result: result, err: err}
+	}()
+	return outcome
+}
+
+// awaitCheck waits for the outcome of a check until ctx is done. Checks which didn't finish in time return
+// ErrCheckTimedOut and are logged as warning.
+func awaitCheck(ctx context.Context, logger *slog.Logger, name string, outcome <-chan checkOutcome) (*VerificationResult, error) {
+	select {
+	case o := <-outcome:
+		return o.result, o.err
+	case <-ctx.Done():
+		logger.Warn("DNS check did not finish in time, continuing without it", "check", name)
+		return nil, fmt.Errorf("%w: %s", ErrCheckTimedOut, name)
+	}
+}
+
+// VerifyStartupRecords checks the DKIM and SPF records of the mail domain and the DMARC records of the
+// senders concurrently and logs what needs to be fixed. Problems are only logged unless strict checks are
+// configured, in which case missing or incorrect DKIM records, and with StrictSPFCheck SPF records, are
+// returned as error. Checks which don't finish within the startup DNS check timeout are treated like failed
+// lookups, so a broken resolver can't hang startup.
+func VerifyStartupRecords(logger *slog.Logger, cfg *config.Config, senders ...SenderIdentity) error {
+	ctx := context.Background()
+	if cfg.StartupDNSCheckTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.StartupDNSCheckTimeout)
+		defer cancel()
+	}
+	dkimCheck := startCheck(func() (*VerificationResult, error) {
+		return VerifyValidDKIMRecords(cfg.MailDomain, cfg.Dkim)
+	})
+	spfCheck := startCheck(func() (*VerificationResult, error) {
+		return VerifySPFRecord(cfg.MailDomain, cfg.TlsDomain, cfg.SendAddr)
+	})
+	dmarcCheck := startCheck(func() (*VerificationResult, error) {
+		return verifySenderDMARCRecords(cfg.MailDomain, senders)
+	})
+
+	var errs []error
+	if result, err := awaitCheck(ctx, logger, "DKIM", dkimCheck); err != nil {
+		logger.Error("failed to verify DKIM records", "err", err)
+		if cfg.StrictDNSChecks {
+			errs = append(errs, fmt.Errorf("failed to verify DKIM records: %w", err))
+		}
+	} else if !result.Success() {
+		logger.Warn("Please fix the DKIM DNS records", "create", result.Create, "delete", result.Delete, "update", result.Update)
+		if cfg.StrictDNSChecks {
+			errs = append(errs, fmt.Errorf("%w: DKIM records need to be created %v, updated %v or deleted %v",
+				ErrRecordsInvalid, result.Create, result.Update, result.Delete))
+		}
+	} else {
+		logger.Info("DKIM DNS records look good")
+	}
+
+	strictSPF := cfg.StrictDNSChecks && cfg.StrictSPFCheck
+	if spfResult, err := awaitCheck(ctx, logger, "SPF", spfCheck); err != nil {
+		logger.Warn("failed to verify spf records", "err", err)
+		if strictSPF && errors.Is(err, ErrRecordNotFound) {
+			errs = append(errs, fmt.Errorf("%w: no SPF record found for %s", ErrRecordsInvalid, cfg.MailDomain))
+		} else if strictSPF {
+			errs = append(errs, fmt.Errorf("failed to verify SPF records: %w", err))
+		}
+	} else if !spfResult.Success() {
+		logger.Warn("Please fix your SPF records", "create", spfResult.Create, "delete", spfResult.Delete, "update", spfResult.Update)
+		if strictSPF {
+			errs = append(errs, fmt.Errorf("%w: SPF records need to be created %v, updated %v or deleted %v",
+				ErrRecordsInvalid, spfResult.Create, spfResult.Update, spfResult.Delete))
+		}
+	} else {
+		logger.Info("SPF records look good")
+	}
+
+	if dmarcResult, err := awaitCheck(ctx, logger, "DMARC", dmarcCheck); err != nil {
+		logger.Warn("DMARC checks will likely fail", "err", err)
+	} else if !dmarcResult.Success() {
+		logger.Warn("Please create a DMARC record", "create", dmarcResult.Create)
+	} else {
+		logger.Info("DMARC records look good")
+	}
+	return errors.Join(errs...)
+}
+
+// verifySenderDMARCRecords checks the DMARC records and alignment of every sender. Without senders only the
+// existence of the DMARC record of the mail domain is checked.
+func verifySenderDMARCRecords(mailDomain string, senders []SenderIdentity) (*VerificationResult, error) {
+	if len(senders) == 0 {
+		return VerifyDMARCRecord(mailDomain, mailDomain, mailDomain)
+	}
+	result := newVerificarionResult()
+	var errs []error
+	for _, sender := range senders {
+		senderResult, err := VerifyDMARCRecord(sender.FromDomain, sender.SigningDomain, sender.EnvelopeDomain)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("DMARC check of %s failed: %w", sender.FromDomain, err))
+			continue
+		}
+		for _, record := range senderResult.Create {
+			if !slices.Contains(result.Create, record) {
+				result.Create = append(result.Create, record)
+			}
+		}
+	}
+	return result, errors.Join(errs...)
+}
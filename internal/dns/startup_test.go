@@ -0,0 +1,136 @@
+package dns
+
+import (
+	"bytes"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dereulenspiegel/smolmailer/internal/config"
+	"github.com/dereulenspiegel/smolmailer/internal/utils"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyStartupRecords(t *testing.T) {
+	cfg := &config.Config{
+		MailDomain: "example.com",
+		SendAddr:   "192.0.2.10",
+		Dkim: &config.DkimOpts{
+			Signer: map[string]*config.DkimSigner{
+				"ed25519": {Selector: "example", PrivateKey: &config.PrivateKey{Value: testEd25519Key}},
+			},
+		},
+	}
+	dkimKey, err := utils.ParseDkimKey(testEd25519Key)
+	require.NoError(t, err)
+	dkimRecord, err := utils.DkimTxtRecordContent(dkimKey)
+	require.NoError(t, err)
+
+	records := map[string]string{}
+	replaceResolveFunc(t, func(domain string, recordType uint16) ([]dns.RR, error) {
+		record, exists := records[domain]
+		if !exists {
+			return nil, ErrRecordNotFound
+		}
+		return []dns.RR{&dns.TXT{Txt: []string{record}}}, nil
+	})
+
+	// Missing records are only logged by default
+	assert.NoError(t, VerifyStartupRecords(slog.Default(), cfg))
+
+	cfg.StrictDNSChecks = true
+	assert.ErrorIs(t, VerifyStartupRecords(slog.Default(), cfg), ErrRecordsInvalid)
+
+	records[utils.DkimDomain("example", "example.com")] = dkimRecord
+	assert.NoError(t, VerifyStartupRecords(slog.Default(), cfg))
+
+	cfg.StrictSPFCheck = true
+	assert.ErrorIs(t, VerifyStartupRecords(slog.Default(), cfg), ErrRecordsInvalid)
+
+	records["example.com"] = "v=spf1 ip4:192.0.2.10 -all"
+	assert.NoError(t, VerifyStartupRecords(slog.Default(), cfg))
+
+	// Records are checked by their content and not just for presence
+	records[utils.DkimDomain("example", "example.com")] = "v=DKIM1;k=ed25519;p=AAAA"
+	assert.ErrorIs(t, VerifyStartupRecords(slog.Default(), cfg), ErrRecordsInvalid)
+}
+
+func TestVerifyStartupRecordsTimesOut(t *testing.T) {
+	cfg := &config.Config{
+		MailDomain: "example.com",
+		SendAddr:   "192.0.2.10",
+		Dkim: &config.DkimOpts{
+			Signer: map[string]*config.DkimSigner{
+				"ed25519": {Selector: "example", PrivateKey: &config.PrivateKey{Value: testEd25519Key}},
+			},
+		},
+		StartupDNSCheckTimeout: time.Millisecond * 200,
+	}
+	// Every lookup hangs until the test is done, each check does a single lookup
+	release := make(chan struct{})
+	finished := make(chan struct{}, 6)
+	replaceResolveFunc(t, func(domain string, recordType uint16) ([]dns.RR, error) {
+		<-release
+		finished <- struct{}{}
+		return nil, ErrRecordNotFound
+	})
+	defer func() {
+		close(release)
+		for range cap(finished) {
+			<-finished
+		}
+	}()
+
+	logs := &bytes.Buffer{}
+	logger := slog.New(slog.NewTextHandler(logs, nil))
+	start := time.Now()
+	assert.NoError(t, VerifyStartupRecords(logger, cfg), "startup proceeds without the checks")
+	assert.Less(t, time.Since(start), time.Second, "hanging checks are not waited for")
+	assert.Contains(t, logs.String(), "level=WARN msg=\"DNS check did not finish in time, continuing without it\" check=DKIM")
+
+	cfg.StrictDNSChecks = true
+	assert.ErrorIs(t, VerifyStartupRecords(logger, cfg), ErrCheckTimedOut, "strict checks require the records to be verified")
+}
+
+// startStubDNSServer answers every TXT query with record
+func startStubDNSServer(t *testing.T, record string) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = append(resp.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+			Txt: []string{record},
+		})
+		w.WriteMsg(resp)
+	})}
+	go server.ActivateAndServe()
+	t.Cleanup(func() {
+		server.Shutdown()
+	})
+	return conn.LocalAddr().String()
+}
+
+func TestConfiguredResolversAreTriedInOrder(t *testing.T) {
+	t.Cleanup(func() {
+		ConfigureResolver(nil, 0)
+	})
+	// Nothing answers on the first server, so the query times out and the second server is asked
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer silent.Close()
+	ConfigureResolver([]string{silent.LocalAddr().String(), startStubDNSServer(t, "v=spf1 -all")}, time.Millisecond*200)
+
+	answer, err := defaultResolve("example.com", dns.TypeTXT)
+	require.NoError(t, err)
+	require.Len(t, answer, 1)
+	assert.Equal(t, []string{"v=spf1 -all"}, answer[0].(*dns.TXT).Txt)
+
+	ConfigureResolver([]string{silent.LocalAddr().String()}, time.Millisecond*50)
+	_, err = defaultResolve("example.com", dns.TypeTXT)
+	assert.Error(t, err)
+}
@@ -0,0 +1,251 @@
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/dereulenspiegel/liteq"
+)
+
+// jobStore hands out the jobs of a job table with the layout of liteq and records their outcome
+type jobStore interface {
+	resetJobs(ctx context.Context, queueName string, fetchedBefore int64) error
+	grabJobs(ctx context.Context, queueName string, count int) ([]*liteq.Job, error)
+	completeJob(ctx context.Context, job *liteq.Job) error
+	failJob(ctx context.Context, job *liteq.Job, workerErr error) error
+}
+
+// consumeJobs processes the jobs of the queue with the worker until ctx is done, and then waits for the jobs
+// in processing. Only as many jobs are taken from the queue as there are idle workers.
+func consumeJobs[T any](ctx context.Context, store jobStore, queueName string, marshaler liteq.Marshaler[T], worker liteq.ConsumeFunc[T], logger *slog.Logger, options ...liteq.ConsumeOpt) error {
+	params := &liteq.ConsumeParams{
+		Queue: queueName,
+	}
+	for _, opt := range options {
+		opt(params)
+	}
+	poolSize := max(params.PoolSize, 1)
+	sleep := params.OnEmptySleep
+	if sleep == 0 {
+		sleep = time.Second
+	}
+
+	workers := make(chan struct{}, poolSize)
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case workers <- struct{}{}:
+		}
+		idle := 1
+	acquire:
+		for idle < poolSize {
+			select {
+			case workers <- struct{}{}:
+				idle++
+			default:
+				break acquire
+			}
+		}
+
+		if params.VisibilityTimeout > 0 {
+			if err := store.resetJobs(ctx, queueName, time.Now().Unix()-params.VisibilityTimeout); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return fmt.Errorf("error resetting jobs: %w", err)
+			}
+		}
+		jobs, err := store.grabJobs(ctx, queueName, idle)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("error grabbing jobs: %w", err)
+		}
+		for range idle - len(jobs) {
+			<-workers
+		}
+
+		if len(jobs) == 0 {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(sleep):
+			}
+			continue
+		}
+		for _, job := range jobs {
+			wg.Go(func() {
+				defer func() { <-workers }()
+				work(ctx, store, marshaler, worker, logger, job)
+			})
+		}
+	}
+}
+
+func work[T any](ctx context.Context, store jobStore, marshaler liteq.Marshaler[T], worker liteq.ConsumeFunc[T], logger *slog.Logger, job *liteq.Job) {
+	item, err := marshaler.Unmarshal(job.Job)
+	if err != nil {
+		err = fmt.Errorf("failed to unmarshal job item: %w", err)
+	} else {
+		jobCtx := context.WithValue(ctx, liteq.CtxJobRemainingAttempts, job.RemainingAttempts)
+		jobCtx = context.WithValue(jobCtx, liteq.CtxJobCreatedAt, time.Unix(job.CreatedAt, 0))
+		jobCtx = context.WithValue(jobCtx, liteq.CtxJobLastUpdated, time.Unix(job.UpdatedAt, 0))
+		err = worker(jobCtx, item)
+	}
+	// The outcome is recorded even if consuming stopped in the meantime, otherwise the job would be
+	// processed again after the visibility timeout
+	ctx = context.WithoutCancel(ctx)
+	if err != nil {
+		if failErr := store.failJob(ctx, job, err); failErr != nil {
+			logger.Error("failed to record the failure of job, it is processed again after the visibility timeout",
+				"queue", job.Queue, "jobId", job.ID, "jobErr", err, "err", failErr)
+		}
+		return
+	}
+	if err := store.completeJob(ctx, job); err != nil {
+		logger.Error("failed to complete job, it is processed again after the visibility timeout",
+			"queue", job.Queue, "jobId", job.ID, "err", err)
+	}
+}
+
+// failedAttempts returns the remaining attempts of the job after the worker failed with workerErr and when
+// it is retried
+func failedAttempts(job *liteq.Job, workerErr error) (remainingAttempts, executeAfter int64) {
+	remainingAttempts = job.RemainingAttempts - 1
+	werr := liteq.NewWorkerError(nil)
+	if errors.As(workerErr, &werr) {
+		executeAfter = time.Now().Add(werr.DelayRetry).Unix()
+		if werr.RemainingAttempts != nil {
+			remainingAttempts = int64(*werr.RemainingAttempts)
+		}
+	}
+	return remainingAttempts, executeAfter
+}
+
+const (
+	sqliteGrabJobs = `UPDATE jobs SET consumer_fetched_at = unixepoch(), updated_at = unixepoch(), job_status = 'fetched'
+	WHERE job_status = 'queued' AND remaining_attempts > 0 AND id IN (
+		SELECT id FROM jobs
+		WHERE queue = ? AND job_status = 'queued' AND execute_after <= ? AND remaining_attempts > 0
+		ORDER BY execute_after ASC
+		LIMIT ?
+	) RETURNING ` + pgJobColumns
+
+	sqliteResetJobs = `UPDATE jobs SET
+		job_status = CASE WHEN remaining_attempts <= 1 THEN 'failed' ELSE 'queued' END,
+		updated_at = unixepoch(),
+		consumer_fetched_at = 0,
+		remaining_attempts = MAX(remaining_attempts - 1, 0),
+		errors = json_insert(errors, '$[#]', 'visibility timeout expired')
+	WHERE job_status = 'fetched' AND queue = ? AND consumer_fetched_at < ?`
+
+	sqliteCompleteJob = `UPDATE jobs SET job_status = 'completed', finished_at = unixepoch(), updated_at = unixepoch(),
+	consumer_fetched_at = 0, remaining_attempts = 0 WHERE id = ?`
+
+	// sqliteFailJob decides on the remaining attempts after the failure like pgFailJob, so jobs given up by
+	// the worker are failed and can be replayed
+	sqliteFailJob = `UPDATE jobs SET
+		job_status = CASE WHEN ?1 <= 0 THEN 'failed' ELSE 'queued' END,
+		finished_at = 0,
+		updated_at = unixepoch(),
+		consumer_fetched_at = 0,
+		remaining_attempts = MAX(?1, 0),
+		execute_after = ?2,
+		errors = ?3
+	WHERE id = ?4`
+)
+
+// sqliteJobColumns are the columns of the liteq job table the queries of sqliteJobStore rely on
+var sqliteJobColumns = []string{"id", "queue", "job", "job_status", "execute_after", "remaining_attempts",
+	"consumer_fetched_at", "finished_at", "deduping_key", "errors", "created_at", "updated_at"}
+
+// checkSQLiteJobTable verifies that the job table created by liteq has the columns sqliteJobStore relies on,
+// so an incompatible version of liteq fails consuming instead of corrupting the queue
+func checkSQLiteJobTable(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, `SELECT name FROM pragma_table_info('jobs')`)
+	if err != nil {
+		return fmt.Errorf("failed to inspect job table: %w", err)
+	}
+	defer rows.Close()
+	columns := []string{}
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return fmt.Errorf("failed to inspect job table: %w", err)
+		}
+		columns = append(columns, column)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to inspect job table: %w", err)
+	}
+	for _, column := range sqliteJobColumns {
+		if !slices.Contains(columns, column) {
+			return fmt.Errorf("job table of liteq has no column %s", column)
+		}
+	}
+	return nil
+}
+
+// sqliteJobStore hands out the jobs of the liteq job table. liteq records the outcome of jobs with the context
+// consuming was stopped with, which loses the outcome of jobs in processing during shutdown. The outcome of jobs
+// is recorded again if the database is busy, like queueing jobs.
+type sqliteJobStore struct {
+	db *sql.DB
+
+	busyRetries    int
+	busyRetryDelay time.Duration
+}
+
+func (s *sqliteJobStore) resetJobs(ctx context.Context, queueName string, fetchedBefore int64) error {
+	_, err := s.db.ExecContext(ctx, sqliteResetJobs, queueName, fetchedBefore)
+	return err
+}
+
+func (s *sqliteJobStore) grabJobs(ctx context.Context, queueName string, count int) ([]*liteq.Job, error) {
+	rows, err := s.db.QueryContext(ctx, sqliteGrabJobs, queueName, time.Now().Unix(), count)
+	if err != nil {
+		return nil, err
+	}
+	return scanJobs(rows)
+}
+
+func (s *sqliteJobStore) completeJob(ctx context.Context, job *liteq.Job) error {
+	return retryBusy(ctx, s.busyRetries, s.busyRetryDelay, func() error {
+		_, err := s.db.ExecContext(ctx, sqliteCompleteJob, job.ID)
+		return err
+	})
+}
+
+func (s *sqliteJobStore) failJob(ctx context.Context, job *liteq.Job, workerErr error) error {
+	remainingAttempts, executeAfter := failedAttempts(job, workerErr)
+	errs := liteq.ErrorList(append(slices.Clone(job.Errors), workerErr.Error()))
+	return retryBusy(ctx, s.busyRetries, s.busyRetryDelay, func() error {
+		_, err := s.db.ExecContext(ctx, sqliteFailJob, remainingAttempts, executeAfter, errs, job.ID)
+		return err
+	})
+}
+
+// scanJobs reads the jobs returned by a query for pgJobColumns
+func scanJobs(rows *sql.Rows) ([]*liteq.Job, error) {
+	defer rows.Close()
+	jobs := []*liteq.Job{}
+	for rows.Next() {
+		j := &liteq.Job{}
+		if err := rows.Scan(&j.ID, &j.Queue, &j.Job, &j.JobStatus, &j.ExecuteAfter, &j.RemainingAttempts,
+			&j.ConsumerFetchedAt, &j.FinishedAt, &j.DedupingKey, &j.Errors, &j.CreatedAt, &j.UpdatedAt); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
@@ -2,25 +2,94 @@ package queue
 
 import (
 	"log/slog"
+	"slices"
 	"time"
 
+	"github.com/dereulenspiegel/liteq"
+	"github.com/dereulenspiegel/smolmailer/internal/tracing"
 	"github.com/emersion/go-smtp"
 )
 
+// Priority classes of outgoing messages. Every class is delivered from its own send queue, so
+// transactional messages are not delayed by a backlog of bulk messages.
+const (
+	PriorityTransactional = "transactional"
+	PriorityBulk          = "bulk"
+)
+
 type QueuedMessage struct {
 	From string
 	To   string
 	Body []byte
 
+	// SubmissionID is shared by all messages which were created from the same submission
+	SubmissionID string
+	// DedupKey is shared by identical messages, the DeliveryTracker only lets one of them wait for delivery at a time
+	DedupKey string
+	// TraceContext continues the trace of the submission during delivery
+	TraceContext tracing.TraceContext
+
 	MailOpts *smtp.MailOptions
 	RcptOpt  *smtp.RcptOptions
 
+	// DeliverAt is the earliest time the message is delivered, it is delivered right away if zero
+	DeliverAt time.Time
+
 	ReceivedAt          time.Time
 	LastDeliveryAttempt time.Time
 	ErrorCount          int
 	LastErr             error
 }
 
+// QueueOptions returns the options to queue the message with, holding back scheduled messages until their
+// delivery time
+func (m *QueuedMessage) QueueOptions(options ...liteq.QueueOption) []liteq.QueueOption {
+	options = slices.Clone(options)
+	if delay := time.Until(m.DeliverAt); delay > 0 {
+		// The queue only knows whole seconds, rounding up guarantees the message is never delivered early
+		options = append(options, liteq.ExecuteAfter(time.Until(m.DeliverAt.Truncate(time.Second).Add(time.Second))))
+	}
+	return options
+}
+
+// DueAt returns when the message was due for delivery, which is the scheduled delivery time or when it
+// was received
+func (m *QueuedMessage) DueAt() time.Time {
+	if m.DeliverAt.After(m.ReceivedAt) {
+		return m.DeliverAt
+	}
+	return m.ReceivedAt
+}
+
+// RequiresTLS returns true if the sender requested REQUIRETLS (RFC 8689) for this message, in which
+// case the message must not be delivered over an unencrypted connection
+func (m *QueuedMessage) RequiresTLS() bool {
+	return m.MailOpts != nil && m.MailOpts.RequireTLS
+}
+
+// DeliverBy returns the delivery deadline the sender requested with DELIVERBY (RFC 2852), nil if there is none
+func (m *QueuedMessage) DeliverBy() *smtp.DeliverByOptions {
+	if m.RcptOpt == nil {
+		return nil
+	}
+	return m.RcptOpt.DeliverBy
+}
+
+// RelayRcptOptions returns the recipient options to relay the message with. The delivery deadline only has the
+// time left since the message was received.
+func (m *QueuedMessage) RelayRcptOptions() *smtp.RcptOptions {
+	deliverBy := m.DeliverBy()
+	if deliverBy == nil || m.ReceivedAt.IsZero() {
+		return m.RcptOpt
+	}
+	opts := *m.RcptOpt
+	relayedDeliverBy := *deliverBy
+	// The deadline is given in whole seconds and must stay positive
+	relayedDeliverBy.Time = max(deliverBy.Time-time.Since(m.ReceivedAt), time.Second).Truncate(time.Second)
+	opts.DeliverBy = &relayedDeliverBy
+	return &opts
+}
+
 func (m *QueuedMessage) LogValue() slog.Value {
 	envelopeID := "na"
 	if m.MailOpts != nil {
@@ -30,5 +99,6 @@ func (m *QueuedMessage) LogValue() slog.Value {
 		slog.String("from", m.From),
 		slog.String("to", m.To),
 		slog.String("envelopeId", envelopeID),
+		slog.String("submissionId", m.SubmissionID),
 	)
 }
@@ -0,0 +1,381 @@
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dereulenspiegel/liteq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/modules/postgres"
+)
+
+// queueBackend creates queues of the same backend on a shared database
+type queueBackend struct {
+	db         *sql.DB
+	newQueue   func(name string) GenericWorkQueue[*TestMsgType]
+	newTracker func() (*DeliveryTracker, error)
+}
+
+func newSQLiteQueueBackend(t *testing.T) *queueBackend {
+	db, err := OpenDB(filepath.Join(t.TempDir(), "queue.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	jq, err := liteq.New(db)
+	require.NoError(t, err)
+	return &queueBackend{
+		db: db,
+		newQueue: func(name string) GenericWorkQueue[*TestMsgType] {
+			return NewSQLiteWorkQueueOnJobQueue[*TestMsgType](db, jq, name)
+		},
+		newTracker: func() (*DeliveryTracker, error) {
+			return NewDeliveryTracker(db)
+		},
+	}
+}
+
+func newPostgresQueueBackend(t *testing.T) *queueBackend {
+	testcontainers.SkipIfProviderIsNotHealthy(t)
+	ctx := context.Background()
+	pgContainer, err := postgres.Run(ctx, "postgres:17-alpine", postgres.BasicWaitStrategies())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		if err := testcontainers.TerminateContainer(pgContainer); err != nil {
+			log.Printf("failed to terminate container: %s", err)
+		}
+	})
+	dsn, err := pgContainer.ConnectionString(ctx, "sslmode=disable")
+	require.NoError(t, err)
+	db, err := OpenPostgresDB(dsn, WithMaxOpenConns(8))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	jq, err := NewPostgresJobQueue(db)
+	require.NoError(t, err)
+	return &queueBackend{
+		db: db,
+		newQueue: func(name string) GenericWorkQueue[*TestMsgType] {
+			return NewPostgresWorkQueue[*TestMsgType](jq, name)
+		},
+		newTracker: func() (*DeliveryTracker, error) {
+			return NewPostgresDeliveryTracker(db)
+		},
+	}
+}
+
+type jobState struct {
+	Job               string
+	Status            string
+	RemainingAttempts int64
+	Errors            int
+}
+
+// jobStates returns the state of all jobs in the queue, both backends use the same job table
+func (b *queueBackend) jobStates(t *testing.T, queueName string) []jobState {
+	rows, err := b.db.Query(`SELECT queue, job, job_status, remaining_attempts, errors FROM jobs ORDER BY id`)
+	require.NoError(t, err)
+	defer rows.Close()
+	states := []jobState{}
+	for rows.Next() {
+		var queue string
+		var job []byte
+		var errs liteq.ErrorList
+		state := jobState{}
+		require.NoError(t, rows.Scan(&queue, &job, &state.Status, &state.RemainingAttempts, &errs))
+		if queue == queueName {
+			state.Job = string(job)
+			state.Errors = len(errs)
+			states = append(states, state)
+		}
+	}
+	require.NoError(t, rows.Err())
+	return states
+}
+
+// forEachQueueBackend runs the test against the SQLite and the Postgres queue backend, so both behave the same
+func forEachQueueBackend(t *testing.T, test func(t *testing.T, b *queueBackend)) {
+	for name, newBackend := range map[string]func(t *testing.T) *queueBackend{
+		"sqlite":   newSQLiteQueueBackend,
+		"postgres": newPostgresQueueBackend,
+	} {
+		t.Run(name, func(t *testing.T) {
+			test(t, newBackend(t))
+		})
+	}
+}
+
+func consumeInBackground(t *testing.T, q GenericWorkQueue[*TestMsgType], worker liteq.ConsumeFunc[*TestMsgType], options ...liteq.ConsumeOpt) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, q.Consume(ctx, worker, append([]liteq.ConsumeOpt{liteq.OnEmptySleep(time.Millisecond * 10)}, options...)...))
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func TestQueueBackendsQueueAndConsume(t *testing.T) {
+	forEachQueueBackend(t, func(t *testing.T, b *queueBackend) {
+		q := b.newQueue("test.queue")
+		other := b.newQueue("other.queue")
+		ctx := context.Background()
+		for i := range 3 {
+			require.NoError(t, q.Queue(ctx, &TestMsgType{TestField: fmt.Sprintf("foo-%d", i)}))
+		}
+		require.NoError(t, other.Queue(ctx, &TestMsgType{TestField: "other"}))
+
+		lock := sync.Mutex{}
+		consumed := []string{}
+		consumeInBackground(t, q, func(ctx context.Context, msg *TestMsgType) error {
+			assert.Equal(t, int64(1), ctx.Value(liteq.CtxJobRemainingAttempts))
+			assert.WithinDuration(t, time.Now(), ctx.Value(liteq.CtxJobCreatedAt).(time.Time), time.Minute)
+			lock.Lock()
+			defer lock.Unlock()
+			consumed = append(consumed, msg.TestField)
+			return nil
+		}, liteq.PoolSize(2))
+
+		require.Eventually(t, func() bool {
+			lock.Lock()
+			defer lock.Unlock()
+			return len(consumed) == 3
+		}, time.Second*5, time.Millisecond*10)
+		assert.ElementsMatch(t, []string{"foo-0", "foo-1", "foo-2"}, consumed)
+		require.Eventually(t, func() bool {
+			for _, state := range b.jobStates(t, "test.queue") {
+				if state.Status != "completed" {
+					return false
+				}
+			}
+			return true
+		}, time.Second*5, time.Millisecond*10)
+		assert.Equal(t, []jobState{{Job: `{"TestField":"other"}`, Status: "queued", RemainingAttempts: 1}},
+			b.jobStates(t, "other.queue"), "jobs of other queues must not be consumed")
+	})
+}
+
+func TestQueueBackendsDeduplicate(t *testing.T) {
+	forEachQueueBackend(t, func(t *testing.T, b *queueBackend) {
+		q := b.newQueue("test.queue")
+		ctx := context.Background()
+		require.NoError(t, q.Queue(ctx, &TestMsgType{TestField: "first"}, liteq.DedupeKey(liteq.IgnoreDuplicate("ignore"))))
+		require.NoError(t, q.Queue(ctx, &TestMsgType{TestField: "second"}, liteq.DedupeKey(liteq.IgnoreDuplicate("ignore"))))
+		require.NoError(t, q.Queue(ctx, &TestMsgType{TestField: "third"}, liteq.DedupeKey(liteq.ReplaceDuplicate("replace"))))
+		require.NoError(t, q.Queue(ctx, &TestMsgType{TestField: "fourth"}, liteq.DedupeKey(liteq.ReplaceDuplicate("replace")), liteq.Retries(3)))
+
+		assert.Equal(t, []jobState{
+			{Job: `{"TestField":"first"}`, Status: "queued", RemainingAttempts: 1},
+			{Job: `{"TestField":"fourth"}`, Status: "queued", RemainingAttempts: 3},
+		}, b.jobStates(t, "test.queue"))
+	})
+}
+
+func TestQueueBackendsRetryFailedJobs(t *testing.T) {
+	forEachQueueBackend(t, func(t *testing.T, b *queueBackend) {
+		ctx := context.Background()
+		q := b.newQueue("test.queue")
+		require.NoError(t, q.Queue(ctx, &TestMsgType{TestField: "retried"}, liteq.Retries(3)))
+		require.NoError(t, q.Queue(ctx, &TestMsgType{TestField: "delayed"}, liteq.Retries(3)))
+		require.NoError(t, q.Queue(ctx, &TestMsgType{TestField: "given up"}, liteq.Retries(3)))
+
+		lock := sync.Mutex{}
+		attempts := map[string][]int64{}
+		consumeInBackground(t, q, func(ctx context.Context, msg *TestMsgType) error {
+			lock.Lock()
+			defer lock.Unlock()
+			attempts[msg.TestField] = append(attempts[msg.TestField], ctx.Value(liteq.CtxJobRemainingAttempts).(int64))
+			err := errors.New("delivery failed")
+			switch msg.TestField {
+			case "delayed":
+				return liteq.NewWorkerError(err, liteq.WithRetryDelay(time.Hour))
+			case "given up":
+				return liteq.NewWorkerError(err, liteq.WithRemainingAttemps(0))
+			}
+			return err
+		})
+
+		require.Eventually(t, func() bool {
+			states := b.jobStates(t, "test.queue")
+			return states[0].Status == "failed" && states[1].Status == "queued" && states[2].Status != "fetched"
+		}, time.Second*5, time.Millisecond*10)
+		// Give the delayed job the chance to be consumed too early
+		time.Sleep(time.Millisecond * 100)
+		lock.Lock()
+		defer lock.Unlock()
+		assert.Equal(t, map[string][]int64{
+			"retried":  {3, 2, 1},
+			"delayed":  {3},
+			"given up": {3},
+		}, attempts)
+		states := b.jobStates(t, "test.queue")
+		assert.Equal(t, jobState{Job: `{"TestField":"retried"}`, Status: "failed", RemainingAttempts: 0, Errors: 3}, states[0])
+		assert.Equal(t, jobState{Job: `{"TestField":"delayed"}`, Status: "queued", RemainingAttempts: 2, Errors: 1}, states[1])
+		assert.Equal(t, int64(0), states[2].RemainingAttempts, "jobs without remaining attempts are never consumed again")
+	})
+}
+
+func TestQueueBackendsCompetingConsumers(t *testing.T) {
+	forEachQueueBackend(t, func(t *testing.T, b *queueBackend) {
+		const items = 50
+		ctx := context.Background()
+		lock := sync.Mutex{}
+		consumed := map[string]int{}
+		// Several consumers of the same queue, as if several instances shared the queue database
+		for range 3 {
+			consumeInBackground(t, b.newQueue("test.queue"), func(ctx context.Context, msg *TestMsgType) error {
+				lock.Lock()
+				defer lock.Unlock()
+				consumed[msg.TestField]++
+				return nil
+			}, liteq.PoolSize(4))
+		}
+		q := b.newQueue("test.queue")
+		for i := range items {
+			require.NoError(t, q.Queue(ctx, &TestMsgType{TestField: fmt.Sprintf("item-%d", i)}))
+		}
+
+		require.Eventually(t, func() bool {
+			lock.Lock()
+			defer lock.Unlock()
+			return len(consumed) == items
+		}, time.Second*10, time.Millisecond*50)
+		// Wait for late duplicates
+		time.Sleep(time.Millisecond * 100)
+		lock.Lock()
+		defer lock.Unlock()
+		for item, count := range consumed {
+			assert.Equal(t, 1, count, item)
+		}
+	})
+}
+
+func TestQueueBackendsCountPendingJobs(t *testing.T) {
+	forEachQueueBackend(t, func(t *testing.T, b *queueBackend) {
+		ctx := context.Background()
+		q := b.newQueue("test.queue")
+		pending := func() int {
+			count, err := q.(PendingCounter).Pending(ctx)
+			require.NoError(t, err)
+			return count
+		}
+		assert.Equal(t, 0, pending())
+
+		require.NoError(t, q.Queue(ctx, &TestMsgType{TestField: "completed"}))
+		require.NoError(t, q.Queue(ctx, &TestMsgType{TestField: "given up"}, liteq.Retries(3)))
+		require.NoError(t, q.Queue(ctx, &TestMsgType{TestField: "scheduled"}, liteq.ExecuteAfter(time.Hour)))
+		require.NoError(t, b.newQueue("other.queue").Queue(ctx, &TestMsgType{TestField: "other"}))
+		assert.Equal(t, 3, pending(), "queued but unconsumed jobs of the queue are pending")
+
+		release := make(chan struct{})
+		consumeInBackground(t, q, func(ctx context.Context, msg *TestMsgType) error {
+			if msg.TestField == "given up" {
+				return liteq.NewWorkerError(errors.New("delivery failed"), liteq.WithRemainingAttemps(0))
+			}
+			select {
+			case <-release:
+			case <-ctx.Done():
+			}
+			return nil
+		}, liteq.PoolSize(2))
+		// The job in processing is still pending
+		require.Eventually(t, func() bool { return pending() == 2 }, time.Second*5, time.Millisecond*10)
+		close(release)
+		require.Eventually(t, func() bool { return pending() == 1 }, time.Second*5, time.Millisecond*10)
+		time.Sleep(time.Millisecond * 50)
+		assert.Equal(t, 1, pending(), "only the scheduled job is left")
+	})
+}
+
+func TestQueueBackendsCompleteJobsInProcessingAfterConsumeStopped(t *testing.T) {
+	forEachQueueBackend(t, func(t *testing.T, b *queueBackend) {
+		q := b.newQueue("test.queue")
+		require.NoError(t, q.Queue(context.Background(), &TestMsgType{TestField: "in processing"}))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		processing := make(chan struct{})
+		release := make(chan struct{})
+		done := make(chan error)
+		go func() {
+			done <- q.Consume(ctx, func(ctx context.Context, msg *TestMsgType) error {
+				close(processing)
+				<-release
+				return nil
+			}, liteq.OnEmptySleep(time.Millisecond*10))
+		}()
+		<-processing
+		cancel()
+		select {
+		case <-done:
+			t.Fatal("consuming stopped before the job in processing finished")
+		case <-time.After(time.Millisecond * 50):
+		}
+		close(release)
+		require.NoError(t, <-done)
+		assert.Equal(t, []jobState{{Job: `{"TestField":"in processing"}`, Status: "completed"}}, b.jobStates(t, "test.queue"))
+	})
+}
+
+func TestQueueBackendsTrackDeliveryStatus(t *testing.T) {
+	forEachQueueBackend(t, func(t *testing.T, b *queueBackend) {
+		ctx := context.Background()
+		tracker, err := b.newTracker()
+		require.NoError(t, err)
+		_, err = b.newTracker()
+		require.NoError(t, err, "the schema is only created once")
+
+		first := &QueuedMessage{SubmissionID: "first", To: "one@example.com", DedupKey: "key"}
+		require.NoError(t, tracker.Track(ctx, first))
+		require.NoError(t, tracker.Track(ctx, &QueuedMessage{SubmissionID: "first", To: "two@example.com"}))
+		assert.ErrorIs(t, tracker.Track(ctx, &QueuedMessage{SubmissionID: "second", To: "one@example.com", DedupKey: "key"}), ErrDuplicateMessage)
+		require.NoError(t, tracker.UpdateStatus(ctx, first, DeliveryStatusFailed, errors.New("permanent failure")))
+
+		status, err := tracker.Submission(ctx, "first")
+		require.NoError(t, err)
+		require.Len(t, status.Recipients, 2)
+		assert.Equal(t, DeliveryStatusFailed, status.Recipients[0].Status)
+		assert.Equal(t, "permanent failure", status.Recipients[0].LastError)
+		assert.WithinDuration(t, time.Now(), status.Recipients[0].UpdatedAt, time.Minute)
+		assert.Equal(t, DeliveryStatusPending, status.Recipients[1].Status)
+	})
+}
+
+func TestQueueBackendsTrackOnlyOneOfConcurrentDuplicates(t *testing.T) {
+	forEachQueueBackend(t, func(t *testing.T, b *queueBackend) {
+		ctx := context.Background()
+		tracker, err := b.newTracker()
+		require.NoError(t, err)
+
+		const submissions = 20
+		tracked := atomic.Int32{}
+		wg := &sync.WaitGroup{}
+		for i := range submissions {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				msg := &QueuedMessage{SubmissionID: fmt.Sprintf("submission-%d", i), To: "one@example.com", DedupKey: "key"}
+				if err := tracker.Track(ctx, msg); err == nil {
+					tracked.Add(1)
+				} else {
+					assert.ErrorIs(t, err, ErrDuplicateMessage)
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, int32(1), tracked.Load())
+	})
+}
+
+func TestPostgresPlaceholders(t *testing.T) {
+	assert.Equal(t, `SELECT a FROM t WHERE b = $1 AND c IN ($2, $3)`, PostgresPlaceholders(`SELECT a FROM t WHERE b = ? AND c IN (?, ?)`))
+}
@@ -3,10 +3,24 @@ package queue
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"log/slog"
+	"strings"
+	"time"
 
 	"github.com/dereulenspiegel/liteq"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	// defaultBusyTimeout is how long SQLite waits for a lock before returning SQLITE_BUSY
+	defaultBusyTimeout = time.Second * 5
+	defaultJournalMode = "WAL"
+	defaultSynchronous = "NORMAL"
+
+	defaultBusyRetries    = 5
+	defaultBusyRetryDelay = time.Millisecond * 50
 )
 
 type GenericWorkQueue[T any] interface {
@@ -14,21 +28,212 @@ type GenericWorkQueue[T any] interface {
 	Consume(ctx context.Context, worker liteq.ConsumeFunc[T], options ...liteq.ConsumeOpt) error
 }
 
-type SQLiteWorkQueue[T any] = liteq.Queue[T]
+// PendingCounter is implemented by work queues which can count their outstanding jobs
+type PendingCounter interface {
+	// Pending returns the number of jobs which are queued or being processed. Jobs delayed for a retry
+	// or a scheduled delivery are outstanding too.
+	Pending(ctx context.Context) (int, error)
+}
+
+// pendingJobs counts the jobs of a queue which will still be consumed. Jobs given up by workers of older
+// versions, which consumed with liteq, stay queued without remaining attempts but are never consumed again.
+const pendingJobs = `SELECT COUNT(*) FROM jobs
+WHERE queue = ? AND (job_status = 'fetched' OR (job_status = 'queued' AND remaining_attempts > 0))`
+
+// SQLiteWorkQueue retries queueing items with an exponential backoff if the database is busy or locked. Jobs
+// are queued with liteq, but consumed like the jobs of a PostgresWorkQueue, so the outcome of jobs in processing
+// is still recorded after consuming stopped.
+type SQLiteWorkQueue[T any] struct {
+	q      *liteq.Queue[T]
+	db     *sql.DB
+	name   string
+	logger *slog.Logger
+
+	busyRetries    int
+	busyRetryDelay time.Duration
+}
+
+type workQueueOptions struct {
+	logger *slog.Logger
+}
+
+type WorkQueueOpt func(*workQueueOptions)
+
+// WithLogger logs failures to record the outcome of consumed jobs
+func WithLogger(logger *slog.Logger) WorkQueueOpt {
+	return func(o *workQueueOptions) {
+		o.logger = logger
+	}
+}
+
+func newWorkQueueOptions(opts []WorkQueueOpt) *workQueueOptions {
+	o := &workQueueOptions{
+		logger: slog.Default(),
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+type dbOptions struct {
+	journalMode  string
+	synchronous  string
+	busyTimeout  time.Duration
+	maxOpenConns int
+}
+
+type DBOpt func(*dbOptions)
+
+// WithJournalMode sets the SQLite journal mode, e.g. WAL or DELETE
+func WithJournalMode(journalMode string) DBOpt {
+	return func(o *dbOptions) {
+		if journalMode != "" {
+			o.journalMode = journalMode
+		}
+	}
+}
+
+// WithSynchronous sets the SQLite synchronous mode, e.g. NORMAL or FULL
+func WithSynchronous(synchronous string) DBOpt {
+	return func(o *dbOptions) {
+		if synchronous != "" {
+			o.synchronous = synchronous
+		}
+	}
+}
+
+// WithBusyTimeout sets how long SQLite waits for a lock before returning SQLITE_BUSY
+func WithBusyTimeout(busyTimeout time.Duration) DBOpt {
+	return func(o *dbOptions) {
+		if busyTimeout > 0 {
+			o.busyTimeout = busyTimeout
+		}
+	}
+}
+
+// WithMaxOpenConns limits the size of the connection pool. Values of 0 or less don't limit the pool.
+func WithMaxOpenConns(maxOpenConns int) DBOpt {
+	return func(o *dbOptions) {
+		o.maxOpenConns = maxOpenConns
+	}
+}
+
+// OpenDB opens the SQLite database at path. By default the database uses a write ahead log, so consumers
+// can read while messages are queued, and concurrent writers wait for locks instead of failing immediately.
+func OpenDB(path string, opts ...DBOpt) (*sql.DB, error) {
+	o := &dbOptions{
+		journalMode: defaultJournalMode,
+		synchronous: defaultSynchronous,
+		busyTimeout: defaultBusyTimeout,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	dsn := fmt.Sprintf("%s%s_journal_mode=%s&_synchronous=%s&_busy_timeout=%d", path, separator,
+		o.journalMode, o.synchronous, o.busyTimeout.Milliseconds())
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if o.maxOpenConns > 0 {
+		db.SetMaxOpenConns(o.maxOpenConns)
+		db.SetMaxIdleConns(o.maxOpenConns)
+	}
+	return db, nil
+}
+
+// NewSQLiteWorkQueueOnJobQueue creates a queue on a job queue shared with other queues, db must be the
+// database of the job queue
+func NewSQLiteWorkQueueOnJobQueue[T any](db *sql.DB, jq *liteq.JobQueue, queueName string, opts ...WorkQueueOpt) *SQLiteWorkQueue[T] {
+	o := newWorkQueueOptions(opts)
+	return &SQLiteWorkQueue[T]{
+		q:              liteq.NewQueue(jq, queueName, liteq.JSONMarshaler[T]{}),
+		db:             db,
+		name:           queueName,
+		logger:         o.logger,
+		busyRetries:    defaultBusyRetries,
+		busyRetryDelay: defaultBusyRetryDelay,
+	}
+}
 
 func NewSQLiteWorkQueueOnDb[T any](db *sql.DB, queueName string, poolSize, timeout int) (*SQLiteWorkQueue[T], error) {
 	jq, err := liteq.New(db)
 	if err != nil {
 		return nil, fmt.Errorf("failed to setup job queue: %w", err)
 	}
-	q := liteq.NewQueue(jq, queueName, liteq.JSONMarshaler[T]{})
-	return q, nil
+	return NewSQLiteWorkQueueOnJobQueue[T](db, jq, queueName), nil
 }
 
 func NewSQLiteWorkQueue[T any](path, queueName string, poolSize, timeout int) (*SQLiteWorkQueue[T], error) {
-	liteDb, err := sql.Open("sqlite3", path)
+	liteDb, err := OpenDB(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open queue db: %w", err)
 	}
 	return NewSQLiteWorkQueueOnDb[T](liteDb, queueName, poolSize, timeout)
 }
+
+func (q *SQLiteWorkQueue[T]) Queue(ctx context.Context, item T, options ...liteq.QueueOption) error {
+	return q.Put(ctx, item, options...)
+}
+
+func (q *SQLiteWorkQueue[T]) Put(ctx context.Context, item T, options ...liteq.QueueOption) error {
+	return retryBusy(ctx, q.busyRetries, q.busyRetryDelay, func() error {
+		return q.q.Put(ctx, item, options...)
+	})
+}
+
+// Consume processes jobs with the worker until ctx is done and waits for the jobs in processing. The jobs are
+// consumed directly from the job table of liteq, Consume fails if its layout is not the expected one.
+func (q *SQLiteWorkQueue[T]) Consume(ctx context.Context, worker liteq.ConsumeFunc[T], options ...liteq.ConsumeOpt) error {
+	if err := checkSQLiteJobTable(ctx, q.db); err != nil {
+		return err
+	}
+	store := &sqliteJobStore{
+		db:             q.db,
+		busyRetries:    q.busyRetries,
+		busyRetryDelay: q.busyRetryDelay,
+	}
+	return consumeJobs(ctx, store, q.name, liteq.JSONMarshaler[T]{}, worker, q.logger, options...)
+}
+
+func (q *SQLiteWorkQueue[T]) Pending(ctx context.Context) (int, error) {
+	return countPending(ctx, q.db, pendingJobs, q.name)
+}
+
+func countPending(ctx context.Context, db *sql.DB, query, queueName string) (int, error) {
+	var pending int
+	if err := db.QueryRowContext(ctx, query, queueName).Scan(&pending); err != nil {
+		return 0, fmt.Errorf("failed to count pending jobs of queue %s: %w", queueName, err)
+	}
+	return pending, nil
+}
+
+// retryBusy calls fn again with an exponential backoff as long as it fails because the database is busy or locked
+func retryBusy(ctx context.Context, retries int, delay time.Duration, fn func() error) (err error) {
+	for attempt := 0; ; attempt++ {
+		err = fn()
+		if err == nil || !isBusy(err) || attempt >= retries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// isBusy returns true if the error was caused by another connection holding a lock on the database
+func isBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+}
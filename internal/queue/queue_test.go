@@ -1,11 +1,18 @@
 package queue
 
 import (
+	"bytes"
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
 	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/dereulenspiegel/liteq"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -45,3 +52,179 @@ func TestWorkerQueue(t *testing.T) {
 		t.Fatal("failed to process job")
 	}
 }
+
+// lockDatabase holds an exclusive lock on the database from a separate connection until release is called
+func lockDatabase(t *testing.T, path string) (release func()) {
+	db, err := sql.Open("sqlite3", path)
+	require.NoError(t, err)
+	conn, err := db.Conn(context.Background())
+	require.NoError(t, err)
+	_, err = conn.ExecContext(context.Background(), "BEGIN EXCLUSIVE")
+	require.NoError(t, err)
+	return func() {
+		_, err := conn.ExecContext(context.Background(), "COMMIT")
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+		require.NoError(t, db.Close())
+	}
+}
+
+func TestQueueRetriesWhileDatabaseIsBusy(t *testing.T) {
+	qPath := filepath.Join(t.TempDir(), "queue.db")
+	// Without a busy timeout SQLite fails immediately, which forces the queue to retry
+	db, err := sql.Open("sqlite3", qPath+"?_busy_timeout=0")
+	require.NoError(t, err)
+	wq, err := NewSQLiteWorkQueueOnDb[*TestMsgType](db, "test.queue", 1, 5)
+	require.NoError(t, err)
+	wq.busyRetryDelay = time.Millisecond * 20
+
+	release := lockDatabase(t, qPath)
+	time.AfterFunc(time.Millisecond*100, release)
+
+	require.NoError(t, wq.Queue(context.Background(), &TestMsgType{TestField: "foo"}))
+}
+
+func TestQueueGivesUpIfDatabaseStaysBusy(t *testing.T) {
+	qPath := filepath.Join(t.TempDir(), "queue.db")
+	db, err := sql.Open("sqlite3", qPath+"?_busy_timeout=0")
+	require.NoError(t, err)
+	wq, err := NewSQLiteWorkQueueOnDb[*TestMsgType](db, "test.queue", 1, 5)
+	require.NoError(t, err)
+	wq.busyRetries = 2
+	wq.busyRetryDelay = time.Millisecond
+
+	release := lockDatabase(t, qPath)
+	defer release()
+
+	err = wq.Queue(context.Background(), &TestMsgType{TestField: "foo"})
+	require.Error(t, err)
+	assert.True(t, isBusy(err))
+}
+
+func TestOpenDBUsesWAL(t *testing.T) {
+	db, err := OpenDB(filepath.Join(t.TempDir(), "queue.db"), WithMaxOpenConns(4))
+	require.NoError(t, err)
+	defer db.Close()
+
+	var journalMode string
+	require.NoError(t, db.QueryRow("PRAGMA journal_mode").Scan(&journalMode))
+	assert.Equal(t, "wal", journalMode)
+	var synchronous int
+	require.NoError(t, db.QueryRow("PRAGMA synchronous").Scan(&synchronous))
+	assert.Equal(t, 1, synchronous, "synchronous should be NORMAL")
+	var timeout int
+	require.NoError(t, db.QueryRow("PRAGMA busy_timeout").Scan(&timeout))
+	assert.Equal(t, 5000, timeout)
+	assert.Equal(t, 4, db.Stats().MaxOpenConnections)
+
+	wq, err := NewSQLiteWorkQueueOnDb[*TestMsgType](db, "test.queue", 1, 5)
+	require.NoError(t, err)
+
+	const producers, itemsPerProducer = 4, 25
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lock := sync.Mutex{}
+	consumed := map[string]int{}
+	go wq.Consume(ctx, func(ctx context.Context, msg *TestMsgType) error {
+		lock.Lock()
+		defer lock.Unlock()
+		consumed[msg.TestField]++
+		return nil
+	}, liteq.PoolSize(4))
+
+	wg := sync.WaitGroup{}
+	for p := range producers {
+		wg.Go(func() {
+			for i := range itemsPerProducer {
+				assert.NoError(t, wq.Queue(ctx, &TestMsgType{TestField: fmt.Sprintf("%d-%d", p, i)}))
+			}
+		})
+	}
+	wg.Wait()
+
+	require.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(consumed) == producers*itemsPerProducer
+	}, time.Second*10, time.Millisecond*50)
+	lock.Lock()
+	defer lock.Unlock()
+	for item, count := range consumed {
+		assert.Equal(t, 1, count, item)
+	}
+}
+
+// sqliteJobState returns the status of the job with the given id
+func sqliteJobState(t *testing.T, db *sql.DB, id int64) string {
+	var status string
+	require.NoError(t, db.QueryRow(`SELECT job_status FROM jobs WHERE id = ?`, id).Scan(&status))
+	return status
+}
+
+func TestConsumeRetriesCompletingJobsWhileDatabaseIsBusy(t *testing.T) {
+	qPath := filepath.Join(t.TempDir(), "queue.db")
+	db, err := sql.Open("sqlite3", qPath+"?_busy_timeout=0")
+	require.NoError(t, err)
+	defer db.Close()
+	wq, err := NewSQLiteWorkQueueOnDb[*TestMsgType](db, "test.queue", 1, 5)
+	require.NoError(t, err)
+	wq.busyRetryDelay = time.Millisecond * 20
+	require.NoError(t, wq.Queue(context.Background(), &TestMsgType{TestField: "foo"}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err = wq.Consume(ctx, func(ctx context.Context, msg *TestMsgType) error {
+		// The job is completed while another connection holds the lock
+		release := lockDatabase(t, qPath)
+		time.AfterFunc(time.Millisecond*100, release)
+		cancel()
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "completed", sqliteJobState(t, db, 1))
+}
+
+func TestConsumeLogsJobsWhoseOutcomeCanNotBeRecorded(t *testing.T) {
+	qPath := filepath.Join(t.TempDir(), "queue.db")
+	db, err := sql.Open("sqlite3", qPath+"?_busy_timeout=0")
+	require.NoError(t, err)
+	defer db.Close()
+	jq, err := liteq.New(db)
+	require.NoError(t, err)
+	logs := &bytes.Buffer{}
+	wq := NewSQLiteWorkQueueOnJobQueue[*TestMsgType](db, jq, "test.queue", WithLogger(slog.New(slog.NewTextHandler(logs, nil))))
+	wq.busyRetries = 1
+	wq.busyRetryDelay = time.Millisecond
+	require.NoError(t, wq.Queue(context.Background(), &TestMsgType{TestField: "foo"}))
+
+	var release func()
+	ctx, cancel := context.WithCancel(context.Background())
+	err = wq.Consume(ctx, func(ctx context.Context, msg *TestMsgType) error {
+		release = lockDatabase(t, qPath)
+		cancel()
+		return errors.New("delivery failed")
+	})
+	require.NoError(t, err)
+	release()
+
+	assert.Contains(t, logs.String(), "failed to record the failure of job")
+	assert.Contains(t, logs.String(), "jobId=1")
+	assert.Equal(t, "fetched", sqliteJobState(t, db, 1), "the job is processed again after the visibility timeout")
+}
+
+func TestConsumeRequiresTheJobTableOfLiteq(t *testing.T) {
+	db, err := OpenDB(filepath.Join(t.TempDir(), "queue.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	jq, err := liteq.New(db)
+	require.NoError(t, err)
+	require.NoError(t, checkSQLiteJobTable(context.Background(), db))
+
+	_, err = db.Exec(`ALTER TABLE jobs DROP COLUMN consumer_fetched_at`)
+	require.NoError(t, err)
+	assert.ErrorContains(t, checkSQLiteJobTable(context.Background(), db), "consumer_fetched_at")
+
+	wq := NewSQLiteWorkQueueOnJobQueue[*TestMsgType](db, jq, "test.queue")
+	assert.Error(t, wq.Consume(context.Background(), func(ctx context.Context, msg *TestMsgType) error {
+		return nil
+	}))
+}
@@ -0,0 +1,90 @@
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dereulenspiegel/liteq"
+)
+
+// ReplayFilter selects the failed messages to replay
+type ReplayFilter struct {
+	// RecipientDomain only replays messages to recipients in this domain, messages to all domains if empty
+	RecipientDomain string
+	// MaxAge only replays messages which failed within this duration, all failed messages if 0
+	MaxAge time.Duration
+}
+
+func (f ReplayFilter) matches(msg *QueuedMessage, failedAt time.Time) bool {
+	if f.MaxAge > 0 && time.Since(failedAt) > f.MaxAge {
+		return false
+	}
+	if f.RecipientDomain != "" {
+		domain := msg.To[strings.LastIndex(msg.To, "@")+1:]
+		if !strings.EqualFold(domain, strings.TrimSuffix(f.RecipientDomain, ".")) {
+			return false
+		}
+	}
+	return true
+}
+
+// failedMessage is a message as stored by a failed job. The last error is an interface and can't be decoded,
+// it is replaced anyway when the message is replayed.
+type failedMessage struct {
+	*QueuedMessage
+	LastErr json.RawMessage
+}
+
+// ReplayFailed queues the messages, which permanently failed in the queue queueName, into target again. Their
+// error count is reset and the failed jobs are removed. Replayed messages are returned, even if replaying
+// failed for later messages.
+func ReplayFailed(ctx context.Context, db *sql.DB, queueName string, target GenericWorkQueue[*QueuedMessage], filter ReplayFilter, options ...liteq.QueueOption) (replayed []*QueuedMessage, err error) {
+	rows, err := db.QueryContext(ctx, `SELECT id, job, updated_at FROM jobs WHERE queue = ? AND job_status = 'failed' ORDER BY id`, queueName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query failed messages of %s: %w", queueName, err)
+	}
+	type failedJob struct {
+		id       int64
+		msg      *QueuedMessage
+		failedAt time.Time
+	}
+	failedJobs := []failedJob{}
+	for rows.Next() {
+		var id, updatedAt int64
+		var job []byte
+		if err := rows.Scan(&id, &job, &updatedAt); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read failed message of %s: %w", queueName, err)
+		}
+		stored := &failedMessage{QueuedMessage: &QueuedMessage{}}
+		if err := json.Unmarshal(job, stored); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to decode failed message %d of %s: %w", id, queueName, err)
+		}
+		failedJobs = append(failedJobs, failedJob{id: id, msg: stored.QueuedMessage, failedAt: time.Unix(updatedAt, 0)})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read failed messages of %s: %w", queueName, err)
+	}
+
+	for _, job := range failedJobs {
+		if !filter.matches(job.msg, job.failedAt) {
+			continue
+		}
+		job.msg.ErrorCount = 0
+		job.msg.LastErr = nil
+		if err := target.Queue(ctx, job.msg, job.msg.QueueOptions(options...)...); err != nil {
+			return replayed, fmt.Errorf("failed to queue message %d of %s again: %w", job.id, queueName, err)
+		}
+		if _, err := db.ExecContext(ctx, `DELETE FROM jobs WHERE id = ? AND job_status = 'failed'`, job.id); err != nil {
+			return replayed, fmt.Errorf("failed to remove replayed message %d of %s: %w", job.id, queueName, err)
+		}
+		replayed = append(replayed, job.msg)
+	}
+	return replayed, nil
+}
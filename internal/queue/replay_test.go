@@ -0,0 +1,77 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dereulenspiegel/liteq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplayFailed(t *testing.T) {
+	ctx := context.Background()
+	db, err := OpenDB(filepath.Join(t.TempDir(), "queue.db"))
+	require.NoError(t, err)
+	jq, err := liteq.New(db)
+	require.NoError(t, err)
+	sendQueue := NewSQLiteWorkQueueOnJobQueue[*QueuedMessage](db, jq, "send.queue")
+
+	require.NoError(t, sendQueue.Queue(ctx, &QueuedMessage{
+		From:       "from@example.com",
+		To:         "to@example.com",
+		Body:       []byte("Subject: Test\r\n\r\nbody\r\n"),
+		ErrorCount: 5,
+		LastErr:    errors.New("failed to lookup mx records"),
+	}))
+	require.NoError(t, sendQueue.Queue(ctx, &QueuedMessage{
+		From:       "from@example.com",
+		To:         "to@example.org",
+		ErrorCount: 2,
+	}))
+	// Let both messages end up as failed jobs, the one to example.org failed a day ago
+	_, err = db.Exec(`UPDATE jobs SET job_status = 'failed', remaining_attempts = 0`)
+	require.NoError(t, err)
+	_, err = db.Exec(`UPDATE jobs SET updated_at = ? WHERE job LIKE '%to@example.org%'`, time.Now().Add(-time.Hour*24).Unix())
+	require.NoError(t, err)
+
+	replayed, err := ReplayFailed(ctx, db, "send.queue", sendQueue, ReplayFilter{RecipientDomain: "EXAMPLE.com"}, liteq.Retries(3))
+	require.NoError(t, err)
+	require.Len(t, replayed, 1)
+	assert.Equal(t, "to@example.com", replayed[0].To)
+
+	delivered := make(chan *QueuedMessage, 2)
+	consumeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go sendQueue.Consume(consumeCtx, func(ctx context.Context, msg *QueuedMessage) error {
+		delivered <- msg
+		return nil
+	}, liteq.OnEmptySleep(time.Millisecond*10))
+
+	select {
+	case msg := <-delivered:
+		assert.Equal(t, "to@example.com", msg.To)
+		assert.Equal(t, []byte("Subject: Test\r\n\r\nbody\r\n"), msg.Body)
+		assert.Equal(t, 0, msg.ErrorCount)
+		assert.Nil(t, msg.LastErr)
+	case <-time.After(time.Second * 5):
+		t.Fatal("replayed message was not queued")
+	}
+
+	replayed, err = ReplayFailed(ctx, db, "send.queue", sendQueue, ReplayFilter{MaxAge: time.Hour})
+	require.NoError(t, err)
+	assert.Empty(t, replayed)
+
+	replayed, err = ReplayFailed(ctx, db, "send.queue", sendQueue, ReplayFilter{})
+	require.NoError(t, err)
+	require.Len(t, replayed, 1)
+	assert.Equal(t, "to@example.org", replayed[0].To)
+	assert.Equal(t, 0, replayed[0].ErrorCount)
+
+	var failed int
+	require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM jobs WHERE job_status = 'failed'`).Scan(&failed))
+	assert.Equal(t, 0, failed)
+}
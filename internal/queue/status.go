@@ -0,0 +1,192 @@
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// ErrDuplicateMessage is returned when tracking a message while an identical message of another submission is
+// still waiting for delivery
+var ErrDuplicateMessage = errors.New("an identical message is already waiting for delivery")
+
+type DeliveryStatus string
+
+const (
+	DeliveryStatusPending   DeliveryStatus = "pending"
+	DeliveryStatusDeferred  DeliveryStatus = "deferred"
+	DeliveryStatusDelivered DeliveryStatus = "delivered"
+	DeliveryStatusFailed    DeliveryStatus = "failed"
+)
+
+// Final returns true if no further delivery attempts will be made for a recipient with this status
+func (d DeliveryStatus) Final() bool {
+	return d == DeliveryStatusDelivered || d == DeliveryStatusFailed
+}
+
+type RecipientStatus struct {
+	Recipient string
+	Status    DeliveryStatus
+	LastError string
+	UpdatedAt time.Time
+}
+
+// SubmissionStatus aggregates the delivery status of all recipients of a single submission
+type SubmissionStatus struct {
+	SubmissionID string
+	Recipients   []*RecipientStatus
+}
+
+func (s *SubmissionStatus) Count(status DeliveryStatus) (count int) {
+	for _, rcpt := range s.Recipients {
+		if rcpt.Status == status {
+			count++
+		}
+	}
+	return
+}
+
+// Complete returns true if the delivery to all recipients either succeeded or failed permanently
+func (s *SubmissionStatus) Complete() bool {
+	for _, rcpt := range s.Recipients {
+		if !rcpt.Status.Final() {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *SubmissionStatus) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("submissionId", s.SubmissionID),
+		slog.Int("recipients", len(s.Recipients)),
+		slog.Int("delivered", s.Count(DeliveryStatusDelivered)),
+		slog.Int("failed", s.Count(DeliveryStatusFailed)),
+		slog.Int("pending", s.Count(DeliveryStatusPending)+s.Count(DeliveryStatusDeferred)),
+	)
+}
+
+const deliveryStatusSchema = `
+CREATE TABLE IF NOT EXISTS delivery_status (
+	submission_id TEXT NOT NULL,
+	recipient TEXT NOT NULL,
+	status TEXT NOT NULL,
+	last_error TEXT NOT NULL DEFAULT '',
+	updated_at INTEGER NOT NULL,
+	PRIMARY KEY (submission_id, recipient)
+);
+`
+
+// deliveryStatusDedupColumn is added to delivery status tables created before messages were deduplicated
+const deliveryStatusDedupColumn = `ALTER TABLE delivery_status ADD COLUMN dedup_key TEXT NOT NULL DEFAULT ''`
+
+// deliveryStatusDedupIndex lets only one message per dedup key wait for delivery. Duplicates tracked before the
+// index existed keep waiting, but lose their dedup key so the index can be created.
+const deliveryStatusDedupIndex = `
+UPDATE delivery_status SET dedup_key = ''
+WHERE dedup_key != '' AND status IN ('pending', 'deferred') AND EXISTS (
+	SELECT 1 FROM delivery_status waiting
+	WHERE waiting.dedup_key = delivery_status.dedup_key AND waiting.status IN ('pending', 'deferred')
+	AND (waiting.submission_id, waiting.recipient) < (delivery_status.submission_id, delivery_status.recipient));
+
+CREATE UNIQUE INDEX IF NOT EXISTS delivery_status_dedup ON delivery_status (dedup_key)
+WHERE dedup_key != '' AND status IN ('pending', 'deferred');
+`
+
+// DeliveryTracker records the delivery status of every recipient under the submission ID of its message
+type DeliveryTracker struct {
+	db *sql.DB
+	// bind converts the placeholders of queries to the ones of the database
+	bind func(query string) string
+}
+
+func NewDeliveryTracker(db *sql.DB) (*DeliveryTracker, error) {
+	if _, err := db.Exec(deliveryStatusSchema); err != nil {
+		return nil, fmt.Errorf("failed to create delivery status schema: %w", err)
+	}
+	if _, err := db.Exec(`SELECT dedup_key FROM delivery_status LIMIT 0`); err != nil {
+		if _, err := db.Exec(deliveryStatusDedupColumn); err != nil {
+			return nil, fmt.Errorf("failed to add dedup key to delivery status schema: %w", err)
+		}
+	}
+	if _, err := db.Exec(deliveryStatusDedupIndex); err != nil {
+		return nil, fmt.Errorf("failed to create dedup index of delivery status schema: %w", err)
+	}
+	return &DeliveryTracker{
+		db:   db,
+		bind: func(query string) string { return query },
+	}, nil
+}
+
+// Track registers the recipient of the message as pending, if it is not tracked yet. If an identical message of
+// another submission, with the same dedup key, is still pending or deferred, the message is not tracked and
+// ErrDuplicateMessage is returned. Tracking a message again, e.g. when processing its submission is retried, is
+// not a duplicate.
+func (d *DeliveryTracker) Track(ctx context.Context, msg *QueuedMessage) error {
+	// Conflicts either with the row of this recipient or, enforced by the dedup index, with an identical message
+	res, err := d.db.ExecContext(ctx, d.bind(
+		`INSERT INTO delivery_status (submission_id, recipient, status, updated_at, dedup_key) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT DO NOTHING`),
+		msg.SubmissionID, msg.To, DeliveryStatusPending, time.Now().Unix(), msg.DedupKey)
+	if err != nil {
+		return fmt.Errorf("failed to track delivery status of %s: %w", msg.To, err)
+	}
+	if inserted, err := res.RowsAffected(); err != nil || inserted > 0 || msg.DedupKey == "" {
+		return nil
+	}
+	var tracked int
+	if err := d.db.QueryRowContext(ctx,
+		d.bind(`SELECT COUNT(*) FROM delivery_status WHERE submission_id = ? AND recipient = ?`),
+		msg.SubmissionID, msg.To).Scan(&tracked); err != nil {
+		return fmt.Errorf("failed to track delivery status of %s: %w", msg.To, err)
+	}
+	if tracked == 0 {
+		return ErrDuplicateMessage
+	}
+	return nil
+}
+
+func (d *DeliveryTracker) UpdateStatus(ctx context.Context, msg *QueuedMessage, status DeliveryStatus, deliveryErr error) error {
+	lastError := ""
+	if deliveryErr != nil {
+		lastError = deliveryErr.Error()
+	}
+	_, err := d.db.ExecContext(ctx, d.bind(
+		`INSERT INTO delivery_status (submission_id, recipient, status, last_error, updated_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (submission_id, recipient) DO UPDATE SET status = excluded.status, last_error = excluded.last_error, updated_at = excluded.updated_at`),
+		msg.SubmissionID, msg.To, status, lastError, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to update delivery status of %s: %w", msg.To, err)
+	}
+	return nil
+}
+
+func (d *DeliveryTracker) Submission(ctx context.Context, submissionID string) (*SubmissionStatus, error) {
+	rows, err := d.db.QueryContext(ctx,
+		d.bind(`SELECT recipient, status, last_error, updated_at FROM delivery_status WHERE submission_id = ? ORDER BY recipient`),
+		submissionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query delivery status of submission %s: %w", submissionID, err)
+	}
+	defer rows.Close()
+
+	status := &SubmissionStatus{
+		SubmissionID: submissionID,
+	}
+	for rows.Next() {
+		rcpt := &RecipientStatus{}
+		var updatedAt int64
+		if err := rows.Scan(&rcpt.Recipient, &rcpt.Status, &rcpt.LastError, &updatedAt); err != nil {
+			return nil, fmt.Errorf("failed to read delivery status of submission %s: %w", submissionID, err)
+		}
+		rcpt.UpdatedAt = time.Unix(updatedAt, 0)
+		status.Recipients = append(status.Recipients, rcpt)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read delivery status of submission %s: %w", submissionID, err)
+	}
+	return status, nil
+}
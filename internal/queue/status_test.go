@@ -0,0 +1,144 @@
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeliveryTrackerAggregatesStatus(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "status.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	tracker, err := NewDeliveryTracker(db)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	msgs := []*QueuedMessage{
+		{SubmissionID: "submission", To: "one@example.com"},
+		{SubmissionID: "submission", To: "two@example.com"},
+		{SubmissionID: "submission", To: "three@example.com"},
+		{SubmissionID: "other", To: "one@example.com"},
+	}
+	for _, msg := range msgs {
+		require.NoError(t, tracker.Track(ctx, msg))
+	}
+
+	status, err := tracker.Submission(ctx, "submission")
+	require.NoError(t, err)
+	require.Len(t, status.Recipients, 3)
+	assert.Equal(t, 3, status.Count(DeliveryStatusPending))
+	assert.False(t, status.Complete())
+
+	require.NoError(t, tracker.UpdateStatus(ctx, msgs[0], DeliveryStatusDelivered, nil))
+	require.NoError(t, tracker.UpdateStatus(ctx, msgs[1], DeliveryStatusDeferred, errors.New("temporary failure")))
+	require.NoError(t, tracker.UpdateStatus(ctx, msgs[2], DeliveryStatusFailed, errors.New("permanent failure")))
+	// Tracking an already tracked recipient again must not reset its status
+	require.NoError(t, tracker.Track(ctx, msgs[0]))
+
+	status, err = tracker.Submission(ctx, "submission")
+	require.NoError(t, err)
+	assert.Equal(t, 1, status.Count(DeliveryStatusDelivered))
+	assert.Equal(t, 1, status.Count(DeliveryStatusDeferred))
+	assert.Equal(t, 1, status.Count(DeliveryStatusFailed))
+	assert.Equal(t, 0, status.Count(DeliveryStatusPending))
+	assert.False(t, status.Complete())
+
+	require.NoError(t, tracker.UpdateStatus(ctx, msgs[1], DeliveryStatusDelivered, nil))
+	status, err = tracker.Submission(ctx, "submission")
+	require.NoError(t, err)
+	assert.Equal(t, 2, status.Count(DeliveryStatusDelivered))
+	assert.True(t, status.Complete())
+	for _, rcpt := range status.Recipients {
+		if rcpt.Recipient == "three@example.com" {
+			assert.Equal(t, "permanent failure", rcpt.LastError)
+		} else {
+			assert.Empty(t, rcpt.LastError)
+		}
+	}
+
+	status, err = tracker.Submission(ctx, "other")
+	require.NoError(t, err)
+	require.Len(t, status.Recipients, 1)
+	assert.Equal(t, DeliveryStatusPending, status.Recipients[0].Status)
+}
+
+func TestDeliveryTrackerRejectsDuplicates(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "status.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	tracker, err := NewDeliveryTracker(db)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	first := &QueuedMessage{SubmissionID: "first", To: "one@example.com", DedupKey: "key"}
+	second := &QueuedMessage{SubmissionID: "second", To: "one@example.com", DedupKey: "key"}
+	require.NoError(t, tracker.Track(ctx, first))
+	require.NoError(t, tracker.Track(ctx, first), "tracking the same message again is no duplicate")
+	assert.ErrorIs(t, tracker.Track(ctx, second), ErrDuplicateMessage)
+	assert.NoError(t, tracker.Track(ctx, &QueuedMessage{SubmissionID: "second", To: "two@example.com", DedupKey: "other"}))
+	assert.NoError(t, tracker.Track(ctx, &QueuedMessage{SubmissionID: "third", To: "one@example.com"}),
+		"messages without dedup key are never duplicates")
+
+	require.NoError(t, tracker.UpdateStatus(ctx, first, DeliveryStatusDeferred, errors.New("temporary failure")))
+	assert.ErrorIs(t, tracker.Track(ctx, second), ErrDuplicateMessage)
+	require.NoError(t, tracker.UpdateStatus(ctx, first, DeliveryStatusDelivered, nil))
+	assert.NoError(t, tracker.Track(ctx, second), "identical messages are sent again once the first one was delivered")
+
+	status, err := tracker.Submission(ctx, "second")
+	require.NoError(t, err)
+	assert.Len(t, status.Recipients, 2)
+}
+
+func TestDeliveryTrackerAddsDedupKeyToExistingSchema(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "status.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = db.Exec(`CREATE TABLE delivery_status (
+		submission_id TEXT NOT NULL,
+		recipient TEXT NOT NULL,
+		status TEXT NOT NULL,
+		last_error TEXT NOT NULL DEFAULT '',
+		updated_at INTEGER NOT NULL,
+		PRIMARY KEY (submission_id, recipient))`)
+	require.NoError(t, err)
+
+	tracker, err := NewDeliveryTracker(db)
+	require.NoError(t, err)
+	assert.NoError(t, tracker.Track(context.Background(), &QueuedMessage{SubmissionID: "first", To: "one@example.com", DedupKey: "key"}))
+	_, err = NewDeliveryTracker(db)
+	assert.NoError(t, err, "the dedup key is only added once")
+}
+
+func TestDeliveryTrackerKeepsDuplicatesTrackedBeforeTheDedupIndex(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "status.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = db.Exec(deliveryStatusSchema + deliveryStatusDedupColumn)
+	require.NoError(t, err)
+	for _, submission := range []string{"first", "second"} {
+		_, err = db.Exec(`INSERT INTO delivery_status (submission_id, recipient, status, updated_at, dedup_key)
+			VALUES (?, 'one@example.com', 'pending', 0, 'key')`, submission)
+		require.NoError(t, err)
+	}
+
+	tracker, err := NewDeliveryTracker(db)
+	require.NoError(t, err)
+	ctx := context.Background()
+	for _, submission := range []string{"first", "second"} {
+		status, err := tracker.Submission(ctx, submission)
+		require.NoError(t, err)
+		require.Len(t, status.Recipients, 1, submission)
+		assert.Equal(t, DeliveryStatusPending, status.Recipients[0].Status, submission)
+	}
+	assert.ErrorIs(t, tracker.Track(ctx, &QueuedMessage{SubmissionID: "third", To: "one@example.com", DedupKey: "key"}),
+		ErrDuplicateMessage)
+}
@@ -0,0 +1,97 @@
+package sender
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/dereulenspiegel/smolmailer/internal/queue"
+	"github.com/emersion/go-smtp"
+)
+
+// accessLogMsg is the message of every access log entry, so log pipelines can select them
+const accessLogMsg = "delivery access"
+
+// Events of the delivery access log
+const (
+	// AccessEventQueued means the message was put back into the send queue without a delivery attempt
+	AccessEventQueued = "queued"
+	// AccessEventStarted means a delivery attempt started
+	AccessEventStarted = "started"
+	// AccessEventSucceeded means the remote server accepted the message
+	AccessEventSucceeded = "succeeded"
+	// AccessEventDeferred means the delivery attempt failed and is retried later
+	AccessEventDeferred = "deferred"
+	// AccessEventBounced means the delivery failed permanently
+	AccessEventBounced = "bounced"
+)
+
+// deliveryAttempt collects what is logged about a delivery attempt in the access log
+type deliveryAttempt struct {
+	started    time.Time
+	mxHost     string
+	tlsVersion string
+}
+
+type deliveryAttemptKey struct{}
+
+func withDeliveryAttempt(ctx context.Context) (context.Context, *deliveryAttempt) {
+	attempt := &deliveryAttempt{started: time.Now()}
+	return context.WithValue(ctx, deliveryAttemptKey{}, attempt), attempt
+}
+
+// recordMxHost records the mx host the delivery attempt of ctx tried last and the TLS version of the
+// connection to it, if it could be established
+func recordMxHost(ctx context.Context, host string, c *mxClient) {
+	attempt, ok := ctx.Value(deliveryAttemptKey{}).(*deliveryAttempt)
+	if !ok {
+		return
+	}
+	attempt.mxHost, attempt.tlsVersion = host, ""
+	if c == nil {
+		return
+	}
+	if state, isTLS := c.TLSConnectionState(); isTLS {
+		attempt.tlsVersion = tls.VersionName(state.Version)
+	}
+}
+
+// logAccess writes the access log entry of a delivery attempt
+func (s *Sender) logAccess(event string, msg *queue.QueuedMessage, attempt *deliveryAttempt, deliveryErr error) {
+	logAccess(s.logger, event, msg, attempt, deliveryErr)
+}
+
+// logAccess writes an access log entry to logger. Every entry has the same fields, fields which are unknown
+// for an event are empty.
+func logAccess(logger *slog.Logger, event string, msg *queue.QueuedMessage, attempt *deliveryAttempt, deliveryErr error) {
+	envelopeID := ""
+	if msg.MailOpts != nil {
+		envelopeID = msg.MailOpts.EnvelopeID
+	}
+	if attempt == nil {
+		attempt = &deliveryAttempt{}
+	}
+	var duration time.Duration
+	if !attempt.started.IsZero() && event != AccessEventStarted {
+		duration = time.Since(attempt.started)
+	}
+	smtpCode := 0
+	var smtpErr *smtp.SMTPError
+	if errors.As(deliveryErr, &smtpErr) {
+		smtpCode = smtpErr.Code
+	} else if event == AccessEventSucceeded {
+		smtpCode = 250
+	}
+	logger.LogAttrs(context.Background(), slog.LevelInfo, accessLogMsg,
+		slog.String("event", event),
+		slog.String("envelopeId", envelopeID),
+		slog.String("from", msg.From),
+		slog.String("to", msg.To),
+		slog.String("mxHost", attempt.mxHost),
+		slog.Int64("durationMs", duration.Milliseconds()),
+		slog.Int("smtpCode", smtpCode),
+		slog.String("tlsVersion", attempt.tlsVersion),
+	)
+}
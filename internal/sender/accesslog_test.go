@@ -0,0 +1,112 @@
+package sender
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dereulenspiegel/liteq"
+	"github.com/dereulenspiegel/smolmailer/internal/config"
+	"github.com/dereulenspiegel/smolmailer/internal/queue"
+	"github.com/dereulenspiegel/smolmailer/internal/queue/queuemocks"
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type accessLogEntry struct {
+	Msg        string  `json:"msg"`
+	Event      string  `json:"event"`
+	EnvelopeID string  `json:"envelopeId"`
+	From       string  `json:"from"`
+	To         string  `json:"to"`
+	MxHost     string  `json:"mxHost"`
+	DurationMs *int64  `json:"durationMs"`
+	SmtpCode   *int    `json:"smtpCode"`
+	TLSVersion *string `json:"tlsVersion"`
+}
+
+func accessLogEntries(t *testing.T, logs *bytes.Buffer) []accessLogEntry {
+	entries := []accessLogEntry{}
+	for line := range strings.SplitSeq(strings.TrimSpace(logs.String()), "\n") {
+		entry := accessLogEntry{}
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		if entry.Msg == accessLogMsg {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func TestAccessLogOfSuccessfulDelivery(t *testing.T) {
+	host, port := startTestSmtpServer(t, &concurrencyBackend{})
+	logs := &bytes.Buffer{}
+	s := newTestSender(t, &config.Config{MailDomain: "example.com"}, queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t), host, port)
+	s.logger = slog.New(slog.NewJSONHandler(logs, nil))
+
+	require.NoError(t, s.trySend(context.Background(), &queue.QueuedMessage{
+		From:     "from@example.com",
+		To:       "rcpt@example.org",
+		Body:     []byte("test"),
+		MailOpts: &smtp.MailOptions{EnvelopeID: "envelope"},
+	}))
+
+	entries := accessLogEntries(t, logs)
+	require.Len(t, entries, 2)
+	for _, entry := range entries {
+		assert.Equal(t, "envelope", entry.EnvelopeID)
+		assert.Equal(t, "from@example.com", entry.From)
+		assert.Equal(t, "rcpt@example.org", entry.To)
+		// Every field is always present, so the schema is stable
+		assert.NotNil(t, entry.DurationMs)
+		assert.NotNil(t, entry.SmtpCode)
+		assert.NotNil(t, entry.TLSVersion)
+	}
+	assert.Equal(t, AccessEventStarted, entries[0].Event)
+	assert.Empty(t, entries[0].MxHost)
+	assert.Equal(t, AccessEventSucceeded, entries[1].Event)
+	assert.Equal(t, host, entries[1].MxHost)
+	assert.Equal(t, 250, *entries[1].SmtpCode)
+	assert.Empty(t, *entries[1].TLSVersion, "the test server does not offer TLS")
+}
+
+func TestAccessLogOfFailedDeliveries(t *testing.T) {
+	host, port := startTestSmtpServer(t, &bouncingBackend{})
+	logs := &bytes.Buffer{}
+	q := queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t)
+	s := newTestSender(t, &config.Config{MailDomain: "example.com"}, q, host, port)
+	s.logger = slog.New(slog.NewJSONHandler(logs, nil))
+	msg := func() *queue.QueuedMessage {
+		return &queue.QueuedMessage{
+			From:     "from@example.com",
+			To:       "unknown@example.org",
+			Body:     []byte("test"),
+			MailOpts: &smtp.MailOptions{EnvelopeID: "envelope"},
+		}
+	}
+
+	ctx := context.WithValue(context.Background(), liteq.CtxJobCreatedAt, time.Now())
+	require.Error(t, s.trySend(ctx, msg()))
+	entries := accessLogEntries(t, logs)
+	require.Len(t, entries, 2)
+	assert.Equal(t, AccessEventDeferred, entries[1].Event)
+	assert.Equal(t, host, entries[1].MxHost)
+	assert.Equal(t, 550, *entries[1].SmtpCode)
+
+	// Messages are not retried anymore once the delivery attempts are used up, the sender gets a bounce
+	logs.Reset()
+	q.On("Queue", mock.Anything, mock.MatchedBy(func(bounce *queue.QueuedMessage) bool {
+		return bounce.From == "" && bounce.To == "from@example.com"
+	}), mock.Anything).Return(nil).Once()
+	ctx = context.WithValue(context.Background(), liteq.CtxJobRemainingAttempts, int64(1))
+	require.Error(t, s.trySend(ctx, msg()))
+	entries = accessLogEntries(t, logs)
+	require.Len(t, entries, 2)
+	assert.Equal(t, AccessEventBounced, entries[1].Event)
+	assert.Equal(t, 550, *entries[1].SmtpCode)
+}
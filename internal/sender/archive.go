@@ -0,0 +1,186 @@
+package sender
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dereulenspiegel/smolmailer/internal/backend"
+)
+
+const (
+	archiveDateLayout          = "2006-01-02"
+	archiveDirMode             = 0700
+	archiveFileMode            = 0600
+	defaultArchiveCleanupDelay = time.Hour
+)
+
+// MessageArchive retains a copy of every outgoing message as it is sent, i.e. after DKIM signing. Every day
+// gets its own Maildir below the archive directory and messages are stored in its new directory, named
+// after the time of archiving and the envelope id.
+type MessageArchive struct {
+	dir       string
+	retention time.Duration
+	hostname  string
+	counter   atomic.Uint64
+	writing   *sync.WaitGroup
+
+	now    func() time.Time
+	logger *slog.Logger
+}
+
+// NewMessageArchive archives messages below dir. Days older than retention are removed periodically until
+// ctx is done, a retention of 0 keeps all messages.
+func NewMessageArchive(ctx context.Context, logger *slog.Logger, dir string, retention time.Duration) (*MessageArchive, error) {
+	if err := os.MkdirAll(dir, archiveDirMode); err != nil {
+		return nil, fmt.Errorf("failed to create archive directory %s: %w", dir, err)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	a := &MessageArchive{
+		dir:       dir,
+		retention: retention,
+		hostname:  maildirSafe(hostname),
+		writing:   &sync.WaitGroup{},
+		now:       time.Now,
+		logger:    logger,
+	}
+	if retention > 0 {
+		go a.goCleanup(ctx)
+	}
+	return a, nil
+}
+
+// Archive writes a copy of the message in the background, so archiving never delays processing
+func (a *MessageArchive) Archive(msg *backend.ReceivedMessage) {
+	body := make([]byte, len(msg.Body))
+	copy(body, msg.Body)
+	envelopeID := archivedEnvelopeID(msg)
+	archived := a.now()
+
+	a.writing.Add(1)
+	go func() {
+		defer a.writing.Done()
+		path, err := a.write(archived, envelopeID, body)
+		if err != nil {
+			a.logger.Error("failed to archive message", "err", err, "envelopeId", envelopeID)
+			return
+		}
+		a.logger.Debug("archived message", "path", path, "envelopeId", envelopeID)
+	}()
+}
+
+// Store writes the message right away and returns the path it was stored at
+func (a *MessageArchive) Store(msg *backend.ReceivedMessage) (string, error) {
+	return a.write(a.now(), archivedEnvelopeID(msg), msg.Body)
+}
+
+// archivedEnvelopeID returns the envelope id the archived message is named after, the submission id if the
+// client didn't supply one
+func archivedEnvelopeID(msg *backend.ReceivedMessage) string {
+	if msg.MailOpts != nil && msg.MailOpts.EnvelopeID != "" {
+		return msg.MailOpts.EnvelopeID
+	}
+	return msg.SubmissionID
+}
+
+// Close waits until all messages are written to the archive or ctx is done
+func (a *MessageArchive) Close(ctx context.Context) error {
+	written := make(chan struct{})
+	go func() {
+		a.writing.Wait()
+		close(written)
+	}()
+	select {
+	case <-written:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to wait for messages being archived: %w", ctx.Err())
+	}
+}
+
+// write delivers the message into the Maildir of the day. Like every Maildir delivery the message is written
+// to tmp first and moved to new once complete, so readers never see partial messages. Unique file names
+// make concurrent writes safe.
+func (a *MessageArchive) write(archived time.Time, envelopeID string, body []byte) (string, error) {
+	maildir := filepath.Join(a.dir, archived.UTC().Format(archiveDateLayout))
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(maildir, sub), archiveDirMode); err != nil {
+			return "", fmt.Errorf("failed to create maildir %s: %w", maildir, err)
+		}
+	}
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s.%s", archived.Unix(), archived.Nanosecond()/1000, os.Getpid(),
+		a.counter.Add(1), maildirSafe(envelopeID), a.hostname)
+	tmpPath := filepath.Join(maildir, "tmp", name)
+	if err := os.WriteFile(tmpPath, body, archiveFileMode); err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("failed to write archived message %s: %w", tmpPath, err)
+	}
+	newPath := filepath.Join(maildir, "new", name)
+	if err := os.Rename(tmpPath, newPath); err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("failed to move archived message to %s: %w", newPath, err)
+	}
+	return newPath, nil
+}
+
+func (a *MessageArchive) goCleanup(ctx context.Context) {
+	tick := time.NewTicker(min(a.retention, defaultArchiveCleanupDelay))
+	defer tick.Stop()
+	for {
+		if err := a.cleanup(); err != nil {
+			a.logger.Error("failed to remove expired archived messages", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// cleanup removes the Maildirs of all days which ended before the retention
+func (a *MessageArchive) cleanup() error {
+	entries, err := os.ReadDir(a.dir)
+	if err != nil {
+		return fmt.Errorf("failed to list archive directory %s: %w", a.dir, err)
+	}
+	cutoff := a.now().Add(-a.retention)
+	for _, entry := range entries {
+		day, err := time.Parse(archiveDateLayout, entry.Name())
+		if !entry.IsDir() || err != nil {
+			continue
+		}
+		if day.AddDate(0, 0, 1).After(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(a.dir, entry.Name())); err != nil {
+			return fmt.Errorf("failed to remove archived messages of %s: %w", entry.Name(), err)
+		}
+	}
+	return nil
+}
+
+// maildirSafe replaces everything but letters, digits and a few punctuation characters, as Maildir file names
+// use dots and colons as separators and envelope ids are chosen by the client
+func maildirSafe(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '@', r == '+', r == '=':
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
@@ -0,0 +1,135 @@
+package sender
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dereulenspiegel/liteq"
+	"github.com/dereulenspiegel/smolmailer/internal/backend"
+	"github.com/dereulenspiegel/smolmailer/internal/queue"
+	"github.com/dereulenspiegel/smolmailer/internal/queue/queuemocks"
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchiveSignedMessages(t *testing.T) {
+	ctx := context.Background()
+	jq, err := liteq.NewFromPath(filepath.Join(t.TempDir(), "queue.db"))
+	require.NoError(t, err)
+	rq := liteq.NewQueue[*backend.ReceivedMessage](jq, "receive", liteq.JSONMarshaler[*backend.ReceivedMessage]{})
+
+	archiveDir := t.TempDir()
+	archive, err := NewMessageArchive(ctx, slog.Default(), archiveDir, 0)
+	require.NoError(t, err)
+
+	signer := func(msg *backend.ReceivedMessage) (*backend.ReceivedMessage, error) {
+		msg.Body = append([]byte("DKIM-Signature: v=1; s=test\r\n"), msg.Body...)
+		return msg, nil
+	}
+	queued := make(chan struct{}, 1)
+	sq := queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t)
+	sq.On("Queue", mock.Anything, mock.Anything).Run(func(mock.Arguments) {
+		queued <- struct{}{}
+	}).Return(nil)
+
+	p, err := NewProcessorHandler(ctx, slog.Default(), rq,
+		WithSigningProcessors(signer),
+		WithArchive(archive),
+		WithPreSendProcessors(SendProcessor(ctx, sq)))
+	require.NoError(t, err)
+
+	require.NoError(t, rq.Put(ctx, &backend.ReceivedMessage{
+		From:     "from@example.com",
+		To:       []*backend.Rcpt{{To: "to@example.com"}},
+		Body:     []byte("Subject: Test\r\n\r\nbody\r\n"),
+		MailOpts: &smtp.MailOptions{EnvelopeID: "env/1"},
+	}))
+	select {
+	case <-queued:
+	case <-time.After(time.Second * 10):
+		t.Fatal("message was not processed")
+	}
+	require.NoError(t, p.Shutdown(ctx))
+
+	maildir := filepath.Join(archiveDir, time.Now().UTC().Format(archiveDateLayout))
+	for _, sub := range []string{"tmp", "cur"} {
+		entries, err := os.ReadDir(filepath.Join(maildir, sub))
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	}
+	entries, err := os.ReadDir(filepath.Join(maildir, "new"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Regexp(t, `^\d+\.M\d+P\d+Q1\.env_1\.[^.]+$`, entries[0].Name())
+
+	archived, err := os.ReadFile(filepath.Join(maildir, "new", entries[0].Name()))
+	require.NoError(t, err)
+	assert.Equal(t, "DKIM-Signature: v=1; s=test\r\nSubject: Test\r\n\r\nbody\r\n", string(archived))
+}
+
+func TestArchiveConcurrentWrites(t *testing.T) {
+	archive, err := NewMessageArchive(context.Background(), slog.Default(), t.TempDir(), 0)
+	require.NoError(t, err)
+
+	const messageCount = 50
+	wg := &sync.WaitGroup{}
+	for i := range messageCount {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			archive.Archive(&backend.ReceivedMessage{
+				SubmissionID: "submission",
+				Body:         []byte(fmt.Sprintf("message %d", i)),
+			})
+		}()
+	}
+	wg.Wait()
+	require.NoError(t, archive.Close(context.Background()))
+
+	entries, err := os.ReadDir(filepath.Join(archive.dir, time.Now().UTC().Format(archiveDateLayout), "new"))
+	require.NoError(t, err)
+	require.Len(t, entries, messageCount)
+	bodies := map[string]bool{}
+	for _, entry := range entries {
+		assert.True(t, strings.Contains(entry.Name(), ".submission."))
+		body, err := os.ReadFile(filepath.Join(archive.dir, time.Now().UTC().Format(archiveDateLayout), "new", entry.Name()))
+		require.NoError(t, err)
+		bodies[string(body)] = true
+	}
+	assert.Len(t, bodies, messageCount)
+}
+
+func TestArchiveRetention(t *testing.T) {
+	archive, err := NewMessageArchive(context.Background(), slog.Default(), t.TempDir(), 0)
+	require.NoError(t, err)
+	archive.retention = time.Hour * 24 * 2
+
+	for _, day := range []time.Time{
+		time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC),
+		time.Date(2025, 3, 2, 12, 0, 0, 0, time.UTC),
+		time.Date(2025, 3, 3, 12, 0, 0, 0, time.UTC),
+	} {
+		_, err := archive.write(day, "envelope", []byte("message"))
+		require.NoError(t, err)
+	}
+
+	archive.now = func() time.Time { return time.Date(2025, 3, 4, 6, 0, 0, 0, time.UTC) }
+	require.NoError(t, archive.cleanup())
+
+	entries, err := os.ReadDir(archive.dir)
+	require.NoError(t, err)
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{"2025-03-02", "2025-03-03"}, names)
+}
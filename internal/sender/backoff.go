@@ -0,0 +1,85 @@
+package sender
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+const (
+	defaultRetryDelay  = time.Minute * 5
+	defaultHostBackoff = time.Minute * 5
+	maxRetryDelayHint  = time.Hour * 6
+)
+
+// Matches hints like "try again in 5 minutes" or "retry after 300 seconds"
+var retryDelayHintRegexp = regexp.MustCompile(`(?i)(?:try\s+again|retry)\D{0,20}?(\d+)\s*(seconds?|secs?|s|minutes?|mins?|m|hours?|hrs?|h)\b`)
+
+// retryDelayHint extracts the delay a remote server suggested in a temporary failure response
+func retryDelayHint(err error) (time.Duration, bool) {
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || !smtpErr.Temporary() {
+		return 0, false
+	}
+	match := retryDelayHintRegexp.FindStringSubmatch(smtpErr.Message)
+	if match == nil {
+		return 0, false
+	}
+	value, err := strconv.Atoi(match[1])
+	if err != nil || value <= 0 {
+		return 0, false
+	}
+	unit := time.Second
+	switch strings.ToLower(match[2])[0] {
+	case 'm':
+		unit = time.Minute
+	case 'h':
+		unit = time.Hour
+	}
+	return min(time.Duration(value)*unit, maxRetryDelayHint), true
+}
+
+// isServiceUnavailable returns true if the remote server rejected us with 421, i.e. while greeting
+func isServiceUnavailable(err error) bool {
+	var smtpErr *smtp.SMTPError
+	return errors.As(err, &smtpErr) && smtpErr.Code == 421
+}
+
+// hostBackoff remembers mx hosts which asked us to stay away for some time
+type hostBackoff struct {
+	lock  *sync.Mutex
+	until map[string]time.Time
+}
+
+func newHostBackoff() *hostBackoff {
+	return &hostBackoff{
+		lock:  &sync.Mutex{},
+		until: make(map[string]time.Time),
+	}
+}
+
+func (h *hostBackoff) BackOff(host string, delay time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.until[host] = time.Now().Add(delay)
+}
+
+// BackingOff returns true if the host should not be contacted yet
+func (h *hostBackoff) BackingOff(host string) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	until, exists := h.until[host]
+	if !exists {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(h.until, host)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,152 @@
+package sender
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dereulenspiegel/liteq"
+	"github.com/dereulenspiegel/smolmailer/internal/config"
+	"github.com/dereulenspiegel/smolmailer/internal/queue"
+	"github.com/dereulenspiegel/smolmailer/internal/queue/queuemocks"
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryDelayHint(t *testing.T) {
+	for _, exp := range []struct {
+		err   error
+		delay time.Duration
+		found bool
+	}{
+		{err: &smtp.SMTPError{Code: 451, Message: "Greylisted, please try again in 7 minutes"}, delay: time.Minute * 7, found: true},
+		{err: &smtp.SMTPError{Code: 450, Message: "Mailbox busy, retry after 300 seconds"}, delay: time.Second * 300, found: true},
+		{err: &smtp.SMTPError{Code: 421, Message: "Too many connections, try again in 1h"}, delay: time.Hour, found: true},
+		{err: &smtp.SMTPError{Code: 451, Message: "Try again later in 90s"}, delay: time.Second * 90, found: true},
+		{err: &smtp.SMTPError{Code: 451, Message: "Try again in 48 hours"}, delay: maxRetryDelayHint, found: true},
+		{err: fmt.Errorf("rcpt cmd failed: %w", &smtp.SMTPError{Code: 451, Message: "try again in 2 minutes"}), delay: time.Minute * 2, found: true},
+		{err: &smtp.SMTPError{Code: 451, Message: "Temporary local problem"}, found: false},
+		{err: &smtp.SMTPError{Code: 550, Message: "No such user, do not try again in 5 minutes"}, found: false},
+		{err: errors.New("try again in 5 minutes"), found: false},
+	} {
+		delay, found := retryDelayHint(exp.err)
+		assert.Equal(t, exp.found, found, exp.err.Error())
+		assert.Equal(t, exp.delay, delay, exp.err.Error())
+	}
+}
+
+type greylistingBackend struct {
+	concurrencyBackend
+}
+
+func (b *greylistingBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &greylistingSession{concurrencySession{b: &b.concurrencyBackend}}, nil
+}
+
+type greylistingSession struct {
+	concurrencySession
+}
+
+func (s *greylistingSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Greylisted, please try again in 7 minutes",
+	}
+}
+
+func TestTemporaryFailureHonorsRetryDelayHint(t *testing.T) {
+	be := &greylistingBackend{}
+	host, port := startTestSmtpServer(t, be)
+
+	q := queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t)
+	s := newTestSender(t, &config.Config{MailDomain: "example.com"}, q, host, port)
+
+	ctx := context.WithValue(context.Background(), liteq.CtxJobCreatedAt, time.Now())
+	err := s.trySend(ctx, &queue.QueuedMessage{
+		From:     "from@example.com",
+		To:       "rcpt@example.org",
+		Body:     []byte("test"),
+		MailOpts: &smtp.MailOptions{},
+	})
+	require.Error(t, err)
+	werr := liteq.NewWorkerError(nil)
+	require.ErrorAs(t, err, &werr)
+	assert.Equal(t, time.Minute*7, werr.DelayRetry)
+	assert.Equal(t, int32(0), be.delivered.Load())
+	assert.False(t, s.hostBackoff.BackingOff(host), "a 451 for a single recipient must not back off the whole host")
+}
+
+func TestTemporaryFailureWithoutHintUsesDefaultDelay(t *testing.T) {
+	q := queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t)
+	// Nothing listens on the port, so delivery fails without any hint
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().(*net.TCPAddr)
+	listener.Close()
+	s := newTestSender(t, &config.Config{MailDomain: "example.com"}, q, addr.IP.String(), addr.Port)
+
+	ctx := context.WithValue(context.Background(), liteq.CtxJobCreatedAt, time.Now())
+	err = s.trySend(ctx, &queue.QueuedMessage{
+		From:     "from@example.com",
+		To:       "rcpt@example.org",
+		Body:     []byte("test"),
+		MailOpts: &smtp.MailOptions{},
+	})
+	require.Error(t, err)
+	werr := liteq.NewWorkerError(nil)
+	require.ErrorAs(t, err, &werr)
+	assert.Equal(t, defaultRetryDelay, werr.DelayRetry)
+}
+
+func TestUnavailableHostIsBackedOff(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	var connections atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			connections.Add(1)
+			conn.Write([]byte("421 4.7.0 mx.example.com Too many connections, try again in 3 minutes\r\n"))
+			conn.Close()
+		}
+	}()
+	addr := listener.Addr().(*net.TCPAddr)
+	host := addr.IP.String()
+
+	q := queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t)
+	s := newTestSender(t, &config.Config{MailDomain: "example.com"}, q, host, addr.Port)
+
+	msg := &queue.QueuedMessage{
+		From:     "from@example.com",
+		To:       "rcpt@example.org",
+		Body:     []byte("test"),
+		MailOpts: &smtp.MailOptions{},
+	}
+	ctx := context.WithValue(context.Background(), liteq.CtxJobCreatedAt, time.Now())
+	err = s.trySend(ctx, msg)
+	require.Error(t, err)
+	werr := liteq.NewWorkerError(nil)
+	require.ErrorAs(t, err, &werr)
+	assert.Equal(t, time.Minute*3, werr.DelayRetry)
+	assert.True(t, s.hostBackoff.BackingOff(host))
+	assert.Equal(t, int32(1), connections.Load())
+
+	// The host must not be contacted again while we are backing off
+	require.Error(t, s.trySend(ctx, msg))
+	assert.Equal(t, int32(1), connections.Load())
+
+	s.hostBackoff.BackOff(host, -time.Second)
+	assert.False(t, s.hostBackoff.BackingOff(host))
+}
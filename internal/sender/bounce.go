@@ -0,0 +1,136 @@
+package sender
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dereulenspiegel/smolmailer/internal/queue"
+	"github.com/emersion/go-smtp"
+	"github.com/google/uuid"
+)
+
+// bounceSender is the local part of the From header of bounces
+const bounceSender = "MAILER-DAEMON"
+
+// bounceStatus returns the enhanced status code (RFC 3463) reported in the bounce for deliveryErr
+func bounceStatus(deliveryErr error) smtp.EnhancedCode {
+	var smtpErr *smtp.SMTPError
+	switch {
+	case errors.Is(deliveryErr, ErrMessageExpired):
+		// Delivery time expired
+		return smtp.EnhancedCode{5, 4, 7}
+	case errors.Is(deliveryErr, ErrMalformedRecipient):
+		return smtp.EnhancedCode{5, 1, 3}
+	case errors.Is(deliveryErr, ErrRecipientDomainDenied):
+		return smtp.EnhancedCode{5, 7, 1}
+	case errors.Is(deliveryErr, ErrTLSRequired):
+		// REQUIRETLS support not available (RFC 8689 section 5)
+		return smtp.EnhancedCode{5, 7, 10}
+	case errors.As(deliveryErr, &smtpErr) && smtpErr.EnhancedCode != (smtp.EnhancedCode{}) && smtpErr.EnhancedCode != smtp.NoEnhancedCode:
+		// Bounces report permanent failures, even if the last attempt failed temporarily
+		return smtp.EnhancedCode{5, smtpErr.EnhancedCode[1], smtpErr.EnhancedCode[2]}
+	default:
+		return smtp.EnhancedCode{5, 0, 0}
+	}
+}
+
+// wantsBounce returns false for messages which must not be bounced: messages with the null sender, like
+// bounces themselves (RFC 5321 section 4.5.5), and recipients which asked not to be notified of failures
+// with DSN (RFC 3461)
+func wantsBounce(msg *queue.QueuedMessage) bool {
+	if msg.From == "" {
+		return false
+	}
+	if msg.RcptOpt == nil || len(msg.RcptOpt.Notify) == 0 {
+		return true
+	}
+	return slices.Contains(msg.RcptOpt.Notify, smtp.DSNNotifyFailure)
+}
+
+// newBounce creates the delivery status notification (RFC 3464) telling the sender of msg that it could not be
+// delivered to its recipient. The bounce is sent with the null sender from the postmaster of mailDomain and
+// contains the header of the failed message, or all of it if the sender asked for RET=FULL. Bounces of
+// REQUIRETLS messages require TLS themselves, since they contain parts of the message (RFC 8689 section 5).
+func newBounce(mailDomain, reportingMTA string, msg *queue.QueuedMessage, deliveryErr error) (*queue.QueuedMessage, error) {
+	now := time.Now()
+	body := &bytes.Buffer{}
+	report := multipart.NewWriter(body)
+	fmt.Fprintf(body, "From: Mail Delivery System <%s@%s>\r\n", bounceSender, mailDomain)
+	fmt.Fprintf(body, "To: <%s>\r\n", msg.From)
+	fmt.Fprintf(body, "Subject: Undelivered Mail Returned to Sender\r\n")
+	fmt.Fprintf(body, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(body, "Message-ID: <%s@%s>\r\n", uuid.NewString(), mailDomain)
+	fmt.Fprintf(body, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(body, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(body, "Content-Type: multipart/report; report-type=delivery-status; boundary=\"%s\"\r\n\r\n", report.Boundary())
+
+	notification, err := report.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create notification part: %w", err)
+	}
+	fmt.Fprintf(notification, "Your message could not be delivered to <%s>.\r\n\r\n%s\r\n", msg.To, deliveryErr)
+
+	deliveryStatus, err := report.CreatePart(textproto.MIMEHeader{"Content-Type": {"message/delivery-status"}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create delivery status part: %w", err)
+	}
+	fmt.Fprintf(deliveryStatus, "Reporting-MTA: dns; %s\r\n", reportingMTA)
+	if msg.MailOpts != nil && msg.MailOpts.EnvelopeID != "" {
+		fmt.Fprintf(deliveryStatus, "Original-Envelope-Id: %s\r\n", msg.MailOpts.EnvelopeID)
+	}
+	if !msg.ReceivedAt.IsZero() {
+		fmt.Fprintf(deliveryStatus, "Arrival-Date: %s\r\n", msg.ReceivedAt.Format(time.RFC1123Z))
+	}
+	fmt.Fprintf(deliveryStatus, "\r\nFinal-Recipient: rfc822; %s\r\n", msg.To)
+	if msg.RcptOpt != nil && msg.RcptOpt.OriginalRecipient != "" {
+		fmt.Fprintf(deliveryStatus, "Original-Recipient: %s; %s\r\n", msg.RcptOpt.OriginalRecipientType, msg.RcptOpt.OriginalRecipient)
+	}
+	status := bounceStatus(deliveryErr)
+	fmt.Fprintf(deliveryStatus, "Action: failed\r\nStatus: %d.%d.%d\r\n", status[0], status[1], status[2])
+	var smtpErr *smtp.SMTPError
+	if errors.As(deliveryErr, &smtpErr) {
+		fmt.Fprintf(deliveryStatus, "Diagnostic-Code: smtp; %d %s\r\n", smtpErr.Code, strings.ReplaceAll(smtpErr.Message, "\n", " "))
+	}
+	fmt.Fprintf(deliveryStatus, "Last-Attempt-Date: %s\r\n", now.Format(time.RFC1123Z))
+
+	returned, contentType := returnedContent(msg)
+	original, err := report.CreatePart(textproto.MIMEHeader{"Content-Type": {contentType}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create original message part: %w", err)
+	}
+	if _, err := original.Write(returned); err != nil {
+		return nil, fmt.Errorf("failed to write original message: %w", err)
+	}
+	if err := report.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finish bounce: %w", err)
+	}
+
+	return &queue.QueuedMessage{
+		From:         "",
+		To:           msg.From,
+		Body:         body.Bytes(),
+		SubmissionID: uuid.NewString(),
+		MailOpts:     &smtp.MailOptions{EnvelopeID: uuid.NewString(), RequireTLS: msg.RequiresTLS()},
+		RcptOpt:      &smtp.RcptOptions{},
+		ReceivedAt:   now,
+	}, nil
+}
+
+// returnedContent returns the part of the failed message returned in the bounce and its content type. Only the
+// header is returned unless the sender asked for the full message.
+func returnedContent(msg *queue.QueuedMessage) ([]byte, string) {
+	if msg.MailOpts != nil && msg.MailOpts.Return == smtp.DSNReturnFull {
+		return msg.Body, "message/rfc822"
+	}
+	header := msg.Body
+	if end := bytes.Index(header, []byte("\r\n\r\n")); end >= 0 {
+		header = header[:end+2]
+	}
+	return header, "text/rfc822-headers"
+}
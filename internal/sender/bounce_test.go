@@ -0,0 +1,161 @@
+package sender
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dereulenspiegel/liteq"
+	"github.com/dereulenspiegel/smolmailer/internal/config"
+	"github.com/dereulenspiegel/smolmailer/internal/queue"
+	"github.com/dereulenspiegel/smolmailer/internal/queue/queuemocks"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBounceIsDeliveryStatusNotification(t *testing.T) {
+	msg := &queue.QueuedMessage{
+		From:       "from@example.com",
+		To:         "unknown@example.org",
+		Body:       []byte("Subject: Hello\r\nFrom: from@example.com\r\n\r\nsecret body\r\n"),
+		MailOpts:   &smtp.MailOptions{EnvelopeID: "envelope"},
+		RcptOpt:    &smtp.RcptOptions{OriginalRecipientType: smtp.DSNAddressTypeRFC822, OriginalRecipient: "Unknown@example.org"},
+		ReceivedAt: time.Now().Add(-time.Hour),
+	}
+	deliveryErr := &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"}
+	bounce, err := newBounce("example.com", "mx.example.com", msg, deliveryErr)
+	require.NoError(t, err)
+	assert.Empty(t, bounce.From, "bounces are sent with the null sender")
+	assert.Equal(t, "from@example.com", bounce.To)
+
+	parsed, err := mail.ReadMessage(bytes.NewReader(bounce.Body))
+	require.NoError(t, err)
+	assert.Equal(t, "Mail Delivery System <MAILER-DAEMON@example.com>", parsed.Header.Get("From"))
+	assert.Equal(t, "auto-replied", parsed.Header.Get("Auto-Submitted"))
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/report", mediaType)
+	assert.Equal(t, "delivery-status", params["report-type"])
+
+	parts := map[string]string{}
+	reader := multipart.NewReader(parsed.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		content, err := io.ReadAll(part)
+		require.NoError(t, err)
+		parts[part.Header.Get("Content-Type")] = string(content)
+	}
+	require.Len(t, parts, 3)
+	assert.Contains(t, parts["text/plain; charset=utf-8"], "unknown@example.org")
+	status := parts["message/delivery-status"]
+	assert.Contains(t, status, "Reporting-MTA: dns; mx.example.com\r\n")
+	assert.Contains(t, status, "Original-Envelope-Id: envelope\r\n")
+	assert.Contains(t, status, "Final-Recipient: rfc822; unknown@example.org\r\n")
+	assert.Contains(t, status, "Original-Recipient: RFC822; Unknown@example.org\r\n")
+	assert.Contains(t, status, "Action: failed\r\nStatus: 5.1.1\r\n")
+	assert.Contains(t, status, "Diagnostic-Code: smtp; 550 No such user\r\n")
+	assert.Equal(t, "Subject: Hello\r\nFrom: from@example.com\r\n", parts["text/rfc822-headers"], "only the header is returned by default")
+
+	msg.MailOpts.Return = smtp.DSNReturnFull
+	bounce, err = newBounce("example.com", "mx.example.com", msg, deliveryErr)
+	require.NoError(t, err)
+	assert.Contains(t, string(bounce.Body), "Content-Type: message/rfc822\r\n\r\nSubject: Hello\r\nFrom: from@example.com\r\n\r\nsecret body\r\n")
+}
+
+func TestBounceStatus(t *testing.T) {
+	assert.Equal(t, smtp.EnhancedCode{5, 4, 7}, bounceStatus(ErrMessageExpired))
+	assert.Equal(t, smtp.EnhancedCode{5, 1, 3}, bounceStatus(ErrMalformedRecipient))
+	assert.Equal(t, smtp.EnhancedCode{5, 7, 10}, bounceStatus(fmt.Errorf("failed to deliver email: %w", errors.Join(ErrTLSRequired,
+		&smtp.SMTPError{Code: 421, EnhancedCode: smtp.EnhancedCode{4, 4, 2}}))))
+	assert.Equal(t, smtp.EnhancedCode{5, 2, 2}, bounceStatus(&smtp.SMTPError{Code: 452, EnhancedCode: smtp.EnhancedCode{4, 2, 2}}),
+		"the last temporary failure is reported as permanent")
+	assert.Equal(t, smtp.EnhancedCode{5, 0, 0}, bounceStatus(errors.New("connection refused")))
+}
+
+func TestWantsBounce(t *testing.T) {
+	assert.True(t, wantsBounce(&queue.QueuedMessage{From: "from@example.com"}))
+	assert.False(t, wantsBounce(&queue.QueuedMessage{From: ""}), "bounces are never bounced")
+	assert.False(t, wantsBounce(&queue.QueuedMessage{From: "from@example.com", RcptOpt: &smtp.RcptOptions{Notify: []smtp.DSNNotify{smtp.DSNNotifyNever}}}))
+	assert.False(t, wantsBounce(&queue.QueuedMessage{From: "from@example.com", RcptOpt: &smtp.RcptOptions{Notify: []smtp.DSNNotify{smtp.DSNNotifySuccess}}}))
+	assert.True(t, wantsBounce(&queue.QueuedMessage{From: "from@example.com", RcptOpt: &smtp.RcptOptions{Notify: []smtp.DSNNotify{smtp.DSNNotifyDelayed, smtp.DSNNotifyFailure}}}))
+}
+
+func TestBouncesAreDkimSigned(t *testing.T) {
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	q := queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t)
+	s := newTestSender(t, &config.Config{MailDomain: "example.com", DeniedRecipientDomains: []string{"example.org"}}, q, "127.0.0.1", 25)
+	WithBounceSigning(time.Hour, &dkim.SignOptions{
+		Domain:     "example.com",
+		Selector:   "test",
+		Signer:     privKey,
+		HeaderKeys: []string{"From", "To", "Subject"},
+	})(s)
+	var bounce *queue.QueuedMessage
+	expectBounce(q, "from@example.com").Run(func(args mock.Arguments) {
+		bounce = args.Get(1).(*queue.QueuedMessage)
+	}).Once()
+
+	require.Error(t, s.trySend(context.Background(), &queue.QueuedMessage{
+		From:     "from@example.com",
+		To:       "rcpt@example.org",
+		Body:     []byte("Subject: Test\r\n\r\nbody\r\n"),
+		MailOpts: &smtp.MailOptions{},
+	}))
+	require.NotNil(t, bounce)
+
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(bounce.Body), &dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			return []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pubKey)}, nil
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, verifications, 1)
+	assert.NoError(t, verifications[0].Err)
+	assert.Equal(t, "example.com", verifications[0].Domain, "the signature aligns with the From of the bounce")
+}
+
+func TestFailedBouncesAreDiscarded(t *testing.T) {
+	q := queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t)
+	cfg := &config.Config{MailDomain: "example.com", DeniedRecipientDomains: []string{"denied.example.org"}}
+	// Nothing listens on the port, so deliveries fail
+	s := newTestSender(t, cfg, q, "127.0.0.1", 1)
+	logs := &bytes.Buffer{}
+	s.logger = slog.New(slog.NewTextHandler(logs, nil))
+
+	failedBounce := func(to string) *queue.QueuedMessage {
+		bounce, err := newBounce("example.com", "mail.example.com", &queue.QueuedMessage{
+			From: to,
+			To:   "rcpt@example.net",
+			Body: []byte("Subject: Test\r\n\r\nbody\r\n"),
+		}, errors.New("mailbox unavailable"))
+		require.NoError(t, err)
+		return bounce
+	}
+	// Bounces rejected permanently and bounces which used up their attempts
+	lastAttempt := context.WithValue(context.Background(), liteq.CtxJobRemainingAttempts, int64(1))
+	require.Error(t, s.trySend(lastAttempt, failedBounce("sender@denied.example.org")))
+	require.Error(t, s.trySend(lastAttempt, failedBounce("sender@example.org")))
+
+	q.AssertNotCalled(t, "Queue", mock.Anything, mock.Anything, mock.Anything)
+	assert.Equal(t, 2, strings.Count(logs.String(), "discarding undeliverable message with the null sender"))
+}
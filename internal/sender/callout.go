@@ -0,0 +1,175 @@
+package sender
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dereulenspiegel/smolmailer/internal/config"
+	"github.com/emersion/go-smtp"
+)
+
+type calloutResult struct {
+	deliverable bool
+	expiresAt   time.Time
+}
+
+// CalloutVerifier verifies that envelope senders can receive bounces, by asking the MX of the sender domain
+// whether it accepts a message from the null sender to the sender address (MAIL FROM:<> followed by
+// RCPT TO:<sender>). No message is sent, so the callout doesn't need TLS. Deliverable and undeliverable
+// senders are cached separately.
+type CalloutVerifier struct {
+	cfg         *config.Config
+	timeout     time.Duration
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	dialer     contextDialer
+	mxResolver func(string) ([]*net.MX, error)
+	mxPorts    []int
+
+	lock  *sync.Mutex
+	cache map[string]calloutResult
+	now   func() time.Time
+
+	logger *slog.Logger
+}
+
+func NewCalloutVerifier(logger *slog.Logger, cfg *config.Config) *CalloutVerifier {
+	v := &CalloutVerifier{
+		cfg:         cfg,
+		timeout:     cfg.SenderCallout.Timeout,
+		ttl:         cfg.SenderCallout.CacheTTL,
+		negativeTTL: cfg.SenderCallout.NegativeCacheTTL,
+		dialer:      outboundDialer(logger, cfg, newDialer(logger, cfg.SendAddr)),
+		mxResolver:  lookupMX,
+		mxPorts:     []int{25},
+		lock:        &sync.Mutex{},
+		cache:       make(map[string]calloutResult),
+		now:         time.Now,
+		logger:      logger,
+	}
+	if cfg.TestingOpts != nil {
+		v.mxPorts = cfg.TestingOpts.MxPorts
+		v.mxResolver = cfg.TestingOpts.MxResolv
+	}
+	return v
+}
+
+// Verify returns whether the MX of the sender domain accepts bounces to the sender. Errors mean the callout
+// was inconclusive, e.g. because the MX was unreachable or answered with a temporary failure, these are
+// not cached.
+func (v *CalloutVerifier) Verify(ctx context.Context, sender string) (deliverable bool, err error) {
+	key := strings.ToLower(sender)
+	v.lock.Lock()
+	cached, exists := v.cache[key]
+	v.lock.Unlock()
+	if exists && v.now().Before(cached.expiresAt) {
+		return cached.deliverable, nil
+	}
+
+	if v.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, v.timeout)
+		defer cancel()
+	}
+	deliverable, err = v.callout(ctx, sender)
+	if err != nil {
+		return false, err
+	}
+	ttl := v.ttl
+	if !deliverable {
+		ttl = v.negativeTTL
+	}
+	if ttl > 0 {
+		v.lock.Lock()
+		v.pruneExpired()
+		v.cache[key] = calloutResult{deliverable: deliverable, expiresAt: v.now().Add(ttl)}
+		v.lock.Unlock()
+	}
+	return deliverable, nil
+}
+
+// pruneExpired must be called while holding the lock
+func (v *CalloutVerifier) pruneExpired() {
+	now := v.now()
+	for key, result := range v.cache {
+		if !now.Before(result.expiresAt) {
+			delete(v.cache, key)
+		}
+	}
+}
+
+// callout asks the MX hosts in order of preference until one gives a conclusive answer
+func (v *CalloutVerifier) callout(ctx context.Context, sender string) (bool, error) {
+	at := strings.LastIndex(sender, "@")
+	if at < 0 {
+		return false, nil
+	}
+	domain := sender[at+1:]
+	mxRecords, err := v.mxResolver(domain)
+	if err != nil {
+		return false, err
+	}
+	if len(mxRecords) == 0 {
+		// Implicit MX (RFC 5321 section 5.1)
+		mxRecords = []*net.MX{{Host: domain}}
+	}
+	errs := []error{}
+	for _, mx := range mxRecords {
+		host := strings.TrimSuffix(mx.Host, ".")
+		if host == "" {
+			// Null MX (RFC 7505), the domain does not accept any mail
+			return false, nil
+		}
+		for _, port := range v.mxPorts {
+			deliverable, err := v.calloutHost(ctx, host, port, sender)
+			if err == nil {
+				return deliverable, nil
+			}
+			v.logger.Debug("sender callout was inconclusive", "host", host, "port", port, "err", err)
+			errs = append(errs, err)
+			if ctx.Err() != nil {
+				return false, errors.Join(errs...)
+			}
+		}
+	}
+	return false, errors.Join(errs...)
+}
+
+func (v *CalloutVerifier) calloutHost(ctx context.Context, host string, port int, sender string) (bool, error) {
+	address := net.JoinHostPort(host, fmt.Sprint(port))
+	conn, err := v.dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return false, fmt.Errorf("failed to dial %s: %w", address, err)
+	}
+	nconn := newNotifyingConn(conn)
+	stop := abortOnDone(ctx, nconn)
+	defer stop()
+	c := smtp.NewClient(nconn)
+	defer c.Close()
+
+	if err := c.Hello(v.cfg.MailDomain); err != nil {
+		return false, fmt.Errorf("hello cmd failed: %w", err)
+	}
+	if err := c.Mail("", nil); err != nil {
+		return false, fmt.Errorf("mail cmd failed: %w", err)
+	}
+	err = c.Rcpt(sender, nil)
+	var smtpErr *smtp.SMTPError
+	switch {
+	case err == nil:
+		c.Quit()
+		return true, nil
+	case errors.As(err, &smtpErr) && smtpErr.Code >= 500:
+		c.Quit()
+		return false, nil
+	default:
+		return false, fmt.Errorf("rcpt cmd failed: %w", err)
+	}
+}
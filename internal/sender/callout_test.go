@@ -0,0 +1,155 @@
+package sender
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dereulenspiegel/smolmailer/internal/config"
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type calloutBackend struct {
+	callouts    atomic.Int32
+	nullSenders atomic.Int32
+	data        atomic.Int32
+}
+
+func (b *calloutBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	b.callouts.Add(1)
+	return &calloutSession{b: b}, nil
+}
+
+type calloutSession struct {
+	b *calloutBackend
+}
+
+func (s *calloutSession) Mail(from string, opts *smtp.MailOptions) error {
+	if from == "" {
+		s.b.nullSenders.Add(1)
+	}
+	return nil
+}
+
+func (s *calloutSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	switch to {
+	case "unknown@example.org":
+		return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"}
+	case "greylisted@example.org":
+		return &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 7, 1}, Message: "Try again later"}
+	}
+	return nil
+}
+
+func (s *calloutSession) Data(r io.Reader) error {
+	s.b.data.Add(1)
+	return errors.New("callouts must not send data")
+}
+
+func (s *calloutSession) Reset()        {}
+func (s *calloutSession) Logout() error { return nil }
+
+func newTestCalloutVerifier(t *testing.T, be smtp.Backend) *CalloutVerifier {
+	host, port := startTestSmtpServer(t, be)
+	return NewCalloutVerifier(slog.Default(), &config.Config{
+		MailDomain:    "example.com",
+		SenderCallout: &config.SenderCallout{Enabled: true, Timeout: time.Second * 5, CacheTTL: time.Hour, NegativeCacheTTL: time.Minute},
+		TestingOpts: &config.TestingOpts{
+			MxPorts: []int{port},
+			MxResolv: func(string) ([]*net.MX, error) {
+				return []*net.MX{{Host: host, Pref: 10}}, nil
+			},
+		},
+	})
+}
+
+func TestCalloutVerifier(t *testing.T) {
+	be := &calloutBackend{}
+	v := newTestCalloutVerifier(t, be)
+	ctx := context.Background()
+
+	deliverable, err := v.Verify(ctx, "sender@example.org")
+	require.NoError(t, err)
+	assert.True(t, deliverable)
+
+	deliverable, err = v.Verify(ctx, "unknown@example.org")
+	require.NoError(t, err)
+	assert.False(t, deliverable)
+
+	_, err = v.Verify(ctx, "greylisted@example.org")
+	assert.Error(t, err)
+
+	assert.Equal(t, int32(3), be.callouts.Load())
+	assert.Equal(t, int32(3), be.nullSenders.Load())
+	assert.Zero(t, be.data.Load())
+}
+
+func TestCalloutVerifierCachesResults(t *testing.T) {
+	be := &calloutBackend{}
+	v := newTestCalloutVerifier(t, be)
+	now := time.Now()
+	v.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for range 2 {
+		deliverable, err := v.Verify(ctx, "sender@example.org")
+		require.NoError(t, err)
+		assert.True(t, deliverable)
+		deliverable, err = v.Verify(ctx, "unknown@example.org")
+		require.NoError(t, err)
+		assert.False(t, deliverable)
+		_, err = v.Verify(ctx, "greylisted@example.org")
+		assert.Error(t, err)
+	}
+	// Inconclusive callouts are not cached
+	assert.Equal(t, int32(4), be.callouts.Load())
+
+	// The undeliverable sender expired, the deliverable one is still cached
+	now = now.Add(time.Minute * 2)
+	deliverable, err := v.Verify(ctx, "sender@example.org")
+	require.NoError(t, err)
+	assert.True(t, deliverable)
+	deliverable, err = v.Verify(ctx, "unknown@example.org")
+	require.NoError(t, err)
+	assert.False(t, deliverable)
+	assert.Equal(t, int32(5), be.callouts.Load())
+}
+
+func TestCalloutVerifierIsTimeBounded(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		// Accepts connections, but never greets
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	addr := listener.Addr().(*net.TCPAddr)
+	v := NewCalloutVerifier(slog.Default(), &config.Config{
+		MailDomain:    "example.com",
+		SenderCallout: &config.SenderCallout{Enabled: true, Timeout: time.Millisecond * 200},
+		TestingOpts: &config.TestingOpts{
+			MxPorts: []int{addr.Port},
+			MxResolv: func(string) ([]*net.MX, error) {
+				return []*net.MX{{Host: addr.IP.String(), Pref: 10}}, nil
+			},
+		},
+	})
+
+	start := time.Now()
+	_, err = v.Verify(context.Background(), "sender@example.org")
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), time.Second*2)
+}
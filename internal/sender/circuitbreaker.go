@@ -0,0 +1,112 @@
+package sender
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+type circuitState struct {
+	failures int
+	// openUntil is zero while the circuit is closed
+	openUntil time.Time
+}
+
+// hostCircuitBreaker stops contacting mx hosts which failed a number of times in a row. Once the cooldown
+// passed, a single attempt is let through to retest the host (half-open). The circuit closes again if it
+// succeeds, otherwise the host is skipped for another cooldown. A threshold of 0 or less disables it.
+type hostCircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	lock  *sync.Mutex
+	hosts map[string]*circuitState
+	now   func() time.Time
+}
+
+func newHostCircuitBreaker(threshold int, cooldown time.Duration) *hostCircuitBreaker {
+	return &hostCircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		lock:      &sync.Mutex{},
+		hosts:     make(map[string]*circuitState),
+		now:       time.Now,
+	}
+}
+
+// Allow returns true if the host may be contacted. Letting the retest of a half-open circuit through
+// keeps the circuit open for another cooldown, so concurrent deliveries don't pile onto the host and a
+// retest which never reports back doesn't leave the host skipped forever.
+func (b *hostCircuitBreaker) Allow(host string) bool {
+	if b.threshold <= 0 {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	state, exists := b.hosts[host]
+	if !exists || state.openUntil.IsZero() {
+		return true
+	}
+	now := b.now()
+	if now.Before(state.openUntil) {
+		return false
+	}
+	state.openUntil = now.Add(b.cooldown)
+	return true
+}
+
+// Success closes the circuit of the host
+func (b *hostCircuitBreaker) Success(host string) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.hosts, host)
+}
+
+// Failure opens the circuit of the host once it failed threshold times in a row
+func (b *hostCircuitBreaker) Failure(host string) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	state, exists := b.hosts[host]
+	if !exists {
+		state = &circuitState{}
+		b.hosts[host] = state
+	}
+	state.failures++
+	if state.failures >= b.threshold {
+		state.openUntil = b.now().Add(b.cooldown)
+	}
+}
+
+// isHostFailure returns true if err shows the host is not working, i.e. it couldn't be reached, dropped the
+// connection or closed the transmission channel with 421
+func isHostFailure(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || isServiceUnavailable(err)
+}
+
+// recordHostHealth feeds the outcome of contacting host into its circuit breaker. Every other SMTP reply
+// proves the host is working, even if it rejected the message. Outcomes of aborted deliveries say nothing
+// about the host and are ignored, just like failures unrelated to the host's health.
+func (s *Sender) recordHostHealth(ctx context.Context, host string, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	var smtpErr *smtp.SMTPError
+	switch {
+	case isHostFailure(err):
+		s.circuitBreaker.Failure(host)
+	case err == nil || errors.As(err, &smtpErr):
+		s.circuitBreaker.Success(host)
+	}
+}
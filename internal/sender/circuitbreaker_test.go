@@ -0,0 +1,108 @@
+package sender
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dereulenspiegel/smolmailer/internal/config"
+	"github.com/dereulenspiegel/smolmailer/internal/queue"
+	"github.com/dereulenspiegel/smolmailer/internal/queue/queuemocks"
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostCircuitBreaker(t *testing.T) {
+	b := newHostCircuitBreaker(2, time.Minute)
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	b.Failure("mx.example.com")
+	assert.True(t, b.Allow("mx.example.com"))
+	b.Failure("mx.example.com")
+	assert.False(t, b.Allow("mx.example.com"))
+	assert.True(t, b.Allow("mx2.example.com"))
+
+	// Only a single retest is let through once the cooldown passed
+	now = now.Add(time.Minute * 2)
+	assert.True(t, b.Allow("mx.example.com"))
+	assert.False(t, b.Allow("mx.example.com"))
+	b.Failure("mx.example.com")
+	assert.False(t, b.Allow("mx.example.com"))
+
+	now = now.Add(time.Minute * 2)
+	assert.True(t, b.Allow("mx.example.com"))
+	b.Success("mx.example.com")
+	assert.True(t, b.Allow("mx.example.com"))
+	b.Failure("mx.example.com")
+	assert.True(t, b.Allow("mx.example.com"), "failures before the success must not count")
+
+	disabled := newHostCircuitBreaker(0, time.Minute)
+	for range 10 {
+		disabled.Failure("mx.example.com")
+	}
+	assert.True(t, disabled.Allow("mx.example.com"))
+}
+
+func TestIsHostFailure(t *testing.T) {
+	assert.True(t, isHostFailure(&net.OpError{Op: "dial", Err: errors.New("connection refused")}))
+	assert.True(t, isHostFailure(io.EOF))
+	assert.True(t, isHostFailure(&smtp.SMTPError{Code: 421, Message: "Service not available"}))
+	assert.False(t, isHostFailure(&smtp.SMTPError{Code: 550, Message: "No such user"}))
+	assert.False(t, isHostFailure(errors.New("connection is not TLS secured")))
+}
+
+func TestSendMailShortCircuitsFailingHosts(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	var connections atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			connections.Add(1)
+			conn.Close()
+		}
+	}()
+	addr := listener.Addr().(*net.TCPAddr)
+
+	s := newTestSender(t, &config.Config{MailDomain: "example.com", CircuitBreakerThreshold: 2, CircuitBreakerCooldown: time.Minute},
+		queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t), addr.IP.String(), addr.Port)
+	now := time.Now()
+	s.circuitBreaker.now = func() time.Time { return now }
+	send := func() error {
+		return s.sendMail(context.Background(), &queue.QueuedMessage{
+			From:     "from@example.com",
+			To:       "rcpt@example.org",
+			Body:     []byte("test"),
+			MailOpts: &smtp.MailOptions{},
+		})
+	}
+
+	for range 2 {
+		require.Error(t, send())
+	}
+	assert.Equal(t, int32(2), connections.Load())
+
+	started := time.Now()
+	err = send()
+	require.Error(t, err)
+	assert.ErrorContains(t, err, "circuit")
+	assert.Less(t, time.Since(started), time.Millisecond*100)
+	assert.Equal(t, int32(2), connections.Load(), "the open circuit must skip the host")
+
+	// The retest after the cooldown fails, so the circuit opens again
+	now = now.Add(time.Minute * 2)
+	require.Error(t, send())
+	assert.Equal(t, int32(3), connections.Load())
+	require.Error(t, send())
+	assert.Equal(t, int32(3), connections.Load())
+}
@@ -0,0 +1,259 @@
+package sender
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/dereulenspiegel/smolmailer/internal/backend"
+	"github.com/dereulenspiegel/smolmailer/internal/config"
+)
+
+// Headers added to tagged messages. Headers of the same names set by the client are removed, so they can't
+// pretend to be scanned.
+const (
+	spamFlagHeader   = "X-Spam-Flag"
+	spamStatusHeader = "X-Spam-Status"
+)
+
+// clamdChunkSize is the size of the chunks messages are streamed to clamd in
+const clamdChunkSize = 64 * 1024
+
+// ScanVerdict is the result of scanning a message
+type ScanVerdict struct {
+	// Spam is set if the message is spam or infected
+	Spam bool
+	// Score is the spam score of scanners rating messages, e.g. rspamd
+	Score float64
+	// Reason describes the finding, e.g. the name of the virus or the rspamd action
+	Reason string
+}
+
+func (v *ScanVerdict) String() string {
+	status := "No"
+	if v.Spam {
+		status = "Yes"
+	}
+	if v.Reason == "" {
+		return fmt.Sprintf("%s, score=%.2f", status, v.Score)
+	}
+	return fmt.Sprintf("%s, score=%.2f reason=%q", status, v.Score, v.Reason)
+}
+
+// ContentScanner scans messages for spam or viruses
+type ContentScanner interface {
+	Scan(ctx context.Context, msg *backend.ReceivedMessage) (*ScanVerdict, error)
+}
+
+// NewContentScanner creates the client of the configured scanner
+func NewContentScanner(cfg *config.ContentScan) (ContentScanner, error) {
+	scannerUrl, err := url.Parse(cfg.Url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid content scanner url: %w", err)
+	}
+	switch cfg.Scanner {
+	case config.ContentScannerRspamd:
+		return &rspamdScanner{
+			url:       scannerUrl.JoinPath("checkv2").String(),
+			password:  cfg.Password,
+			threshold: cfg.Threshold,
+			client:    &http.Client{},
+		}, nil
+	case config.ContentScannerClamAV:
+		address := scannerUrl.Host
+		if scannerUrl.Scheme == "unix" {
+			address = scannerUrl.Path
+		}
+		return &clamdScanner{network: scannerUrl.Scheme, address: address, dialer: &net.Dialer{}}, nil
+	default:
+		return nil, fmt.Errorf("unknown content scanner '%s'", cfg.Scanner)
+	}
+}
+
+// ContentScanProcessor scans every message and rejects, quarantines or tags it, if it is spam or infected.
+// Scanning is limited by the timeout of the config. Failed scans either let the message pass unscanned or fail
+// processing, so it is scanned again later. Quarantined messages are stored in the quarantine. It must run
+// before the DKIM signers so the headers of tagged messages are covered by the signature.
+func ContentScanProcessor(ctx context.Context, logger *slog.Logger, scanner ContentScanner, cfg *config.ContentScan, quarantine *MessageArchive) ReceiveProcessor {
+	return func(msg *backend.ReceivedMessage) (*backend.ReceivedMessage, error) {
+		logger := logger.With("submissionId", msg.SubmissionID, "from", msg.From)
+		scanCtx := ctx
+		if cfg.Timeout > 0 {
+			var cancel context.CancelFunc
+			scanCtx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+			defer cancel()
+		}
+		verdict, err := scanner.Scan(scanCtx, msg)
+		if err != nil {
+			if cfg.FailOpen {
+				logger.Warn("failed to scan message, delivering it unscanned", "err", err)
+				return msg, nil
+			}
+			return msg, fmt.Errorf("failed to scan message: %w", err)
+		}
+		logger = logger.With("verdict", verdict.String())
+
+		switch {
+		case cfg.Action == config.ContentScanActionTag:
+			msg.Body = removeHeader(removeHeader(msg.Body, spamFlagHeader), spamStatusHeader)
+			flag := "NO"
+			if verdict.Spam {
+				flag = "YES"
+				logger.Warn("content scan found spam, tagging message")
+			}
+			msg.Body = append([]byte(fmt.Sprintf("%s: %s\r\n%s: %s\r\n", spamFlagHeader, flag, spamStatusHeader, verdict)), msg.Body...)
+			return msg, nil
+		case !verdict.Spam:
+			return msg, nil
+		case cfg.Action == config.ContentScanActionQuarantine:
+			path, err := quarantine.Store(msg)
+			if err != nil {
+				return msg, fmt.Errorf("failed to quarantine message: %w", err)
+			}
+			logger.Warn("content scan found spam, quarantined message", "path", path)
+			return msg, fmt.Errorf("%w: quarantined by content scan (%s)", ErrMessageDiscarded, verdict)
+		default:
+			logger.Warn("content scan found spam, rejecting message")
+			return msg, fmt.Errorf("%w: rejected by content scan (%s)", ErrMessageDiscarded, verdict)
+		}
+	}
+}
+
+// rspamdScanner submits messages to the rspamd HTTP API. Messages with a score at or above the threshold are spam.
+type rspamdScanner struct {
+	url       string
+	password  string
+	threshold float64
+	client    *http.Client
+}
+
+type rspamdResult struct {
+	Score  float64 `json:"score"`
+	Action string  `json:"action"`
+}
+
+func (r *rspamdScanner) Scan(ctx context.Context, msg *backend.ReceivedMessage) (*ScanVerdict, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(msg.Body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create rspamd request: %w", err)
+	}
+	if r.password != "" {
+		req.Header.Set("Password", r.password)
+	}
+	req.Header.Set("From", msg.From)
+	for _, rcpt := range msg.To {
+		req.Header.Add("Rcpt", rcpt.To)
+	}
+	if msg.AuthUser != "" {
+		req.Header.Set("User", msg.AuthUser)
+	}
+	if msg.SubmissionID != "" {
+		req.Header.Set("Queue-Id", msg.SubmissionID)
+	}
+	if msg.Received != nil {
+		req.Header.Set("Helo", msg.Received.Helo)
+		if host, _, err := net.SplitHostPort(msg.Received.RemoteAddr); err == nil {
+			req.Header.Set("IP", host)
+		}
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to submit message to rspamd: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rspamd failed to scan message: %s", resp.Status)
+	}
+	result := &rspamdResult{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, fmt.Errorf("failed to decode rspamd result: %w", err)
+	}
+	return &ScanVerdict{
+		Spam:   result.Score >= r.threshold,
+		Score:  result.Score,
+		Reason: result.Action,
+	}, nil
+}
+
+// clamdScanner streams messages to clamd with the INSTREAM command. Messages with a virus found are infected.
+type clamdScanner struct {
+	network string
+	address string
+	dialer  *net.Dialer
+}
+
+func (c *clamdScanner) Scan(ctx context.Context, msg *backend.ReceivedMessage) (*ScanVerdict, error) {
+	conn, err := c.dialer.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to clamd: %w", err)
+	}
+	defer conn.Close()
+	stop := abortOnDone(ctx, conn)
+	defer stop()
+
+	reply, err := clamdInstream(conn, msg.Body)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = errors.Join(ctxErr, err)
+		}
+		return nil, fmt.Errorf("failed to scan message with clamd: %w", err)
+	}
+	return parseClamdReply(reply)
+}
+
+// clamdInstream sends the body in chunks prefixed with their length, terminated by an empty chunk, and
+// returns the reply of clamd
+func clamdInstream(conn net.Conn, body []byte) (string, error) {
+	writer := bufio.NewWriter(conn)
+	if _, err := writer.WriteString("zINSTREAM\x00"); err != nil {
+		return "", err
+	}
+	length := make([]byte, 4)
+	for len(body) > 0 {
+		chunk := body[:min(len(body), clamdChunkSize)]
+		body = body[len(chunk):]
+		binary.BigEndian.PutUint32(length, uint32(len(chunk)))
+		if _, err := writer.Write(length); err != nil {
+			return "", err
+		}
+		if _, err := writer.Write(chunk); err != nil {
+			return "", err
+		}
+	}
+	binary.BigEndian.PutUint32(length, 0)
+	if _, err := writer.Write(length); err != nil {
+		return "", err
+	}
+	if err := writer.Flush(); err != nil {
+		return "", err
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !(errors.Is(err, io.EOF) && reply != "") {
+		return "", err
+	}
+	return strings.TrimRight(reply, "\x00\n"), nil
+}
+
+// parseClamdReply interprets replies like "stream: OK" or "stream: Eicar-Signature FOUND"
+func parseClamdReply(reply string) (*ScanVerdict, error) {
+	result := strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+	switch {
+	case result == "OK":
+		return &ScanVerdict{}, nil
+	case strings.HasSuffix(result, " FOUND"):
+		return &ScanVerdict{Spam: true, Reason: strings.TrimSuffix(result, " FOUND")}, nil
+	default:
+		return nil, fmt.Errorf("clamd failed to scan message: %s", reply)
+	}
+}
@@ -0,0 +1,254 @@
+package sender
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dereulenspiegel/smolmailer/internal/backend"
+	"github.com/dereulenspiegel/smolmailer/internal/config"
+	"github.com/dereulenspiegel/smolmailer/internal/queue"
+	"github.com/dereulenspiegel/smolmailer/internal/queue/queuemocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// eicar is the start of the EICAR anti virus test file, the stub clamd reports every message containing it
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// startStubClamd answers INSTREAM commands like clamd, messages containing the EICAR test file are infected
+func startStubClamd(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				if command, err := reader.ReadString(0); err != nil || command != "zINSTREAM\x00" {
+					return
+				}
+				body := &bytes.Buffer{}
+				for {
+					var length uint32
+					if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+						return
+					}
+					if length == 0 {
+						break
+					}
+					if _, err := io.CopyN(body, reader, int64(length)); err != nil {
+						return
+					}
+				}
+				if bytes.Contains(body.Bytes(), []byte("EICAR-STANDARD-ANTIVIRUS-TEST-FILE")) {
+					io.WriteString(conn, "stream: Eicar-Signature FOUND\x00")
+					return
+				}
+				io.WriteString(conn, "stream: OK\x00")
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func testScannedMessage(body string) *backend.ReceivedMessage {
+	return &backend.ReceivedMessage{
+		From:         "from@example.com",
+		To:           []*backend.Rcpt{{To: "to@example.org"}, {To: "cc@example.org"}},
+		Body:         []byte(body),
+		AuthUser:     "sender",
+		SubmissionID: "2c9a1f0e",
+		Received:     &backend.ReceivedInfo{Helo: "client.example.com", RemoteAddr: "192.0.2.10:50000"},
+	}
+}
+
+func TestClamdScanner(t *testing.T) {
+	scanner, err := NewContentScanner(&config.ContentScan{Scanner: config.ContentScannerClamAV, Url: "tcp://" + startStubClamd(t)})
+	require.NoError(t, err)
+
+	verdict, err := scanner.Scan(context.Background(), testScannedMessage("Subject: clean\r\n\r\nhello\r\n"))
+	require.NoError(t, err)
+	assert.False(t, verdict.Spam)
+
+	// Larger than a single chunk, so the virus is split across chunks
+	infected := "Subject: infected\r\n\r\n" + string(bytes.Repeat([]byte("a"), clamdChunkSize-40)) + eicar + "\r\n"
+	verdict, err = scanner.Scan(context.Background(), testScannedMessage(infected))
+	require.NoError(t, err)
+	assert.True(t, verdict.Spam)
+	assert.Equal(t, "Eicar-Signature", verdict.Reason)
+}
+
+func TestRspamdScanner(t *testing.T) {
+	requests := make(chan *http.Request, 2)
+	rspamd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		body, _ := io.ReadAll(r.Body)
+		result := rspamdResult{Score: 1.5, Action: "no action"}
+		if bytes.Contains(body, []byte("cheap pills")) {
+			result = rspamdResult{Score: 12.3, Action: "reject"}
+		}
+		json.NewEncoder(w).Encode(result)
+	}))
+	defer rspamd.Close()
+
+	scanner, err := NewContentScanner(&config.ContentScan{Scanner: config.ContentScannerRspamd, Url: rspamd.URL, Password: "secret", Threshold: 6})
+	require.NoError(t, err)
+
+	verdict, err := scanner.Scan(context.Background(), testScannedMessage("Subject: hello\r\n\r\nhello\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, &ScanVerdict{Score: 1.5, Reason: "no action"}, verdict)
+	req := <-requests
+	assert.Equal(t, "/checkv2", req.URL.Path)
+	assert.Equal(t, "secret", req.Header.Get("Password"))
+	assert.Equal(t, "from@example.com", req.Header.Get("From"))
+	assert.Equal(t, []string{"to@example.org", "cc@example.org"}, req.Header.Values("Rcpt"))
+	assert.Equal(t, "192.0.2.10", req.Header.Get("IP"))
+	assert.Equal(t, "client.example.com", req.Header.Get("Helo"))
+	assert.Equal(t, "sender", req.Header.Get("User"))
+
+	verdict, err = scanner.Scan(context.Background(), testScannedMessage("Subject: offer\r\n\r\ncheap pills\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, &ScanVerdict{Spam: true, Score: 12.3, Reason: "reject"}, verdict)
+}
+
+type stubScanner func(ctx context.Context, msg *backend.ReceivedMessage) (*ScanVerdict, error)
+
+func (s stubScanner) Scan(ctx context.Context, msg *backend.ReceivedMessage) (*ScanVerdict, error) {
+	return s(ctx, msg)
+}
+
+func verdictScanner(verdict *ScanVerdict) ContentScanner {
+	return stubScanner(func(context.Context, *backend.ReceivedMessage) (*ScanVerdict, error) {
+		return verdict, nil
+	})
+}
+
+func TestContentScanProcessorTagsMessages(t *testing.T) {
+	cfg := &config.ContentScan{Action: config.ContentScanActionTag}
+
+	process := ContentScanProcessor(context.Background(), slog.Default(), verdictScanner(&ScanVerdict{Score: 1.5}), cfg, nil)
+	msg, err := process(testScannedMessage("X-Spam-Flag: NO\r\nSubject: clean\r\n\r\nhello\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "X-Spam-Flag: NO\r\nX-Spam-Status: No, score=1.50\r\nSubject: clean\r\n\r\nhello\r\n", string(msg.Body))
+
+	process = ContentScanProcessor(context.Background(), slog.Default(), verdictScanner(&ScanVerdict{Spam: true, Reason: "Eicar-Signature"}), cfg, nil)
+	msg, err = process(testScannedMessage("Subject: infected\r\n\r\nhello\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "X-Spam-Flag: YES\r\nX-Spam-Status: Yes, score=0.00 reason=\"Eicar-Signature\"\r\nSubject: infected\r\n\r\nhello\r\n", string(msg.Body))
+}
+
+func TestContentScanProcessorRejectsAndQuarantines(t *testing.T) {
+	infected := &ScanVerdict{Spam: true, Reason: "Eicar-Signature"}
+
+	process := ContentScanProcessor(context.Background(), slog.Default(), verdictScanner(infected),
+		&config.ContentScan{Action: config.ContentScanActionReject}, nil)
+	_, err := process(testScannedMessage("Subject: infected\r\n\r\nhello\r\n"))
+	assert.ErrorIs(t, err, ErrMessageDiscarded)
+
+	quarantineDir := t.TempDir()
+	quarantine, err := NewMessageArchive(context.Background(), slog.Default(), quarantineDir, 0)
+	require.NoError(t, err)
+	cfg := &config.ContentScan{Action: config.ContentScanActionQuarantine}
+
+	process = ContentScanProcessor(context.Background(), slog.Default(), verdictScanner(&ScanVerdict{}), cfg, quarantine)
+	msg, err := process(testScannedMessage("Subject: clean\r\n\r\nhello\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "Subject: clean\r\n\r\nhello\r\n", string(msg.Body), "clean messages are not tagged")
+
+	process = ContentScanProcessor(context.Background(), slog.Default(), verdictScanner(infected), cfg, quarantine)
+	_, err = process(testScannedMessage("Subject: infected\r\n\r\nhello\r\n"))
+	assert.ErrorIs(t, err, ErrMessageDiscarded)
+	quarantined, err := filepath.Glob(filepath.Join(quarantineDir, "*", "new", "*"))
+	require.NoError(t, err)
+	require.Len(t, quarantined, 1)
+	body, err := os.ReadFile(quarantined[0])
+	require.NoError(t, err)
+	assert.Equal(t, "Subject: infected\r\n\r\nhello\r\n", string(body))
+}
+
+func TestContentScanProcessorFailure(t *testing.T) {
+	// The scanner hangs until the scan times out
+	hanging := stubScanner(func(ctx context.Context, msg *backend.ReceivedMessage) (*ScanVerdict, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	cfg := &config.ContentScan{Action: config.ContentScanActionReject, Timeout: time.Millisecond * 50}
+
+	_, err := ContentScanProcessor(context.Background(), slog.Default(), hanging, cfg, nil)(testScannedMessage("Subject: test\r\n\r\nhello\r\n"))
+	require.Error(t, err, "fails closed by default")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.False(t, errors.Is(err, ErrMessageDiscarded), "unscanned messages are scanned again later")
+
+	cfg.FailOpen = true
+	msg, err := ContentScanProcessor(context.Background(), slog.Default(), hanging, cfg, nil)(testScannedMessage("Subject: test\r\n\r\nhello\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "Subject: test\r\n\r\nhello\r\n", string(msg.Body))
+}
+
+func TestDiscardedMessagesAreNotQueued(t *testing.T) {
+	ctx := context.Background()
+	bodyFile := filepath.Join(t.TempDir(), "body.eml")
+	require.NoError(t, os.WriteFile(bodyFile, []byte("Subject: infected\r\n\r\n"+eicar+"\r\n"), 0600))
+
+	rq := queuemocks.NewGenericWorkQueueMock[*backend.ReceivedMessage](t)
+	rq.On("Consume", mock.Anything, mock.Anything, mock.Anything).Return(nil).Maybe()
+	sq := queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t)
+
+	db, err := queue.OpenDB(filepath.Join(t.TempDir(), "status.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	tracker, err := queue.NewDeliveryTracker(db)
+	require.NoError(t, err)
+	logs := &bytes.Buffer{}
+
+	scanner, err := NewContentScanner(&config.ContentScan{Scanner: config.ContentScannerClamAV, Url: "tcp://" + startStubClamd(t)})
+	require.NoError(t, err)
+	p, err := NewProcessorHandler(ctx, slog.New(slog.NewJSONHandler(logs, nil)), rq,
+		WithReceiveProcessors(ContentScanProcessor(ctx, slog.Default(), scanner, &config.ContentScan{Action: config.ContentScanActionReject}, nil)),
+		WithPreSendProcessors(SendProcessor(ctx, sq)),
+		WithDiscardTracking(tracker))
+	require.NoError(t, err)
+	defer p.Shutdown(ctx)
+
+	require.NoError(t, p.consumeReceivingQueue(ctx, &backend.ReceivedMessage{
+		SubmissionID: "submission",
+		From:         "from@example.com",
+		To:           []*backend.Rcpt{{To: "one@example.com"}, {To: "two@example.com"}},
+		BodyFile:     bodyFile,
+	}), "discarded messages are not processed again")
+	sq.AssertNotCalled(t, "Queue", mock.Anything, mock.Anything)
+	assert.NoFileExists(t, bodyFile)
+
+	// The client got a 250 already, so the submitter must learn about the discarded message from its status
+	status, err := tracker.Submission(ctx, "submission")
+	require.NoError(t, err)
+	require.Len(t, status.Recipients, 2)
+	assert.Equal(t, 2, status.Count(queue.DeliveryStatusFailed))
+	assert.Contains(t, status.Recipients[0].LastError, "rejected by content scan")
+	entries := accessLogEntries(t, logs)
+	require.Len(t, entries, 2)
+	for _, entry := range entries {
+		assert.Equal(t, AccessEventBounced, entry.Event)
+	}
+}
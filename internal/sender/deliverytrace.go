@@ -0,0 +1,112 @@
+package sender
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"strconv"
+	"sync"
+)
+
+// Stages of the delivery decision path recorded in a deliveryTrace
+const (
+	traceStageMx        = "mx"
+	traceStageSkip      = "skip"
+	traceStageDial      = "dial"
+	traceStageConnected = "connected"
+	traceStageDialog    = "dialog"
+)
+
+// Dial strategies which are tried for every port of a mx host
+const (
+	dialModeStartTLS = "starttls"
+	dialModeTLS      = "tls"
+	dialModePlain    = "plain"
+)
+
+// deliveryStep is a single decision made while delivering a message
+type deliveryStep struct {
+	Stage      string
+	Host       string
+	Port       int
+	Mode       string
+	TLSVersion string
+	TLSCipher  string
+	Detail     string
+	Err        string
+}
+
+func (d deliveryStep) LogValue() slog.Value {
+	attrs := []slog.Attr{slog.String("stage", d.Stage)}
+	if d.Host != "" {
+		attrs = append(attrs, slog.String("host", d.Host))
+	}
+	if d.Port != 0 {
+		attrs = append(attrs, slog.Int("port", d.Port))
+	}
+	if d.Mode != "" {
+		attrs = append(attrs, slog.String("mode", d.Mode))
+	}
+	if d.TLSVersion != "" {
+		attrs = append(attrs, slog.String("tlsVersion", d.TLSVersion), slog.String("tlsCipher", d.TLSCipher))
+	}
+	if d.Detail != "" {
+		attrs = append(attrs, slog.String("detail", d.Detail))
+	}
+	if d.Err != "" {
+		attrs = append(attrs, slog.String("err", d.Err))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// deliveryTrace collects the decision path of a delivery attempt, so it can be logged as a single entry.
+// Dial strategies are tried in parallel, so steps may be recorded concurrently.
+type deliveryTrace struct {
+	lock  *sync.Mutex
+	steps []deliveryStep
+}
+
+type deliveryTraceKey struct{}
+
+func withDeliveryTrace(ctx context.Context) (context.Context, *deliveryTrace) {
+	trace := &deliveryTrace{lock: &sync.Mutex{}}
+	return context.WithValue(ctx, deliveryTraceKey{}, trace), trace
+}
+
+// traceStep records the step in the delivery trace of ctx, if the delivery is traced
+func traceStep(ctx context.Context, step deliveryStep) {
+	trace, ok := ctx.Value(deliveryTraceKey{}).(*deliveryTrace)
+	if !ok {
+		return
+	}
+	trace.lock.Lock()
+	defer trace.lock.Unlock()
+	trace.steps = append(trace.steps, step)
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// traceConnected records the dial strategy which succeeded together with the negotiated TLS parameters
+func traceConnected(ctx context.Context, c *mxClient) {
+	step := deliveryStep{Stage: traceStageConnected, Host: c.host, Port: c.port, Mode: c.mode}
+	if state, isTLS := c.TLSConnectionState(); isTLS {
+		step.TLSVersion = tls.VersionName(state.Version)
+		step.TLSCipher = tls.CipherSuiteName(state.CipherSuite)
+	}
+	traceStep(ctx, step)
+}
+
+func (d *deliveryTrace) LogValue() slog.Value {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	attrs := make([]slog.Attr, 0, len(d.steps))
+	for i, step := range d.steps {
+		attrs = append(attrs, slog.Any(strconv.Itoa(i), step))
+	}
+	return slog.GroupValue(attrs...)
+}
@@ -0,0 +1,134 @@
+package sender
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dereulenspiegel/smolmailer/internal/queue"
+	"github.com/emersion/go-smtp"
+)
+
+const deliveryWebhookTimeout = time.Second * 10
+
+// ReasonCode is the machine readable reason of a delivery event
+type ReasonCode string
+
+const (
+	// ReasonDelivered means the remote server accepted the message
+	ReasonDelivered ReasonCode = "delivered"
+	// ReasonHardBounce means the remote server rejected the message permanently (5xx)
+	ReasonHardBounce ReasonCode = "hard_bounce"
+	// ReasonSoftBounce means the remote server rejected the message temporarily (4xx)
+	ReasonSoftBounce ReasonCode = "soft_bounce"
+	// ReasonConnectionFailed means no remote server could be resolved or reached
+	ReasonConnectionFailed ReasonCode = "connection_failed"
+	// ReasonTLSRequired means the message requires TLS, but no remote server offered it
+	ReasonTLSRequired ReasonCode = "tls_required"
+	// ReasonRecipientDomainDenied means delivery to the recipient domain is not permitted by the configuration
+	ReasonRecipientDomainDenied ReasonCode = "recipient_domain_denied"
+	// ReasonMalformedRecipient means the recipient address has no domain to deliver to
+	ReasonMalformedRecipient ReasonCode = "malformed_recipient"
+	// ReasonExpired means the message exceeded the maximum queue age
+	ReasonExpired ReasonCode = "expired"
+	// ReasonSmarthostAuthRejected means the smarthost rejected our credentials
+	ReasonSmarthostAuthRejected ReasonCode = "smarthost_auth_rejected"
+)
+
+// reasonCodeFor categorizes the outcome of a delivery attempt
+func reasonCodeFor(deliveryErr error) ReasonCode {
+	var smtpErr *smtp.SMTPError
+	switch {
+	case deliveryErr == nil:
+		return ReasonDelivered
+	case errors.Is(deliveryErr, ErrMessageExpired):
+		return ReasonExpired
+	case errors.Is(deliveryErr, ErrRecipientDomainDenied):
+		return ReasonRecipientDomainDenied
+	case errors.Is(deliveryErr, ErrMalformedRecipient):
+		return ReasonMalformedRecipient
+	case errors.Is(deliveryErr, ErrTLSRequired):
+		return ReasonTLSRequired
+	case errors.Is(deliveryErr, ErrSmarthostAuthRejected):
+		return ReasonSmarthostAuthRejected
+	case errors.As(deliveryErr, &smtpErr) && smtpErr.Temporary():
+		return ReasonSoftBounce
+	case errors.As(deliveryErr, &smtpErr) && smtpErr.Code >= 500:
+		return ReasonHardBounce
+	default:
+		return ReasonConnectionFailed
+	}
+}
+
+type deliveryEvent struct {
+	SubmissionID string               `json:"submissionId"`
+	From         string               `json:"from"`
+	To           string               `json:"to"`
+	Status       queue.DeliveryStatus `json:"status"`
+	ReasonCode   ReasonCode           `json:"reasonCode"`
+	Reason       string               `json:"reason,omitempty"`
+	SmtpCode     int                  `json:"smtpCode,omitempty"`
+	EnhancedCode string               `json:"enhancedCode,omitempty"`
+	Time         time.Time            `json:"time"`
+}
+
+func newDeliveryEvent(msg *queue.QueuedMessage, status queue.DeliveryStatus, deliveryErr error) *deliveryEvent {
+	event := &deliveryEvent{
+		SubmissionID: msg.SubmissionID,
+		From:         msg.From,
+		To:           msg.To,
+		Status:       status,
+		ReasonCode:   reasonCodeFor(deliveryErr),
+		Time:         time.Now(),
+	}
+	if deliveryErr != nil {
+		event.Reason = deliveryErr.Error()
+	}
+	var smtpErr *smtp.SMTPError
+	if errors.As(deliveryErr, &smtpErr) {
+		event.SmtpCode = smtpErr.Code
+		if smtpErr.EnhancedCode != (smtp.EnhancedCode{}) && smtpErr.EnhancedCode != smtp.NoEnhancedCode {
+			event.EnhancedCode = fmt.Sprintf("%d.%d.%d", smtpErr.EnhancedCode[0], smtpErr.EnhancedCode[1], smtpErr.EnhancedCode[2])
+		}
+	}
+	return event
+}
+
+// notifyDelivery posts the delivery event to the configured delivery webhook
+func (s *Sender) notifyDelivery(ctx context.Context, msg *queue.QueuedMessage, status queue.DeliveryStatus, deliveryErr error) {
+	if s.cfg.DeliveryWebhook == "" {
+		return
+	}
+	event := newDeliveryEvent(msg, status, deliveryErr)
+	if err := s.sendDeliveryEvent(ctx, event); err != nil {
+		s.logger.Error("failed to send delivery event", "err", err, "webhook", s.cfg.DeliveryWebhook,
+			"to", msg.To, "reasonCode", event.ReasonCode)
+	}
+}
+
+func (s *Sender) sendDeliveryEvent(ctx context.Context, event *deliveryEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal delivery event: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, deliveryWebhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.DeliveryWebhook, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create delivery event request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post delivery event: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("delivery webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package sender
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dereulenspiegel/liteq"
+	"github.com/dereulenspiegel/smolmailer/internal/config"
+	"github.com/dereulenspiegel/smolmailer/internal/queue"
+	"github.com/dereulenspiegel/smolmailer/internal/queue/queuemocks"
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReasonCodeFor(t *testing.T) {
+	for _, exp := range []struct {
+		err    error
+		reason ReasonCode
+	}{
+		{err: nil, reason: ReasonDelivered},
+		{err: fmt.Errorf("rcpt cmd failed: %w", &smtp.SMTPError{Code: 550, Message: "No such user"}), reason: ReasonHardBounce},
+		{err: &smtp.SMTPError{Code: 451, Message: "Greylisted"}, reason: ReasonSoftBounce},
+		{err: errors.New("failed to dial smtp"), reason: ReasonConnectionFailed},
+		{err: fmt.Errorf("failed to deliver: %w", ErrTLSRequired), reason: ReasonTLSRequired},
+		{err: fmt.Errorf("failed to deliver: %w", ErrRecipientDomainDenied), reason: ReasonRecipientDomainDenied},
+		{err: ErrMessageExpired, reason: ReasonExpired},
+		{err: errors.Join(ErrSmarthostAuthRejected, &smtp.SMTPError{Code: 535}), reason: ReasonSmarthostAuthRejected},
+	} {
+		assert.Equal(t, exp.reason, reasonCodeFor(exp.err), fmt.Sprintf("%v", exp.err))
+	}
+}
+
+type bouncingBackend struct {
+	concurrencyBackend
+}
+
+func (b *bouncingBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &bouncingSession{concurrencySession{b: &b.concurrencyBackend}}, nil
+}
+
+type bouncingSession struct {
+	concurrencySession
+}
+
+func (s *bouncingSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+		Message:      "No such user",
+	}
+}
+
+func TestHardBounceEventCarriesReasonCode(t *testing.T) {
+	be := &bouncingBackend{}
+	host, port := startTestSmtpServer(t, be)
+
+	events := make(chan *deliveryEvent, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := &deliveryEvent{}
+		if err := json.NewDecoder(r.Body).Decode(event); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		events <- event
+	}))
+	defer webhook.Close()
+
+	q := queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t)
+	s := newTestSender(t, &config.Config{MailDomain: "example.com", DeliveryWebhook: webhook.URL}, q, host, port)
+
+	ctx := context.WithValue(context.Background(), liteq.CtxJobCreatedAt, time.Now())
+	require.Error(t, s.trySend(ctx, &queue.QueuedMessage{
+		From:         "from@example.com",
+		To:           "unknown@example.org",
+		Body:         []byte("test"),
+		SubmissionID: "submission",
+		MailOpts:     &smtp.MailOptions{},
+	}))
+
+	select {
+	case event := <-events:
+		assert.Equal(t, ReasonHardBounce, event.ReasonCode)
+		assert.Equal(t, 550, event.SmtpCode)
+		assert.Equal(t, "5.1.1", event.EnhancedCode)
+		assert.Equal(t, "unknown@example.org", event.To)
+		assert.Equal(t, "submission", event.SubmissionID)
+		assert.Contains(t, event.Reason, "No such user")
+	case <-time.After(time.Second * 5):
+		t.Fatal("no delivery event received")
+	}
+}
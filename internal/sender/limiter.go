@@ -0,0 +1,47 @@
+package sender
+
+import "sync"
+
+// submissionLimiter limits the number of deliveries which are in flight at the same time for a
+// single submission, so that a message with many recipients doesn't occupy all delivery workers
+type submissionLimiter struct {
+	maxInFlight int
+	lock        *sync.Mutex
+	inFlight    map[string]int
+}
+
+func newSubmissionLimiter(maxInFlight int) *submissionLimiter {
+	return &submissionLimiter{
+		maxInFlight: maxInFlight,
+		lock:        &sync.Mutex{},
+		inFlight:    make(map[string]int),
+	}
+}
+
+// Acquire reserves a delivery slot for the submission and returns false if all slots are taken.
+// Messages without submission ID and limiters without a limit are never limited.
+func (l *submissionLimiter) Acquire(submissionID string) bool {
+	if l.maxInFlight <= 0 || submissionID == "" {
+		return true
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.inFlight[submissionID] >= l.maxInFlight {
+		return false
+	}
+	l.inFlight[submissionID]++
+	return true
+}
+
+// Release frees a delivery slot previously reserved with Acquire
+func (l *submissionLimiter) Release(submissionID string) {
+	if l.maxInFlight <= 0 || submissionID == "" {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.inFlight[submissionID]--
+	if l.inFlight[submissionID] <= 0 {
+		delete(l.inFlight, submissionID)
+	}
+}
@@ -0,0 +1,120 @@
+package sender
+
+import (
+	"bufio"
+	"bytes"
+	"mime"
+	"net/textproto"
+	"strings"
+
+	"github.com/dereulenspiegel/smolmailer/internal/backend"
+)
+
+// LineEndingProcessor converts line feeds without carriage return to CRLF, as SMTP requires and DKIM
+// verifiers expect. Existing CRLFs are kept as they are. The content of MIME parts with the binary transfer
+// encoding is left intact, since line feeds in it are data and not line endings. It must run before the DKIM
+// signers so the signature covers the converted body.
+func LineEndingProcessor() ReceiveProcessor {
+	return func(msg *backend.ReceivedMessage) (*backend.ReceivedMessage, error) {
+		msg.Body = normalizeEntity(msg.Body)
+		return msg, nil
+	}
+}
+
+// normalizeEntity converts the line endings of the header and, depending on the transfer encoding and media
+// type, of the body of a message or MIME part
+func normalizeEntity(entity []byte) []byte {
+	header, body := splitHeader(entity)
+	header = fixBareLf(header)
+	if len(body) == 0 {
+		return header
+	}
+	mimeHeader, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(header))).ReadMIMEHeader()
+	if err != nil {
+		// Without a parsable header nothing is known about the body, so it is treated as text
+		return append(header, fixBareLf(body)...)
+	}
+	if strings.EqualFold(strings.TrimSpace(mimeHeader.Get("Content-Transfer-Encoding")), "binary") {
+		return append(header, body...)
+	}
+	mediaType, params, err := mime.ParseMediaType(mimeHeader.Get("Content-Type"))
+	if err == nil && strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+		return append(header, normalizeMultipart(body, params["boundary"])...)
+	}
+	return append(header, fixBareLf(body)...)
+}
+
+// splitHeader splits the entity after the empty line ending the header section. Entities without an empty
+// line consist only of a header.
+func splitHeader(entity []byte) (header, body []byte) {
+	rest := entity
+	for len(rest) > 0 {
+		line := rest
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line = rest[:i+1]
+		}
+		rest = rest[len(line):]
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+	}
+	headerLen := len(entity) - len(rest)
+	return entity[:headerLen], entity[headerLen:]
+}
+
+// normalizeMultipart normalizes every part of a multipart body on its own. Preamble, epilogue and the
+// boundary delimiter lines are text.
+func normalizeMultipart(body []byte, boundary string) []byte {
+	delimiter := []byte("--" + boundary)
+	result := make([]byte, 0, len(body)+len(body)/32)
+	var part []byte
+	inPart := false
+	flushPart := func() {
+		if inPart {
+			result = append(result, normalizeEntity(part)...)
+		} else {
+			result = append(result, fixBareLf(part)...)
+		}
+		part = nil
+	}
+	rest := body
+	for len(rest) > 0 {
+		line := rest
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line = rest[:i+1]
+		}
+		rest = rest[len(line):]
+		trimmed := bytes.TrimRight(line, " \t\r\n")
+		if !bytes.HasPrefix(trimmed, delimiter) {
+			part = append(part, line...)
+			continue
+		}
+		isClose := bytes.Equal(trimmed[len(delimiter):], []byte("--"))
+		if !isClose && len(trimmed) != len(delimiter) {
+			part = append(part, line...)
+			continue
+		}
+		flushPart()
+		result = append(result, fixBareLf(line)...)
+		inPart = !isClose
+	}
+	flushPart()
+	return result
+}
+
+// fixBareLf converts line feeds without preceding carriage return to CRLF
+func fixBareLf(b []byte) []byte {
+	if bytes.Count(b, []byte("\n")) == bytes.Count(b, []byte("\r\n")) {
+		return b
+	}
+	fixed := make([]byte, 0, len(b)+bytes.Count(b, []byte("\n")))
+	var prev byte
+	for _, c := range b {
+		if c == '\n' && prev != '\r' {
+			fixed = append(fixed, '\r')
+		}
+		fixed = append(fixed, c)
+		prev = c
+	}
+	return fixed
+}
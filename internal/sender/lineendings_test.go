@@ -0,0 +1,94 @@
+package sender
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/dereulenspiegel/smolmailer/internal/backend"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLineEndingProcessor(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{
+			name:     "bare LF",
+			body:     "From: sender@example.com\nSubject: Test\n\nHello\nworld\n",
+			expected: "From: sender@example.com\r\nSubject: Test\r\n\r\nHello\r\nworld\r\n",
+		},
+		{
+			name:     "mixed",
+			body:     "From: sender@example.com\r\nSubject: Test\n\r\nHello\r\nworld\n",
+			expected: "From: sender@example.com\r\nSubject: Test\r\n\r\nHello\r\nworld\r\n",
+		},
+		{
+			name:     "CRLF",
+			body:     "From: sender@example.com\r\n\r\nHello\r\n\r\n",
+			expected: "From: sender@example.com\r\n\r\nHello\r\n\r\n",
+		},
+		{
+			name:     "header only",
+			body:     "From: sender@example.com\n",
+			expected: "From: sender@example.com\r\n",
+		},
+		{
+			name: "binary part",
+			body: "From: sender@example.com\nContent-Type: multipart/mixed; boundary=\"b1\"\n\n" +
+				"preamble\n--b1\nContent-Type: text/plain\n\ntext\n" +
+				"--b1\nContent-Type: application/octet-stream\nContent-Transfer-Encoding: binary\n\n\x00\x01\n\x02\r\n" +
+				"--b1--\nepilogue\n",
+			expected: "From: sender@example.com\r\nContent-Type: multipart/mixed; boundary=\"b1\"\r\n\r\n" +
+				"preamble\r\n--b1\r\nContent-Type: text/plain\r\n\r\ntext\r\n" +
+				"--b1\r\nContent-Type: application/octet-stream\r\nContent-Transfer-Encoding: binary\r\n\r\n\x00\x01\n\x02\r\n" +
+				"--b1--\r\nepilogue\r\n",
+		},
+		{
+			name: "nested multipart",
+			body: "Content-Type: multipart/mixed; boundary=outer\n\n--outer\nContent-Type: multipart/alternative; boundary=inner\n\n" +
+				"--inner\n\nplain\n--inner--\n--outer--\n",
+			expected: "Content-Type: multipart/mixed; boundary=outer\r\n\r\n--outer\r\nContent-Type: multipart/alternative; boundary=inner\r\n\r\n" +
+				"--inner\r\n\r\nplain\r\n--inner--\r\n--outer--\r\n",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			msg, err := LineEndingProcessor()(&backend.ReceivedMessage{Body: []byte(test.body)})
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, string(msg.Body))
+		})
+	}
+}
+
+func TestLineEndingProcessorBeforeSigning(t *testing.T) {
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	msg := &backend.ReceivedMessage{From: "sender@example.com", Body: []byte("From: sender@example.com\nSubject: Test\n\nHello\nworld\n")}
+
+	msg, err = LineEndingProcessor()(msg)
+	require.NoError(t, err)
+	msg, err = DkimProcessor(&dkim.SignOptions{
+		Domain:                 "example.com",
+		Selector:               "test",
+		Signer:                 privKey,
+		HeaderCanonicalization: dkim.CanonicalizationSimple,
+		BodyCanonicalization:   dkim.CanonicalizationSimple,
+	}, 0)(msg)
+	require.NoError(t, err)
+	assert.NotContains(t, strings.ReplaceAll(string(msg.Body), "\r\n", ""), "\n")
+
+	lookupTXT := func(domain string) ([]string, error) {
+		return []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pubKey)}, nil
+	}
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(msg.Body), &dkim.VerifyOptions{LookupTXT: lookupTXT})
+	require.NoError(t, err)
+	require.Len(t, verifications, 1)
+	assert.NoError(t, verifications[0].Err)
+}
@@ -0,0 +1,88 @@
+package sender
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// submissionMxTTL is how long MX records are shared between the deliveries of a submission
+const submissionMxTTL = time.Minute * 10
+
+type mxLookupKey struct {
+	submissionID string
+	domain       string
+}
+
+type mxLookup struct {
+	done      chan struct{}
+	records   []*net.MX
+	err       error
+	expiresAt time.Time
+}
+
+// submissionMxResolver resolves the MX records of every recipient domain only once per submission
+// and shares them between all deliveries created from that submission. Concurrent lookups for the
+// same domain wait for the first one, failed lookups are not shared.
+type submissionMxResolver struct {
+	resolve func(string) ([]*net.MX, error)
+	ttl     time.Duration
+
+	lock    *sync.Mutex
+	lookups map[mxLookupKey]*mxLookup
+}
+
+func newSubmissionMxResolver(resolve func(string) ([]*net.MX, error)) *submissionMxResolver {
+	return &submissionMxResolver{
+		resolve: resolve,
+		ttl:     submissionMxTTL,
+		lock:    &sync.Mutex{},
+		lookups: make(map[mxLookupKey]*mxLookup),
+	}
+}
+
+func (r *submissionMxResolver) Resolve(submissionID, domain string) ([]*net.MX, error) {
+	if submissionID == "" {
+		return r.resolve(domain)
+	}
+	key := mxLookupKey{submissionID: submissionID, domain: domain}
+
+	r.lock.Lock()
+	r.pruneExpired()
+	lookup, exists := r.lookups[key]
+	if exists {
+		r.lock.Unlock()
+		<-lookup.done
+		return lookup.records, lookup.err
+	}
+	lookup = &mxLookup{done: make(chan struct{})}
+	r.lookups[key] = lookup
+	r.lock.Unlock()
+
+	lookup.records, lookup.err = r.resolve(domain)
+	lookup.expiresAt = time.Now().Add(r.ttl)
+
+	r.lock.Lock()
+	if lookup.err != nil {
+		// Waiting deliveries get the error, but later ones should try again
+		delete(r.lookups, key)
+	}
+	r.lock.Unlock()
+	close(lookup.done)
+	return lookup.records, lookup.err
+}
+
+// pruneExpired must be called while holding the lock
+func (r *submissionMxResolver) pruneExpired() {
+	now := time.Now()
+	for key, lookup := range r.lookups {
+		select {
+		case <-lookup.done:
+			if now.After(lookup.expiresAt) {
+				delete(r.lookups, key)
+			}
+		default:
+			// Still resolving
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package sender
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dereulenspiegel/smolmailer/internal/config"
+	"github.com/dereulenspiegel/smolmailer/internal/queue"
+	"github.com/dereulenspiegel/smolmailer/internal/queue/queuemocks"
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMxLookupsAreSharedPerSubmission(t *testing.T) {
+	be := &concurrencyBackend{delay: time.Millisecond * 10}
+	host, port := startTestSmtpServer(t, be)
+
+	q := queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t)
+	s := newTestSender(t, &config.Config{MailDomain: "example.com"}, q, host, port)
+	lookups := &sync.Map{}
+	var lookupCount atomic.Int32
+	s.mxLookups = newSubmissionMxResolver(func(domain string) ([]*net.MX, error) {
+		lookupCount.Add(1)
+		count, _ := lookups.LoadOrStore(domain, &atomic.Int32{})
+		count.(*atomic.Int32).Add(1)
+		// Give concurrent deliveries a chance to ask for the same domain while we are resolving
+		time.Sleep(time.Millisecond * 20)
+		return []*net.MX{{Host: host, Pref: 10}}, nil
+	})
+
+	domains := []string{"example.org", "example.net", "example.de"}
+	wg := &sync.WaitGroup{}
+	errs := make(chan error, len(domains)*4)
+	for i := range 4 {
+		for _, domain := range domains {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- s.trySend(context.Background(), &queue.QueuedMessage{
+					From:         "from@example.com",
+					To:           fmt.Sprintf("rcpt%d@%s", i, domain),
+					Body:         []byte("test"),
+					SubmissionID: "submission",
+					MailOpts:     &smtp.MailOptions{},
+				})
+			}()
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, int32(12), be.delivered.Load())
+	assert.Equal(t, int32(3), lookupCount.Load())
+	for _, domain := range domains {
+		count, exists := lookups.Load(domain)
+		require.True(t, exists, domain)
+		assert.Equal(t, int32(1), count.(*atomic.Int32).Load(), domain)
+	}
+}
+
+func TestSubmissionMxResolver(t *testing.T) {
+	var lookupCount atomic.Int32
+	failing := true
+	r := newSubmissionMxResolver(func(domain string) ([]*net.MX, error) {
+		lookupCount.Add(1)
+		if failing {
+			return nil, errors.New("lookup failed")
+		}
+		return []*net.MX{{Host: "mx." + domain, Pref: 10}}, nil
+	})
+
+	_, err := r.Resolve("one", "example.org")
+	require.Error(t, err)
+	failing = false
+	records, err := r.Resolve("one", "example.org")
+	require.NoError(t, err, "failed lookups must not be shared")
+	assert.Equal(t, "mx.example.org", records[0].Host)
+	_, err = r.Resolve("one", "example.org")
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), lookupCount.Load())
+
+	_, err = r.Resolve("two", "example.org")
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), lookupCount.Load(), "lookups must not be shared across submissions")
+
+	_, err = r.Resolve("", "example.org")
+	require.NoError(t, err)
+	_, err = r.Resolve("", "example.org")
+	require.NoError(t, err)
+	assert.Equal(t, int32(5), lookupCount.Load(), "messages without submission must always be resolved")
+
+	r = newSubmissionMxResolver(func(domain string) ([]*net.MX, error) {
+		return []*net.MX{{Host: "mx." + domain, Pref: 10}}, nil
+	})
+	r.ttl = -time.Second
+	_, err = r.Resolve("one", "example.org")
+	require.NoError(t, err)
+	_, err = r.Resolve("two", "example.org")
+	require.NoError(t, err)
+	r.lock.Lock()
+	assert.Len(t, r.lookups, 1, "expired lookups must be pruned")
+	r.lock.Unlock()
+}
@@ -0,0 +1,148 @@
+package sender
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+
+	"github.com/dereulenspiegel/smolmailer/internal/queue"
+	"github.com/dereulenspiegel/smolmailer/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// hello greets the mx host, unless that already happened while racing the mx hosts
+func (s *Sender) hello(c *mxClient) error {
+	if c.greeted {
+		return nil
+	}
+	if err := c.Hello(s.cfg.MailDomain); err != nil {
+		return fmt.Errorf("hello cmd failed: %w", err)
+	}
+	c.greeted = true
+	return nil
+}
+
+// sendParallel connects to the most preferred mx hosts at the same time and delivers the message over the
+// connection of the first host which greeted us, the other connections are closed. Only a single host
+// receives the message, so it is never delivered twice. All raced hosts count as attempted, the remaining
+// mx records are returned to be tried one after another if the delivery failed.
+func (s *Sender) sendParallel(ctx context.Context, logger *slog.Logger, mxRecords []*net.MX, ports []int, requireTLS bool, msg *queue.QueuedMessage) (delivered bool, remaining []*net.MX, attempts int, errs []error) {
+	limit := s.cfg.ParallelMxHosts
+	if s.cfg.MaxMxHosts > 0 {
+		limit = min(limit, s.cfg.MaxMxHosts)
+	}
+	hosts := []string{}
+	for _, mx := range mxRecords {
+		if len(hosts) < limit && !s.hostBackoff.BackingOff(mx.Host) && s.circuitBreaker.Allow(mx.Host) {
+			hosts = append(hosts, mx.Host)
+			continue
+		}
+		remaining = append(remaining, mx)
+	}
+	if len(hosts) == 0 {
+		return false, remaining, 0, nil
+	}
+
+	logger.Info("connecting to mx hosts in parallel", "hosts", hosts)
+	c, winner, errs := s.raceMx(ctx, hosts, ports, requireTLS)
+	if c == nil {
+		return false, remaining, len(hosts), errs
+	}
+	host := hosts[winner]
+	recordMxHost(ctx, host, c)
+
+	_, dialogSpan := tracing.Tracer().Start(ctx, "smtp.dialog", trace.WithAttributes(attribute.String("net.peer.name", host)))
+	err := s.smtpDialog(ctx, c, msg)
+	tracing.End(dialogSpan, err)
+	traceStep(ctx, deliveryStep{Stage: traceStageDialog, Host: host, Port: c.port, Mode: c.mode, Err: errString(err)})
+	s.recordHostHealth(ctx, host, err)
+	if err != nil {
+		logger.Error("smtp dialog failed", "host", host, "err", err)
+		s.backOffIfUnavailable(host, err)
+		return false, remaining, len(hosts), append(errs, err)
+	}
+	logger.Info("Successfully delivered message", "host", host)
+	return true, nil, len(hosts), errs
+}
+
+type raceResult struct {
+	index int
+	c     *mxClient
+	err   error
+}
+
+// raceMx dials and greets all hosts in parallel and returns the client of the first host which completed
+// the greeting together with its index. If several hosts became ready at the same time, the most preferred
+// one wins. The clients of all other hosts are closed.
+func (s *Sender) raceMx(ctx context.Context, hosts []string, ports []int, requireTLS bool) (*mxClient, int, []error) {
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan raceResult, len(hosts))
+	for i, host := range hosts {
+		go func() {
+			c, err := s.dialMx(raceCtx, host, ports, requireTLS)
+			if err == nil {
+				stop := abortOnDone(raceCtx, c.conn)
+				err = s.hello(c)
+				if !stop() && err == nil {
+					// The race was decided while greeting, the connection can't be used anymore
+					err = context.Cause(raceCtx)
+				}
+				if err != nil {
+					c.Close()
+					c = nil
+				}
+			}
+			results <- raceResult{index: i, c: c, err: err}
+		}()
+	}
+
+	errs := []error{}
+	var winner *raceResult
+	received := 0
+	for winner == nil && received < len(hosts) {
+		r := <-results
+		received++
+		if r.err != nil {
+			s.logger.Error("failed to connect to mx host", "host", hosts[r.index], "err", r.err)
+			s.recordHostHealth(ctx, hosts[r.index], r.err)
+			s.backOffIfUnavailable(hosts[r.index], r.err)
+			errs = append(errs, r.err)
+			continue
+		}
+		winner = &r
+	}
+	if winner == nil {
+		return nil, -1, errs
+	}
+	// The mx preference breaks ties between hosts which were ready at the same time
+	for ready := true; ready && received < len(hosts); {
+		select {
+		case r := <-results:
+			received++
+			switch {
+			case r.err != nil:
+				errs = append(errs, r.err)
+			case r.index < winner.index:
+				winner.c.Close()
+				winner = &r
+			default:
+				r.c.Close()
+			}
+		default:
+			ready = false
+		}
+	}
+	cancel()
+	go func(pending int) {
+		for range pending {
+			if r := <-results; r.c != nil {
+				r.c.Close()
+			}
+		}
+	}(len(hosts) - received)
+	return winner.c, winner.index, errs
+}
@@ -0,0 +1,62 @@
+package sender
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dereulenspiegel/smolmailer/internal/config"
+	"github.com/dereulenspiegel/smolmailer/internal/queue"
+	"github.com/dereulenspiegel/smolmailer/internal/queue/queuemocks"
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newParallelTestSender(t *testing.T, port int, mxRecords []*net.MX) *Sender {
+	s := newTestSender(t, &config.Config{MailDomain: "example.com", ParallelMxHosts: 2}, queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t), "", port)
+	s.mxLookups = newSubmissionMxResolver(func(string) ([]*net.MX, error) {
+		return mxRecords, nil
+	})
+	return s
+}
+
+func TestParallelMxDeliveryFallsBackToFastSecondary(t *testing.T) {
+	// Both hosts need to listen on the same port, since the mx ports apply to all hosts
+	slowHost, port := startHangingServer(t)
+	be := &concurrencyBackend{}
+	fastHost, _ := startTestSmtpServerAt(t, be, fmt.Sprintf("127.0.0.2:%d", port))
+
+	s := newParallelTestSender(t, port, []*net.MX{{Host: slowHost, Pref: 10}, {Host: fastHost, Pref: 20}})
+	started := time.Now()
+	err := s.sendMail(context.Background(), &queue.QueuedMessage{
+		From:     "from@example.com",
+		To:       "rcpt@example.org",
+		Body:     []byte("test"),
+		MailOpts: &smtp.MailOptions{},
+	})
+	require.NoError(t, err)
+	assert.Less(t, time.Since(started), time.Second)
+	assert.Equal(t, int32(1), be.delivered.Load())
+}
+
+func TestParallelMxDeliveryDeliversOnce(t *testing.T) {
+	primary := &concurrencyBackend{}
+	primaryHost, port := startTestSmtpServer(t, primary)
+	secondary := &concurrencyBackend{}
+	secondaryHost, _ := startTestSmtpServerAt(t, secondary, fmt.Sprintf("127.0.0.2:%d", port))
+
+	s := newParallelTestSender(t, port, []*net.MX{{Host: primaryHost, Pref: 10}, {Host: secondaryHost, Pref: 20}})
+	for range 5 {
+		err := s.sendMail(context.Background(), &queue.QueuedMessage{
+			From:     "from@example.com",
+			To:       "rcpt@example.org",
+			Body:     []byte("test"),
+			MailOpts: &smtp.MailOptions{},
+		})
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int32(5), primary.delivered.Load()+secondary.delivered.Load())
+}
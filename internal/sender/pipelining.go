@@ -0,0 +1,166 @@
+package sender
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// notifyingConn signals every write to the underlying connection. go-smtp doesn't support
+// PIPELINING on the client side, but its commands are sequenced, so concurrently issued commands
+// are pipelined as long as each command is only issued after the previous one was written.
+type notifyingConn struct {
+	net.Conn
+	written chan struct{}
+
+	deadlineMtx sync.Mutex
+	// pendingDeadlines counts the commands which set a deadline and didn't clear it yet
+	pendingDeadlines int
+	deadline         time.Time
+	aborted          bool
+}
+
+// errConnAborted is returned when setting a deadline of an aborted connection
+var errConnAborted = errors.New("connection was aborted")
+
+func newNotifyingConn(conn net.Conn) *notifyingConn {
+	return &notifyingConn{
+		Conn:    conn,
+		written: make(chan struct{}, 1),
+	}
+}
+
+func (n *notifyingConn) Write(b []byte) (int, error) {
+	i, err := n.Conn.Write(b)
+	select {
+	case n.written <- struct{}{}:
+	default:
+	}
+	return i, err
+}
+
+// SetDeadline keeps the deadlines of concurrently issued commands in effect. Every go-smtp command sets a
+// deadline and clears it once it received its response, which would leave the remaining pipelined commands
+// waiting for their responses without a deadline. The deadline is only cleared once no command is pending
+// anymore, until then the earliest deadline applies.
+func (n *notifyingConn) SetDeadline(t time.Time) error {
+	n.deadlineMtx.Lock()
+	defer n.deadlineMtx.Unlock()
+	if n.aborted {
+		return errConnAborted
+	}
+	if t.IsZero() {
+		n.pendingDeadlines = max(n.pendingDeadlines-1, 0)
+		if n.pendingDeadlines > 0 {
+			return nil
+		}
+		n.deadline = time.Time{}
+		return n.Conn.SetDeadline(t)
+	}
+	n.pendingDeadlines++
+	if n.deadline.IsZero() || t.Before(n.deadline) {
+		n.deadline = t
+	}
+	return n.Conn.SetDeadline(n.deadline)
+}
+
+func (n *notifyingConn) SetReadDeadline(t time.Time) error {
+	n.deadlineMtx.Lock()
+	defer n.deadlineMtx.Unlock()
+	if n.aborted {
+		return errConnAborted
+	}
+	return n.Conn.SetReadDeadline(t)
+}
+
+func (n *notifyingConn) SetWriteDeadline(t time.Time) error {
+	n.deadlineMtx.Lock()
+	defer n.deadlineMtx.Unlock()
+	if n.aborted {
+		return errConnAborted
+	}
+	return n.Conn.SetWriteDeadline(t)
+}
+
+// abort interrupts all pending and future reads and writes. go-smtp sets a new deadline for every command,
+// so deadlines can't be changed anymore afterwards.
+func (n *notifyingConn) abort() {
+	n.deadlineMtx.Lock()
+	defer n.deadlineMtx.Unlock()
+	n.aborted = true
+	n.Conn.SetDeadline(time.Now())
+}
+
+func (n *notifyingConn) drain() {
+	select {
+	case <-n.written:
+	default:
+	}
+}
+
+// mxClient is an SMTP client together with the connection it writes to
+type mxClient struct {
+	*smtp.Client
+	conn *notifyingConn
+
+	// host, port and mode describe the dial strategy the client was connected with
+	host string
+	port int
+	mode string
+	// greeted is set once the EHLO/HELO exchange took place
+	greeted bool
+}
+
+func newMxClient(conn *notifyingConn, c *smtp.Client) *mxClient {
+	return &mxClient{
+		Client: c,
+		conn:   conn,
+	}
+}
+
+// dialedWith records the dial strategy the client was connected with
+func (c *mxClient) dialedWith(host string, port int, mode string) *mxClient {
+	c.host, c.port, c.mode = host, port, mode
+	return c
+}
+
+func (c *mxClient) supportsPipelining() bool {
+	ok, _ := c.Extension("PIPELINING")
+	return ok
+}
+
+// pipeline issues the commands in order without waiting for the response of the previous command
+// (RFC 2920) and returns the first error in command order. If a command fails before it was
+// written, no further commands are issued.
+func (c *mxClient) pipeline(cmds ...func() error) error {
+	errs := make([]error, len(cmds))
+	wg := &sync.WaitGroup{}
+issue:
+	for i, cmd := range cmds {
+		c.conn.drain()
+		done := make(chan struct{})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(done)
+			errs[i] = cmd()
+		}()
+		select {
+		case <-c.conn.written:
+		case <-done:
+			if errs[i] != nil {
+				break issue
+			}
+		}
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package sender
+
+import (
+	"errors"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dereulenspiegel/smolmailer/internal/config"
+	"github.com/dereulenspiegel/smolmailer/internal/queue"
+	"github.com/dereulenspiegel/smolmailer/internal/queue/queuemocks"
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scriptedSmtpServer accepts a single connection and records the commands it receives. If pipelining
+// is enabled, it only responds once MAIL, RCPT and DATA have all been received.
+func scriptedSmtpServer(t *testing.T, pipelining bool) (string, int, <-chan []string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	result := make(chan []string, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		commands := []string{}
+		defer func() { result <- commands }()
+
+		text := textproto.NewConn(conn)
+		readCmd := func(timeout time.Duration) (string, error) {
+			conn.SetReadDeadline(time.Now().Add(timeout))
+			line, err := text.ReadLine()
+			if err != nil {
+				return "", err
+			}
+			cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			commands = append(commands, cmd)
+			return cmd, nil
+		}
+
+		text.PrintfLine("220 mx.example.com ESMTP")
+		if _, err := readCmd(time.Second); err != nil {
+			return
+		}
+		if pipelining {
+			text.PrintfLine("250-mx.example.com\r\n250 PIPELINING")
+			for range 3 {
+				// If the client waits for a response here it is not pipelining and the read times out
+				if _, err := readCmd(time.Second); err != nil {
+					return
+				}
+			}
+			text.PrintfLine("250 OK\r\n250 OK\r\n354 Go ahead")
+		} else {
+			text.PrintfLine("250 mx.example.com")
+			for _, response := range []string{"250 OK", "250 OK", "354 Go ahead"} {
+				if _, err := readCmd(time.Second); err != nil {
+					return
+				}
+				// A client which is not allowed to pipeline must not send the next command yet
+				if _, err := readCmd(time.Millisecond * 100); err == nil {
+					return
+				} else if netErr := (net.Error)(nil); !errors.As(err, &netErr) || !netErr.Timeout() {
+					return
+				}
+				text.PrintfLine("%s", response)
+			}
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := text.ReadDotBytes(); err != nil {
+			return
+		}
+		text.PrintfLine("250 Queued")
+		if _, err := readCmd(time.Second); err != nil {
+			return
+		}
+		text.PrintfLine("221 Bye")
+	}()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, result
+}
+
+func TestSendMailPipelining(t *testing.T) {
+	for name, pipelining := range map[string]bool{
+		"pipelining":    true,
+		"no pipelining": false,
+	} {
+		t.Run(name, func(t *testing.T) {
+			host, port, result := scriptedSmtpServer(t, pipelining)
+			s := newTestSender(t, &config.Config{MailDomain: "example.com"}, queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t), host, port)
+
+			err := s.trySend(t.Context(), &queue.QueuedMessage{
+				From:     "from@example.com",
+				To:       "rcpt@example.org",
+				Body:     []byte("Subject: test\r\n\r\ntest\r\n"),
+				MailOpts: &smtp.MailOptions{},
+			})
+			require.NoError(t, err)
+			assert.Equal(t, []string{"EHLO", "MAIL", "RCPT", "DATA", "QUIT"}, <-result)
+		})
+	}
+}
+
+func TestNotifyingConnKeepsDeadlinesOfPendingCommands(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := newNotifyingConn(client)
+	defer conn.Close()
+
+	// Two pipelined commands set their deadline, the first one clears it once it received its response
+	require.NoError(t, conn.SetDeadline(time.Now().Add(time.Millisecond*50)))
+	require.NoError(t, conn.SetDeadline(time.Now().Add(time.Minute)))
+	require.NoError(t, conn.SetDeadline(time.Time{}))
+	_, err := conn.Read(make([]byte, 1))
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout(), "the second command must not wait for its response without deadline")
+
+	// Once the second command is done as well, the deadline is cleared
+	require.NoError(t, conn.SetDeadline(time.Time{}))
+	go server.Write([]byte("2"))
+	_, err = conn.Read(make([]byte, 1))
+	require.NoError(t, err)
+}
+
+func TestAbortedNotifyingConnRefusesDeadlines(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := newNotifyingConn(client)
+	defer conn.Close()
+
+	require.NoError(t, conn.SetDeadline(time.Now().Add(time.Minute)))
+	conn.abort()
+	// go-smtp sets a new deadline for every command and clears it afterwards
+	assert.ErrorIs(t, conn.SetDeadline(time.Now().Add(time.Minute)), errConnAborted)
+	assert.ErrorIs(t, conn.SetDeadline(time.Time{}), errConnAborted)
+	assert.ErrorIs(t, conn.SetReadDeadline(time.Time{}), errConnAborted)
+
+	go server.Write([]byte("2"))
+	_, err := conn.Read(make([]byte, 1))
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+}
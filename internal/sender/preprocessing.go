@@ -3,14 +3,24 @@ package sender
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net/mail"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dereulenspiegel/liteq"
 	"github.com/dereulenspiegel/smolmailer/internal/backend"
 	"github.com/dereulenspiegel/smolmailer/internal/queue"
+	"github.com/dereulenspiegel/smolmailer/internal/tracing"
 	"github.com/emersion/go-msgauth/dkim"
 	"github.com/emersion/go-smtp"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ReceiveProcessor func(*backend.ReceivedMessage) (*backend.ReceivedMessage, error)
@@ -21,11 +31,42 @@ type JobQueue[M any] interface {
 	Consume(context.Context, liteq.ConsumeFunc[M], ...liteq.ConsumeOpt) error
 }
 
+var ErrProcessingClosed = errors.New("message processing is closed")
+
+// ErrMessageDiscarded is returned by receive processors which deliberately drop a message, e.g. because it is
+// spam. The message is removed from the receive queue instead of being processed again and all of its
+// recipients are recorded as bounced.
+var ErrMessageDiscarded = errors.New("message was discarded")
+
+// DefaultProcessingPoolSize is the number of messages processed concurrently without a configured pool size
+const DefaultProcessingPoolSize = 1
+
+const (
+	defaultConsumeRestartDelay = time.Second
+	maxConsumeRestartDelay     = time.Minute
+)
+
 type PreprocessorHandler struct {
 	receivingQueue queue.GenericWorkQueue[*backend.ReceivedMessage]
 
 	receiveProcessors []ReceiveProcessor
+	signingProcessors []ReceiveProcessor
 	preprocessors     []PreSendProcessor
+	archive           *MessageArchive
+	deliveryTracker   *queue.DeliveryTracker
+
+	poolSize          int
+	signingSlots      chan struct{}
+	visibilityTimeout time.Duration
+
+	consumeRestartDelay time.Duration
+	consumeRestarts     atomic.Int64
+
+	ctxCancel  context.CancelFunc
+	runDone    chan struct{}
+	closeLock  *sync.Mutex
+	closing    bool
+	processing *sync.WaitGroup
 
 	logger *slog.Logger
 }
@@ -38,12 +79,72 @@ func WithReceiveProcessors(receiveProcessors ...ReceiveProcessor) ProcessingOpt
 	}
 }
 
+// WithSigningProcessors runs the CPU bound signing processors, e.g. DKIM signers, after all receive processors.
+// How many messages are signed concurrently can be limited with WithSigningPoolSize.
+func WithSigningProcessors(signingProcessors ...ReceiveProcessor) ProcessingOpt {
+	return func(p *PreprocessorHandler) {
+		p.signingProcessors = append(p.signingProcessors, signingProcessors...)
+	}
+}
+
+// WithSigningPoolSize limits the number of messages signed concurrently independently of the processing pool
+// size, so bursts of submissions can't saturate all cores with signing. Values of 0 or less don't limit signing.
+func WithSigningPoolSize(signingPoolSize int) ProcessingOpt {
+	return func(p *PreprocessorHandler) {
+		if signingPoolSize > 0 {
+			p.signingSlots = make(chan struct{}, signingPoolSize)
+		}
+	}
+}
+
+// WithArchive retains a copy of every message in the archive once it is signed
+func WithArchive(archive *MessageArchive) ProcessingOpt {
+	return func(p *PreprocessorHandler) {
+		p.archive = archive
+	}
+}
+
+// WithDiscardTracking records the recipients of discarded messages as failed with the delivery tracker, since
+// the client was told the message was accepted already
+func WithDiscardTracking(tracker *queue.DeliveryTracker) ProcessingOpt {
+	return func(p *PreprocessorHandler) {
+		p.deliveryTracker = tracker
+	}
+}
+
 func WithPreSendProcessors(preSendProcessors ...PreSendProcessor) ProcessingOpt {
 	return func(p *PreprocessorHandler) {
 		p.preprocessors = append(p.preprocessors, preSendProcessors...)
 	}
 }
 
+// WithProcessingPoolSize sets the number of messages processed concurrently. Values of 0 or less use the default.
+func WithProcessingPoolSize(poolSize int) ProcessingOpt {
+	return func(p *PreprocessorHandler) {
+		if poolSize > 0 {
+			p.poolSize = poolSize
+		}
+	}
+}
+
+// WithProcessingVisibilityTimeout processes messages again, which were taken from the receive queue by a
+// consumer that did not finish within the timeout. A value of 0 never processes them again.
+func WithProcessingVisibilityTimeout(visibilityTimeout time.Duration) ProcessingOpt {
+	return func(p *PreprocessorHandler) {
+		p.visibilityTimeout = visibilityTimeout
+	}
+}
+
+// WithConsumeRestartDelay sets the initial delay before consuming the receive queue is restarted after it
+// failed. The delay doubles with every consecutive failure up to a minute.
+func WithConsumeRestartDelay(restartDelay time.Duration) ProcessingOpt {
+	return func(p *PreprocessorHandler) {
+		if restartDelay > 0 {
+			p.consumeRestartDelay = restartDelay
+		}
+	}
+}
+
 func NewProcessorHandler(ctx context.Context,
 	logger *slog.Logger,
 	receivingQueue queue.GenericWorkQueue[*backend.ReceivedMessage], opts ...ProcessingOpt) (*PreprocessorHandler, error) {
@@ -52,38 +153,144 @@ func NewProcessorHandler(ctx context.Context,
 		receivingQueue:    receivingQueue,
 		receiveProcessors: make([]ReceiveProcessor, 0),
 		preprocessors:     make([]PreSendProcessor, 0),
+		poolSize:          DefaultProcessingPoolSize,
+		runDone:           make(chan struct{}),
+		closeLock:         &sync.Mutex{},
+		processing:        &sync.WaitGroup{},
 		logger:            logger,
+
+		consumeRestartDelay: defaultConsumeRestartDelay,
 	}
 
 	for _, opt := range opts {
 		opt(p)
 	}
 
+	ctx, p.ctxCancel = context.WithCancel(ctx)
 	go p.runConsumeReceivingQueue(ctx)
 
 	return p, nil
 }
 
+// Shutdown stops consuming the receive queue and waits until all messages in processing have been
+// queued for sending or ctx is done. Messages not taken from the receive queue yet stay queued.
+func (p *PreprocessorHandler) Shutdown(ctx context.Context) error {
+	p.ctxCancel()
+	select {
+	case <-p.runDone:
+	case <-ctx.Done():
+		return fmt.Errorf("failed to stop consuming the receive queue: %w", ctx.Err())
+	}
+
+	p.closeLock.Lock()
+	p.closing = true
+	p.closeLock.Unlock()
+
+	processingDone := make(chan struct{})
+	go func() {
+		p.processing.Wait()
+		close(processingDone)
+	}()
+	select {
+	case <-processingDone:
+	case <-ctx.Done():
+		return fmt.Errorf("failed to wait for messages in processing: %w", ctx.Err())
+	}
+	if p.archive != nil {
+		return p.archive.Close(ctx)
+	}
+	return nil
+}
+
+// ConsumeRestarts returns how often consuming the receive queue was restarted after a failure
+func (p *PreprocessorHandler) ConsumeRestarts() int64 {
+	return p.consumeRestarts.Load()
+}
+
+// runConsumeReceivingQueue consumes the receive queue until ctx is done. If consuming fails, e.g. because of
+// a transient database error, it is restarted with an exponential backoff instead of stopping all processing.
 func (p *PreprocessorHandler) runConsumeReceivingQueue(ctx context.Context) {
-	if err := p.receivingQueue.Consume(ctx, p.consumeReceivingQueue); err != nil {
-		p.logger.Error("failed to consume from receiving queue", "err", err)
+	defer close(p.runDone)
+	consumeOpts := []liteq.ConsumeOpt{liteq.PoolSize(p.poolSize)}
+	if p.visibilityTimeout > 0 {
+		consumeOpts = append(consumeOpts, liteq.VisibilityTimeout(p.visibilityTimeout))
+	}
+	restartDelay := p.consumeRestartDelay
+	for {
+		started := time.Now()
+		err := p.receivingQueue.Consume(ctx, p.consume, consumeOpts...)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > maxConsumeRestartDelay {
+			// The consumer ran fine for a while, so this is not a consecutive failure
+			restartDelay = p.consumeRestartDelay
+		}
+		restarts := p.consumeRestarts.Add(1)
+		p.logger.Error("failed to consume from receiving queue, restarting", "err", err, "restartDelay", restartDelay, "restarts", restarts)
+		select {
+		case <-time.After(restartDelay):
+		case <-ctx.Done():
+			return
+		}
+		restartDelay = min(restartDelay*2, maxConsumeRestartDelay)
+	}
+}
+
+// consume keeps track of messages in processing, so shutting down can wait for them
+func (p *PreprocessorHandler) consume(ctx context.Context, receivedMsg *backend.ReceivedMessage) error {
+	p.closeLock.Lock()
+	if p.closing {
+		p.closeLock.Unlock()
+		// Do not start processing new messages while shutting down
+		return ErrProcessingClosed
 	}
+	p.processing.Add(1)
+	p.closeLock.Unlock()
+	defer p.processing.Done()
+	// Messages in processing are not interrupted when shutting down stops consuming the receive queue
+	return p.consumeReceivingQueue(context.WithoutCancel(ctx), receivedMsg)
 }
 
 func (p *PreprocessorHandler) consumeReceivingQueue(ctx context.Context, receivedMsg *backend.ReceivedMessage) (err error) {
 	if receivedMsg.MailOpts == nil {
+		// Sessions give every message mail options with an envelope id, only messages queued by older versions lack them
 		receivedMsg.MailOpts = &smtp.MailOptions{}
 	}
+	ctx, span := tracing.Tracer().Start(tracing.Extract(ctx, receivedMsg.TraceContext), "process", trace.WithAttributes(
+		attribute.Int("smtp.recipients", len(receivedMsg.To)),
+	))
+	defer func() { tracing.End(span, err) }()
 	logger := p.logger.With(slog.Any("receivedMsg", receivedMsg))
 	logger.Info("processing received message")
+	if err := receivedMsg.LoadBody(); err != nil {
+		logger.Error("failed to load spooled body of received message", "err", err)
+		return fmt.Errorf("failed to process received message: %w", err)
+	}
 	for _, receiveProcessor := range p.receiveProcessors {
 		receivedMsg, err = receiveProcessor(receivedMsg)
+		if errors.Is(err, ErrMessageDiscarded) {
+			logger.Warn("discarded received message", "err", err)
+			p.bounceDiscarded(ctx, logger, receivedMsg, err)
+			if err := receivedMsg.RemoveBodyFile(); err != nil {
+				logger.Warn("failed to remove spooled body", "err", err)
+			}
+			return nil
+		}
 		if err != nil {
 			logger.Error("failed to process received message", "err", err, "processor", fmt.Sprintf("%T", receiveProcessor))
 			return fmt.Errorf("failed to process received message: %w", err)
 		}
 	}
 
+	if receivedMsg, err = p.sign(ctx, receivedMsg); err != nil {
+		logger.Error("failed to sign received message", "err", err)
+		return fmt.Errorf("failed to sign received message: %w", err)
+	}
+	if p.archive != nil {
+		p.archive.Archive(receivedMsg)
+	}
+
 	queuedMsgs, err := p.processReceivedMessage(receivedMsg)
 	if err != nil {
 		logger.Error("failed to transform received message into queued message", "err", err)
@@ -92,18 +299,70 @@ func (p *PreprocessorHandler) consumeReceivingQueue(ctx context.Context, receive
 
 	for _, queuedMsg := range queuedMsgs {
 		logger := logger.With(slog.String("to", queuedMsg.To))
+		queuedMsg.TraceContext = tracing.Inject(ctx)
 		for _, pr := range p.preprocessors {
 			queuedMsg, err = pr(queuedMsg)
+			if errors.Is(err, queue.ErrDuplicateMessage) {
+				logger.Info("skipping message, an identical message is already waiting for delivery")
+				break
+			}
 			if err != nil {
 				logger.Error("failed to process queued message", "err", err, "processor", fmt.Sprintf("%T", pr))
 				return fmt.Errorf("failed to process queued msg: %w", err)
 			}
 		}
 	}
+	if err := receivedMsg.RemoveBodyFile(); err != nil {
+		// The message is queued for sending, so only the disk space is lost
+		logger.Warn("failed to remove spooled body", "err", err)
+	}
 
 	return nil
 }
 
+// bounceDiscarded logs every recipient of a discarded message as bounced and marks it as failed, so the
+// submitter can learn from the delivery status that the message won't be delivered
+func (p *PreprocessorHandler) bounceDiscarded(ctx context.Context, logger *slog.Logger, receivedMsg *backend.ReceivedMessage, discardErr error) {
+	for _, msg := range receivedMsg.QueuedMessages() {
+		logAccess(p.logger, AccessEventBounced, msg, nil, discardErr)
+		if p.deliveryTracker == nil {
+			continue
+		}
+		// The message is never queued, so it can't be a duplicate of a message waiting for delivery
+		msg.DedupKey = ""
+		logger := logger.With("to", msg.To)
+		if err := p.deliveryTracker.Track(ctx, msg); err != nil {
+			logger.Error("failed to track discarded message", "err", err)
+			continue
+		}
+		if err := p.deliveryTracker.UpdateStatus(ctx, msg, queue.DeliveryStatusFailed, discardErr); err != nil {
+			logger.Error("failed to update delivery status of discarded message", "err", err)
+		}
+	}
+}
+
+// sign runs the signing processors as soon as one of the signing slots is free
+func (p *PreprocessorHandler) sign(ctx context.Context, receivedMsg *backend.ReceivedMessage) (_ *backend.ReceivedMessage, err error) {
+	if len(p.signingProcessors) == 0 {
+		return receivedMsg, nil
+	}
+	if p.signingSlots != nil {
+		select {
+		case p.signingSlots <- struct{}{}:
+			defer func() { <-p.signingSlots }()
+		case <-ctx.Done():
+			return receivedMsg, ctx.Err()
+		}
+	}
+	for _, signingProcessor := range p.signingProcessors {
+		receivedMsg, err = signingProcessor(receivedMsg)
+		if err != nil {
+			return receivedMsg, err
+		}
+	}
+	return receivedMsg, nil
+}
+
 func (p *PreprocessorHandler) processReceivedMessage(receivedMsg *backend.ReceivedMessage) (queuedMsgs []*queue.QueuedMessage, err error) {
 	queuedMsgs = receivedMsg.QueuedMessages()
 	return queuedMsgs, nil
@@ -111,18 +370,293 @@ func (p *PreprocessorHandler) processReceivedMessage(receivedMsg *backend.Receiv
 
 func SendProcessor(ctx context.Context, sendingQueue queue.GenericWorkQueue[*queue.QueuedMessage], options ...liteq.QueueOption) PreSendProcessor {
 	return func(msg *queue.QueuedMessage) (*queue.QueuedMessage, error) {
-		err := sendingQueue.Queue(ctx, msg, options...)
+		err := sendingQueue.Queue(ctx, msg, msg.QueueOptions(options...)...)
+		return msg, err
+	}
+}
+
+// dnsblHeader names the DNS blocklists the client of a message is listed in
+const dnsblHeader = "X-DNSBL"
+
+const authenticationResultsHeaderName = "Authentication-Results"
+
+// PriorityHeader explicitly selects the priority class, and thereby the send queue, of a message
+const PriorityHeader = "X-Smolmailer-Priority"
+
+// PriorityRoutingProcessor queues every message into the send queue of its priority class. The class is taken
+// from the PriorityHeader if it names a configured queue, messages with a Precedence of bulk, list or junk are
+// sent as bulk and everything else is considered transactional.
+func PriorityRoutingProcessor(ctx context.Context, sendingQueues map[string]queue.GenericWorkQueue[*queue.QueuedMessage], options ...liteq.QueueOption) PreSendProcessor {
+	return func(msg *queue.QueuedMessage) (*queue.QueuedMessage, error) {
+		class := priorityClass(msg.Body, sendingQueues)
+		sendingQueue, exists := sendingQueues[class]
+		if !exists {
+			return msg, fmt.Errorf("no send queue configured for priority class %s", class)
+		}
+		err := sendingQueue.Queue(ctx, msg, msg.QueueOptions(options...)...)
+		return msg, err
+	}
+}
+
+func priorityClass(body []byte, sendingQueues map[string]queue.GenericWorkQueue[*queue.QueuedMessage]) string {
+	parsedMsg, err := mail.ReadMessage(bytes.NewReader(body))
+	if err != nil {
+		return queue.PriorityTransactional
+	}
+	class := strings.ToLower(strings.TrimSpace(parsedMsg.Header.Get(PriorityHeader)))
+	if _, exists := sendingQueues[class]; exists {
+		return class
+	}
+	switch strings.ToLower(strings.TrimSpace(parsedMsg.Header.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		if _, exists := sendingQueues[queue.PriorityBulk]; exists {
+			return queue.PriorityBulk
+		}
+	}
+	return queue.PriorityTransactional
+}
+
+// DeliverAtHeader schedules the delivery of a message, its value is a RFC 3339 or RFC 5322 date
+const DeliverAtHeader = backend.DeliverAtHeader
+
+// DeliverAtProcessor schedules messages carrying the DeliverAtHeader for delivery at the given time. The
+// header is removed, so it must run before the DKIM signers. Messages with an invalid time are rejected while
+// they are received, those which got past that fail to be processed instead of being delivered early.
+func DeliverAtProcessor() ReceiveProcessor {
+	return func(msg *backend.ReceivedMessage) (*backend.ReceivedMessage, error) {
+		parsedMsg, err := mail.ReadMessage(bytes.NewReader(msg.Body))
+		if err != nil {
+			return msg, nil
+		}
+		value := strings.TrimSpace(parsedMsg.Header.Get(DeliverAtHeader))
+		if value == "" {
+			return msg, nil
+		}
+		deliverAt, err := backend.ParseDeliverAt(value)
+		if err != nil {
+			return msg, err
+		}
+		msg.DeliverAt = deliverAt
+		msg.Body = removeHeader(msg.Body, DeliverAtHeader)
+		return msg, nil
+	}
+}
+
+// TrackingProcessor registers the recipient of every queued message as pending with the delivery tracker. It
+// must run before the message is queued for sending, so identical messages are not queued twice.
+func TrackingProcessor(ctx context.Context, tracker *queue.DeliveryTracker) PreSendProcessor {
+	return func(msg *queue.QueuedMessage) (*queue.QueuedMessage, error) {
+		err := tracker.Track(ctx, msg)
 		return msg, err
 	}
 }
 
-func DkimProcessor(dkimOptions *dkim.SignOptions) ReceiveProcessor {
+// SubmissionIDHeaderProcessor assigns a submission ID to the received message and adds it as the given header,
+// so delivered messages can be correlated with the delivery logs. It must run before the DKIM signers so the
+// header is covered by the signature. Headers of the same name set by the client are replaced.
+func SubmissionIDHeaderProcessor(header string) ReceiveProcessor {
+	return func(msg *backend.ReceivedMessage) (*backend.ReceivedMessage, error) {
+		if msg.SubmissionID == "" {
+			msg.SubmissionID = uuid.NewString()
+		}
+		body := removeHeader(msg.Body, header)
+		msg.Body = append([]byte(fmt.Sprintf("%s: %s\r\n", header, msg.SubmissionID)), body...)
+		return msg, nil
+	}
+}
+
+// ReceivedHeaderProcessor adds a Received header (RFC 5321 section 4.4) recording the submission of the
+// message. If includeTLS is set, the TLS version and cipher of TLS secured submissions are added as comment.
+func ReceivedHeaderProcessor(domain string, includeTLS bool) ReceiveProcessor {
+	return func(msg *backend.ReceivedMessage) (*backend.ReceivedMessage, error) {
+		if msg.Received == nil {
+			return msg, nil
+		}
+		msg.Body = append([]byte(receivedHeader(domain, msg, includeTLS)), msg.Body...)
+		return msg, nil
+	}
+}
+
+func receivedHeader(domain string, msg *backend.ReceivedMessage, includeTLS bool) string {
+	info := msg.Received
+	header := &strings.Builder{}
+	header.WriteString("Received: from ")
+	if info.Helo != "" {
+		header.WriteString(info.Helo + " ")
+	}
+	fmt.Fprintf(header, "([%s])\r\n\tby %s with %s", info.RemoteAddr, domain, info.Protocol)
+	if includeTLS && info.TLSVersion != "" {
+		fmt.Fprintf(header, "\r\n\t(version=%s cipher=%s)", info.TLSVersion, info.TLSCipher)
+	}
+	if msg.SubmissionID != "" {
+		fmt.Fprintf(header, "\r\n\tid %s", msg.SubmissionID)
+	}
+	if msg.MailOpts != nil && msg.MailOpts.EnvelopeID != "" && !strings.ContainsAny(msg.MailOpts.EnvelopeID, "()\\") {
+		// Envelope ids with characters that would end the comment are left out
+		fmt.Fprintf(header, "\r\n\t(envelope-id %s)", msg.MailOpts.EnvelopeID)
+	}
+	fmt.Fprintf(header, ";\r\n\t%s\r\n", info.Time.Format(time.RFC1123Z))
+	return header.String()
+}
+
+// AuthenticationResultsProcessor adds an Authentication-Results header (RFC 8601) with the result of the SPF
+// check of the submission. Headers of the client claiming to come from domain are removed (RFC 8601 section 5),
+// apart from that messages without SPF result are left unchanged. It must run before the DKIM signers so the
+// header is covered by the signature.
+func AuthenticationResultsProcessor(domain string) ReceiveProcessor {
+	return func(msg *backend.ReceivedMessage) (*backend.ReceivedMessage, error) {
+		msg.Body = removeHeaderFunc(msg.Body, authenticationResultsHeaderName, func(value string) bool {
+			return strings.EqualFold(authservID(value), domain)
+		})
+		if msg.SPF == nil {
+			return msg, nil
+		}
+		msg.Body = append([]byte(authenticationResultsHeader(domain, msg)), msg.Body...)
+		return msg, nil
+	}
+}
+
+// DNSBLHeaderProcessor adds an X-DNSBL header naming the DNS blocklists the client is listed in, messages of
+// clients not listed are left unchanged. Headers of the same name set by the client are removed, so they can't
+// pretend to be listed or not. It must run before the DKIM signers so the header is covered by the signature.
+func DNSBLHeaderProcessor() ReceiveProcessor {
+	return func(msg *backend.ReceivedMessage) (*backend.ReceivedMessage, error) {
+		msg.Body = removeHeader(msg.Body, dnsblHeader)
+		if msg.Received == nil || len(msg.Received.DNSBLListings) == 0 {
+			return msg, nil
+		}
+		msg.Body = append([]byte(fmt.Sprintf("%s: %s\r\n", dnsblHeader, strings.Join(msg.Received.DNSBLListings, ", "))), msg.Body...)
+		return msg, nil
+	}
+}
+
+func authenticationResultsHeader(domain string, msg *backend.ReceivedMessage) string {
+	property := "smtp.mailfrom"
+	if msg.From == "" {
+		// The HELO identity is checked for the null sender
+		property = "smtp.helo"
+	}
+	return fmt.Sprintf(authenticationResultsHeaderName+": %s;\r\n\tspf=%s (sender IP is %s) %s=%s\r\n",
+		domain, strings.ToLower(string(msg.SPF.Result)), msg.SPF.ClientIP, property, msg.SPF.Domain)
+}
+
+// removeHeader removes all occurrences of the header, including folded continuation lines, from the
+// header section of the message
+func removeHeader(body []byte, name string) []byte {
+	return removeHeaderFunc(body, name, func(string) bool { return true })
+}
+
+// removeHeaderFunc removes the occurrences of the header whose unfolded value matches, including their folded
+// continuation lines, from the header section of the message
+func removeHeaderFunc(body []byte, name string, match func(value string) bool) []byte {
+	result := make([]byte, 0, len(body))
+	var field []byte
+	flush := func() {
+		key, value, _ := bytes.Cut(field, []byte(":"))
+		if !strings.EqualFold(strings.TrimSpace(string(key)), name) || !match(unfoldHeaderValue(value)) {
+			result = append(result, field...)
+		}
+		field = nil
+	}
+	rest := body
+	for len(rest) > 0 {
+		line := rest
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line = rest[:i+1]
+		}
+		rest = rest[len(line):]
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			// End of the header section
+			flush()
+			result = append(result, line...)
+			return append(result, rest...)
+		}
+		if (line[0] == ' ' || line[0] == '\t') && field != nil {
+			field = append(field, line...)
+			continue
+		}
+		flush()
+		field = line
+	}
+	flush()
+	return result
+}
+
+func unfoldHeaderValue(value []byte) string {
+	return strings.TrimSpace(strings.NewReplacer("\r\n", "", "\n", "").Replace(string(value)))
+}
+
+// authservID returns the authserv-id of an Authentication-Results header value, skipping leading comments
+func authservID(value string) string {
+	for strings.HasPrefix(value, "(") {
+		depth := 0
+		end := strings.IndexFunc(value, func(r rune) bool {
+			switch r {
+			case '(':
+				depth++
+			case ')':
+				depth--
+			}
+			return depth == 0
+		})
+		if end < 0 {
+			return ""
+		}
+		value = strings.TrimSpace(value[end+1:])
+	}
+	id, _, _ := strings.Cut(value, ";")
+	id, _, _ = strings.Cut(strings.TrimSpace(id), " ")
+	id, _, _ = strings.Cut(id, "\t")
+	return id
+}
+
+// UserDkimProcessor signs the messages of users with the DKIM signing options userOptions returns for them,
+// valid for signatureValidity like the signatures of DkimProcessor. The messages of users without own signing
+// options are signed by the default signers.
+func UserDkimProcessor(userOptions func(username string) *dkim.SignOptions, signatureValidity time.Duration, defaultSigners ...ReceiveProcessor) ReceiveProcessor {
+	return func(msg *backend.ReceivedMessage) (*backend.ReceivedMessage, error) {
+		if msg.AuthUser != "" {
+			if dkimOptions := userOptions(msg.AuthUser); dkimOptions != nil {
+				return DkimProcessor(dkimOptions, signatureValidity)(msg)
+			}
+		}
+		var err error
+		for _, signer := range defaultSigners {
+			if msg, err = signer(msg); err != nil {
+				return msg, err
+			}
+		}
+		return msg, nil
+	}
+}
+
+// DkimProcessor signs messages with the DKIM signing options. If signatureValidity is set, the signatures expire
+// (x=) this long after signing, otherwise they don't expire. Messages with the null sender, like bounces, are
+// not signed.
+func DkimProcessor(dkimOptions *dkim.SignOptions, signatureValidity time.Duration) ReceiveProcessor {
 	return func(msg *backend.ReceivedMessage) (*backend.ReceivedMessage, error) {
-		signedBuf := &bytes.Buffer{}
-		if err := dkim.Sign(signedBuf, bytes.NewReader(msg.Body), dkimOptions); err != nil {
-			return msg, fmt.Errorf("failed to sign messag: %w", err)
+		if msg.From == "" {
+			return msg, nil
 		}
-		msg.Body = signedBuf.Bytes()
+		signed, err := signDkim(msg.Body, dkimOptions, signatureValidity)
+		if err != nil {
+			return msg, err
+		}
+		msg.Body = signed
 		return msg, nil
 	}
 }
+
+func signDkim(body []byte, dkimOptions *dkim.SignOptions, signatureValidity time.Duration) ([]byte, error) {
+	signOptions := dkimOptions
+	if signatureValidity > 0 {
+		expiringOptions := *dkimOptions
+		expiringOptions.Expiration = time.Now().Add(signatureValidity)
+		signOptions = &expiringOptions
+	}
+	signedBuf := &bytes.Buffer{}
+	if err := dkim.Sign(signedBuf, bytes.NewReader(body), signOptions); err != nil {
+		return nil, fmt.Errorf("failed to sign messag: %w", err)
+	}
+	return signedBuf.Bytes(), nil
+}
@@ -1,12 +1,19 @@
 package sender
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"log/slog"
+	"net/mail"
+	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/asggo/spf"
 	"github.com/dereulenspiegel/liteq"
 	"github.com/dereulenspiegel/smolmailer/internal/backend"
 	"github.com/dereulenspiegel/smolmailer/internal/queue"
@@ -64,3 +71,529 @@ func TestSuccessfullPreProcessing(t *testing.T) {
 
 	sq.AssertExpectations(t)
 }
+
+func TestPriorityClass(t *testing.T) {
+	sendingQueues := map[string]queue.GenericWorkQueue[*queue.QueuedMessage]{
+		queue.PriorityTransactional: nil,
+		queue.PriorityBulk:          nil,
+		"newsletter":                nil,
+	}
+	for _, exp := range []struct {
+		body  string
+		class string
+	}{
+		{body: "Subject: Password reset\r\n\r\nbody", class: queue.PriorityTransactional},
+		{body: "Precedence: bulk\r\n\r\nbody", class: queue.PriorityBulk},
+		{body: "Precedence: List\r\n\r\nbody", class: queue.PriorityBulk},
+		{body: "X-Smolmailer-Priority: newsletter\r\nPrecedence: bulk\r\n\r\nbody", class: "newsletter"},
+		{body: "X-Smolmailer-Priority: unknown\r\nPrecedence: bulk\r\n\r\nbody", class: queue.PriorityBulk},
+		{body: "not a message", class: queue.PriorityTransactional},
+	} {
+		assert.Equal(t, exp.class, priorityClass([]byte(exp.body), sendingQueues), exp.body)
+	}
+
+	delete(sendingQueues, queue.PriorityBulk)
+	assert.Equal(t, queue.PriorityTransactional, priorityClass([]byte("Precedence: bulk\r\n\r\nbody"), sendingQueues))
+}
+
+func TestSubmissionIDHeaderProcessor(t *testing.T) {
+	processor := SubmissionIDHeaderProcessor("X-Smolmailer-ID")
+	msg, err := processor(&backend.ReceivedMessage{
+		To: []*backend.Rcpt{{To: "a@example.org"}, {To: "b@example.org"}},
+		Body: []byte("From: sender@example.com\r\nX-Smolmailer-ID: forged\r\n  continued\r\n" +
+			"Subject: Test\r\n\r\nX-Smolmailer-ID: part of the body\r\n"),
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, msg.SubmissionID)
+	assert.Equal(t, "X-Smolmailer-ID: "+msg.SubmissionID+"\r\nFrom: sender@example.com\r\nSubject: Test\r\n\r\n"+
+		"X-Smolmailer-ID: part of the body\r\n", string(msg.Body))
+
+	queuedMsgs := msg.QueuedMessages()
+	require.Len(t, queuedMsgs, 2)
+	for _, queuedMsg := range queuedMsgs {
+		assert.Equal(t, msg.SubmissionID, queuedMsg.SubmissionID)
+	}
+}
+
+func TestProcessorHandlerShutdownWaitsForProcessing(t *testing.T) {
+	ctx := context.Background()
+	jq, err := liteq.NewFromPath(filepath.Join(t.TempDir(), "queue.db"))
+	require.NoError(t, err)
+	rq := liteq.NewQueue[*backend.ReceivedMessage](jq, "receive", liteq.JSONMarshaler[*backend.ReceivedMessage]{})
+	sq := queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t)
+	sq.On("Queue", mock.Anything, mock.MatchedBy(func(msg *queue.QueuedMessage) bool {
+		return msg.To == "to@example.com" && string(msg.Body) == "Signed: yes\r\nfoobar"
+	})).Once().Return(nil)
+
+	processingStarted := make(chan struct{})
+	slowSigner := func(msg *backend.ReceivedMessage) (*backend.ReceivedMessage, error) {
+		close(processingStarted)
+		time.Sleep(time.Millisecond * 300)
+		msg.Body = append([]byte("Signed: yes\r\n"), msg.Body...)
+		return msg, nil
+	}
+	p, err := NewProcessorHandler(ctx, slog.Default(), rq,
+		WithReceiveProcessors(slowSigner),
+		WithPreSendProcessors(SendProcessor(ctx, sq)))
+	require.NoError(t, err)
+
+	require.NoError(t, rq.Put(ctx, &backend.ReceivedMessage{
+		From: "from@example.com",
+		To:   []*backend.Rcpt{{To: "to@example.com"}},
+		Body: []byte("foobar"),
+	}))
+	select {
+	case <-processingStarted:
+	case <-time.After(time.Second * 5):
+		t.Fatal("message processing did not start")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	require.NoError(t, p.Shutdown(shutdownCtx))
+	sq.AssertExpectations(t)
+}
+
+func TestSigningConcurrencyIsBounded(t *testing.T) {
+	ctx := context.Background()
+	jq, err := liteq.NewFromPath(filepath.Join(t.TempDir(), "queue.db"))
+	require.NoError(t, err)
+	rq := liteq.NewQueue[*backend.ReceivedMessage](jq, "receive", liteq.JSONMarshaler[*backend.ReceivedMessage]{})
+
+	const messageCount = 20
+	const signingPoolSize = 2
+	var signing, maxSigning atomic.Int32
+	signer := func(msg *backend.ReceivedMessage) (*backend.ReceivedMessage, error) {
+		current := signing.Add(1)
+		defer signing.Add(-1)
+		for {
+			maxCurrent := maxSigning.Load()
+			if current <= maxCurrent || maxSigning.CompareAndSwap(maxCurrent, current) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond * 20)
+		return msg, nil
+	}
+
+	queued := make(chan struct{}, messageCount)
+	sq := queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t)
+	sq.On("Queue", mock.Anything, mock.Anything).Run(func(mock.Arguments) {
+		queued <- struct{}{}
+	}).Return(nil)
+
+	p, err := NewProcessorHandler(ctx, slog.Default(), rq,
+		WithSigningProcessors(signer),
+		WithSigningPoolSize(signingPoolSize),
+		WithProcessingPoolSize(8),
+		WithPreSendProcessors(SendProcessor(ctx, sq)))
+	require.NoError(t, err)
+
+	for range messageCount {
+		require.NoError(t, rq.Put(ctx, &backend.ReceivedMessage{
+			From: "from@example.com",
+			To:   []*backend.Rcpt{{To: "to@example.com"}},
+			Body: []byte("foobar"),
+		}))
+	}
+	for range messageCount {
+		select {
+		case <-queued:
+		case <-time.After(time.Second * 10):
+			t.Fatal("not all messages were processed")
+		}
+	}
+	require.NoError(t, p.Shutdown(ctx))
+
+	assert.LessOrEqual(t, maxSigning.Load(), int32(signingPoolSize))
+	assert.Equal(t, int32(signingPoolSize), maxSigning.Load(), "messages should be signed concurrently up to the bound")
+}
+
+func TestReceivedHeaderProcessor(t *testing.T) {
+	receivedAt := time.Date(2025, 3, 1, 12, 30, 0, 0, time.UTC)
+	tlsMsg := func() *backend.ReceivedMessage {
+		return &backend.ReceivedMessage{
+			Body:         []byte("Subject: Test\r\n\r\nbody\r\n"),
+			SubmissionID: "submission-1",
+			Received: &backend.ReceivedInfo{
+				Helo:       "client.example.org",
+				RemoteAddr: "192.0.2.1",
+				Protocol:   "ESMTPSA",
+				TLSVersion: "TLS 1.3",
+				TLSCipher:  "TLS_AES_128_GCM_SHA256",
+				Time:       receivedAt,
+			},
+		}
+	}
+
+	msg, err := ReceivedHeaderProcessor("mail.example.com", true)(tlsMsg())
+	require.NoError(t, err)
+	assert.Equal(t, "Received: from client.example.org ([192.0.2.1])\r\n\tby mail.example.com with ESMTPSA\r\n"+
+		"\t(version=TLS 1.3 cipher=TLS_AES_128_GCM_SHA256)\r\n\tid submission-1;\r\n\tSat, 01 Mar 2025 12:30:00 +0000\r\n"+
+		"Subject: Test\r\n\r\nbody\r\n", string(msg.Body))
+	parsedMsg, err := mail.ReadMessage(bytes.NewReader(msg.Body))
+	require.NoError(t, err)
+	assert.Contains(t, parsedMsg.Header.Get("Received"), "cipher=TLS_AES_128_GCM_SHA256")
+
+	msg, err = ReceivedHeaderProcessor("mail.example.com", false)(tlsMsg())
+	require.NoError(t, err)
+	assert.NotContains(t, string(msg.Body), "version=")
+
+	plaintextMsg := tlsMsg()
+	plaintextMsg.Received.Protocol = "ESMTPA"
+	plaintextMsg.Received.TLSVersion = ""
+	plaintextMsg.Received.TLSCipher = ""
+	msg, err = ReceivedHeaderProcessor("mail.example.com", true)(plaintextMsg)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(msg.Body), "Received: from client.example.org ([192.0.2.1])\r\n\tby mail.example.com with ESMTPA\r\n\tid submission-1;"))
+	assert.NotContains(t, string(msg.Body), "version=")
+
+	envelopeMsg := tlsMsg()
+	envelopeMsg.MailOpts = &smtp.MailOptions{EnvelopeID: "envelope-1"}
+	msg, err = ReceivedHeaderProcessor("mail.example.com", false)(envelopeMsg)
+	require.NoError(t, err)
+	assert.Contains(t, string(msg.Body), "\tid submission-1\r\n\t(envelope-id envelope-1);\r\n")
+
+	envelopeMsg = tlsMsg()
+	envelopeMsg.MailOpts = &smtp.MailOptions{EnvelopeID: "x) injected (y"}
+	msg, err = ReceivedHeaderProcessor("mail.example.com", false)(envelopeMsg)
+	require.NoError(t, err)
+	assert.NotContains(t, string(msg.Body), "envelope-id")
+}
+
+func TestAuthenticationResultsProcessor(t *testing.T) {
+	msg, err := AuthenticationResultsProcessor("mail.example.com")(&backend.ReceivedMessage{
+		From: "user@example.org",
+		Body: []byte("Subject: Test\r\n\r\nbody\r\n"),
+		SPF:  &backend.SPFResult{Result: spf.SoftFail, Domain: "example.org", ClientIP: "192.0.2.1"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "Authentication-Results: mail.example.com;\r\n\tspf=softfail (sender IP is 192.0.2.1) smtp.mailfrom=example.org\r\n"+
+		"Subject: Test\r\n\r\nbody\r\n", string(msg.Body))
+
+	msg, err = AuthenticationResultsProcessor("mail.example.com")(&backend.ReceivedMessage{
+		Body: []byte("Subject: Test\r\n\r\nbody\r\n"),
+		SPF:  &backend.SPFResult{Result: spf.Pass, Domain: "client.example.org", ClientIP: "192.0.2.1"},
+	})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(msg.Body), "Authentication-Results: mail.example.com;\r\n\tspf=pass (sender IP is 192.0.2.1) smtp.helo=client.example.org\r\n"))
+
+	msg, err = AuthenticationResultsProcessor("mail.example.com")(&backend.ReceivedMessage{
+		Body: []byte("Subject: Test\r\n\r\nbody\r\n"),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "Subject: Test\r\n\r\nbody\r\n", string(msg.Body))
+
+	// Results the client claims we added are removed, results of other servers are kept
+	msg, err = AuthenticationResultsProcessor("mail.example.com")(&backend.ReceivedMessage{
+		Body: []byte("Authentication-Results: mail.example.com; spf=pass smtp.mailfrom=example.org\r\n" +
+			"Authentication-Results: other.example.net; dkim=pass header.d=example.org\r\n" +
+			"Authentication-Results: (forged)\r\n\tMAIL.example.com 1;\r\n\tdkim=pass\r\n" +
+			"Subject: Test\r\n\r\nAuthentication-Results: mail.example.com; spf=pass\r\n"),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "Authentication-Results: other.example.net; dkim=pass header.d=example.org\r\n"+
+		"Subject: Test\r\n\r\nAuthentication-Results: mail.example.com; spf=pass\r\n", string(msg.Body))
+}
+
+func TestAuthservID(t *testing.T) {
+	assert.Equal(t, "mail.example.com", authservID("mail.example.com; spf=pass"))
+	assert.Equal(t, "mail.example.com", authservID("mail.example.com 1; spf=pass"))
+	assert.Equal(t, "mail.example.com", authservID("(a (nested) comment) mail.example.com; none"))
+	assert.Equal(t, "mail.example.com", authservID("mail.example.com;none"))
+	assert.Equal(t, "", authservID("(unterminated mail.example.com; none"))
+}
+
+func TestDNSBLHeaderProcessor(t *testing.T) {
+	msg, err := DNSBLHeaderProcessor()(&backend.ReceivedMessage{
+		Body:     []byte("X-DNSBL: none\r\nSubject: Test\r\n\r\nbody\r\n"),
+		Received: &backend.ReceivedInfo{DNSBLListings: []string{"zen.example.org", "bl.example.org"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "X-DNSBL: zen.example.org, bl.example.org\r\nSubject: Test\r\n\r\nbody\r\n", string(msg.Body))
+
+	// Clients which are not listed can't pretend to be
+	msg, err = DNSBLHeaderProcessor()(&backend.ReceivedMessage{
+		Body:     []byte("X-DNSBL: zen.example.org\r\nSubject: Test\r\n\r\nbody\r\n"),
+		Received: &backend.ReceivedInfo{},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "Subject: Test\r\n\r\nbody\r\n", string(msg.Body))
+}
+
+func TestProcessingConsumeOptionsReachQueue(t *testing.T) {
+	rq := queuemocks.NewGenericWorkQueueMock[*backend.ReceivedMessage](t)
+	consumeParams := make(chan liteq.ConsumeParams, 1)
+	rq.On("Consume", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		params := liteq.ConsumeParams{}
+		for _, opt := range args[2:] {
+			opt.(liteq.ConsumeOpt)(&params)
+		}
+		consumeParams <- params
+	}).Return(nil)
+
+	p, err := NewProcessorHandler(context.Background(), slog.Default(), rq,
+		WithProcessingPoolSize(4), WithProcessingVisibilityTimeout(time.Minute*2))
+	require.NoError(t, err)
+	defer p.Shutdown(context.Background())
+
+	select {
+	case params := <-consumeParams:
+		assert.Equal(t, 4, params.PoolSize)
+		assert.Equal(t, int64(120), params.VisibilityTimeout)
+	case <-time.After(time.Second * 5):
+		t.Fatal("receive queue was not consumed")
+	}
+}
+
+func TestProcessingResumesAfterConsumeFailure(t *testing.T) {
+	ctx := context.Background()
+	rq := queuemocks.NewGenericWorkQueueMock[*backend.ReceivedMessage](t)
+	rq.On("Consume", mock.Anything, mock.Anything, mock.Anything).Return(errors.New("database is locked")).Once()
+	rq.On("Consume", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		ctx := args.Get(0).(context.Context)
+		worker := args.Get(1).(liteq.ConsumeFunc[*backend.ReceivedMessage])
+		assert.NoError(t, worker(ctx, &backend.ReceivedMessage{
+			From: "from@example.com",
+			To:   []*backend.Rcpt{{To: "to@example.com"}},
+			Body: []byte("foobar"),
+		}))
+		<-ctx.Done()
+	}).Return(nil).Once()
+
+	queued := make(chan struct{})
+	sq := queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t)
+	sq.On("Queue", mock.Anything, mock.Anything).Run(func(mock.Arguments) {
+		close(queued)
+	}).Return(nil).Once()
+
+	p, err := NewProcessorHandler(ctx, slog.Default(), rq,
+		WithConsumeRestartDelay(time.Millisecond*10),
+		WithPreSendProcessors(SendProcessor(ctx, sq)))
+	require.NoError(t, err)
+
+	select {
+	case <-queued:
+	case <-time.After(time.Second * 5):
+		t.Fatal("processing did not resume after the consumer failed")
+	}
+	require.NoError(t, p.Shutdown(ctx))
+	assert.Equal(t, int64(1), p.ConsumeRestarts())
+}
+
+func TestProcessingDeduplicatesIdenticalMessages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db, err := queue.OpenDB(filepath.Join(t.TempDir(), "queue.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	jq, err := liteq.New(db)
+	require.NoError(t, err)
+	sq := queue.NewSQLiteWorkQueueOnJobQueue[*queue.QueuedMessage](db, jq, "send")
+	tracker, err := queue.NewDeliveryTracker(db)
+	require.NoError(t, err)
+
+	rq := queuemocks.NewGenericWorkQueueMock[*backend.ReceivedMessage](t)
+	rq.On("Consume", mock.Anything, mock.Anything, mock.Anything).Return(nil).Maybe()
+	p, err := NewProcessorHandler(ctx, slog.Default(), rq, WithPreSendProcessors(
+		TrackingProcessor(ctx, tracker),
+		SendProcessor(ctx, sq, liteq.Retries(5))))
+	require.NoError(t, err)
+	defer p.Shutdown(ctx)
+
+	received := func(to string) *backend.ReceivedMessage {
+		return &backend.ReceivedMessage{
+			From:        "from@example.com",
+			To:          []*backend.Rcpt{{To: to}},
+			Body:        []byte("Subject: test\r\n\r\ntest\r\n"),
+			ContentHash: []byte("hash"),
+		}
+	}
+	first := received("to@example.com")
+	require.NoError(t, p.consumeReceivingQueue(ctx, first))
+	// Processing the same submission again must queue it again, it was not queued before if processing failed
+	require.NoError(t, p.consumeReceivingQueue(ctx, first))
+
+	deliveries := make(chan *queue.QueuedMessage, 5)
+	release := make(chan struct{})
+	var attempts atomic.Int32
+	go sq.Consume(ctx, func(ctx context.Context, msg *queue.QueuedMessage) error {
+		deliveries <- msg
+		<-release
+		if attempts.Add(1) == 1 {
+			// Failing the first attempt must not collide with the skipped duplicates
+			return liteq.NewWorkerError(errors.New("temporary failure"), liteq.WithRetryDelay(time.Hour))
+		}
+		return nil
+	}, liteq.PoolSize(1), liteq.OnEmptySleep(time.Millisecond*10))
+	var fetched *queue.QueuedMessage
+	select {
+	case fetched = <-deliveries:
+	case <-time.After(time.Second * 5):
+		t.Fatal("message was not delivered")
+	}
+
+	// Identical submissions are skipped while the first one is being delivered
+	require.NoError(t, p.consumeReceivingQueue(ctx, received("to@example.com")))
+	require.NoError(t, p.consumeReceivingQueue(ctx, received("other@example.com")))
+	require.NoError(t, tracker.UpdateStatus(ctx, fetched, queue.DeliveryStatusDeferred, errors.New("temporary failure")))
+	close(release)
+
+	delivered := []string{fetched.To}
+	timeout := time.After(time.Second * 2)
+collect:
+	for {
+		select {
+		case msg := <-deliveries:
+			if msg.SubmissionID != fetched.SubmissionID {
+				delivered = append(delivered, msg.To)
+			}
+		case <-timeout:
+			break collect
+		}
+	}
+	assert.ElementsMatch(t, []string{"to@example.com", "other@example.com"}, delivered)
+}
+
+func TestProcessingLoadsSpooledBody(t *testing.T) {
+	ctx := context.Background()
+	bodyFile := filepath.Join(t.TempDir(), "body.eml")
+	require.NoError(t, os.WriteFile(bodyFile, []byte("Subject: spooled\r\n\r\ntest\r\n"), 0600))
+
+	rq := queuemocks.NewGenericWorkQueueMock[*backend.ReceivedMessage](t)
+	rq.On("Consume", mock.Anything, mock.Anything, mock.Anything).Return(nil).Maybe()
+	sq := queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t)
+	sq.On("Queue", mock.Anything, mock.MatchedBy(func(msg *queue.QueuedMessage) bool {
+		return string(msg.Body) == "Subject: spooled\r\n\r\ntest\r\n"
+	})).Return(nil).Once()
+
+	p, err := NewProcessorHandler(ctx, slog.Default(), rq, WithPreSendProcessors(SendProcessor(ctx, sq)))
+	require.NoError(t, err)
+	defer p.Shutdown(ctx)
+
+	require.NoError(t, p.consumeReceivingQueue(ctx, &backend.ReceivedMessage{
+		From:     "from@example.com",
+		To:       []*backend.Rcpt{{To: "to@example.com"}},
+		BodyFile: bodyFile,
+	}))
+	assert.NoFileExists(t, bodyFile, "spooled bodies are removed once the message is queued for sending")
+}
+
+func TestAuthUserReachesProcessors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	jq, err := liteq.NewFromPath(filepath.Join(t.TempDir(), "queue.db"))
+	require.NoError(t, err)
+	rq := liteq.NewQueue[*backend.ReceivedMessage](jq, "receive", liteq.JSONMarshaler[*backend.ReceivedMessage]{})
+
+	receivedAs := make(chan string, 1)
+	signedAs := make(chan string, 1)
+	p, err := NewProcessorHandler(ctx, slog.Default(), rq,
+		WithReceiveProcessors(func(msg *backend.ReceivedMessage) (*backend.ReceivedMessage, error) {
+			receivedAs <- msg.AuthUser
+			return msg, nil
+		}),
+		WithSigningProcessors(func(msg *backend.ReceivedMessage) (*backend.ReceivedMessage, error) {
+			signedAs <- msg.AuthUser
+			return msg, nil
+		}))
+	require.NoError(t, err)
+	defer p.Shutdown(context.Background())
+
+	require.NoError(t, rq.Put(ctx, &backend.ReceivedMessage{
+		From:     "from@example.com",
+		To:       []*backend.Rcpt{{To: "to@example.org"}},
+		Body:     []byte("Subject: Test\r\n\r\nbody\r\n"),
+		AuthUser: "tenant",
+	}))
+	for _, processed := range []chan string{receivedAs, signedAs} {
+		select {
+		case authUser := <-processed:
+			assert.Equal(t, "tenant", authUser)
+		case <-time.After(time.Second * 5):
+			t.Fatal("message was not processed")
+		}
+	}
+}
+
+func TestDeliverAtProcessor(t *testing.T) {
+	deliverAt := time.Date(2030, time.March, 4, 10, 30, 0, 0, time.UTC)
+	for _, test := range []struct {
+		name      string
+		header    string
+		deliverAt time.Time
+		err       bool
+	}{
+		{name: "no header", deliverAt: time.Time{}},
+		{name: "RFC 3339", header: "X-Smolmailer-Deliver-At: 2030-03-04T11:30:00+01:00\r\n", deliverAt: deliverAt},
+		{name: "RFC 5322", header: "X-Smolmailer-Deliver-At: Mon, 04 Mar 2030 10:30:00 +0000\r\n", deliverAt: deliverAt},
+		{name: "invalid", header: "X-Smolmailer-Deliver-At: tomorrow\r\n", err: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			msg, err := DeliverAtProcessor()(&backend.ReceivedMessage{
+				Body: []byte("Subject: Test\r\n" + test.header + "\r\nbody\r\n"),
+			})
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.True(t, test.deliverAt.Equal(msg.DeliverAt), "expected %s, got %s", test.deliverAt, msg.DeliverAt)
+			assert.Equal(t, "Subject: Test\r\n\r\nbody\r\n", string(msg.Body), "the header must not be delivered")
+		})
+	}
+}
+
+func TestScheduledMessagesAreNotDeliveredEarly(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	queuePath := filepath.Join(t.TempDir(), "queue.db")
+	db, err := queue.OpenDB(queuePath)
+	require.NoError(t, err)
+	defer db.Close()
+	jq, err := liteq.New(db)
+	require.NoError(t, err)
+	rq := liteq.NewQueue[*backend.ReceivedMessage](jq, "receive", liteq.JSONMarshaler[*backend.ReceivedMessage]{})
+	sq := queue.NewSQLiteWorkQueueOnJobQueue[*queue.QueuedMessage](db, jq, "send")
+
+	queued := make(chan struct{})
+	p, err := NewProcessorHandler(ctx, slog.Default(), rq,
+		WithReceiveProcessors(DeliverAtProcessor()),
+		WithPreSendProcessors(SendProcessor(ctx, sq), func(msg *queue.QueuedMessage) (*queue.QueuedMessage, error) {
+			close(queued)
+			return msg, nil
+		}))
+	require.NoError(t, err)
+	deliverAt := time.Now().Add(time.Second * 2)
+	require.NoError(t, rq.Put(ctx, &backend.ReceivedMessage{
+		From: "from@example.com",
+		To:   []*backend.Rcpt{{To: "to@example.org"}},
+		Body: []byte("X-Smolmailer-Deliver-At: " + deliverAt.Format(time.RFC3339Nano) + "\r\nSubject: Test\r\n\r\nbody\r\n"),
+	}))
+	select {
+	case <-queued:
+	case <-time.After(time.Second * 5):
+		t.Fatal("message was not queued for sending")
+	}
+	require.NoError(t, p.Shutdown(ctx))
+
+	// The schedule must survive a restart
+	db, err = queue.OpenDB(queuePath)
+	require.NoError(t, err)
+	defer db.Close()
+	jq, err = liteq.New(db)
+	require.NoError(t, err)
+	sq = queue.NewSQLiteWorkQueueOnJobQueue[*queue.QueuedMessage](db, jq, "send")
+	delivered := make(chan *queue.QueuedMessage, 1)
+	go sq.Consume(ctx, func(ctx context.Context, msg *queue.QueuedMessage) error {
+		delivered <- msg
+		return nil
+	}, liteq.OnEmptySleep(time.Millisecond*10))
+	select {
+	case msg := <-delivered:
+		assert.False(t, time.Now().Before(deliverAt), "message was delivered %s early", deliverAt.Sub(time.Now()))
+		assert.True(t, deliverAt.Equal(msg.DeliverAt))
+	case <-time.After(time.Second * 5):
+		t.Fatal("scheduled message was not delivered")
+	}
+}
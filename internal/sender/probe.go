@@ -0,0 +1,72 @@
+package sender
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/dereulenspiegel/smolmailer/internal/config"
+)
+
+// PortProbe is the outcome of a connection attempt to a single port of the probe host
+type PortProbe struct {
+	Port      int
+	Reachable bool
+	Err       error
+}
+
+// ProbeOutboundSmtp tries to connect to every probe port of the probe host from the send address.
+// Many providers block outgoing connections on port 25, which otherwise only shows up as failing deliveries.
+// The probe connects through the outbound proxy if one is configured.
+func ProbeOutboundSmtp(ctx context.Context, logger *slog.Logger, cfg *config.Config) []PortProbe {
+	probeCfg := cfg.OutboundProbe
+	dialer := newDialer(logger, cfg.SendAddr)
+	if probeCfg.Timeout > 0 {
+		dialer.Timeout = probeCfg.Timeout
+	}
+	probeDialer := outboundDialer(logger, cfg, dialer)
+
+	results := make([]PortProbe, len(probeCfg.Ports))
+	done := make(chan struct{}, len(probeCfg.Ports))
+	for i, port := range probeCfg.Ports {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			results[i] = probePort(ctx, probeDialer, probeCfg.Host, port)
+		}()
+	}
+	for range probeCfg.Ports {
+		<-done
+	}
+	return results
+}
+
+func probePort(ctx context.Context, dialer contextDialer, host string, port int) PortProbe {
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, fmt.Sprint(port)))
+	if err != nil {
+		return PortProbe{Port: port, Err: err}
+	}
+	conn.Close()
+	return PortProbe{Port: port, Reachable: true}
+}
+
+// newDialer creates the dialer for outgoing connections, bound to the send address if one is configured
+func newDialer(logger *slog.Logger, sendAddr string) *net.Dialer {
+	dialer := &net.Dialer{
+		Timeout: time.Second * 30,
+	}
+
+	if sendAddr != "" {
+		sendIp := net.ParseIP(sendAddr)
+		if sendIp != nil {
+			dialer.LocalAddr = &net.TCPAddr{
+				IP:   sendIp,
+				Port: 0,
+			}
+		} else {
+			logger.With("sendAddr", sendAddr).Error("send address has invalid format, ignoring it")
+		}
+	}
+	return dialer
+}
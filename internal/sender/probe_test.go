@@ -0,0 +1,42 @@
+package sender
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dereulenspiegel/smolmailer/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbeOutboundSmtp(t *testing.T) {
+	host, openPort := startTestSmtpServer(t, &concurrencyBackend{})
+
+	// Take a free port and release it again, so nothing listens on it
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	blockedPort := listener.Addr().(*net.TCPAddr).Port
+	require.NoError(t, listener.Close())
+
+	cfg := &config.Config{
+		SendAddr: "127.0.0.1",
+		OutboundProbe: &config.OutboundProbe{
+			Host:    host,
+			Ports:   []int{openPort, blockedPort},
+			Timeout: time.Second,
+		},
+	}
+	probes := ProbeOutboundSmtp(context.Background(), slog.Default(), cfg)
+	require.Len(t, probes, 2)
+
+	assert.Equal(t, openPort, probes[0].Port)
+	assert.True(t, probes[0].Reachable)
+	assert.NoError(t, probes[0].Err)
+
+	assert.Equal(t, blockedPort, probes[1].Port)
+	assert.False(t, probes[1].Reachable)
+	assert.Error(t, probes[1].Err)
+}
@@ -0,0 +1,191 @@
+package sender
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/dereulenspiegel/smolmailer/internal/config"
+	"golang.org/x/net/proxy"
+)
+
+// contextDialer opens connections to other mail servers, either directly or through a proxy
+type contextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// outboundDialer returns the dialer for connections to other mail servers, which goes through the outbound
+// proxy if one is configured
+func outboundDialer(logger *slog.Logger, cfg *config.Config, dialer *net.Dialer) contextDialer {
+	if !cfg.OutboundProxyEnabled() {
+		return dialer
+	}
+	proxyDialer, err := newProxyDialer(cfg, dialer)
+	if err != nil {
+		// The config was validated before, but connections must never bypass the proxy
+		logger.Error("invalid outbound proxy, outgoing connections will fail", "err", err)
+		return failingDialer{err: err}
+	}
+	return proxyDialer
+}
+
+// newProxyDialer creates a dialer connecting through the outbound proxy. Connecting to the proxy and the
+// proxy handshake are limited by the timeout of the forward dialer.
+func newProxyDialer(cfg *config.Config, forward *net.Dialer) (contextDialer, error) {
+	proxyURL, err := cfg.OutboundProxyURL()
+	if err != nil {
+		return nil, err
+	}
+	var dialer contextDialer
+	switch proxyURL.Scheme {
+	case "http":
+		dialer = &httpConnectDialer{
+			proxyAddr:          proxyAddress(proxyURL),
+			proxyAuthorization: proxyAuthorization(proxyURL),
+			forward:            forward,
+		}
+	default:
+		socksDialer, err := proxy.FromURL(proxyURL, forward)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create outbound proxy dialer: %w", err)
+		}
+		contextDialer, ok := socksDialer.(proxy.ContextDialer)
+		if !ok {
+			return nil, fmt.Errorf("outbound proxy dialer for %s does not support contexts", proxyURL.Scheme)
+		}
+		dialer = contextDialer
+	}
+	return &timeoutDialer{dialer: dialer, timeout: forward.Timeout}, nil
+}
+
+// CheckOutboundProxy ensures the outbound proxy accepts connections from the send address
+func CheckOutboundProxy(ctx context.Context, logger *slog.Logger, cfg *config.Config) error {
+	proxyURL, err := cfg.OutboundProxyURL()
+	if err != nil {
+		return err
+	}
+	dialer := newDialer(logger, cfg.SendAddr)
+	if cfg.DialTimeout > 0 {
+		dialer.Timeout = cfg.DialTimeout
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddress(proxyURL))
+	if err != nil {
+		return fmt.Errorf("outbound proxy %s is unreachable: %w", proxyURL.Redacted(), err)
+	}
+	return conn.Close()
+}
+
+// proxyAddress returns the network address of the proxy, using the default port of its scheme if none is set
+func proxyAddress(proxyURL *url.URL) string {
+	port := proxyURL.Port()
+	if port == "" {
+		port = "1080"
+		if proxyURL.Scheme == "http" {
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(proxyURL.Hostname(), port)
+}
+
+// proxyAuthorization returns the basic credentials for the Proxy-Authorization header or an empty string
+// if the proxy URL has no user
+func proxyAuthorization(proxyURL *url.URL) string {
+	if proxyURL.User == nil {
+		return ""
+	}
+	password, _ := proxyURL.User.Password()
+	credentials := proxyURL.User.Username() + ":" + password
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+}
+
+// timeoutDialer limits connecting through a proxy including the proxy handshake, like the timeout of a
+// net.Dialer limits connecting directly
+type timeoutDialer struct {
+	dialer  contextDialer
+	timeout time.Duration
+}
+
+func (t *timeoutDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if t.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+		defer cancel()
+	}
+	return t.dialer.DialContext(ctx, network, address)
+}
+
+// httpConnectDialer tunnels connections through a HTTP proxy with the CONNECT method
+type httpConnectDialer struct {
+	proxyAddr          string
+	proxyAuthorization string
+	forward            *net.Dialer
+}
+
+func (h *httpConnectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := h.forward.DialContext(ctx, network, h.proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy %s: %w", h.proxyAddr, err)
+	}
+	stop := abortOnDone(ctx, conn)
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if h.proxyAuthorization != "" {
+		req.Header.Set("Proxy-Authorization", h.proxyAuthorization)
+	}
+	reader := bufio.NewReader(conn)
+	err = req.Write(conn)
+	if err == nil {
+		var resp *http.Response
+		resp, err = http.ReadResponse(reader, req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("proxy refused to connect to %s: %s", address, resp.Status)
+			}
+		}
+	}
+	if !stop() && err == nil {
+		err = context.Cause(ctx)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect to %s through proxy %s: %w", address, h.proxyAddr, err)
+	}
+	if reader.Buffered() > 0 {
+		// The server greeting may have arrived together with the response of the proxy
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads the data already buffered while reading the proxy response before reading from the
+// connection
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
+
+// failingDialer refuses every connection, so an unusable proxy is never bypassed
+type failingDialer struct {
+	err error
+}
+
+func (f failingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return nil, errors.Join(fmt.Errorf("can't connect to %s", address), f.err)
+}
@@ -0,0 +1,187 @@
+package sender
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/dereulenspiegel/smolmailer/internal/config"
+	"github.com/dereulenspiegel/smolmailer/internal/queue"
+	"github.com/dereulenspiegel/smolmailer/internal/queue/queuemocks"
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startTestProxy accepts connections, lets handshake read the requested target and relays the connection
+// to the upstream address instead. The requested targets are sent to the returned channel.
+func startTestProxy(t *testing.T, upstream string, handshake func(conn net.Conn, reader *bufio.Reader) (string, error)) (string, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	targets := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				target, err := handshake(conn, reader)
+				if err != nil {
+					return
+				}
+				targets <- target
+				upstreamConn, err := net.Dial("tcp", upstream)
+				if err != nil {
+					return
+				}
+				defer upstreamConn.Close()
+				go io.Copy(upstreamConn, reader)
+				io.Copy(conn, upstreamConn)
+			}()
+		}
+	}()
+	return listener.Addr().String(), targets
+}
+
+// socks5Handshake implements the server side of a SOCKS5 CONNECT without authentication
+func socks5Handshake(conn net.Conn, reader *bufio.Reader) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(reader, make([]byte, header[1])); err != nil {
+		return "", err
+	}
+	if _, err := conn.Write([]byte{0x05, 0x00}); err != nil {
+		return "", err
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(reader, request); err != nil {
+		return "", err
+	}
+	var host string
+	switch request[3] {
+	case 0x01:
+		ip := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case 0x03:
+		length, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		name := make([]byte, length)
+		if _, err := io.ReadFull(reader, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("unsupported address type %d", request[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return "", err
+	}
+	if _, err := conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// httpConnectHandshake accepts a HTTP CONNECT request if it carries the expected Proxy-Authorization header
+func httpConnectHandshake(proxyAuthorization string) func(conn net.Conn, reader *bufio.Reader) (string, error) {
+	return func(conn net.Conn, reader *bufio.Reader) (string, error) {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return "", err
+		}
+		if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != proxyAuthorization {
+			_, err := io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return "", fmt.Errorf("unauthorized proxy request: %w", err)
+		}
+		_, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		return req.Host, err
+	}
+}
+
+// newProxiedTestSender delivers to a mx host which only the proxy can reach
+func newProxiedTestSender(t *testing.T, cfg *config.Config, port int) *Sender {
+	s := newTestSender(t, cfg, queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t), "mx.proxied.invalid", port)
+	proxyDialer, err := newProxyDialer(cfg, s.defaultDialer)
+	require.NoError(t, err)
+	s.proxyDialer = proxyDialer
+	return s
+}
+
+func testProxiedMessage() *queue.QueuedMessage {
+	return &queue.QueuedMessage{
+		From:     "from@example.com",
+		To:       "rcpt@example.org",
+		Body:     []byte("test"),
+		MailOpts: &smtp.MailOptions{},
+	}
+}
+
+func TestDeliveryThroughSocks5Proxy(t *testing.T) {
+	be := &concurrencyBackend{}
+	host, port := startTestSmtpServer(t, be)
+	proxyAddr, targets := startTestProxy(t, net.JoinHostPort(host, strconv.Itoa(port)), socks5Handshake)
+
+	s := newProxiedTestSender(t, &config.Config{MailDomain: "example.com", OutboundProxy: "socks5://" + proxyAddr}, port)
+	require.NoError(t, s.sendMail(context.Background(), testProxiedMessage()))
+	assert.Equal(t, net.JoinHostPort("mx.proxied.invalid", strconv.Itoa(port)), <-targets)
+	assert.Equal(t, int32(1), be.delivered.Load())
+}
+
+func TestDeliveryThroughHttpConnectProxy(t *testing.T) {
+	be := &concurrencyBackend{}
+	host, port := startTestSmtpServer(t, be)
+	proxyAddr, targets := startTestProxy(t, net.JoinHostPort(host, strconv.Itoa(port)),
+		httpConnectHandshake("Basic dXNlcjpzZWNyZXQ="))
+
+	s := newProxiedTestSender(t, &config.Config{MailDomain: "example.com", OutboundProxy: "http://user:secret@" + proxyAddr}, port)
+	require.NoError(t, s.sendMail(context.Background(), testProxiedMessage()))
+	assert.Equal(t, net.JoinHostPort("mx.proxied.invalid", strconv.Itoa(port)), <-targets)
+	assert.Equal(t, int32(1), be.delivered.Load())
+}
+
+func TestHttpConnectProxyRefusal(t *testing.T) {
+	be := &concurrencyBackend{}
+	host, port := startTestSmtpServer(t, be)
+	proxyAddr, _ := startTestProxy(t, net.JoinHostPort(host, strconv.Itoa(port)),
+		httpConnectHandshake("Basic dXNlcjpzZWNyZXQ="))
+
+	s := newProxiedTestSender(t, &config.Config{MailDomain: "example.com", OutboundProxy: "http://user:wrong@" + proxyAddr}, port)
+	err := s.sendMail(context.Background(), testProxiedMessage())
+	require.Error(t, err)
+	assert.ErrorContains(t, err, "407")
+	assert.Equal(t, int32(0), be.delivered.Load())
+}
+
+func TestCheckOutboundProxy(t *testing.T) {
+	proxyAddr, _ := startTestProxy(t, "127.0.0.1:0", socks5Handshake)
+	assert.NoError(t, CheckOutboundProxy(context.Background(), slog.Default(), &config.Config{OutboundProxy: "socks5://" + proxyAddr}))
+
+	// Take a free port and release it again, so nothing listens on it
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closedAddr := listener.Addr().String()
+	require.NoError(t, listener.Close())
+	assert.Error(t, CheckOutboundProxy(context.Background(), slog.Default(), &config.Config{OutboundProxy: "socks5://" + closedAddr}))
+}
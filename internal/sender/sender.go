@@ -8,17 +8,44 @@ import (
 	"log/slog"
 	"net"
 	"slices"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dereulenspiegel/liteq"
 	"github.com/dereulenspiegel/smolmailer/internal/config"
+	"github.com/dereulenspiegel/smolmailer/internal/dns"
 	"github.com/dereulenspiegel/smolmailer/internal/queue"
+	"github.com/dereulenspiegel/smolmailer/internal/tracing"
 	"github.com/dereulenspiegel/smolmailer/internal/utils"
+	"github.com/emersion/go-msgauth/dkim"
 	"github.com/emersion/go-smtp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/oauth2"
 )
 
-const maxRetries = 10
+var (
+	ErrTLSRequired    = errors.New("message requires TLS, but no TLS secured delivery path was available")
+	ErrMessageExpired = errors.New("message exceeded the maximum queue age")
+	ErrSenderClosed   = errors.New("sender is closed")
+	// ErrDeliveryTimeout is the cause of deliveries aborted because they exceeded the configured delivery timeout
+	ErrDeliveryTimeout = errors.New("delivery exceeded the delivery timeout")
+	// ErrDeliveryAborted is the cause of deliveries aborted because shutting down did not wait for them any longer
+	ErrDeliveryAborted = errors.New("delivery aborted during shutdown")
+
+	ErrRecipientDomainDenied = errors.New("delivery to the recipient domain is not permitted")
+	// ErrMalformedRecipient is the cause of deliveries to recipient addresses without domain
+	ErrMalformedRecipient = errors.New("recipient address has no domain")
+	// ErrPendingUnsupported is returned if the send queue can't count its outstanding messages
+	ErrPendingUnsupported = errors.New("send queue can't count pending messages")
+)
+
+// DefaultSendPoolSize is the number of concurrent deliveries from a send queue without a configured pool size
+const DefaultSendPoolSize = 10
+
+// defaultIdlePollInterval is how often Idle checks whether the send queue is drained
+const defaultIdlePollInterval = time.Second
 
 type Sender struct {
 	cfg    *config.Config
@@ -27,241 +54,833 @@ type Sender struct {
 
 	ctx       context.Context
 	ctxCancel context.CancelFunc
+	runDone   chan struct{}
+	// abortCtx is cancelled when shutting down gives up on waiting for deliveries in flight
+	abortCtx        context.Context
+	abortDeliveries context.CancelCauseFunc
+
+	closeLock  *sync.Mutex
+	closing    bool
+	deliveries *sync.WaitGroup
 
 	mxResolver func(string) ([]*net.MX, error)
+	mxLookups  *submissionMxResolver
 	mxPorts    []int
+	poolSize   int
+	// visibilityTimeout is the time after which messages taken by a crashed consumer are delivered again
+	visibilityTimeout time.Duration
+	idlePollInterval  time.Duration
+
+	consumeRestartDelay time.Duration
+	consumeRestarts     atomic.Int64
 
 	defaultDialer *net.Dialer
+	// proxyDialer connects through the outbound proxy, connections are made directly if it is nil
+	proxyDialer contextDialer
+	// smarthostTokens provides the access tokens for smarthosts using XOAUTH2
+	smarthostTokens oauth2.TokenSource
+
+	submissionLimiter *submissionLimiter
+	deliveryTracker   *queue.DeliveryTracker
+	hostBackoff       *hostBackoff
+	circuitBreaker    *hostCircuitBreaker
+
+	// bounceSigning signs the generated bounces, which skip the signing of received messages
+	bounceSigning           []*dkim.SignOptions
+	bounceSignatureValidity time.Duration
 }
 
-func NewSender(ctx context.Context, logger *slog.Logger, cfg *config.Config, q queue.GenericWorkQueue[*queue.QueuedMessage]) (*Sender, error) {
-	bCtx, cancel := context.WithCancel(ctx)
+type SenderOpt func(*Sender)
 
-	dialer := &net.Dialer{
-		Timeout: time.Second * 30,
+// WithVisibilityTimeout delivers messages again, which were taken from the send queue by a consumer that
+// did not finish within the timeout. A value of 0 never delivers them again.
+func WithVisibilityTimeout(visibilityTimeout time.Duration) SenderOpt {
+	return func(s *Sender) {
+		s.visibilityTimeout = visibilityTimeout
 	}
+}
 
-	if cfg.SendAddr != "" {
-		sendIp := net.ParseIP(cfg.SendAddr)
-		if sendIp != nil {
-			dialer.LocalAddr = &net.TCPAddr{
-				IP:   sendIp,
-				Port: 0,
-			}
-		} else {
-			logger.With("sendAddr", cfg.SendAddr).Error("send address has invalid format, ignoring it")
+// WithDeliveryTracker records the delivery status of every sent message
+func WithDeliveryTracker(tracker *queue.DeliveryTracker) SenderOpt {
+	return func(s *Sender) {
+		s.deliveryTracker = tracker
+	}
+}
+
+// WithBounceSigning DKIM signs generated bounces with every sign option, so they pass the DMARC policy of the
+// mail domain. Signatures expire after signatureValidity like the signatures of received messages.
+func WithBounceSigning(signatureValidity time.Duration, signOptions ...*dkim.SignOptions) SenderOpt {
+	return func(s *Sender) {
+		s.bounceSigning = signOptions
+		s.bounceSignatureValidity = signatureValidity
+	}
+}
+
+// WithSendConsumeRestartDelay sets the initial delay before consuming the send queue is restarted after it failed.
+// The delay doubles with every consecutive failure up to a minute.
+func WithSendConsumeRestartDelay(restartDelay time.Duration) SenderOpt {
+	return func(s *Sender) {
+		if restartDelay > 0 {
+			s.consumeRestartDelay = restartDelay
+		}
+	}
+}
+
+// WithPoolSize sets the number of concurrent deliveries from the send queue. Values of 0 or less use the default.
+func WithPoolSize(poolSize int) SenderOpt {
+	return func(s *Sender) {
+		if poolSize > 0 {
+			s.poolSize = poolSize
 		}
 	}
+}
+
+func NewSender(ctx context.Context, logger *slog.Logger, cfg *config.Config, q queue.GenericWorkQueue[*queue.QueuedMessage], opts ...SenderOpt) (*Sender, error) {
+	bCtx, cancel := context.WithCancel(ctx)
+	abortCtx, abortDeliveries := context.WithCancelCause(context.Background())
+
+	dialer := newDialer(logger, cfg.SendAddr)
+	if cfg.DialTimeout > 0 {
+		dialer.Timeout = cfg.DialTimeout
+	}
 
 	if cfg.Dkim == nil {
 		cancel()
+		abortDeliveries(nil)
 		return nil, errors.New("no dkim config specified")
 	}
 
 	s := &Sender{
-		ctx:           bCtx,
-		ctxCancel:     cancel,
-		q:             q,
-		cfg:           cfg,
-		mxResolver:    lookupMX,
-		logger:        logger,
-		mxPorts:       []int{25, 465, 587},
-		defaultDialer: dialer,
+		ctx:       bCtx,
+		ctxCancel: cancel,
+		runDone:   make(chan struct{}),
+
+		abortCtx:        abortCtx,
+		abortDeliveries: abortDeliveries,
+		closeLock:       &sync.Mutex{},
+		deliveries:      &sync.WaitGroup{},
+		q:               q,
+		cfg:             cfg,
+		mxResolver:      lookupMX,
+		logger:          logger,
+		mxPorts:         []int{25, 465, 587},
+		poolSize:        DefaultSendPoolSize,
+		defaultDialer:   dialer,
+
+		idlePollInterval: defaultIdlePollInterval,
+
+		consumeRestartDelay: defaultConsumeRestartDelay,
+
+		submissionLimiter: newSubmissionLimiter(cfg.MaxDeliveriesPerSubmission),
+		hostBackoff:       newHostBackoff(),
+		circuitBreaker:    newHostCircuitBreaker(cfg.CircuitBreakerThreshold, cfg.CircuitBreakerCooldown),
+	}
+	if cfg.OutboundProxyEnabled() {
+		s.proxyDialer = outboundDialer(logger, cfg, dialer)
+	}
+	if len(cfg.MxPorts) > 0 {
+		s.mxPorts = cfg.MxPorts
+	}
+	if cfg.SmarthostEnabled() && cfg.Smarthost.OAuth2Enabled() {
+		s.smarthostTokens = newSmarthostTokenSource(ctx, cfg.Smarthost.OAuth2)
 	}
 	if cfg.TestingOpts != nil {
 		s.mxPorts = cfg.TestingOpts.MxPorts
 		s.mxResolver = cfg.TestingOpts.MxResolv
 	}
+	s.mxLookups = newSubmissionMxResolver(func(domain string) ([]*net.MX, error) {
+		return s.mxResolver(domain)
+	})
+	for _, opt := range opts {
+		opt(s)
+	}
 	go s.run()
 	return s, nil
 }
 
+// Close stops consuming the send queue and blocks until all deliveries in flight have finished
 func (s *Sender) Close() error {
+	return s.Shutdown(context.Background())
+}
+
+// Shutdown stops consuming the send queue and waits until all deliveries in flight have finished
+// or ctx is done, in which case the remaining deliveries are aborted.
+func (s *Sender) Shutdown(ctx context.Context) error {
 	s.ctxCancel()
+	select {
+	case <-s.runDone:
+	case <-ctx.Done():
+		s.abortDeliveries(ErrDeliveryAborted)
+		return fmt.Errorf("failed to stop consuming the send queue: %w", ctx.Err())
+	}
+
+	s.closeLock.Lock()
+	s.closing = true
+	s.closeLock.Unlock()
+
+	deliveriesDone := make(chan struct{})
+	go func() {
+		s.deliveries.Wait()
+		close(deliveriesDone)
+	}()
+	select {
+	case <-deliveriesDone:
+	case <-ctx.Done():
+		s.abortDeliveries(ErrDeliveryAborted)
+		return fmt.Errorf("failed to wait for deliveries in flight: %w", ctx.Err())
+	}
 	return nil
 }
 
+// ConsumeRestarts returns how often consuming the send queue was restarted after a failure
+func (s *Sender) ConsumeRestarts() int64 {
+	return s.consumeRestarts.Load()
+}
+
+// Pending returns the number of messages in the send queue which are waiting for delivery or being
+// delivered, including messages waiting for a retry or their scheduled delivery time
+func (s *Sender) Pending(ctx context.Context) (int, error) {
+	counter, ok := s.q.(queue.PendingCounter)
+	if !ok {
+		return 0, ErrPendingUnsupported
+	}
+	return counter.Pending(ctx)
+}
+
+// Idle returns a channel which is closed as soon as the send queue is drained. The send queue is checked
+// until it is drained or the sender is shut down, in which case the channel is never closed. The channel
+// is never closed either if the send queue can't count its pending messages.
+func (s *Sender) Idle() <-chan struct{} {
+	idle := make(chan struct{})
+	go func() {
+		tick := time.NewTicker(s.idlePollInterval)
+		defer tick.Stop()
+		for {
+			pending, err := s.Pending(s.ctx)
+			if errors.Is(err, ErrPendingUnsupported) {
+				return
+			}
+			if err != nil && s.ctx.Err() == nil {
+				s.logger.Error("failed to check whether the send queue is drained", "err", err)
+			}
+			if err == nil && pending == 0 {
+				close(idle)
+				return
+			}
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-tick.C:
+			}
+		}
+	}()
+	return idle
+}
+
+// run consumes the send queue until the sender is shut down. Like consuming the receive queue, it is restarted
+// with an exponential backoff if it fails, so a transient database error doesn't stop all deliveries.
 func (s *Sender) run() {
+	defer close(s.runDone)
+	consumeOpts := []liteq.ConsumeOpt{liteq.PoolSize(s.poolSize)}
+	if s.visibilityTimeout > 0 {
+		consumeOpts = append(consumeOpts, liteq.VisibilityTimeout(s.visibilityTimeout))
+	}
+	restartDelay := s.consumeRestartDelay
+	for {
+		started := time.Now()
+		err := s.q.Consume(s.ctx, s.consume, consumeOpts...)
+		if err == nil || s.ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > maxConsumeRestartDelay {
+			// The consumer ran fine for a while, so this is not a consecutive failure
+			restartDelay = s.consumeRestartDelay
+		}
+		restarts := s.consumeRestarts.Add(1)
+		s.logger.Error("failed to consume send queue, restarting", "err", err, "restartDelay", restartDelay, "restarts", restarts)
+		select {
+		case <-time.After(restartDelay):
+		case <-s.ctx.Done():
+			return
+		}
+		restartDelay = min(restartDelay*2, maxConsumeRestartDelay)
+	}
+}
 
-	if err := s.q.Consume(s.ctx, s.trySend); err != nil {
-		s.logger.Error("failed to consume queue", "err", err)
-		return
+// consume keeps track of deliveries in flight, so shutting down can wait for them
+func (s *Sender) consume(ctx context.Context, msg *queue.QueuedMessage) error {
+	s.closeLock.Lock()
+	if s.closing {
+		s.closeLock.Unlock()
+		// Do not start new deliveries while shutting down
+		return ErrSenderClosed
 	}
+	s.deliveries.Add(1)
+	s.closeLock.Unlock()
+	defer s.deliveries.Done()
+
+	// Deliveries in flight are not interrupted when the queue consumption stops, but only when shutting
+	// down does not wait for them any longer
+	ctx, cancel := context.WithCancelCause(context.WithoutCancel(ctx))
+	defer cancel(nil)
+	stop := context.AfterFunc(s.abortCtx, func() { cancel(context.Cause(s.abortCtx)) })
+	defer stop()
+	return s.trySend(ctx, msg)
 }
 
 func (s *Sender) trySend(ctx context.Context, msg *queue.QueuedMessage) error {
 	if msg.MailOpts == nil {
-		// TODO generate envelope id if missing
+		// Sessions give every message mail options with an envelope id, only messages queued by older versions lack them
 		msg.MailOpts = &smtp.MailOptions{}
 	}
 	logger := s.logger.With("from", msg.From, "to", msg.To, "msgid", msg.MailOpts.EnvelopeID)
+	if s.isExpired(msg) {
+		logger.Error("message exceeded the maximum queue age, giving up", "receivedAt", msg.ReceivedAt, "queueMaxAge", s.cfg.QueueMaxAge)
+		s.logAccess(AccessEventBounced, msg, nil, ErrMessageExpired)
+		return s.failPermanently(ctx, msg, ErrMessageExpired)
+	}
+	if !s.submissionLimiter.Acquire(msg.SubmissionID) {
+		logger.Debug("too many deliveries in flight for submission, deferring message", "submissionId", msg.SubmissionID)
+		s.logAccess(AccessEventQueued, msg, nil, nil)
+		return s.deferMessage(ctx, msg)
+	}
+	defer s.submissionLimiter.Release(msg.SubmissionID)
 	logger.Info("sending mail")
-
-	err := s.sendMail(msg)
+	ctx, attempt := withDeliveryAttempt(ctx)
+	s.logAccess(AccessEventStarted, msg, attempt, nil)
+
+	ctx, span := tracing.Tracer().Start(tracing.Extract(ctx, msg.TraceContext), "deliver", trace.WithAttributes(
+		attribute.String("smtp.to", msg.To),
+		attribute.String("smolmailer.submission_id", msg.SubmissionID),
+	))
+	err := s.sendMail(ctx, msg)
+	tracing.End(span, err)
+	if errors.Is(err, ErrSmarthostAuthRejected) {
+		logger.Error("smarthost rejected our credentials", "err", err)
+		s.logAccess(AccessEventBounced, msg, attempt, err)
+		return s.failPermanently(ctx, msg, err)
+	}
+	if errors.Is(err, ErrMalformedRecipient) {
+		logger.Error("refusing to deliver message to a malformed recipient address", "err", err)
+		s.logAccess(AccessEventBounced, msg, attempt, err)
+		return s.failPermanently(ctx, msg, err)
+	}
+	if errors.Is(err, ErrRecipientDomainDenied) {
+		logger.Error("refusing to deliver message to a denied recipient domain", "err", err)
+		s.logAccess(AccessEventBounced, msg, attempt, err)
+		return s.failPermanently(ctx, msg, err)
+	}
+	if errors.Is(err, ErrTLSRequired) {
+		// Do not retry, REQUIRETLS messages must fail instead of being downgraded (RFC 8689 section 4.2.1)
+		logger.Error("refusing to deliver message without TLS", "err", err)
+		s.logAccess(AccessEventBounced, msg, attempt, err)
+		return s.failPermanently(ctx, msg, err)
+	}
 	if err != nil {
 		logger.Error("failed to send outgoing message", "err", err)
-		return decideRetry(ctx, err)
+		retryErr, retry := decideRetry(ctx, msg, err)
+		if !retry || s.isExpired(msg) {
+			s.logAccess(AccessEventBounced, msg, attempt, err)
+			return s.failPermanently(ctx, msg, err)
+		}
+		s.logAccess(AccessEventDeferred, msg, attempt, err)
+		s.trackDelivery(ctx, msg, queue.DeliveryStatusDeferred, err)
+		return retryErr
 	}
+	s.logAccess(AccessEventSucceeded, msg, attempt, nil)
+	s.trackDelivery(ctx, msg, queue.DeliveryStatusDelivered, nil)
 	return nil
 }
 
-const retryDuration = time.Hour * 12
+// isExpired returns true if the message is queued for longer than the configured maximum queue age, scheduled
+// messages only age once they are due. A deadline requested with DELIVERBY (RFC 2852) in return mode expires
+// the message earlier.
+func (s *Sender) isExpired(msg *queue.QueuedMessage) bool {
+	if msg.ReceivedAt.IsZero() {
+		return false
+	}
+	if s.cfg.QueueMaxAge > 0 && time.Since(msg.DueAt()) > s.cfg.QueueMaxAge {
+		return true
+	}
+	deliverBy := msg.DeliverBy()
+	return deliverBy != nil && deliverBy.Mode == smtp.DeliverByReturn && time.Since(msg.ReceivedAt) > deliverBy.Time
+}
+
+// failPermanently marks the delivery as failed, bounces the message and prevents any further attempts. The job
+// is kept as failed job in the queue, from where it can be replayed.
+func (s *Sender) failPermanently(ctx context.Context, msg *queue.QueuedMessage, err error) error {
+	s.trackDelivery(ctx, msg, queue.DeliveryStatusFailed, err)
+	s.bounce(ctx, msg, err)
+	return liteq.NewWorkerError(err, liteq.WithRemainingAttemps(0))
+}
+
+// bounce queues the notification of the sender that msg could not be delivered into the send queue
+func (s *Sender) bounce(ctx context.Context, msg *queue.QueuedMessage, deliveryErr error) {
+	logger := s.logger.With("from", msg.From, "to", msg.To, "submissionId", msg.SubmissionID)
+	if msg.From == "" {
+		// There is nobody to notify of a failed bounce, bouncing it again would only start a loop
+		logger.Warn("discarding undeliverable message with the null sender", "err", deliveryErr)
+		return
+	}
+	if !wantsBounce(msg) {
+		return
+	}
+	bounceMsg, err := newBounce(s.cfg.MailDomain, s.cfg.Hostname(), msg, deliveryErr)
+	if err != nil {
+		logger.Error("failed to create bounce", "err", err)
+		return
+	}
+	for _, signOptions := range s.bounceSigning {
+		if bounceMsg.Body, err = signDkim(bounceMsg.Body, signOptions, s.bounceSignatureValidity); err != nil {
+			logger.Error("failed to sign bounce", "err", err)
+			return
+		}
+	}
+	if err := s.q.Queue(ctx, bounceMsg, liteq.Retries(s.cfg.DeliveryAttempts())); err != nil {
+		logger.Error("failed to queue bounce", "err", err)
+		return
+	}
+	logger.Info("queued bounce", "bounceSubmissionId", bounceMsg.SubmissionID)
+}
+
+// trackDelivery notifies the delivery webhook, records the delivery status of the recipient and logs
+// the aggregated status of the submission once all of its recipients are done
+func (s *Sender) trackDelivery(ctx context.Context, msg *queue.QueuedMessage, status queue.DeliveryStatus, deliveryErr error) {
+	s.notifyDelivery(ctx, msg, status, deliveryErr)
+	if s.deliveryTracker == nil || msg.SubmissionID == "" {
+		return
+	}
+	logger := s.logger.With("submissionId", msg.SubmissionID, "to", msg.To)
+	if err := s.deliveryTracker.UpdateStatus(ctx, msg, status, deliveryErr); err != nil {
+		logger.Error("failed to update delivery status", "err", err)
+		return
+	}
+	if !status.Final() {
+		return
+	}
+	submission, err := s.deliveryTracker.Submission(ctx, msg.SubmissionID)
+	if err != nil {
+		logger.Error("failed to query submission status", "err", err)
+		return
+	}
+	if submission.Complete() {
+		s.logger.Info("finished delivery of submission", "submission", submission)
+	}
+}
+
+const deferDelay = time.Second
+
+// deferMessage puts the message back into the queue without using up a delivery attempt
+func (s *Sender) deferMessage(ctx context.Context, msg *queue.QueuedMessage) error {
+	remainingAttempts, _ := ctx.Value(liteq.CtxJobRemainingAttempts).(int64)
+	if remainingAttempts < 1 {
+		remainingAttempts = 1
+	}
+	if err := s.q.Queue(ctx, msg, liteq.ExecuteAfter(deferDelay), liteq.Retries(int(remainingAttempts))); err != nil {
+		return fmt.Errorf("failed to defer message: %w", err)
+	}
+	return nil
+}
 
-func decideRetry(ctx context.Context, err error) error {
+// decideRetry retries failed deliveries until the configured delivery attempts are used up and reports
+// whether the delivery is retried. How long messages are retried at most is limited by the maximum queue age.
+func decideRetry(ctx context.Context, msg *queue.QueuedMessage, err error) (retryErr error, retry bool) {
 	if err == nil {
 		// Job finished successfully
-		return nil
+		return nil, false
 	}
-	startedAt, _ := ctx.Value(liteq.CtxJobCreatedAt).(time.Time)
-	if startedAt.Add(retryDuration).Before(time.Now()) {
-		// We should stop retrying and just communicate the last error
-		return err
+	remainingAttempts, known := ctx.Value(liteq.CtxJobRemainingAttempts).(int64)
+	if known && remainingAttempts <= 1 {
+		// This was the last of the configured delivery attempts
+		return err, false
+	}
+	retryDelay := defaultRetryDelay
+	if hint, ok := retryDelayHint(err); ok {
+		// The remote server told us when to try again
+		retryDelay = hint
 	}
-	return liteq.NewWorkerError(err, liteq.WithRemainingAttemps(1), liteq.WithRetryDelay(time.Minute*5))
+	// The queue uses up one of the remaining attempts
+	return liteq.NewWorkerError(err, liteq.WithRetryDelay(retryDelay)), true
 }
 
-func (s *Sender) dialHost(host string) (c *smtp.Client, err error) {
-	logger := s.logger.With("host", host)
+// dial connects to the address of a mail server, through the outbound proxy if one is configured
+func (s *Sender) dial(ctx context.Context, address string) (net.Conn, error) {
+	if s.proxyDialer != nil {
+		return s.proxyDialer.DialContext(ctx, "tcp", address)
+	}
+	return s.defaultDialer.DialContext(ctx, "tcp", address)
+}
+
+func (s *Sender) dialHost(ctx context.Context, host string, ports []int, requireTLS bool) (c *mxClient, err error) {
+	logger := s.logger.With("host", host, "requireTLS", requireTLS)
 	logger.Info("dialing mx host")
 	errs := []error{}
 
-	dialTls := func(logger *slog.Logger, tlsConfig *tls.Config, address string) func() (*smtp.Client, error) {
-		return func() (*smtp.Client, error) {
-			tlsDialer := tls.Dialer{
-				NetDialer: s.defaultDialer,
-				Config:    tlsConfig,
-			}
-			conn, err := tlsDialer.Dial("tcp", address)
+	dialTls := func(logger *slog.Logger, tlsConfig *tls.Config, address string) func(ctx context.Context) (*mxClient, error) {
+		return func(ctx context.Context) (*mxClient, error) {
+			rawConn, err := s.dial(ctx, address)
 			if err != nil {
 				err = fmt.Errorf("failed to dial tls to %s. %w", address, err)
 				errs = append(errs, err)
 				return nil, err
 			}
-			return smtp.NewClient(conn), nil
+			conn := newNotifyingConn(rawConn)
+			tlsConn := tls.Client(conn, tlsConfig)
+			ctx, cancel := context.WithTimeout(ctx, s.defaultDialer.Timeout)
+			defer cancel()
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				rawConn.Close()
+				err = fmt.Errorf("failed to dial tls to %s. %w", address, err)
+				errs = append(errs, err)
+				return nil, err
+			}
+			return newMxClient(conn, smtp.NewClient(tlsConn)), nil
 		}
 	}
 
-	dialStartTls := func(logger *slog.Logger, tlsConfig *tls.Config, address string) func() (*smtp.Client, error) {
-		return func() (*smtp.Client, error) {
-			conn, err := s.defaultDialer.Dial("tcp", address)
+	dialStartTls := func(logger *slog.Logger, tlsConfig *tls.Config, address string) func(ctx context.Context) (*mxClient, error) {
+		return func(ctx context.Context) (*mxClient, error) {
+			rawConn, err := s.dial(ctx, address)
 			if err != nil {
 				err = fmt.Errorf("failed to dial for start TLS to %s. %w", address, err)
 				errs = append(errs, err)
 				return nil, err
 			}
-			return smtp.NewClientStartTLS(conn, tlsConfig)
+			conn := newNotifyingConn(rawConn)
+			stop := abortOnDone(ctx, conn)
+			c, err := smtp.NewClientStartTLS(conn, tlsConfig)
+			if !stop() && err == nil {
+				// ctx was done after the handshake finished, but the connection can't be used anymore
+				c.Close()
+				err = context.Cause(ctx)
+			}
+			if err != nil {
+				return nil, err
+			}
+			return newMxClient(conn, c), nil
 		}
 	}
 
-	dialSmtp := func(logger *slog.Logger, address string) func() (*smtp.Client, error) {
-		return func() (*smtp.Client, error) {
-			conn, err := s.defaultDialer.Dial("tcp", address)
+	dialSmtp := func(logger *slog.Logger, address string) func(ctx context.Context) (*mxClient, error) {
+		return func(ctx context.Context) (*mxClient, error) {
+			rawConn, err := s.dial(ctx, address)
 			if err != nil {
 				err = fmt.Errorf("failed to dial smtp to %s. %w", address, err)
 				errs = append(errs, err)
 				return nil, err
 			}
 			// Assume smtp for testing
-			c = smtp.NewClient(conn)
-			return c, nil
+			conn := newNotifyingConn(rawConn)
+			return newMxClient(conn, smtp.NewClient(conn)), nil
 		}
 	}
 
-	dialFuncs := []func() (*smtp.Client, error){}
-	for _, port := range s.mxPorts {
+	// traced records the outcome of every dial strategy in the delivery trace
+	traced := func(port int, mode string, dial func(context.Context) (*mxClient, error)) func(context.Context) (*mxClient, error) {
+		return func(dialCtx context.Context) (*mxClient, error) {
+			c, err := dial(dialCtx)
+			traceStep(ctx, deliveryStep{Stage: traceStageDial, Host: host, Port: port, Mode: mode, Err: errString(err)})
+			if err != nil {
+				return nil, err
+			}
+			s.applyTimeouts(c)
+			return c.dialedWith(host, port, mode), nil
+		}
+	}
+
+	dialFuncs := []func(context.Context) (*mxClient, error){}
+	for _, port := range ports {
 		logger := logger.With("port", port)
 		address := fmt.Sprintf("%s:%d", host, port)
 		tlsConfig := &tls.Config{
 			ServerName: host,
 			MinVersion: tls.VersionTLS12,
 		}
+		if err := s.cfg.Tls.Apply(tlsConfig); err != nil {
+			return nil, err
+		}
 
+		startTls := traced(port, dialModeStartTLS, dialStartTls(logger, tlsConfig, address))
+		implicitTls := traced(port, dialModeTLS, dialTls(logger, tlsConfig, address))
+		plain := traced(port, dialModePlain, dialSmtp(logger, address))
 		switch port {
 		case 25:
-			dialFuncs = append(dialFuncs, dialStartTls(logger, tlsConfig, address))
-			dialFuncs = append(dialFuncs, dialTls(logger, tlsConfig, address))
-			dialFuncs = append(dialFuncs, dialSmtp(logger, address))
+			dialFuncs = append(dialFuncs, startTls, implicitTls)
+			if !requireTLS {
+				dialFuncs = append(dialFuncs, plain)
+			}
 		case 587, 465:
-			dialFuncs = append(dialFuncs, dialTls(logger, tlsConfig, address))
-			dialFuncs = append(dialFuncs, dialStartTls(logger, tlsConfig, address))
+			dialFuncs = append(dialFuncs, implicitTls, startTls)
 		default:
-			dialFuncs = append(dialFuncs, dialSmtp(logger, address))
+			if requireTLS {
+				dialFuncs = append(dialFuncs, startTls)
+			} else {
+				dialFuncs = append(dialFuncs, plain)
+			}
 		}
 	}
-	return utils.ResolveParallel(dialFuncs...)
+	// Dials still in flight are aborted as soon as the first one succeeded
+	return utils.ResolveParallel(ctx, dialFuncs...)
 }
 
-func (s *Sender) smtpDialog(c *smtp.Client, msg *queue.QueuedMessage) error {
-	if err := c.Hello(s.cfg.MailDomain); err != nil {
-		c.Close()
-		return fmt.Errorf("hello cmd failed: %w", err)
+// applyTimeouts sets the configured command and submission timeouts on c. Every dial strategy passes its
+// client through here, so the timeouts apply regardless of the strategy which won.
+func (s *Sender) applyTimeouts(c *mxClient) {
+	if s.cfg.CommandTimeout > 0 {
+		c.CommandTimeout = s.cfg.CommandTimeout
 	}
-
-	if err := c.Mail(msg.From, msg.MailOpts); err != nil {
-		c.Close()
-		return fmt.Errorf("mail cmd failed: %w", err)
+	if s.cfg.SubmissionTimeout > 0 {
+		c.SubmissionTimeout = s.cfg.SubmissionTimeout
 	}
+}
+
+// dialMx connects to the mx host and ensures the connection is TLS secured if required
+func (s *Sender) dialMx(ctx context.Context, host string, ports []int, requireTLS bool) (c *mxClient, err error) {
+	_, span := tracing.Tracer().Start(ctx, "smtp.dial", trace.WithAttributes(attribute.String("net.peer.name", host)))
+	defer func() { tracing.End(span, err) }()
 
-	if err := c.Rcpt(msg.To, msg.RcptOpt); err != nil {
+	c, err = s.dialHost(ctx, host, ports, requireTLS)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, errors.New("smtp client is nil, but we got no error")
+	}
+	traceConnected(ctx, c)
+	if _, isTLS := c.TLSConnectionState(); requireTLS && !isTLS {
 		c.Close()
-		return fmt.Errorf("rcpt cmd failed: %w", err)
+		return nil, fmt.Errorf("connection to %s is not TLS secured, but message requires TLS", host)
 	}
+	return c, nil
+}
 
-	if w, err := c.Data(); err != nil {
+func (s *Sender) smtpDialog(ctx context.Context, c *mxClient, msg *queue.QueuedMessage) error {
+	stop := abortOnDone(ctx, c.conn)
+	defer stop()
+
+	if err := s.hello(c); err != nil {
 		c.Close()
-		return fmt.Errorf("data cmd failed: %w", err)
-	} else {
-		if n, err := w.Write(msg.Body); err != nil {
-			w.Close()
+		return err
+	}
+	if s.cfg.SmarthostEnabled() && s.cfg.Smarthost.Username != "" {
+		if err := s.smarthostAuth(ctx, c); err != nil {
 			c.Close()
 			return err
-		} else if n != len(msg.Body) {
-			// TODO define error
-			w.Close()
+		}
+	}
+
+	var w *smtp.DataCommand
+	mailCmd := func() error {
+		if err := c.Mail(msg.From, msg.MailOpts); err != nil {
+			return fmt.Errorf("mail cmd failed: %w", err)
+		}
+		return nil
+	}
+	rcptCmd := func() error {
+		if err := c.Rcpt(msg.To, msg.RelayRcptOptions()); err != nil {
+			return fmt.Errorf("rcpt cmd failed: %w", err)
+		}
+		return nil
+	}
+	dataCmd := func() (err error) {
+		if w, err = c.Data(); err != nil {
+			return fmt.Errorf("data cmd failed: %w", err)
+		}
+		return nil
+	}
+
+	if c.supportsPipelining() {
+		if err := c.pipeline(mailCmd, rcptCmd, dataCmd); err != nil {
+			if w != nil {
+				// The server accepted DATA although an earlier command failed, terminate the empty message
+				w.Close()
+			}
 			c.Close()
-			return fmt.Errorf("failed to write all data")
+			return err
 		}
+	} else {
+		for _, cmd := range []func() error{mailCmd, rcptCmd, dataCmd} {
+			if err := cmd(); err != nil {
+				c.Close()
+				return err
+			}
+		}
+	}
+
+	if n, err := w.Write(msg.Body); err != nil {
 		w.Close()
+		c.Close()
+		return err
+	} else if n != len(msg.Body) {
+		// TODO define error
+		w.Close()
+		c.Close()
+		return fmt.Errorf("failed to write all data")
 	}
-	return c.Quit()
+	if err := w.Close(); err != nil {
+		// The server did not acknowledge the final dot, so the message was not accepted
+		c.Close()
+		return fmt.Errorf("message was not accepted: %w", err)
+	}
+	// The server took responsibility for the message with the reply to the final dot. Retrying after the
+	// connection dropped before QUIT would only deliver the message twice.
+	if err := c.Quit(); err != nil {
+		s.logger.Warn("mx host closed the connection after accepting the message", "host", c.host, "to", msg.To, "err", err)
+		c.Close()
+	}
+	return nil
 }
 
-func (s *Sender) sendMail(msg *queue.QueuedMessage) error {
+func (s *Sender) sendMail(ctx context.Context, msg *queue.QueuedMessage) (err error) {
+	if s.cfg.DeliveryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, s.cfg.DeliveryTimeout, ErrDeliveryTimeout)
+		defer cancel()
+	}
 	logger := s.logger.With("to", msg.To, "from", msg.From, "envelopeId", msg.MailOpts.EnvelopeID)
 	msg.LastDeliveryAttempt = time.Now()
-	domain := strings.Split(msg.To, "@")[1]
+	domain := utils.AddressDomain(msg.To)
+	if domain == "" {
+		// Sessions reject malformed recipients, but messages might have been queued before they did
+		return fmt.Errorf("failed to deliver email to %s: %w", msg.To, ErrMalformedRecipient)
+	}
+	if !s.cfg.IsRecipientDomainAllowed(domain) {
+		// Sessions already reject these recipients, but the configuration might have changed since the message was queued
+		return fmt.Errorf("failed to deliver email to %s: %w", msg.To, ErrRecipientDomainDenied)
+	}
 
-	mxRecords, err := s.mxResolver(domain)
-	if err != nil {
-		return err
+	if s.cfg.DeliveryTrace {
+		var trace *deliveryTrace
+		ctx, trace = withDeliveryTrace(ctx)
+		defer func() {
+			logger.Info("delivery trace", "submissionId", msg.SubmissionID, "delivered", err == nil, "trace", trace)
+		}()
 	}
 
+	requireTLS := msg.RequiresTLS() || s.cfg.RequireOutboundTls
+	ports := s.mxPorts
+	var mxRecords []*net.MX
+	if s.cfg.SmarthostEnabled() {
+		mxRecords = []*net.MX{{Host: s.cfg.Smarthost.Host}}
+		ports = []int{s.cfg.Smarthost.Port}
+		if ports[0] == 0 {
+			ports[0] = defaultSmarthostPort
+		}
+		// Never send credentials in plaintext, unless explicitly allowed
+		requireTLS = requireTLS || (s.cfg.Smarthost.Username != "" && !s.cfg.Smarthost.AllowInsecureAuth)
+	} else {
+		_, lookupSpan := tracing.Tracer().Start(ctx, "dns.lookup_mx", trace.WithAttributes(attribute.String("dns.domain", domain)))
+		var err error
+		mxRecords, err = s.mxLookups.Resolve(msg.SubmissionID, domain)
+		tracing.End(lookupSpan, err)
+		if err != nil {
+			traceStep(ctx, deliveryStep{Stage: traceStageMx, Detail: "lookup of " + domain, Err: errString(err)})
+			return err
+		}
+	}
+	mxHosts := make([]string, 0, len(mxRecords))
 	for _, mx := range mxRecords {
+		mxHosts = append(mxHosts, mx.Host)
+	}
+	traceStep(ctx, deliveryStep{Stage: traceStageMx, Detail: fmt.Sprintf("smarthost=%t requireTLS=%t ports=%v hosts=%v", s.cfg.SmarthostEnabled(), requireTLS, ports, mxHosts)})
+
+	errs := []error{}
+	attempts := 0
+	if s.cfg.ParallelMxHosts > 1 {
+		var delivered bool
+		delivered, mxRecords, attempts, errs = s.sendParallel(ctx, logger, mxRecords, ports, requireTLS, msg)
+		if delivered {
+			return nil
+		}
+	}
+	for _, mx := range mxRecords {
+		if ctx.Err() != nil {
+			break
+		}
 		host := mx.Host
+		if s.hostBackoff.BackingOff(host) {
+			logger.Info("skipping mx host which asked us to back off", "host", host)
+			traceStep(ctx, deliveryStep{Stage: traceStageSkip, Host: host, Detail: "backing off"})
+			errs = append(errs, fmt.Errorf("backing off from %s", host))
+			continue
+		}
+		if s.cfg.MaxMxHosts > 0 && attempts >= s.cfg.MaxMxHosts {
+			// Give up on this attempt and retry later instead of waiting for a long list of unreachable hosts
+			logger.Info("tried the maximum number of mx hosts, giving up on this attempt", "maxMxHosts", s.cfg.MaxMxHosts, "mxHosts", len(mxRecords))
+			traceStep(ctx, deliveryStep{Stage: traceStageSkip, Host: host, Detail: "maximum number of mx hosts tried"})
+			break
+		}
+		if !s.circuitBreaker.Allow(host) {
+			logger.Info("skipping mx host which failed repeatedly", "host", host)
+			traceStep(ctx, deliveryStep{Stage: traceStageSkip, Host: host, Detail: "circuit open"})
+			errs = append(errs, fmt.Errorf("circuit of %s is open after repeated failures", host))
+			continue
+		}
+		attempts++
 
-		c, err := s.dialHost(host)
+		c, err := s.dialMx(ctx, host, ports, requireTLS)
+		recordMxHost(ctx, host, c)
 		if err != nil {
 			logger.Error("failed to dial host", "err", err)
-			continue
-		}
-		if c == nil {
-			logger.Error("smtp client is nil, but we got no error")
+			s.recordHostHealth(ctx, host, err)
+			s.backOffIfUnavailable(host, err)
+			errs = append(errs, err)
 			continue
 		}
 
-		if err := s.smtpDialog(c, msg); err != nil {
+		_, dialogSpan := tracing.Tracer().Start(ctx, "smtp.dialog", trace.WithAttributes(attribute.String("net.peer.name", host)))
+		err = s.smtpDialog(ctx, c, msg)
+		tracing.End(dialogSpan, err)
+		traceStep(ctx, deliveryStep{Stage: traceStageDialog, Host: host, Port: c.port, Mode: c.mode, Err: errString(err)})
+		s.recordHostHealth(ctx, host, err)
+		if err != nil {
 			logger.Error("smtp dialog failed", "err", err)
+			s.backOffIfUnavailable(host, err)
+			errs = append(errs, err)
 			continue
 		}
 		logger.Info("Successfully delivered message")
 		return nil
 
 	}
-	return fmt.Errorf("failed to deliver email to %s", msg.To)
+	if ctx.Err() != nil {
+		return fmt.Errorf("failed to deliver email to %s: %w", msg.To, errors.Join(append([]error{context.Cause(ctx)}, errs...)...))
+	}
+	if msg.RequiresTLS() {
+		return fmt.Errorf("failed to deliver email to %s: %w", msg.To, errors.Join(append([]error{ErrTLSRequired}, errs...)...))
+	}
+	return fmt.Errorf("failed to deliver email to %s: %w", msg.To, errors.Join(errs...))
+}
+
+// abortOnDone interrupts all pending and future reads and writes on conn once ctx is done. Calling
+// stop returns false if conn was already interrupted. Connections which are used by a SMTP client
+// must be a notifyingConn, since the client would reset the deadline with its next command.
+func abortOnDone(ctx context.Context, conn net.Conn) (stop func() bool) {
+	return context.AfterFunc(ctx, func() {
+		if n, ok := conn.(*notifyingConn); ok {
+			n.abort()
+			return
+		}
+		conn.SetDeadline(time.Now())
+	})
+}
+
+// backOffIfUnavailable stops contacting a host which closed the transmission channel with 421
+// until the delay it suggested, or the default backoff, has passed
+func (s *Sender) backOffIfUnavailable(host string, err error) {
+	if !isServiceUnavailable(err) {
+		return
+	}
+	delay, ok := retryDelayHint(err)
+	if !ok {
+		delay = defaultHostBackoff
+	}
+	s.logger.Warn("mx host is unavailable, backing off", "host", host, "delay", delay, "err", err)
+	s.hostBackoff.BackOff(host, delay)
 }
 
 func lookupMX(domain string) ([]*net.MX, error) {
-	mxRecords, err := net.LookupMX(domain)
+	mxRecords, err := dns.LookupMX(domain)
 	if err != nil {
 		return nil, fmt.Errorf("failed to lookup mx records for %s:%w", domain, err)
 	}
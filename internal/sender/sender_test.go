@@ -1,23 +1,44 @@
 package sender
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"log/slog"
 	"net"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/dereulenspiegel/liteq"
+	"github.com/dereulenspiegel/smolmailer/internal/backend"
+	"github.com/dereulenspiegel/smolmailer/internal/backend/backendmocks"
 	"github.com/dereulenspiegel/smolmailer/internal/config"
 	"github.com/dereulenspiegel/smolmailer/internal/queue"
+	"github.com/dereulenspiegel/smolmailer/internal/queue/queuemocks"
 	"github.com/docker/go-connections/nat"
 	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/modules/inbucket"
 	"github.com/testcontainers/testcontainers-go/wait"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 func TestDeliverMail(t *testing.T) {
@@ -82,3 +103,1192 @@ MC4CAQAwBQYDK2VwBCIEIJhGWXSKnABUEcPSYV00xfxhR6sf/3iEsJfrOxE3H/3r
 	err = sq.Put(context.Background(), msg)
 	require.NoError(t, err)
 }
+
+type concurrencyBackend struct {
+	delay       time.Duration
+	inFlight    atomic.Int32
+	maxInFlight atomic.Int32
+	delivered   atomic.Int32
+}
+
+func (b *concurrencyBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &concurrencySession{b: b}, nil
+}
+
+type concurrencySession struct {
+	b *concurrencyBackend
+}
+
+func (s *concurrencySession) Mail(from string, opts *smtp.MailOptions) error { return nil }
+func (s *concurrencySession) Rcpt(to string, opts *smtp.RcptOptions) error   { return nil }
+func (s *concurrencySession) Reset()                                         {}
+func (s *concurrencySession) Logout() error                                  { return nil }
+
+func (s *concurrencySession) Data(r io.Reader) error {
+	inFlight := s.b.inFlight.Add(1)
+	defer s.b.inFlight.Add(-1)
+	for {
+		maxInFlight := s.b.maxInFlight.Load()
+		if inFlight <= maxInFlight || s.b.maxInFlight.CompareAndSwap(maxInFlight, inFlight) {
+			break
+		}
+	}
+	time.Sleep(s.b.delay)
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return err
+	}
+	s.b.delivered.Add(1)
+	return nil
+}
+
+func startTestSmtpServer(t *testing.T, be smtp.Backend) (string, int) {
+	return startTestSmtpServerAt(t, be, "127.0.0.1:0")
+}
+
+func startTestSmtpServerAt(t *testing.T, be smtp.Backend, address string) (string, int) {
+	listener, err := net.Listen("tcp", address)
+	require.NoError(t, err)
+	s := smtp.NewServer(be)
+	s.Domain = "mx.example.com"
+	s.AllowInsecureAuth = true
+	s.EnableDSN = true
+	go func() {
+		if err := s.Serve(listener); err != nil && !errors.Is(err, smtp.ErrServerClosed) {
+			log.Printf("test smtp server failed: %s", err)
+		}
+	}()
+	t.Cleanup(func() {
+		s.Close()
+	})
+	addr := listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+func newTestSender(t *testing.T, cfg *config.Config, q queue.GenericWorkQueue[*queue.QueuedMessage], host string, port int) *Sender {
+	mxResolver := func(string) ([]*net.MX, error) {
+		return []*net.MX{{Host: host, Pref: 10}}, nil
+	}
+	return &Sender{
+		cfg:               cfg,
+		q:                 q,
+		logger:            slog.Default(),
+		mxResolver:        mxResolver,
+		mxLookups:         newSubmissionMxResolver(mxResolver),
+		mxPorts:           []int{port},
+		defaultDialer:     &net.Dialer{Timeout: time.Second * 5},
+		submissionLimiter: newSubmissionLimiter(cfg.MaxDeliveriesPerSubmission),
+		hostBackoff:       newHostBackoff(),
+		circuitBreaker:    newHostCircuitBreaker(cfg.CircuitBreakerThreshold, cfg.CircuitBreakerCooldown),
+	}
+}
+
+type envelopeBackend struct {
+	concurrencyBackend
+	envelopeIDs chan string
+}
+
+func (b *envelopeBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &envelopeSession{concurrencySession: concurrencySession{b: &b.concurrencyBackend}, envelopeIDs: b.envelopeIDs}, nil
+}
+
+type envelopeSession struct {
+	concurrencySession
+	envelopeIDs chan string
+}
+
+func (s *envelopeSession) Mail(from string, opts *smtp.MailOptions) error {
+	s.envelopeIDs <- opts.EnvelopeID
+	return nil
+}
+
+func TestSendMailTransmitsEnvelopeID(t *testing.T) {
+	be := &envelopeBackend{envelopeIDs: make(chan string, 1)}
+	host, port := startTestSmtpServer(t, be)
+	s := newTestSender(t, &config.Config{MailDomain: "example.com"}, queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t), host, port)
+
+	err := s.sendMail(context.Background(), &queue.QueuedMessage{
+		From:     "from@example.com",
+		To:       "rcpt@example.org",
+		Body:     []byte("test"),
+		MailOpts: &smtp.MailOptions{EnvelopeID: "3f1c7a52-envelope"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "3f1c7a52-envelope", <-be.envelopeIDs)
+	assert.Equal(t, int32(1), be.delivered.Load())
+}
+
+func TestSubmissionConcurrencyIsCapped(t *testing.T) {
+	be := &concurrencyBackend{delay: time.Millisecond * 100}
+	host, port := startTestSmtpServer(t, be)
+
+	q := queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t)
+	var deferred atomic.Int32
+	q.On("Queue", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		deferred.Add(1)
+	}).Return(nil)
+
+	s := newTestSender(t, &config.Config{MailDomain: "example.com", MaxDeliveriesPerSubmission: 3}, q, host, port)
+
+	ctx := context.WithValue(context.Background(), liteq.CtxJobRemainingAttempts, int64(3))
+	recipients := 50
+	wg := &sync.WaitGroup{}
+	for i := 0; i < recipients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := s.trySend(ctx, &queue.QueuedMessage{
+				From:         "from@example.com",
+				To:           fmt.Sprintf("rcpt%d@example.org", i),
+				Body:         []byte("test"),
+				SubmissionID: "submission",
+				MailOpts:     &smtp.MailOptions{},
+			})
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	assert.LessOrEqual(t, be.maxInFlight.Load(), int32(3))
+	assert.Greater(t, be.delivered.Load(), int32(0))
+	assert.Equal(t, int32(recipients), be.delivered.Load()+deferred.Load())
+}
+
+func TestRequireTLSRefusesPlaintextDelivery(t *testing.T) {
+	be := &concurrencyBackend{}
+	host, port := startTestSmtpServer(t, be)
+
+	q := queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t)
+	s := newTestSender(t, &config.Config{MailDomain: "example.com"}, q, host, port)
+	var bounce *queue.QueuedMessage
+	expectBounce(q, "from@example.com").Run(func(args mock.Arguments) {
+		bounce = args.Get(1).(*queue.QueuedMessage)
+	}).Once()
+
+	err := s.trySend(context.Background(), &queue.QueuedMessage{
+		From:     "from@example.com",
+		To:       "rcpt@example.org",
+		Body:     []byte("test"),
+		MailOpts: &smtp.MailOptions{RequireTLS: true},
+	})
+	require.Error(t, err)
+	assert.ErrorIs(t, err, ErrTLSRequired)
+	assert.Equal(t, int32(0), be.delivered.Load())
+	require.NotNil(t, bounce)
+	assert.Contains(t, string(bounce.Body), "Status: 5.7.10\r\n")
+	assert.True(t, bounce.RequiresTLS(), "the bounce must not be delivered without TLS either")
+
+	err = s.trySend(context.Background(), &queue.QueuedMessage{
+		From:     "from@example.com",
+		To:       "rcpt@example.org",
+		Body:     []byte("test"),
+		MailOpts: &smtp.MailOptions{},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), be.delivered.Load())
+}
+
+func TestSenderRefusesDeniedRecipientDomains(t *testing.T) {
+	be := &concurrencyBackend{}
+	host, port := startTestSmtpServer(t, be)
+
+	q := queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t)
+	s := newTestSender(t, &config.Config{MailDomain: "example.com", DeniedRecipientDomains: []string{"*.example.org"}}, q, host, port)
+	expectBounce(q, "from@example.com").Once()
+
+	err := s.trySend(context.Background(), &queue.QueuedMessage{
+		From:     "from@example.com",
+		To:       "rcpt@mail.example.org",
+		Body:     []byte("test"),
+		MailOpts: &smtp.MailOptions{},
+	})
+	require.Error(t, err)
+	assert.ErrorIs(t, err, ErrRecipientDomainDenied)
+	assert.Equal(t, int32(0), be.delivered.Load())
+
+	require.NoError(t, s.trySend(context.Background(), &queue.QueuedMessage{
+		From:     "from@example.com",
+		To:       "rcpt@example.org",
+		Body:     []byte("test"),
+		MailOpts: &smtp.MailOptions{},
+	}))
+	assert.Equal(t, int32(1), be.delivered.Load())
+}
+
+func TestSenderRefusesMalformedRecipients(t *testing.T) {
+	be := &concurrencyBackend{}
+	host, port := startTestSmtpServer(t, be)
+
+	q := queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t)
+	s := newTestSender(t, &config.Config{MailDomain: "example.com"}, q, host, port)
+	expectBounce(q, "from@example.com").Once()
+
+	// Queued before sessions rejected malformed recipients
+	err := s.trySend(context.Background(), &queue.QueuedMessage{
+		From:     "from@example.com",
+		To:       "no-at-sign",
+		Body:     []byte("test"),
+		MailOpts: &smtp.MailOptions{},
+	})
+	require.Error(t, err)
+	assert.ErrorIs(t, err, ErrMalformedRecipient)
+	assert.Equal(t, ReasonMalformedRecipient, reasonCodeFor(err))
+	assert.Equal(t, int32(0), be.delivered.Load())
+}
+
+func TestRequireOutboundTLSSkipsPlaintext(t *testing.T) {
+	be := &concurrencyBackend{}
+	host, port := startTestSmtpServer(t, be)
+
+	q := queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t)
+	s := newTestSender(t, &config.Config{MailDomain: "example.com", RequireOutboundTls: true}, q, host, port)
+
+	ctx := context.WithValue(context.Background(), liteq.CtxJobCreatedAt, time.Now())
+	msg := &queue.QueuedMessage{
+		From:     "from@example.com",
+		To:       "rcpt@example.org",
+		Body:     []byte("test"),
+		MailOpts: &smtp.MailOptions{},
+	}
+	err := s.trySend(ctx, msg)
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, ErrTLSRequired, "messages without REQUIRETLS must be retried")
+	assert.Equal(t, int32(0), be.delivered.Load())
+
+	s.cfg.RequireOutboundTls = false
+	require.NoError(t, s.trySend(ctx, msg))
+	assert.Equal(t, int32(1), be.delivered.Load())
+}
+
+func TestConsumeOptionsReachQueue(t *testing.T) {
+	q := queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t)
+	consumeParams := make(chan liteq.ConsumeParams, 1)
+	q.On("Consume", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		params := liteq.ConsumeParams{}
+		for _, opt := range args[2:] {
+			opt.(liteq.ConsumeOpt)(&params)
+		}
+		consumeParams <- params
+	}).Return(nil)
+	s, err := NewSender(context.Background(), slog.Default(), &config.Config{
+		MailDomain: "example.com",
+		Dkim:       &config.DkimOpts{},
+	}, q, WithPoolSize(3), WithVisibilityTimeout(time.Minute))
+	require.NoError(t, err)
+	defer s.Close()
+
+	select {
+	case params := <-consumeParams:
+		assert.Equal(t, 3, params.PoolSize)
+		assert.Equal(t, int64(60), params.VisibilityTimeout)
+	case <-time.After(time.Second * 5):
+		t.Fatal("send queue was not consumed")
+	}
+}
+
+func TestDeliveriesResumeAfterConsumeFailure(t *testing.T) {
+	q := queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t)
+	q.On("Consume", mock.Anything, mock.Anything, mock.Anything).Return(errors.New("UNIQUE constraint failed")).Once()
+	consumed := make(chan struct{})
+	q.On("Consume", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		close(consumed)
+		<-args.Get(0).(context.Context).Done()
+	}).Return(nil).Once()
+
+	s, err := NewSender(context.Background(), slog.Default(), &config.Config{
+		MailDomain: "example.com",
+		Dkim:       &config.DkimOpts{},
+	}, q, WithSendConsumeRestartDelay(time.Millisecond*10))
+	require.NoError(t, err)
+
+	select {
+	case <-consumed:
+	case <-time.After(time.Second * 5):
+		t.Fatal("consuming the send queue was not restarted after it failed")
+	}
+	require.NoError(t, s.Close())
+	assert.Equal(t, int64(1), s.ConsumeRestarts())
+}
+
+func TestMxPortsFromConfig(t *testing.T) {
+	q := queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t)
+	q.On("Consume", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	s, err := NewSender(context.Background(), slog.Default(), &config.Config{
+		MailDomain: "example.com",
+		Dkim:       &config.DkimOpts{},
+		MxPorts:    []int{465},
+	}, q)
+	require.NoError(t, err)
+	defer s.Close()
+	assert.Equal(t, []int{465}, s.mxPorts)
+}
+
+func TestDialTimeoutFromConfig(t *testing.T) {
+	q := queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t)
+	q.On("Consume", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	s, err := NewSender(context.Background(), slog.Default(), &config.Config{
+		MailDomain:  "example.com",
+		Dkim:        &config.DkimOpts{},
+		DialTimeout: time.Second * 7,
+	}, q)
+	require.NoError(t, err)
+	defer s.Close()
+	assert.Equal(t, time.Second*7, s.defaultDialer.Timeout)
+}
+
+func TestTimeoutsApplyToParallelDials(t *testing.T) {
+	be := &concurrencyBackend{}
+	host, port := startTestSmtpServer(t, be)
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	require.NoError(t, closed.Close())
+
+	s := newTestSender(t, &config.Config{
+		MailDomain:        "example.com",
+		CommandTimeout:    time.Second * 42,
+		SubmissionTimeout: time.Minute * 3,
+	}, queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t), host, port)
+
+	// Dialing several ports races the dial strategies against each other
+	c, err := s.dialHost(context.Background(), host, []int{closedPort, port}, false)
+	require.NoError(t, err)
+	defer c.Close()
+	assert.Equal(t, port, c.port)
+	assert.Equal(t, time.Second*42, c.CommandTimeout)
+	assert.Equal(t, time.Minute*3, c.SubmissionTimeout)
+}
+
+func TestSenderTracksDeliveryStatus(t *testing.T) {
+	be := &concurrencyBackend{}
+	host, port := startTestSmtpServer(t, be)
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "status.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	tracker, err := queue.NewDeliveryTracker(db)
+	require.NoError(t, err)
+
+	q := queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t)
+	s := newTestSender(t, &config.Config{MailDomain: "example.com"}, q, host, port)
+	s.deliveryTracker = tracker
+	expectBounce(q, "from@example.com").Once()
+
+	ctx := context.Background()
+	msgs := []*queue.QueuedMessage{
+		{From: "from@example.com", To: "one@example.org", SubmissionID: "submission", MailOpts: &smtp.MailOptions{}},
+		{From: "from@example.com", To: "two@example.org", SubmissionID: "submission", MailOpts: &smtp.MailOptions{RequireTLS: true}},
+	}
+	for _, msg := range msgs {
+		require.NoError(t, tracker.Track(ctx, msg))
+	}
+	require.NoError(t, s.trySend(ctx, msgs[0]))
+	require.Error(t, s.trySend(ctx, msgs[1]))
+
+	status, err := tracker.Submission(ctx, "submission")
+	require.NoError(t, err)
+	assert.True(t, status.Complete())
+	assert.Equal(t, 1, status.Count(queue.DeliveryStatusDelivered))
+	assert.Equal(t, 1, status.Count(queue.DeliveryStatusFailed))
+}
+
+type rejectingBackend struct {
+	concurrencyBackend
+}
+
+func (b *rejectingBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &rejectingSession{concurrencySession{b: &b.concurrencyBackend}}, nil
+}
+
+type rejectingSession struct {
+	concurrencySession
+}
+
+func (s *rejectingSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	if strings.HasPrefix(to, "unknown") {
+		return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"}
+	}
+	return nil
+}
+
+func TestRejectedRecipientOnlyFailsItsOwnDelivery(t *testing.T) {
+	be := &rejectingBackend{}
+	host, port := startTestSmtpServer(t, be)
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "status.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	tracker, err := queue.NewDeliveryTracker(db)
+	require.NoError(t, err)
+
+	q := queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t)
+	s := newTestSender(t, &config.Config{MailDomain: "example.com"}, q, host, port)
+	s.deliveryTracker = tracker
+	bounces := []string{}
+	expectBounce(q, "from@example.com").Run(func(args mock.Arguments) {
+		bounces = append(bounces, string(args.Get(1).(*queue.QueuedMessage).Body))
+	}).Twice()
+
+	// Every recipient of a submission is delivered in its own transaction, so a recipient rejected by
+	// the remote doesn't affect the other recipients of the same submission
+	ctx := context.WithValue(context.Background(), liteq.CtxJobRemainingAttempts, int64(1))
+	rejected := []string{"unknown@example.org", "unknown2@example.org"}
+	for _, to := range []string{"one@example.org", rejected[0], "two@example.org", rejected[1]} {
+		msg := &queue.QueuedMessage{From: "from@example.com", To: to, Body: []byte("test"), SubmissionID: "submission", MailOpts: &smtp.MailOptions{}}
+		require.NoError(t, tracker.Track(ctx, msg))
+		err := s.trySend(ctx, msg)
+		if slices.Contains(rejected, to) {
+			var smtpErr *smtp.SMTPError
+			require.ErrorAs(t, err, &smtpErr)
+			assert.Equal(t, 550, smtpErr.Code)
+		} else {
+			require.NoError(t, err)
+		}
+	}
+
+	assert.Equal(t, int32(2), be.delivered.Load())
+	status, err := tracker.Submission(ctx, "submission")
+	require.NoError(t, err)
+	assert.True(t, status.Complete())
+	for _, rcpt := range status.Recipients {
+		if slices.Contains(rejected, rcpt.Recipient) {
+			assert.Equal(t, queue.DeliveryStatusFailed, rcpt.Status)
+		} else {
+			assert.Equal(t, queue.DeliveryStatusDelivered, rcpt.Status)
+		}
+	}
+
+	// Each rejected recipient is bounced on its own, and only the rejected recipients are bounced
+	require.Len(t, bounces, 2)
+	for i, bounce := range bounces {
+		assert.Contains(t, bounce, "Final-Recipient: rfc822; "+rejected[i]+"\r\n")
+		assert.Equal(t, 1, strings.Count(bounce, "Final-Recipient:"))
+	}
+}
+
+type senderCapturingBackend struct {
+	rejectingBackend
+	senders chan string
+}
+
+func (b *senderCapturingBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &senderCapturingSession{rejectingSession: rejectingSession{concurrencySession{b: &b.concurrencyBackend}}, senders: b.senders}, nil
+}
+
+type senderCapturingSession struct {
+	rejectingSession
+	senders chan string
+}
+
+func (s *senderCapturingSession) Mail(from string, opts *smtp.MailOptions) error {
+	s.senders <- from
+	return nil
+}
+
+// expectBounce expects a bounce to be queued for the sender to
+func expectBounce(q *queuemocks.GenericWorkQueueMock[*queue.QueuedMessage], to string) *mock.Call {
+	return q.On("Queue", mock.Anything, mock.MatchedBy(func(msg *queue.QueuedMessage) bool {
+		return msg.From == "" && msg.To == to
+	}), mock.Anything).Return(nil)
+}
+
+func TestNullSenderIsNotBounced(t *testing.T) {
+	be := &senderCapturingBackend{senders: make(chan string, 2)}
+	host, port := startTestSmtpServer(t, be)
+	q := queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t)
+	s := newTestSender(t, &config.Config{MailDomain: "example.com"}, q, host, port)
+
+	ctx := context.WithValue(context.Background(), liteq.CtxJobRemainingAttempts, int64(1))
+	bounce := func(to string) *queue.QueuedMessage {
+		return &queue.QueuedMessage{To: to, Body: []byte("Subject: Undelivered Mail\r\n\r\nbody"), MailOpts: &smtp.MailOptions{}}
+	}
+	require.NoError(t, s.trySend(ctx, bounce("rcpt@example.org")))
+	assert.Equal(t, "", <-be.senders, "the null sender is transmitted as MAIL FROM:<>")
+	assert.Equal(t, int32(1), be.delivered.Load())
+
+	// A rejected bounce fails without bouncing it again
+	require.Error(t, s.trySend(ctx, bounce("unknown@example.org")))
+	assert.Equal(t, "", <-be.senders)
+	q.AssertNotCalled(t, "Queue", mock.Anything, mock.Anything)
+}
+
+func TestPipelineSpanTree(t *testing.T) {
+	spanRecorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)))
+	t.Cleanup(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+	})
+
+	ctx := context.Background()
+	be := &concurrencyBackend{}
+	host, port := startTestSmtpServer(t, be)
+
+	rq := queuemocks.NewGenericWorkQueueMock[*backend.ReceivedMessage](t)
+	var receivedMsg *backend.ReceivedMessage
+	rq.On("Queue", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		receivedMsg = args.Get(1).(*backend.ReceivedMessage)
+	}).Return(nil)
+	sess := backend.NewSession(ctx, slog.Default(), rq, backendmocks.NewUserServiceMock(t), &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000})
+	// Pretend the client went through MAIL and RCPT already
+	sess.Msg.From = "from@example.com"
+	sess.Msg.To = []*backend.Rcpt{{To: "to@example.org"}}
+	require.NoError(t, sess.Data(bytes.NewBufferString("test")))
+	require.NotNil(t, receivedMsg)
+	require.NotEmpty(t, receivedMsg.TraceContext)
+
+	var queuedMsg *queue.QueuedMessage
+	p := &PreprocessorHandler{
+		logger: slog.Default(),
+		preprocessors: []PreSendProcessor{func(msg *queue.QueuedMessage) (*queue.QueuedMessage, error) {
+			queuedMsg = msg
+			return msg, nil
+		}},
+	}
+	require.NoError(t, p.consumeReceivingQueue(ctx, receivedMsg))
+	require.NotNil(t, queuedMsg)
+
+	s := newTestSender(t, &config.Config{MailDomain: "example.com"}, queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t), host, port)
+	require.NoError(t, s.trySend(ctx, queuedMsg))
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range spanRecorder.Ended() {
+		spans[span.Name()] = span
+	}
+	require.Len(t, spans, 6)
+	traceID := spans["smtp.receive"].SpanContext().TraceID()
+	expectedParents := map[string]string{
+		"process":       "smtp.receive",
+		"deliver":       "process",
+		"dns.lookup_mx": "deliver",
+		"smtp.dial":     "deliver",
+		"smtp.dialog":   "deliver",
+	}
+	assert.False(t, spans["smtp.receive"].Parent().IsValid())
+	for name, parentName := range expectedParents {
+		require.Contains(t, spans, name)
+		assert.Equal(t, traceID, spans[name].SpanContext().TraceID(), name)
+		assert.Equal(t, spans[parentName].SpanContext().SpanID(), spans[name].Parent().SpanID(), name)
+	}
+}
+
+func TestExpiredMessagesAreNotRetried(t *testing.T) {
+	be := &concurrencyBackend{}
+	host, port := startTestSmtpServer(t, be)
+
+	q := queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t)
+	s := newTestSender(t, &config.Config{MailDomain: "example.com", QueueMaxAge: time.Hour}, q, host, port)
+	var bounce *queue.QueuedMessage
+	expectBounce(q, "from@example.com").Run(func(args mock.Arguments) {
+		bounce = args.Get(1).(*queue.QueuedMessage)
+	}).Once()
+
+	err := s.trySend(context.Background(), &queue.QueuedMessage{
+		From:       "from@example.com",
+		To:         "rcpt@example.org",
+		Body:       []byte("Subject: test\r\n\r\ntest"),
+		MailOpts:   &smtp.MailOptions{EnvelopeID: "envelope"},
+		ReceivedAt: time.Now().Add(-time.Hour * 2),
+	})
+	require.Error(t, err)
+	assert.ErrorIs(t, err, ErrMessageExpired)
+	werr := liteq.NewWorkerError(nil)
+	require.ErrorAs(t, err, &werr)
+	assert.Equal(t, 0, *werr.RemainingAttempts, "expired messages are moved to the failed jobs regardless of their attempts")
+	assert.Equal(t, int32(0), be.delivered.Load())
+	require.NotNil(t, bounce)
+	assert.Contains(t, string(bounce.Body), "Original-Envelope-Id: envelope\r\n")
+	assert.Contains(t, string(bounce.Body), "Status: 5.4.7\r\n")
+
+	err = s.trySend(context.Background(), &queue.QueuedMessage{
+		From:       "from@example.com",
+		To:         "rcpt@example.org",
+		Body:       []byte("test"),
+		MailOpts:   &smtp.MailOptions{},
+		ReceivedAt: time.Now().Add(-time.Minute * 30),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), be.delivered.Load())
+
+	// Scheduled messages only age once they are due
+	err = s.trySend(context.Background(), &queue.QueuedMessage{
+		From:       "from@example.com",
+		To:         "rcpt@example.org",
+		Body:       []byte("test"),
+		MailOpts:   &smtp.MailOptions{},
+		ReceivedAt: time.Now().Add(-time.Hour * 2),
+		DeliverAt:  time.Now().Add(-time.Minute * 30),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), be.delivered.Load())
+}
+
+func TestMessagesExpireAtTheirDeliverByDeadline(t *testing.T) {
+	be := &concurrencyBackend{}
+	host, port := startTestSmtpServer(t, be)
+
+	q := queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t)
+	s := newTestSender(t, &config.Config{MailDomain: "example.com", QueueMaxAge: time.Hour * 24}, q, host, port)
+	expectBounce(q, "from@example.com").Once()
+
+	msg := func(mode smtp.DeliverByMode) *queue.QueuedMessage {
+		return &queue.QueuedMessage{
+			From:       "from@example.com",
+			To:         "rcpt@example.org",
+			Body:       []byte("test"),
+			MailOpts:   &smtp.MailOptions{},
+			RcptOpt:    &smtp.RcptOptions{DeliverBy: &smtp.DeliverByOptions{Time: time.Hour, Mode: mode}},
+			ReceivedAt: time.Now().Add(-time.Hour * 2),
+		}
+	}
+	err := s.trySend(context.Background(), msg(smtp.DeliverByReturn))
+	assert.ErrorIs(t, err, ErrMessageExpired)
+	assert.Equal(t, int32(0), be.delivered.Load())
+
+	// Messages in notify mode are still delivered after their deadline
+	require.NoError(t, s.trySend(context.Background(), msg(smtp.DeliverByNotify)))
+	assert.Equal(t, int32(1), be.delivered.Load())
+}
+
+func TestDeliverByDeadlineIsRelayedWithTheTimeLeft(t *testing.T) {
+	msg := &queue.QueuedMessage{
+		RcptOpt:    &smtp.RcptOptions{DeliverBy: &smtp.DeliverByOptions{Time: time.Hour, Mode: smtp.DeliverByReturn}},
+		ReceivedAt: time.Now().Add(-time.Minute * 20),
+	}
+	relayed := msg.RelayRcptOptions()
+	assert.InDelta(t, (time.Minute * 40).Seconds(), relayed.DeliverBy.Time.Seconds(), 2)
+	assert.Equal(t, time.Hour, msg.RcptOpt.DeliverBy.Time, "the queued message keeps its deadline")
+}
+
+func TestDeliveriesAreRetriedUntilAttemptsAreUsedUp(t *testing.T) {
+	msg := &queue.QueuedMessage{ReceivedAt: time.Now().Add(-time.Hour * 24)}
+	deliveryErr := &smtp.SMTPError{Code: 451, Message: "Try again later"}
+
+	// How long messages are retried is only limited by the maximum queue age
+	ctx := context.WithValue(context.Background(), liteq.CtxJobCreatedAt, time.Now().Add(-time.Hour*24))
+	ctx = context.WithValue(ctx, liteq.CtxJobRemainingAttempts, int64(2))
+	werr := liteq.NewWorkerError(nil)
+	retryErr, retry := decideRetry(ctx, msg, deliveryErr)
+	assert.True(t, retry)
+	require.ErrorAs(t, retryErr, &werr)
+
+	ctx = context.WithValue(ctx, liteq.CtxJobRemainingAttempts, int64(1))
+	retryErr, retry = decideRetry(ctx, msg, deliveryErr)
+	assert.False(t, retry)
+	assert.Equal(t, deliveryErr, retryErr)
+}
+
+func TestCloseWaitsForConsumeLoopAndDeliveries(t *testing.T) {
+	be := &concurrencyBackend{delay: time.Millisecond * 200}
+	host, port := startTestSmtpServer(t, be)
+
+	q := queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t)
+	var consumeStopped atomic.Bool
+	q.On("Consume", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		ctx := args.Get(0).(context.Context)
+		worker := args.Get(1).(liteq.ConsumeFunc[*queue.QueuedMessage])
+		go worker(ctx, &queue.QueuedMessage{
+			From:     "from@example.com",
+			To:       "rcpt@example.org",
+			Body:     []byte("test"),
+			MailOpts: &smtp.MailOptions{},
+		})
+		<-ctx.Done()
+		time.Sleep(time.Millisecond * 50)
+		consumeStopped.Store(true)
+	}).Return(nil)
+
+	s, err := NewSender(context.Background(), slog.Default(), &config.Config{
+		MailDomain: "example.com",
+		Dkim:       &config.DkimOpts{},
+		TestingOpts: &config.TestingOpts{
+			MxPorts: []int{port},
+			MxResolv: func(string) ([]*net.MX, error) {
+				return []*net.MX{{Host: host, Pref: 10}}, nil
+			},
+		},
+	}, q)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return be.inFlight.Load() == 1
+	}, time.Second, time.Millisecond*5)
+
+	require.NoError(t, s.Close())
+	assert.True(t, consumeStopped.Load())
+	assert.Equal(t, int32(1), be.delivered.Load())
+}
+
+type bulkBlockingBackend struct {
+	concurrencyBackend
+	release       chan struct{}
+	bulkDelivered atomic.Int32
+}
+
+func (b *bulkBlockingBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &bulkBlockingSession{concurrencySession: concurrencySession{b: &b.concurrencyBackend}, be: b}, nil
+}
+
+type bulkBlockingSession struct {
+	concurrencySession
+	be     *bulkBlockingBackend
+	isBulk bool
+}
+
+func (s *bulkBlockingSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	s.isBulk = strings.HasPrefix(to, "bulk")
+	return nil
+}
+
+func (s *bulkBlockingSession) Data(r io.Reader) error {
+	if !s.isBulk {
+		return s.concurrencySession.Data(r)
+	}
+	<-s.be.release
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return err
+	}
+	s.be.bulkDelivered.Add(1)
+	return nil
+}
+
+func TestTransactionalQueueIsNotBlockedByBulkBacklog(t *testing.T) {
+	be := &bulkBlockingBackend{release: make(chan struct{})}
+	host, port := startTestSmtpServer(t, be)
+	released := false
+	releaseBulk := func() {
+		if !released {
+			released = true
+			close(be.release)
+		}
+	}
+	t.Cleanup(releaseBulk)
+
+	ctx := context.Background()
+	jq, err := liteq.NewFromPath(filepath.Join(t.TempDir(), "queue.db"))
+	require.NoError(t, err)
+	sendingQueues := map[string]queue.GenericWorkQueue[*queue.QueuedMessage]{
+		queue.PriorityTransactional: liteq.NewQueue[*queue.QueuedMessage](jq, "send.queue", liteq.JSONMarshaler[*queue.QueuedMessage]{}),
+		queue.PriorityBulk:          liteq.NewQueue[*queue.QueuedMessage](jq, "send.bulk.queue", liteq.JSONMarshaler[*queue.QueuedMessage]{}),
+	}
+	cfg := &config.Config{
+		MailDomain: "example.com",
+		Dkim:       &config.DkimOpts{},
+		TestingOpts: &config.TestingOpts{
+			MxPorts: []int{port},
+			MxResolv: func(string) ([]*net.MX, error) {
+				return []*net.MX{{Host: host, Pref: 10}}, nil
+			},
+		},
+	}
+	for _, sendingQueue := range sendingQueues {
+		s, err := NewSender(ctx, slog.Default(), cfg, sendingQueue, WithPoolSize(2))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			releaseBulk()
+			s.Close()
+		})
+	}
+
+	route := PriorityRoutingProcessor(ctx, sendingQueues)
+	for i := range 5 {
+		_, err := route(&queue.QueuedMessage{
+			From:     "from@example.com",
+			To:       fmt.Sprintf("bulk%d@example.org", i),
+			Body:     []byte("Precedence: bulk\r\nSubject: Newsletter\r\n\r\nbody"),
+			MailOpts: &smtp.MailOptions{},
+		})
+		require.NoError(t, err)
+	}
+	_, err = route(&queue.QueuedMessage{
+		From:     "from@example.com",
+		To:       "rcpt@example.org",
+		Body:     []byte("Subject: Password reset\r\n\r\nbody"),
+		MailOpts: &smtp.MailOptions{},
+	})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return be.delivered.Load() == 1
+	}, time.Second*10, time.Millisecond*20, "transactional message must be delivered while the bulk queue is backlogged")
+	assert.Equal(t, int32(0), be.bulkDelivered.Load())
+
+	releaseBulk()
+	require.Eventually(t, func() bool {
+		return be.bulkDelivered.Load() == 5
+	}, time.Second*10, time.Millisecond*20)
+}
+
+// startHangingServer accepts connections, but never responds
+func startHangingServer(t *testing.T) (string, int) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	conns := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		close(conns)
+		for conn := range conns {
+			conn.Close()
+		}
+	})
+	addr := listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+func TestSendMailAbortsWhenContextIsCancelled(t *testing.T) {
+	host, port := startHangingServer(t)
+	s := newTestSender(t, &config.Config{MailDomain: "example.com"}, queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t), host, port)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*100, cancel)
+	started := time.Now()
+	err := s.sendMail(ctx, &queue.QueuedMessage{
+		From:     "from@example.com",
+		To:       "rcpt@example.org",
+		Body:     []byte("test"),
+		MailOpts: &smtp.MailOptions{},
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(started), time.Second)
+}
+
+func TestSendMailHonorsDeliveryTimeout(t *testing.T) {
+	host, port := startHangingServer(t)
+	s := newTestSender(t, &config.Config{MailDomain: "example.com", DeliveryTimeout: time.Millisecond * 100}, queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t), host, port)
+
+	started := time.Now()
+	err := s.sendMail(context.Background(), &queue.QueuedMessage{
+		From:     "from@example.com",
+		To:       "rcpt@example.org",
+		Body:     []byte("test"),
+		MailOpts: &smtp.MailOptions{},
+	})
+	assert.ErrorIs(t, err, ErrDeliveryTimeout)
+	assert.Less(t, time.Since(started), time.Second)
+}
+
+func TestShutdownAbortsDeliveriesAfterTimeout(t *testing.T) {
+	host, port := startHangingServer(t)
+
+	q := queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t)
+	q.On("Queue", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Maybe().Return(nil)
+	deliveryErr := make(chan error, 1)
+	q.On("Consume", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		ctx := args.Get(0).(context.Context)
+		worker := args.Get(1).(liteq.ConsumeFunc[*queue.QueuedMessage])
+		go func() {
+			deliveryErr <- worker(context.WithValue(ctx, liteq.CtxJobCreatedAt, time.Now()), &queue.QueuedMessage{
+				From:     "from@example.com",
+				To:       "rcpt@example.org",
+				Body:     []byte("test"),
+				MailOpts: &smtp.MailOptions{},
+			})
+		}()
+		<-ctx.Done()
+	}).Return(nil)
+
+	s, err := NewSender(context.Background(), slog.Default(), &config.Config{
+		MailDomain: "example.com",
+		Dkim:       &config.DkimOpts{},
+		TestingOpts: &config.TestingOpts{
+			MxPorts: []int{port},
+			MxResolv: func(string) ([]*net.MX, error) {
+				return []*net.MX{{Host: host, Pref: 10}}, nil
+			},
+		},
+	}, q)
+	require.NoError(t, err)
+	// Give the delivery time to connect, stopping the consumption must not interrupt it
+	time.Sleep(time.Millisecond * 100)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	require.Error(t, s.Shutdown(ctx))
+
+	select {
+	case err := <-deliveryErr:
+		assert.ErrorIs(t, err, ErrDeliveryAborted)
+	case <-time.After(time.Second):
+		t.Fatal("delivery was not aborted")
+	}
+}
+
+func TestSendMailTriesAtMostMaxMxHosts(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	var connections atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			connections.Add(1)
+			conn.Close()
+		}
+	}()
+	addr := listener.Addr().(*net.TCPAddr)
+
+	s := newTestSender(t, &config.Config{MailDomain: "example.com", MaxMxHosts: 3}, queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t), addr.IP.String(), addr.Port)
+	mxRecords := []*net.MX{}
+	for i := range 10 {
+		mxRecords = append(mxRecords, &net.MX{Host: addr.IP.String(), Pref: uint16(i)})
+	}
+	s.mxLookups = newSubmissionMxResolver(func(string) ([]*net.MX, error) {
+		return mxRecords, nil
+	})
+
+	err = s.sendMail(context.Background(), &queue.QueuedMessage{
+		From:     "from@example.com",
+		To:       "rcpt@example.org",
+		Body:     []byte("test"),
+		MailOpts: &smtp.MailOptions{},
+	})
+	require.Error(t, err)
+	assert.Eventually(t, func() bool { return connections.Load() == 3 }, time.Second, time.Millisecond*10)
+	time.Sleep(time.Millisecond * 50)
+	assert.Equal(t, int32(3), connections.Load())
+}
+
+func TestDeliveryTraceCapturesDecisionPath(t *testing.T) {
+	be := &concurrencyBackend{}
+	host, port := startTestSmtpServer(t, be)
+	logs := &bytes.Buffer{}
+	s := newTestSender(t, &config.Config{MailDomain: "example.com", DeliveryTrace: true}, queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t), host, port)
+	s.logger = slog.New(slog.NewJSONHandler(logs, nil))
+
+	require.NoError(t, s.sendMail(context.Background(), &queue.QueuedMessage{
+		From:         "from@example.com",
+		To:           "rcpt@example.org",
+		Body:         []byte("test"),
+		SubmissionID: "submission",
+		MailOpts:     &smtp.MailOptions{},
+	}))
+
+	var entry struct {
+		Msg          string
+		SubmissionID string `json:"submissionId"`
+		Delivered    bool
+		Trace        map[string]map[string]any
+	}
+	for line := range strings.SplitSeq(strings.TrimSpace(logs.String()), "\n") {
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		if entry.Msg == "delivery trace" {
+			break
+		}
+	}
+	require.Equal(t, "delivery trace", entry.Msg)
+	assert.Equal(t, "submission", entry.SubmissionID)
+	assert.True(t, entry.Delivered)
+
+	stages := []string{}
+	for i := range len(entry.Trace) {
+		step := entry.Trace[strconv.Itoa(i)]
+		stages = append(stages, step["stage"].(string))
+		switch step["stage"] {
+		case traceStageMx:
+			assert.Contains(t, step["detail"], "hosts=["+host+"]")
+		case traceStageDial, traceStageConnected, traceStageDialog:
+			assert.Equal(t, host, step["host"])
+			assert.Equal(t, float64(port), step["port"])
+			assert.Equal(t, dialModePlain, step["mode"])
+			assert.NotContains(t, step, "err")
+		}
+	}
+	assert.Equal(t, []string{traceStageMx, traceStageDial, traceStageConnected, traceStageDialog}, stages)
+}
+
+func TestDeliveryGivesUpAfterMaxAttempts(t *testing.T) {
+	for _, maxAttempts := range []int{1, 4} {
+		t.Run(fmt.Sprintf("%d attempts", maxAttempts), func(t *testing.T) {
+			be := &calloutBackend{}
+			host, port := startTestSmtpServer(t, be)
+			q := queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t)
+			s := newTestSender(t, &config.Config{MailDomain: "example.com", MaxDeliveryAttempts: maxAttempts}, q, host, port)
+			expectBounce(q, "from@example.com").Once()
+
+			// The queue is initialized with the configured attempts and uses up one attempt for every
+			// failure, unless the sender decides otherwise
+			remainingAttempts := int64(s.cfg.DeliveryAttempts())
+			attempts := 0
+			for {
+				attempts++
+				require.LessOrEqual(t, attempts, maxAttempts, "delivery must give up after the configured attempts")
+				ctx := context.WithValue(context.Background(), liteq.CtxJobCreatedAt, time.Now())
+				ctx = context.WithValue(ctx, liteq.CtxJobRemainingAttempts, remainingAttempts)
+				err := s.trySend(ctx, &queue.QueuedMessage{
+					From:     "from@example.com",
+					To:       "greylisted@example.org",
+					Body:     []byte("test"),
+					MailOpts: &smtp.MailOptions{},
+				})
+				require.Error(t, err)
+				werr := liteq.NewWorkerError(nil)
+				require.ErrorAs(t, err, &werr)
+				if werr.RemainingAttempts != nil {
+					assert.Equal(t, 0, *werr.RemainingAttempts)
+					break
+				}
+				remainingAttempts--
+			}
+			assert.Equal(t, maxAttempts, attempts)
+			assert.Equal(t, int32(maxAttempts), be.callouts.Load())
+		})
+	}
+}
+
+func TestSenderReportsPendingMessagesUntilIdle(t *testing.T) {
+	be := &concurrencyBackend{delay: time.Millisecond * 200}
+	host, port := startTestSmtpServer(t, be)
+
+	ctx := context.Background()
+	q, err := queue.NewSQLiteWorkQueue[*queue.QueuedMessage](filepath.Join(t.TempDir(), "queue.db"), "send.queue", 1, 5)
+	require.NoError(t, err)
+	for i := range 3 {
+		require.NoError(t, q.Queue(ctx, &queue.QueuedMessage{
+			From:     "from@example.com",
+			To:       fmt.Sprintf("rcpt%d@example.org", i),
+			Body:     []byte("Subject: Test\r\n\r\nbody"),
+			MailOpts: &smtp.MailOptions{},
+		}))
+	}
+	pending, err := q.Pending(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 3, pending)
+
+	s, err := NewSender(ctx, slog.Default(), &config.Config{
+		MailDomain: "example.com",
+		Dkim:       &config.DkimOpts{},
+		TestingOpts: &config.TestingOpts{
+			MxPorts: []int{port},
+			MxResolv: func(string) ([]*net.MX, error) {
+				return []*net.MX{{Host: host, Pref: 10}}, nil
+			},
+		},
+	}, q, WithPoolSize(1))
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	s.idlePollInterval = time.Millisecond * 10
+
+	idle := s.Idle()
+	pending, err = s.Pending(ctx)
+	require.NoError(t, err)
+	assert.Greater(t, pending, 0, "messages being delivered are pending")
+	select {
+	case <-idle:
+		t.Fatal("sender must not be idle while messages are pending")
+	default:
+	}
+
+	select {
+	case <-idle:
+	case <-time.After(time.Second * 10):
+		t.Fatal("sender did not become idle")
+	}
+	assert.Equal(t, int32(3), be.delivered.Load())
+	pending, err = s.Pending(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, pending)
+}
+
+func TestPendingIsUnsupportedWithoutCountingQueue(t *testing.T) {
+	s := newTestSender(t, &config.Config{MailDomain: "example.com"}, queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t), "127.0.0.1", 25)
+	_, err := s.Pending(context.Background())
+	assert.ErrorIs(t, err, ErrPendingUnsupported)
+}
+
+// startDroppingMx speaks just enough SMTP to receive a message and drops the connection once the message
+// was transmitted, either right after accepting it or without replying to the final dot. It returns the
+// number of messages it accepted.
+func startDroppingMx(t *testing.T, acceptBeforeDrop bool) (string, int, *atomic.Int32) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	accepted := &atomic.Int32{}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				io.WriteString(conn, "220 mx.example.com ESMTP\r\n")
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch command := strings.ToUpper(strings.TrimSpace(line)); {
+					case strings.HasPrefix(command, "DATA"):
+						io.WriteString(conn, "354 Go ahead\r\n")
+						for {
+							line, err := reader.ReadString('\n')
+							if err != nil {
+								return
+							}
+							if line == ".\r\n" {
+								break
+							}
+						}
+						if acceptBeforeDrop {
+							accepted.Add(1)
+							io.WriteString(conn, "250 2.0.0 Ok: queued\r\n")
+						}
+						return
+					case strings.HasPrefix(command, "QUIT"):
+						io.WriteString(conn, "221 Bye\r\n")
+						return
+					default:
+						io.WriteString(conn, "250 Ok\r\n")
+					}
+				}
+			}()
+		}
+	}()
+	addr := listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, accepted
+}
+
+func TestMessageAcceptedBeforeDisconnectIsDelivered(t *testing.T) {
+	host, port, accepted := startDroppingMx(t, true)
+	q := queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t)
+	s := newTestSender(t, &config.Config{MailDomain: "example.com"}, q, host, port)
+
+	// The mx host took responsibility for the message, so the dropped connection must not cause a retry
+	// which would deliver the message twice
+	err := s.trySend(context.Background(), &queue.QueuedMessage{
+		From:     "from@example.com",
+		To:       "rcpt@example.org",
+		Body:     []byte("Subject: Test\r\n\r\nbody"),
+		MailOpts: &smtp.MailOptions{},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), accepted.Load())
+	q.AssertNotCalled(t, "Queue", mock.Anything, mock.Anything)
+}
+
+func TestMessageNotAcceptedBeforeDisconnectIsRetried(t *testing.T) {
+	host, port, accepted := startDroppingMx(t, false)
+	s := newTestSender(t, &config.Config{MailDomain: "example.com"}, queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t), host, port)
+
+	err := s.sendMail(context.Background(), &queue.QueuedMessage{
+		From:     "from@example.com",
+		To:       "rcpt@example.org",
+		Body:     []byte("Subject: Test\r\n\r\nbody"),
+		MailOpts: &smtp.MailOptions{},
+	})
+	require.Error(t, err, "the message was never acknowledged and has to be delivered again")
+	assert.Equal(t, int32(0), accepted.Load())
+}
@@ -0,0 +1,98 @@
+package sender
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dereulenspiegel/smolmailer/internal/config"
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+const defaultSmarthostPort = 587
+
+var ErrSmarthostAuthRejected = errors.New("smarthost rejected the credentials")
+
+// newSmarthostTokenSource returns a token source for the smarthost access tokens. Tokens are reused until they expire.
+func newSmarthostTokenSource(ctx context.Context, cfg *config.OAuth2Client) oauth2.TokenSource {
+	clientCfg := &clientcredentials.Config{
+		ClientID:     cfg.ClientId,
+		ClientSecret: cfg.ClientSecret,
+		TokenURL:     cfg.TokenUrl,
+		Scopes:       cfg.Scopes,
+	}
+	return clientCfg.TokenSource(ctx)
+}
+
+// smarthostSaslClient returns the SASL client to authenticate with, depending on whether the smarthost uses OAuth2
+func (s *Sender) smarthostSaslClient() (sasl.Client, error) {
+	smarthost := s.cfg.Smarthost
+	if !smarthost.OAuth2Enabled() {
+		return sasl.NewPlainClient("", smarthost.Username, smarthost.Password), nil
+	}
+	if s.smarthostTokens == nil {
+		return nil, errors.New("no token source for the smarthost configured")
+	}
+	token, err := s.smarthostTokens.Token()
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain smarthost access token: %w", err)
+	}
+	return newXOAuth2Client(smarthost.Username, token.AccessToken), nil
+}
+
+// smarthostAuth authenticates with the smarthost. Transient failures (4xx) are retried on the same
+// connection, permanent failures (5xx) mean the credentials are wrong and are returned as ErrSmarthostAuthRejected.
+func (s *Sender) smarthostAuth(ctx context.Context, c *mxClient) (err error) {
+	smarthost := s.cfg.Smarthost
+	logger := s.logger.With("smarthost", smarthost.Host, "username", smarthost.Username)
+	for attempt := 0; attempt <= smarthost.AuthRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(smarthost.AuthRetryDelay):
+			case <-ctx.Done():
+				return fmt.Errorf("auth cmd failed: %w", errors.Join(context.Cause(ctx), err))
+			}
+		}
+		saslClient, err := s.smarthostSaslClient()
+		if err != nil {
+			return fmt.Errorf("auth cmd failed: %w", err)
+		}
+		err = c.Auth(saslClient)
+		if err == nil {
+			return nil
+		}
+		var smtpErr *smtp.SMTPError
+		if !errors.As(err, &smtpErr) {
+			// Most likely the connection broke, so there is no point in retrying on it
+			return fmt.Errorf("auth cmd failed: %w", err)
+		}
+		if !smtpErr.Temporary() {
+			return fmt.Errorf("auth cmd failed: %w", errors.Join(ErrSmarthostAuthRejected, err))
+		}
+		logger.Warn("transient smarthost authentication failure", "err", err, "attempt", attempt+1)
+	}
+	return fmt.Errorf("auth cmd failed: %w", err)
+}
+
+type xoauth2Client struct {
+	username, token string
+}
+
+// newXOAuth2Client returns a client implementation of the XOAUTH2 authentication mechanism, as described
+// in https://developers.google.com/workspace/gmail/imap/xoauth2-protocol.
+func newXOAuth2Client(username, token string) sasl.Client {
+	return &xoauth2Client{username: username, token: token}
+}
+
+func (a *xoauth2Client) Start() (mech string, ir []byte, err error) {
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+func (a *xoauth2Client) Next(challenge []byte) (response []byte, err error) {
+	// The server sent details about the failed authentication, an empty response makes it finish with an error
+	return []byte{}, nil
+}
@@ -0,0 +1,194 @@
+package sender
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dereulenspiegel/liteq"
+	"github.com/dereulenspiegel/smolmailer/internal/backend"
+	"github.com/dereulenspiegel/smolmailer/internal/config"
+	"github.com/dereulenspiegel/smolmailer/internal/queue"
+	"github.com/dereulenspiegel/smolmailer/internal/queue/queuemocks"
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type smarthostBackend struct {
+	concurrencyBackend
+	authErr             *smtp.SMTPError
+	authFailures        int32
+	authAttempts        atomic.Int32
+	authenticatedAs     atomic.Value
+	unauthenticatedMail atomic.Int32
+}
+
+func (b *smarthostBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &smarthostSession{concurrencySession: concurrencySession{b: &b.concurrencyBackend}, be: b}, nil
+}
+
+type smarthostSession struct {
+	concurrencySession
+	be            *smarthostBackend
+	authenticated bool
+}
+
+func (s *smarthostSession) AuthMechanisms() []string {
+	return []string{sasl.Plain, backend.XOAuth2}
+}
+
+func (s *smarthostSession) Auth(mech string) (sasl.Server, error) {
+	if mech == backend.XOAuth2 {
+		return backend.NewXOAuth2Server(func(username, token string) error {
+			s.be.authAttempts.Add(1)
+			if username != "relay" || token != "access-token" {
+				return errors.New("invalid token")
+			}
+			s.authenticated = true
+			s.be.authenticatedAs.Store(username)
+			return nil
+		}), nil
+	}
+	return sasl.NewPlainServer(func(identity, username, password string) error {
+		if s.be.authAttempts.Add(1) <= s.be.authFailures {
+			return s.be.authErr
+		}
+		if username != "relay" || password != "secret" {
+			return errors.New("invalid credentials")
+		}
+		s.authenticated = true
+		s.be.authenticatedAs.Store(username)
+		return nil
+	}), nil
+}
+
+func (s *smarthostSession) Mail(from string, opts *smtp.MailOptions) error {
+	if !s.authenticated {
+		s.be.unauthenticatedMail.Add(1)
+		return &smtp.SMTPError{Code: 530, EnhancedCode: smtp.EnhancedCode{5, 7, 0}, Message: "Authentication required"}
+	}
+	return nil
+}
+
+func newSmarthostTestSender(t *testing.T, be *smarthostBackend, authRetries int) *Sender {
+	host, port := startTestSmtpServer(t, be)
+	q := queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t)
+	// Messages failing permanently are bounced
+	expectBounce(q, "from@example.com").Maybe()
+	s := newTestSender(t, &config.Config{
+		MailDomain: "example.com",
+		Smarthost: &config.Smarthost{
+			Host:              host,
+			Port:              port,
+			Username:          "relay",
+			Password:          "secret",
+			AllowInsecureAuth: true,
+			AuthRetries:       authRetries,
+			AuthRetryDelay:    time.Millisecond * 10,
+		},
+	}, q, "mx.invalid", 25)
+	return s
+}
+
+func testSmarthostMessage() *queue.QueuedMessage {
+	return &queue.QueuedMessage{
+		From:     "from@example.com",
+		To:       "rcpt@example.org",
+		Body:     []byte("test"),
+		MailOpts: &smtp.MailOptions{},
+	}
+}
+
+func TestSmarthostTransientAuthFailureIsRetried(t *testing.T) {
+	be := &smarthostBackend{
+		authErr:      &smtp.SMTPError{Code: 454, EnhancedCode: smtp.EnhancedCode{4, 7, 0}, Message: "Temporary authentication failure"},
+		authFailures: 1,
+	}
+	s := newSmarthostTestSender(t, be, 2)
+
+	ctx := context.WithValue(context.Background(), liteq.CtxJobCreatedAt, time.Now())
+	require.NoError(t, s.trySend(ctx, testSmarthostMessage()))
+	assert.Equal(t, int32(2), be.authAttempts.Load())
+	assert.Equal(t, "relay", be.authenticatedAs.Load())
+	assert.Equal(t, int32(1), be.delivered.Load())
+}
+
+func TestSmarthostTransientAuthFailureIsEventuallyDelivered(t *testing.T) {
+	be := &smarthostBackend{
+		authErr:      &smtp.SMTPError{Code: 454, EnhancedCode: smtp.EnhancedCode{4, 7, 0}, Message: "Too many authentication attempts"},
+		authFailures: 3,
+	}
+	s := newSmarthostTestSender(t, be, 1)
+
+	ctx := context.WithValue(context.Background(), liteq.CtxJobCreatedAt, time.Now())
+	ctx = context.WithValue(ctx, liteq.CtxJobRemainingAttempts, int64(3))
+	err := s.trySend(ctx, testSmarthostMessage())
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, ErrSmarthostAuthRejected)
+	werr := liteq.NewWorkerError(nil)
+	require.ErrorAs(t, err, &werr, "transient auth failures must be retried later")
+	assert.Nil(t, werr.RemainingAttempts, "retries use up one of the remaining attempts")
+	assert.Equal(t, int32(0), be.delivered.Load())
+
+	require.NoError(t, s.trySend(ctx, testSmarthostMessage()))
+	assert.Equal(t, int32(4), be.authAttempts.Load())
+	assert.Equal(t, int32(1), be.delivered.Load())
+	assert.Equal(t, int32(0), be.unauthenticatedMail.Load())
+}
+
+func TestSmarthostRejectedCredentialsFailPermanently(t *testing.T) {
+	be := &smarthostBackend{
+		authErr:      &smtp.SMTPError{Code: 535, EnhancedCode: smtp.EnhancedCode{5, 7, 8}, Message: "Authentication credentials invalid"},
+		authFailures: 100,
+	}
+	s := newSmarthostTestSender(t, be, 2)
+
+	ctx := context.WithValue(context.Background(), liteq.CtxJobCreatedAt, time.Now())
+	err := s.trySend(ctx, testSmarthostMessage())
+	require.Error(t, err)
+	assert.ErrorIs(t, err, ErrSmarthostAuthRejected)
+	werr := liteq.NewWorkerError(nil)
+	require.ErrorAs(t, err, &werr)
+	assert.Equal(t, 0, *werr.RemainingAttempts)
+	assert.Equal(t, int32(1), be.authAttempts.Load(), "rejected credentials must not be retried")
+	assert.Equal(t, int32(0), be.delivered.Load())
+}
+
+func TestSmarthostXOAuth2(t *testing.T) {
+	var tokenRequests atomic.Int32
+	tokenEndpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenRequests.Add(1)
+		clientID, clientSecret, _ := r.BasicAuth()
+		if clientID != "smolmailer" || clientSecret != "client-secret" || r.FormValue("grant_type") != "client_credentials" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token":"access-token","token_type":"Bearer","expires_in":3600}`)
+	}))
+	defer tokenEndpoint.Close()
+
+	be := &smarthostBackend{}
+	s := newSmarthostTestSender(t, be, 0)
+	s.cfg.Smarthost.Password = ""
+	s.cfg.Smarthost.OAuth2 = &config.OAuth2Client{
+		TokenUrl:     tokenEndpoint.URL,
+		ClientId:     "smolmailer",
+		ClientSecret: "client-secret",
+	}
+	s.smarthostTokens = newSmarthostTokenSource(context.Background(), s.cfg.Smarthost.OAuth2)
+
+	ctx := context.WithValue(context.Background(), liteq.CtxJobCreatedAt, time.Now())
+	require.NoError(t, s.trySend(ctx, testSmarthostMessage()))
+	require.NoError(t, s.trySend(ctx, testSmarthostMessage()))
+	assert.Equal(t, "relay", be.authenticatedAs.Load())
+	assert.Equal(t, int32(2), be.delivered.Load())
+	assert.Equal(t, int32(1), tokenRequests.Load(), "access tokens should be reused until they expire")
+}
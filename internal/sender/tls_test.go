@@ -0,0 +1,81 @@
+package sender
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dereulenspiegel/smolmailer/internal/config"
+	"github.com/dereulenspiegel/smolmailer/internal/queue"
+	"github.com/dereulenspiegel/smolmailer/internal/queue/queuemocks"
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startTestStartTLSServer starts a SMTP server offering STARTTLS with a self signed certificate of at most maxVersion
+func startTestStartTLSServer(t *testing.T, be smtp.Backend, maxVersion uint16) (string, int) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, privateKey.Public(), privateKey)
+	require.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := smtp.NewServer(be)
+	s.Domain = "mx.example.com"
+	s.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{certDER}, PrivateKey: privateKey}},
+		MaxVersion:   maxVersion,
+	}
+	go func() {
+		if err := s.Serve(listener); err != nil && !errors.Is(err, smtp.ErrServerClosed) {
+			log.Printf("test smtp server failed: %s", err)
+		}
+	}()
+	t.Cleanup(func() {
+		s.Close()
+	})
+	addr := listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+func TestSendMailHonorsMinimumTLSVersion(t *testing.T) {
+	be := &concurrencyBackend{}
+	host, port := startTestStartTLSServer(t, be, tls.VersionTLS12)
+	send := func(tlsOpts *config.TlsOpts) error {
+		s := newTestSender(t, &config.Config{MailDomain: "example.com", RequireOutboundTls: true, Tls: tlsOpts},
+			queuemocks.NewGenericWorkQueueMock[*queue.QueuedMessage](t), host, port)
+		return s.sendMail(context.Background(), &queue.QueuedMessage{
+			From:     "from@example.com",
+			To:       "rcpt@example.org",
+			Body:     []byte("test"),
+			MailOpts: &smtp.MailOptions{},
+		})
+	}
+
+	// The self signed certificate is never trusted, but the version is negotiated before it is verified
+	err := send(nil)
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "protocol version")
+
+	err = send(&config.TlsOpts{MinVersion: "1.3"})
+	require.Error(t, err)
+	assert.ErrorContains(t, err, "protocol version")
+	assert.Zero(t, be.delivered.Load())
+}
@@ -2,13 +2,15 @@ package server
 
 import (
 	"context"
-	"crypto"
 	"database/sql"
 	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/dereulenspiegel/liteq"
@@ -18,117 +20,249 @@ import (
 	"github.com/dereulenspiegel/smolmailer/internal/dns"
 	"github.com/dereulenspiegel/smolmailer/internal/queue"
 	"github.com/dereulenspiegel/smolmailer/internal/sender"
+	"github.com/dereulenspiegel/smolmailer/internal/tracing"
 	"github.com/dereulenspiegel/smolmailer/internal/users"
 	"github.com/dereulenspiegel/smolmailer/internal/utils"
 	"github.com/emersion/go-msgauth/dkim"
 	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type Server struct {
 	ctx        context.Context
 	smtpServer *smtp.Server
 
+	queueDb          *sql.DB
+	postgresQueueDb  *sql.DB
 	receiveQueue     queue.GenericWorkQueue[*backend.ReceivedMessage]
-	sendQueue        queue.GenericWorkQueue[*queue.QueuedMessage]
+	sendQueues       map[string]queue.GenericWorkQueue[*queue.QueuedMessage]
 	processorHandler *sender.PreprocessorHandler
-	sender           *sender.Sender
+	senders          []*sender.Sender
+	userSrv          *users.UserService
+	acmeTls          *acme.AcmeTls
 
+	// cancel stops everything started with the context of NewServer
+	cancel        context.CancelFunc
 	backendCtx    context.Context
 	backendCancel context.CancelFunc
 	ctxSender     context.Context
 	senderCancel  context.CancelFunc
 
+	shutdownTracing func(context.Context) error
+
+	metricsRegistry *prometheus.Registry
+	metricsServer   *http.Server
+
+	auditLog *os.File
+
 	cfg    *config.Config
 	logger *slog.Logger
 }
 
-func NewServer(ctx context.Context, logger *slog.Logger, cfg *config.Config) (*Server, error) {
+const receiveQueueName = "receive.queue"
+
+// idlePollInterval is how often Idle checks whether the queues are drained
+const idlePollInterval = time.Second
 
+func NewServer(ctx context.Context, logger *slog.Logger, cfg *config.Config) (_ *Server, err error) {
+	// Everything the setup starts runs with this context, so it can be stopped again if the setup fails
+	ctx, cancel := context.WithCancel(ctx)
 	s := &Server{
-		cfg:    cfg,
-		logger: logger,
+		cfg:             cfg,
+		logger:          logger,
+		metricsRegistry: prometheus.NewRegistry(),
+		cancel:          cancel,
 	}
+	defer func() {
+		if err != nil {
+			s.abortSetup()
+		}
+	}()
+	s.metricsRegistry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
 	if err := os.MkdirAll(cfg.QueuePath, 0770); err != nil {
 		logger.Error("failed to ensure queue folder exists", "err", err, "queuePath", cfg.QueuePath)
 		return nil, fmt.Errorf("failed to ensure queue folder exists: %w", err)
 	}
 
-	liteDb, err := sql.Open("sqlite3", filepath.Join(cfg.QueuePath, "mail.queue"))
+	s.shutdownTracing, err = tracing.Setup(ctx, cfg.OtlpEndpoint)
+	if err != nil {
+		logger.Error("failed to setup tracing", "err", err)
+		return nil, fmt.Errorf("failed to setup tracing: %w", err)
+	}
+
+	sendQueueCfgs := sendQueueConfigs(cfg)
+	liteDb, err := queue.OpenDB(QueueDBPath(cfg), queueDbOpts(cfg, sendQueueCfgs)...)
 	if err != nil {
 		logger.Error("failed to open sqlite queue db", "err", err)
 		return nil, fmt.Errorf("failed to open sqlite queue db: %w", err)
 	}
-	jq, err := liteq.New(liteDb)
-	if err != nil {
-		logger.Error("failed to create sqlite based job queue", "err", err)
-		return nil, fmt.Errorf("failed to create sqlite based job queue: %w", err)
+	s.queueDb = liteDb
+	if cfg.QueueBackend == config.QueueBackendPostgres {
+		// The queues and the delivery status are shared, the SQLite database only keeps instance local state
+		s.postgresQueueDb, err = queue.OpenPostgresDB(cfg.QueueDb.DSN, queueDbOpts(cfg, sendQueueCfgs)...)
+		if err != nil {
+			logger.Error("failed to open postgres queue db", "err", err)
+			return nil, fmt.Errorf("failed to open postgres queue db: %w", err)
+		}
+		pjq, err := queue.NewPostgresJobQueue(s.postgresQueueDb)
+		if err != nil {
+			logger.Error("failed to create postgres based job queue", "err", err)
+			return nil, fmt.Errorf("failed to create postgres based job queue: %w", err)
+		}
+		s.receiveQueue, s.sendQueues = newPostgresWorkQueues(logger.With("component", "queue"), pjq, sendQueueCfgs)
+	} else {
+		jq, err := liteq.New(liteDb)
+		if err != nil {
+			logger.Error("failed to create sqlite based job queue", "err", err)
+			return nil, fmt.Errorf("failed to create sqlite based job queue: %w", err)
+		}
+		s.receiveQueue, s.sendQueues = newWorkQueues(logger.With("component", "queue"), liteDb, jq, sendQueueCfgs)
 	}
 
-	s.receiveQueue = liteq.NewQueue[*backend.ReceivedMessage](jq, "receive.queue", liteq.JSONMarshaler[*backend.ReceivedMessage]{})
+	var deliveryTracker *queue.DeliveryTracker
+	if cfg.QueueBackend == config.QueueBackendPostgres {
+		deliveryTracker, err = queue.NewPostgresDeliveryTracker(s.postgresQueueDb)
+	} else {
+		deliveryTracker, err = queue.NewDeliveryTracker(liteDb)
+	}
 	if err != nil {
-		logger.Error("failed to create receive queue", "err", err)
-		return nil, fmt.Errorf("failed to create receive queue: %w", err)
+		logger.Error("failed to create delivery tracker", "err", err)
+		return nil, fmt.Errorf("failed to create delivery tracker: %w", err)
+	}
+
+	dns.ConfigureResolver(cfg.DNSResolvers, cfg.DNSTimeout)
+
+	if cfg.OutboundProxyEnabled() {
+		if err := sender.CheckOutboundProxy(ctx, logger, cfg); err != nil {
+			logger.Error("refusing to start with unreachable outbound proxy", "err", err)
+			return nil, fmt.Errorf("refusing to start with unreachable outbound proxy: %w", err)
+		}
 	}
-	s.sendQueue = liteq.NewQueue[*queue.QueuedMessage](jq, "send.queue", liteq.JSONMarshaler[*queue.QueuedMessage]{})
+	if cfg.OutboundProbeEnabled() {
+		logOutboundProbe(logger, sender.ProbeOutboundSmtp(ctx, logger, cfg), cfg.OutboundProbe.Host, cfg.SendAddr)
+	}
+
+	userSrv, err := users.NewUserService(logger.With("component", "UserService"), cfg.UserFile,
+		users.WithAddressDetailStripping(cfg.StripAddressDetail))
 	if err != nil {
-		logger.Error("failed to create send queue", "err", err)
-		return nil, fmt.Errorf("failed to create send queue: %w", err)
+		logger.Error("failed to create user service", "err", err)
+		return nil, fmt.Errorf("failed to create user service: %w", err)
 	}
+	s.userSrv = userSrv
 
-	if result, err := dns.VerifyValidDKIMRecords(cfg.MailDomain, cfg.Dkim); err != nil {
-		logger.Error("failed to verify DKIM records", "err", err)
-	} else if !result.Success() {
-		logger.Warn("Please fix the DKIM DNS records", "create", result.Create, "delete", result.Delete, "update", result.Delete)
-	} else {
-		logger.Info("DKIM DNS records look good")
+	if err := dns.VerifyStartupRecords(logger, cfg, senderIdentities(cfg, userSrv.Senders())...); err != nil {
+		logger.Error("refusing to start with invalid DNS records", "err", err)
+		return nil, fmt.Errorf("refusing to start with invalid DNS records: %w", err)
 	}
 
-	if spfResult, err := dns.VerifySPFRecord(cfg.MailDomain, cfg.TlsDomain, cfg.SendAddr); err != nil {
-		logger.Warn("failed to verify spf records", "err", err)
-	} else if !spfResult.Success() {
-		logger.Warn("Please fix your SPF records", "create", spfResult.Create, "delete", spfResult.Delete, "update", spfResult.Update)
-	} else {
-		logger.Info("SPF records look good")
+	receiveProcessors := []sender.ReceiveProcessor{sender.DeliverAtProcessor()}
+	if cfg.BareLfPolicy == config.BareLfPolicyNormalize {
+		receiveProcessors = append(receiveProcessors, sender.LineEndingProcessor())
+	}
+	signedHeaderKeys := cfg.Dkim.SignedHeaderKeys()
+	if cfg.SubmissionIdHeader != "" {
+		// Added before signing, so the header is covered by the DKIM signatures
+		receiveProcessors = append(receiveProcessors, sender.SubmissionIDHeaderProcessor(cfg.SubmissionIdHeader))
+		signedHeaderKeys = append(slices.Clone(signedHeaderKeys), cfg.SubmissionIdHeader)
+	}
+	receiveProcessors = append(receiveProcessors, sender.ReceivedHeaderProcessor(cfg.MailDomain, cfg.ReceivedHeaderTls))
+	// Always added, so clients can't forge results in our name even if SPF checks are off
+	receiveProcessors = append(receiveProcessors, sender.AuthenticationResultsProcessor(cfg.MailDomain))
+	if cfg.DNSBLEnabled() && cfg.DNSBL.Action == config.DNSBLActionTag {
+		receiveProcessors = append(receiveProcessors, sender.DNSBLHeaderProcessor())
+	}
+	if cfg.ContentScanEnabled() {
+		contentScanProcessor, err := newContentScanProcessor(ctx, logger.With("component", "contentScan"), cfg.ContentScan)
+		if err != nil {
+			return nil, err
+		}
+		receiveProcessors = append(receiveProcessors, contentScanProcessor)
+	}
+	signingProcessors, err := dkimSigners(cfg.MailDomain, cfg.Dkim, signedHeaderKeys)
+	if err != nil {
+		return nil, err
+	}
+	userDkimOptions, err := userDkimSignOptions(userSrv, cfg.Dkim, signedHeaderKeys)
+	if err != nil {
+		return nil, err
+	}
+	signingProcessors = []sender.ReceiveProcessor{sender.UserDkimProcessor(userDkimOptions, cfg.Dkim.SignatureValidity, signingProcessors...)}
+	// Bounces are generated by the senders and don't pass the signing processors
+	bounceSignOptions, err := dkimSignOptions(cfg.MailDomain, cfg.Dkim, cfg.Dkim.SignedHeaderKeys())
+	if err != nil {
+		return nil, err
 	}
 
-	dkimSigners := []sender.ReceiveProcessor{}
-	for _, signerConfig := range cfg.Dkim.Signer {
-		dkimSigners = append(dkimSigners, dkimSignerForKey(cfg.MailDomain, signerConfig))
+	processingOpts := []sender.ProcessingOpt{
+		sender.WithReceiveProcessors(receiveProcessors...),
+		sender.WithSigningProcessors(signingProcessors...),
+		sender.WithSigningPoolSize(cfg.SigningPoolSize),
+		sender.WithPreSendProcessors(
+			sender.TrackingProcessor(ctx, deliveryTracker),
+			sender.PriorityRoutingProcessor(ctx, s.sendQueues, liteq.Retries(cfg.DeliveryAttempts()))),
+		sender.WithProcessingPoolSize(cfg.ReceivePoolSize),
+		sender.WithProcessingVisibilityTimeout(cfg.VisibilityTimeout),
+		sender.WithDiscardTracking(deliveryTracker),
+	}
+	if cfg.ArchiveEnabled() {
+		archive, err := sender.NewMessageArchive(ctx, logger.With("component", "archive"), cfg.Archive.Dir, cfg.Archive.Retention)
+		if err != nil {
+			logger.Error("failed to create message archive", "err", err)
+			return nil, fmt.Errorf("failed to create message archive: %w", err)
+		}
+		processingOpts = append(processingOpts, sender.WithArchive(archive))
 	}
 
-	s.processorHandler, err = sender.NewProcessorHandler(ctx, logger.With("component", "messageProcessing"), s.receiveQueue,
-		sender.WithReceiveProcessors(dkimSigners...),
-		sender.WithPreSendProcessors(sender.SendProcessor(ctx, s.sendQueue, liteq.Retries(3))))
+	s.processorHandler, err = sender.NewProcessorHandler(ctx, logger.With("component", "messageProcessing"), s.receiveQueue, processingOpts...)
 	if err != nil {
 		logger.Error("failed to create message processing", "err", err)
 		return nil, fmt.Errorf("failed to create message processing: %w", err)
 	}
 
-	userSrv, err := users.NewUserService(logger.With("component", "UserService"), cfg.UserFile)
+	quotaLocation, err := cfg.QuotaLocation()
 	if err != nil {
-		logger.Error("failed to create user service", "err", err)
-		return nil, fmt.Errorf("failed to create user service: %w", err)
+		logger.Error("failed to load quota timezone", "err", err)
+		return nil, err
+	}
+	var quotaTracker *users.QuotaTracker
+	if cfg.QueueBackend == config.QueueBackendPostgres {
+		// Instances sharing the queues share the quotas of the users as well
+		quotaTracker, err = users.NewPostgresQuotaTracker(s.postgresQueueDb, userSrv.Quota, quotaLocation)
+	} else {
+		quotaTracker, err = users.NewQuotaTracker(liteDb, userSrv.Quota, quotaLocation)
+	}
+	if err != nil {
+		logger.Error("failed to create quota tracker", "err", err)
+		return nil, fmt.Errorf("failed to create quota tracker: %w", err)
+	}
+
+	backendOpts := []backend.BackendOpt{backend.WithQuotas(quotaTracker)}
+	if cfg.SenderCalloutEnabled() {
+		callout := sender.NewCalloutVerifier(logger.With("component", "senderCallout"), cfg)
+		backendOpts = append(backendOpts, backend.WithSenderVerification(callout.Verify))
+	}
+	if cfg.AuditLog != "" {
+		s.auditLog, err = os.OpenFile(cfg.AuditLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+		if err != nil {
+			logger.Error("failed to open audit log", "err", err, "auditLog", cfg.AuditLog)
+			return nil, fmt.Errorf("failed to open audit log: %w", err)
+		}
+		backendOpts = append(backendOpts, backend.WithAuditLog(slog.New(slog.NewJSONHandler(s.auditLog, nil))))
 	}
 
 	s.backendCtx, s.backendCancel = context.WithCancel(ctx)
-	backend, err := backend.NewBackend(s.backendCtx, logger.With("component", "backend"), s.receiveQueue, userSrv, cfg)
+	smtpBackend, err := backend.NewBackend(s.backendCtx, logger.With("component", "backend"), s.receiveQueue, userSrv, cfg,
+		backendOpts...)
 	if err != nil {
 		logger.Error("failed to create backend", "err", err)
 		return nil, fmt.Errorf("failed to create backend: %w", err)
 	}
 
-	smtpServer := smtp.NewServer(backend)
-	smtpServer.Domain = cfg.MailDomain
-	smtpServer.Addr = cfg.ListenAddr
-	smtpServer.WriteTimeout = 10 * time.Second
-	smtpServer.ReadTimeout = 10 * time.Second
-	smtpServer.MaxMessageBytes = 1024 * 1024
-	smtpServer.MaxRecipients = 2
-	smtpServer.AllowInsecureAuth = !cfg.ListenTls
-	smtpServer.EnableREQUIRETLS = cfg.ListenTls
-	smtpServer.ErrorLog = utils.NewSlogLogger(ctx, logger.With("component", "smtp-server"), slog.LevelError)
+	smtpServer := newSMTPServer(ctx, logger, cfg, smtpBackend)
 
-	if cfg.ListenTls {
+	if cfg.TlsEnabled() {
 		acmeTls, err := acme.NewAcme(ctx, logger.With("component", "acme"), cfg.Acme)
 		if err != nil {
 			logger.Error("failed to create ACME setup", "err", err)
@@ -138,20 +272,167 @@ func NewServer(ctx context.Context, logger *slog.Logger, cfg *config.Config) (*S
 			logger.Error("failed to obtain certificate for domain", "domain", cfg.TlsDomain, "err", err)
 			panic(err)
 		}
+		s.acmeTls = acmeTls
 		smtpServer.TLSConfig = acmeTls.NewTlsConfig()
+		if err := cfg.Tls.Apply(smtpServer.TLSConfig); err != nil {
+			return nil, fmt.Errorf("failed to configure TLS: %w", err)
+		}
+		s.metricsRegistry.MustRegister(acmeTls)
+		if cfg.ClientCertAuthEnabled() {
+			if err := backend.ConfigureClientCertAuth(smtpServer.TLSConfig, cfg.ClientCertAuth.CAFile); err != nil {
+				logger.Error("failed to configure client certificate authentication", "err", err)
+				return nil, fmt.Errorf("failed to configure client certificate authentication: %w", err)
+			}
+		}
 	}
 	s.smtpServer = smtpServer
 
 	s.ctxSender, s.senderCancel = context.WithCancel(ctx)
-	s.sender, err = sender.NewSender(s.ctxSender, logger.With("component", "sender"), cfg, s.sendQueue)
-	if err != nil {
-		logger.Error("failed to create sender", "err", err)
-		return nil, fmt.Errorf("failed to create sender: %w", err)
+	for class, sendQueueCfg := range sendQueueCfgs {
+		snd, err := sender.NewSender(s.ctxSender, logger.With("component", "sender", "priorityClass", class), cfg, s.sendQueues[class],
+			sender.WithDeliveryTracker(deliveryTracker),
+			sender.WithPoolSize(sendPoolSize(cfg, sendQueueCfg)),
+			sender.WithVisibilityTimeout(cfg.VisibilityTimeout),
+			sender.WithBounceSigning(cfg.Dkim.SignatureValidity, bounceSignOptions...))
+		if err != nil {
+			logger.Error("failed to create sender", "err", err, "priorityClass", class)
+			return nil, fmt.Errorf("failed to create sender for priority class %s: %w", class, err)
+		}
+		s.senders = append(s.senders, snd)
 	}
 	return s, nil
 }
 
+// newSMTPServer creates the SMTP server accepting submissions for smtpBackend, without TLS configured
+func newSMTPServer(ctx context.Context, logger *slog.Logger, cfg *config.Config, smtpBackend smtp.Backend) *smtp.Server {
+	smtpServer := smtp.NewServer(smtpBackend)
+	// go-smtp announces the domain in the greeting, so it carries the banner as well
+	smtpServer.Domain = cfg.Greeting()
+	smtpServer.Addr = cfg.ListenAddr
+	smtpServer.WriteTimeout = 10 * time.Second
+	smtpServer.ReadTimeout = 10 * time.Second
+	// Advertised with the SIZE extension, go-smtp rejects larger declared sizes and stops reading oversized
+	// messages at the limit, which the session rejects
+	smtpServer.MaxMessageBytes = cfg.MaxMessageBytes
+	smtpServer.MaxRecipients = 2
+	// CHUNKING is always advertised, the chunks of BDAT are passed to the session as a single body. BINARYMIME is
+	// not, messages are relayed with DATA which can't transport binary bodies.
+	smtpServer.EnableBINARYMIME = false
+	smtpServer.AllowInsecureAuth = !cfg.TlsEnabled()
+	smtpServer.EnableREQUIRETLS = cfg.TlsEnabled()
+	// Messages which can't be delivered by the deadline requested with DELIVERBY are bounced like messages
+	// exceeding the maximum queue age
+	smtpServer.EnableDELIVERBY = true
+	smtpServer.ErrorLog = utils.NewSlogLogger(ctx, logger.With("component", "smtp-server"), slog.LevelError)
+	return smtpServer
+}
+
+// newWorkQueues creates the receive queue and one send queue per priority class. Every queue is consumed by
+// exactly one consumer: the message processing consumes the receive queue and the sender of the priority
+// class consumes its send queue.
+func newWorkQueues(logger *slog.Logger, db *sql.DB, jq *liteq.JobQueue, sendQueueCfgs map[string]*config.SendQueue) (queue.GenericWorkQueue[*backend.ReceivedMessage], map[string]queue.GenericWorkQueue[*queue.QueuedMessage]) {
+	receiveQueue := queue.NewSQLiteWorkQueueOnJobQueue[*backend.ReceivedMessage](db, jq, receiveQueueName, queue.WithLogger(logger))
+	sendQueues := make(map[string]queue.GenericWorkQueue[*queue.QueuedMessage], len(sendQueueCfgs))
+	for class := range sendQueueCfgs {
+		sendQueues[class] = queue.NewSQLiteWorkQueueOnJobQueue[*queue.QueuedMessage](db, jq, sendQueueName(class), queue.WithLogger(logger))
+	}
+	return receiveQueue, sendQueues
+}
+
+// newPostgresWorkQueues creates the same queues as newWorkQueues in a Postgres database. Several instances
+// sharing the database compete for the jobs of each queue.
+func newPostgresWorkQueues(logger *slog.Logger, jq *queue.PostgresJobQueue, sendQueueCfgs map[string]*config.SendQueue) (queue.GenericWorkQueue[*backend.ReceivedMessage], map[string]queue.GenericWorkQueue[*queue.QueuedMessage]) {
+	receiveQueue := queue.NewPostgresWorkQueue[*backend.ReceivedMessage](jq, receiveQueueName, queue.WithLogger(logger))
+	sendQueues := make(map[string]queue.GenericWorkQueue[*queue.QueuedMessage], len(sendQueueCfgs))
+	for class := range sendQueueCfgs {
+		sendQueues[class] = queue.NewPostgresWorkQueue[*queue.QueuedMessage](jq, sendQueueName(class), queue.WithLogger(logger))
+	}
+	return receiveQueue, sendQueues
+}
+
+func queueDbOpts(cfg *config.Config, sendQueueCfgs map[string]*config.SendQueue) []queue.DBOpt {
+	maxOpenConns := queueDbConnections(cfg, sendQueueCfgs)
+	if cfg.QueueDb == nil {
+		return []queue.DBOpt{queue.WithMaxOpenConns(maxOpenConns)}
+	}
+	if cfg.QueueDb.MaxOpenConns > 0 {
+		maxOpenConns = cfg.QueueDb.MaxOpenConns
+	}
+	return []queue.DBOpt{
+		queue.WithJournalMode(cfg.QueueDb.JournalMode),
+		queue.WithSynchronous(cfg.QueueDb.Synchronous),
+		queue.WithBusyTimeout(cfg.QueueDb.BusyTimeout),
+		queue.WithMaxOpenConns(maxOpenConns),
+	}
+}
+
+// queueDbConnections returns a connection for every worker and one per queue to fetch jobs, plus one
+// for queueing submissions
+func queueDbConnections(cfg *config.Config, sendQueueCfgs map[string]*config.SendQueue) int {
+	receivePoolSize := cfg.ReceivePoolSize
+	if receivePoolSize <= 0 {
+		receivePoolSize = sender.DefaultProcessingPoolSize
+	}
+	conns := receivePoolSize + 2
+	for _, sendQueueCfg := range sendQueueCfgs {
+		conns += sendPoolSize(cfg, sendQueueCfg) + 1
+	}
+	return conns
+}
+
+// sendPoolSize returns the pool size of the send queue, falling back to the global send pool size
+func sendPoolSize(cfg *config.Config, sendQueueCfg *config.SendQueue) int {
+	if sendQueueCfg.PoolSize > 0 {
+		return sendQueueCfg.PoolSize
+	}
+	if cfg.SendPoolSize > 0 {
+		return cfg.SendPoolSize
+	}
+	return sender.DefaultSendPoolSize
+}
+
+// sendQueueConfigs returns the configured send queues per priority class. There is always a queue for
+// transactional messages, since every message which can't be routed otherwise ends up there.
+func sendQueueConfigs(cfg *config.Config) map[string]*config.SendQueue {
+	sendQueueCfgs := map[string]*config.SendQueue{
+		queue.PriorityTransactional: {},
+	}
+	for class, sendQueueCfg := range cfg.SendQueues {
+		if sendQueueCfg == nil {
+			sendQueueCfg = &config.SendQueue{}
+		}
+		sendQueueCfgs[strings.ToLower(class)] = sendQueueCfg
+	}
+	return sendQueueCfgs
+}
+
+// QueueDBPath returns the path of the SQLite database holding the queues
+func QueueDBPath(cfg *config.Config) string {
+	return filepath.Join(cfg.QueuePath, "mail.queue")
+}
+
+// SendQueueNames returns the names of the send queues of all priority classes configured by cfg
+func SendQueueNames(cfg *config.Config) []string {
+	names := []string{}
+	for class := range sendQueueConfigs(cfg) {
+		names = append(names, sendQueueName(class))
+	}
+	slices.Sort(names)
+	return names
+}
+
+func sendQueueName(class string) string {
+	if class == queue.PriorityTransactional {
+		// Keep the name of the former single send queue so already queued messages are still delivered
+		return "send.queue"
+	}
+	return fmt.Sprintf("send.%s.queue", class)
+}
+
 func (s *Server) Serve() error {
+	if s.cfg.MetricsAddr != "" {
+		s.serveMetrics()
+	}
 	if s.cfg.ListenTls {
 		if err := s.smtpServer.ListenAndServeTLS(); err != nil {
 			s.logger.Error("failed to listen with TLS on addr", "err", err, "addr", s.cfg.ListenAddr)
@@ -166,51 +447,379 @@ func (s *Server) Serve() error {
 	return nil
 }
 
+// serveMetrics serves the metrics in the background, failing to do so doesn't stop the server
+func (s *Server) serveMetrics() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(s.metricsRegistry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/idle", s.serveIdle)
+	s.metricsServer = &http.Server{
+		Addr:              s.cfg.MetricsAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := s.metricsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("failed to serve metrics", "err", err, "addr", s.cfg.MetricsAddr)
+		}
+	}()
+}
+
+// serveIdle responds with 200 if the receive queue and all send queues are drained and with 503 otherwise.
+// The body is the number of pending messages.
+func (s *Server) serveIdle(w http.ResponseWriter, r *http.Request) {
+	pending, err := s.Pending(r.Context())
+	if err != nil {
+		s.logger.Error("failed to count pending messages", "err", err)
+		http.Error(w, "failed to count pending messages", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if pending > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintf(w, "%d\n", pending)
+}
+
+// Pending returns the number of received messages which are waiting for processing or being processed and
+// the number of messages in all send queues which are waiting for delivery or being delivered
+func (s *Server) Pending(ctx context.Context) (int, error) {
+	total := 0
+	if counter, ok := s.receiveQueue.(queue.PendingCounter); ok {
+		pending, err := counter.Pending(ctx)
+		if err != nil {
+			return 0, err
+		}
+		total += pending
+	}
+	for _, snd := range s.senders {
+		pending, err := snd.Pending(ctx)
+		if err != nil {
+			return 0, err
+		}
+		total += pending
+	}
+	return total, nil
+}
+
+// Idle returns a channel which is closed as soon as the receive queue and all send queues are drained. The
+// queues are checked until they are drained or ctx is done, in which case the channel is never closed.
+func (s *Server) Idle(ctx context.Context) <-chan struct{} {
+	idle := make(chan struct{})
+	go func() {
+		tick := time.NewTicker(idlePollInterval)
+		defer tick.Stop()
+		for {
+			pending, err := s.Pending(ctx)
+			if err != nil && ctx.Err() == nil {
+				s.logger.Error("failed to check whether the queues are drained", "err", err)
+			}
+			if err == nil && pending == 0 {
+				close(idle)
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+			}
+		}
+	}()
+	return idle
+}
+
+// ReloadUsers reads the user file again, the current users are kept if that fails
+func (s *Server) ReloadUsers(ctx context.Context) error {
+	if err := s.userSrv.Reload(ctx); err != nil {
+		s.logger.Error("failed to reload users", "err", err)
+		return err
+	}
+	s.logger.Info("reloaded users")
+	return nil
+}
+
+// ReloadCertificates reads the certificate cache again, the current certificates are kept if that fails
+func (s *Server) ReloadCertificates() error {
+	if s.acmeTls == nil {
+		return nil
+	}
+	if err := s.acmeTls.ReloadCertificates(); err != nil {
+		s.logger.Error("failed to reload certificates", "err", err)
+		return err
+	}
+	s.logger.Info("reloaded certificates")
+	return nil
+}
+
 func (s *Server) Close() error {
 	errs := []error{}
 	if err := s.smtpServer.Close(); err != nil {
 		errs = append(errs, err)
 	}
 	s.backendCancel()
-	if err := s.sender.Close(); err != nil {
+	if err := s.processorHandler.Shutdown(context.Background()); err != nil {
+		errs = append(errs, err)
+	}
+	for _, snd := range s.senders {
+		if err := snd.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := s.shutdownTracing(context.Background()); err != nil {
 		errs = append(errs, err)
 	}
+	if s.auditLog != nil {
+		if err := s.auditLog.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := s.closeQueueDb(); err != nil {
+		errs = append(errs, err)
+	}
+	s.cancel()
 
 	return errors.Join(errs...)
 }
 
+// Shutdown stops the server without losing messages. It stops accepting new connections, waits until
+// received messages in processing are queued for sending, waits for deliveries in flight and finally
+// flushes the traces. The whole shutdown is bounded by the configured shutdown timeout, if any.
 func (s *Server) Shutdown() error {
-	ctx, cancel := context.WithTimeout(s.ctx, time.Second*30)
-	defer cancel()
+	ctx := context.Background()
+	if s.cfg.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.cfg.ShutdownTimeout)
+		defer cancel()
+	}
 	errs := []error{}
 	if err := s.smtpServer.Shutdown(ctx); err != nil {
-		errs = append(errs, err)
+		errs = append(errs, fmt.Errorf("failed to stop accepting connections: %w", err))
+	}
+	if s.metricsServer != nil {
+		if err := s.metricsServer.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to stop serving metrics: %w", err))
+		}
 	}
 	s.backendCancel()
-	if err := s.sender.Close(); err != nil {
+	if s.cfg.ShutdownTimeout > 0 {
+		// No new messages are accepted anymore, give the queued messages the chance to be delivered. Without
+		// a shutdown timeout messages waiting for a retry would delay the shutdown until they are delivered.
+		select {
+		case <-s.Idle(ctx):
+		case <-ctx.Done():
+		}
+	}
+	if err := s.processorHandler.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("failed to drain message processing: %w", err))
+	}
+	for _, snd := range s.senders {
+		if err := snd.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to drain deliveries: %w", err))
+		}
+	}
+	if pending, err := s.Pending(ctx); err != nil {
+		s.logger.Warn("failed to check whether the queues are drained", "err", err)
+	} else if pending > 0 {
+		s.logger.Info("shutting down with pending messages in the queues", "pending", pending)
+	}
+	if err := s.shutdownTracing(ctx); err != nil {
 		errs = append(errs, err)
 	}
+	if s.auditLog != nil {
+		if err := s.auditLog.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close audit log: %w", err))
+		}
+	}
+	if err := s.closeQueueDb(); err != nil {
+		errs = append(errs, err)
+	}
+	s.cancel()
 	return errors.Join(errs...)
 }
 
-func dkimSignerForKey(mailDomain string, cfg *config.DkimSigner) sender.ReceiveProcessor {
+// abortSetup stops what NewServer started before it failed and closes the queue databases
+func (s *Server) abortSetup() {
+	s.cancel()
+	if s.processorHandler != nil {
+		if err := s.processorHandler.Shutdown(context.Background()); err != nil {
+			s.logger.Warn("failed to stop message processing", "err", err)
+		}
+	}
+	for _, snd := range s.senders {
+		if err := snd.Close(); err != nil {
+			s.logger.Warn("failed to stop sender", "err", err)
+		}
+	}
+	if s.auditLog != nil {
+		s.auditLog.Close()
+	}
+	if s.shutdownTracing != nil {
+		if err := s.shutdownTracing(context.Background()); err != nil {
+			s.logger.Warn("failed to shut down tracing", "err", err)
+		}
+	}
+	if err := s.closeQueueDb(); err != nil {
+		s.logger.Warn("failed to close queue databases", "err", err)
+	}
+}
+
+// closeQueueDb closes the queue databases, which must only happen after the message processing and the
+// senders stopped consuming the queues
+func (s *Server) closeQueueDb() error {
+	errs := []error{}
+	if s.postgresQueueDb != nil {
+		if err := s.postgresQueueDb.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close postgres queue db: %w", err))
+		}
+	}
+	if s.queueDb != nil {
+		if err := s.queueDb.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close queue db: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func logOutboundProbe(logger *slog.Logger, probes []sender.PortProbe, host, sendAddr string) {
+	for _, probe := range probes {
+		logger := logger.With("host", host, "port", probe.Port, "sendAddr", sendAddr)
+		if probe.Reachable {
+			logger.Info("outbound SMTP is reachable")
+		} else {
+			logger.Warn("outbound SMTP seems to be blocked, deliveries via this port will fail", "err", probe.Err)
+		}
+	}
+}
+
+// newContentScanProcessor creates the processor scanning messages with the configured scanner and the
+// quarantine it stores messages in
+func newContentScanProcessor(ctx context.Context, logger *slog.Logger, contentScan *config.ContentScan) (sender.ReceiveProcessor, error) {
+	scanner, err := sender.NewContentScanner(contentScan)
+	if err != nil {
+		logger.Error("failed to create content scanner", "err", err)
+		return nil, fmt.Errorf("failed to create content scanner: %w", err)
+	}
+	var quarantine *sender.MessageArchive
+	if contentScan.Action == config.ContentScanActionQuarantine {
+		quarantine, err = sender.NewMessageArchive(ctx, logger.With("component", "quarantine"), contentScan.QuarantineDir, 0)
+		if err != nil {
+			logger.Error("failed to create quarantine", "err", err)
+			return nil, fmt.Errorf("failed to create quarantine: %w", err)
+		}
+	}
+	return sender.ContentScanProcessor(ctx, logger, scanner, contentScan, quarantine), nil
+}
+
+// senderIdentities returns the distinct domains DMARC authenticates the mail of the users with. Users send
+// with their from address as envelope sender and their mail is signed with their own DKIM domain or the
+// mail domain.
+func senderIdentities(cfg *config.Config, senders []users.Sender) []dns.SenderIdentity {
+	identities := []dns.SenderIdentity{}
+	for _, sender := range senders {
+		_, domain, found := strings.Cut(sender.FromAddr, "@")
+		if !found {
+			continue
+		}
+		identity := dns.SenderIdentity{FromDomain: domain, SigningDomain: cfg.MailDomain, EnvelopeDomain: domain}
+		if sender.DkimDomain != "" {
+			identity.SigningDomain = sender.DkimDomain
+		}
+		if !slices.Contains(identities, identity) {
+			identities = append(identities, identity)
+		}
+	}
+	return identities
+}
+
+// dkimSigners returns a signing processor for every active DKIM signer, in the order they sign
+func dkimSigners(mailDomain string, dkimOpts *config.DkimOpts, headerKeys []string) ([]sender.ReceiveProcessor, error) {
+	signOptions, err := dkimSignOptions(mailDomain, dkimOpts, headerKeys)
+	if err != nil {
+		return nil, err
+	}
+	signingProcessors := make([]sender.ReceiveProcessor, 0, len(signOptions))
+	for _, options := range signOptions {
+		signingProcessors = append(signingProcessors, sender.DkimProcessor(options, dkimOpts.SignatureValidity))
+	}
+	return signingProcessors, nil
+}
+
+// dkimSignOptions returns the signing options of every active DKIM signer, in the order they sign
+func dkimSignOptions(mailDomain string, dkimOpts *config.DkimOpts, headerKeys []string) ([]*dkim.SignOptions, error) {
+	signers, err := dkimOpts.ActiveSigners()
+	if err != nil {
+		return nil, err
+	}
+	signOptions := make([]*dkim.SignOptions, 0, len(signers))
+	for _, signerConfig := range signers {
+		options, err := dkimSignOptionsForKey(mailDomain, dkimOpts, signerConfig, headerKeys)
+		if err != nil {
+			return nil, err
+		}
+		signOptions = append(signOptions, options)
+	}
+	return signOptions, nil
+}
+
+// userDkimSignOptions returns the DKIM signing options of users with their own signing domain, which are
+// canonicalized and hashed like the messages of all other users
+func userDkimSignOptions(userSrv *users.UserService, dkimOpts *config.DkimOpts, headerKeys []string) (func(username string) *dkim.SignOptions, error) {
+	hash, err := dkimOpts.HashAlgorithm()
+	if err != nil {
+		return nil, err
+	}
+	headerCanonicalization, bodyCanonicalization, err := dkimOpts.Canonicalization()
+	if err != nil {
+		return nil, err
+	}
+	return func(username string) *dkim.SignOptions {
+		signing := userSrv.DkimSigning(username)
+		if signing == nil {
+			return nil
+		}
+		return &dkim.SignOptions{
+			Domain:                 signing.Domain,
+			Selector:               signing.Selector,
+			Signer:                 signing.Signer,
+			HeaderCanonicalization: headerCanonicalization,
+			BodyCanonicalization:   bodyCanonicalization,
+			Hash:                   hash,
+			HeaderKeys:             headerKeys,
+		}
+	}, nil
+}
+
+func dkimSignerForKey(mailDomain string, dkimOpts *config.DkimOpts, cfg *config.DkimSigner, headerKeys []string) (sender.ReceiveProcessor, error) {
+	signOptions, err := dkimSignOptionsForKey(mailDomain, dkimOpts, cfg, headerKeys)
+	if err != nil {
+		return nil, err
+	}
+	return sender.DkimProcessor(signOptions, dkimOpts.SignatureValidity), nil
+}
+
+func dkimSignOptionsForKey(mailDomain string, dkimOpts *config.DkimOpts, cfg *config.DkimSigner, headerKeys []string) (*dkim.SignOptions, error) {
 	keyPem, err := cfg.PrivateKey.GetKey()
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("failed to load DKIM key of selector %s: %w", cfg.Selector, err)
 	}
 	dkimKey, err := utils.ParseDkimKey(keyPem)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("failed to parse DKIM key of selector %s: %w", cfg.Selector, err)
+	}
+	hash, err := dkimOpts.HashAlgorithm()
+	if err != nil {
+		return nil, err
+	}
+	headerCanonicalization, bodyCanonicalization, err := dkimOpts.Canonicalization()
+	if err != nil {
+		return nil, err
 	}
-	return sender.DkimProcessor(&dkim.SignOptions{
+	return &dkim.SignOptions{
 		Domain:                 mailDomain,
 		Selector:               cfg.Selector,
 		Signer:                 utils.Signer(dkimKey),
-		HeaderCanonicalization: dkim.CanonicalizationRelaxed,
-		BodyCanonicalization:   dkim.CanonicalizationRelaxed,
-		Hash:                   crypto.SHA256,
-		HeaderKeys: []string{ // Recommended headers according to https://www.rfc-editor.org/rfc/rfc6376.html#section-5.4.1
-			"From", "Reply-to", "Subject", "Date", "To", "Cc", "Resent-Date", "Resent-From", "Resent-To", "Resent-Cc", "In-Reply-To", "References",
-		},
-	})
+		HeaderCanonicalization: headerCanonicalization,
+		BodyCanonicalization:   bodyCanonicalization,
+		Hash:                   hash,
+		HeaderKeys:             headerKeys,
+	}, nil
 }
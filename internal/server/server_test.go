@@ -1,17 +1,49 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
 	"log"
 	"log/slog"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	netmail "net/mail"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/dereulenspiegel/liteq"
+	"github.com/dereulenspiegel/smolmailer/internal/backend"
+	"github.com/dereulenspiegel/smolmailer/internal/backend/backendmocks"
 	"github.com/dereulenspiegel/smolmailer/internal/config"
+	"github.com/dereulenspiegel/smolmailer/internal/queue"
+	"github.com/dereulenspiegel/smolmailer/internal/queue/queuemocks"
+	"github.com/dereulenspiegel/smolmailer/internal/sender"
+	"github.com/dereulenspiegel/smolmailer/internal/users"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
 	inbucketClient "github.com/inbucket/inbucket/pkg/rest/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/modules/inbucket"
@@ -193,3 +225,713 @@ BALh4y+qYtjgTfnC9g1UshJoTEWh+9cQlgTXn67hazDzLmI4ic+QUy8UDymbgk4f
 	}
 
 }
+
+func newTestDkimSigner(t *testing.T) (*config.DkimSigner, ed25519.PublicKey) {
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(privKey)
+	require.NoError(t, err)
+	keyPem := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}))
+	return &config.DkimSigner{
+		Selector:   "test",
+		PrivateKey: &config.PrivateKey{Value: keyPem},
+	}, pubKey
+}
+
+func mustDkimSignerForKey(t *testing.T, mailDomain string, dkimOpts *config.DkimOpts, signerCfg *config.DkimSigner, headerKeys []string) sender.ReceiveProcessor {
+	signer, err := dkimSignerForKey(mailDomain, dkimOpts, signerCfg, headerKeys)
+	require.NoError(t, err)
+	return signer
+}
+
+func TestDkimSignerForKeyReturnsConfigurationErrors(t *testing.T) {
+	signerCfg, _ := newTestDkimSigner(t)
+	for _, dkimOpts := range []*config.DkimOpts{
+		{Hash: "sha1"},
+		{HeaderCanonicalization: "nofws"},
+		{BodyCanonicalization: "nofws"},
+	} {
+		_, err := dkimSignerForKey("example.com", dkimOpts, signerCfg, config.DefaultDkimHeaderKeys)
+		assert.Error(t, err)
+	}
+	_, err := dkimSignerForKey("example.com", &config.DkimOpts{}, &config.DkimSigner{
+		Selector:   "broken",
+		PrivateKey: &config.PrivateKey{Value: "not a key"},
+	}, config.DefaultDkimHeaderKeys)
+	assert.ErrorContains(t, err, "broken")
+
+	_, err = dkimSigners("example.com", &config.DkimOpts{
+		Signer: map[string]*config.DkimSigner{"ed25519": signerCfg},
+		Hash:   "md5",
+	}, config.DefaultDkimHeaderKeys)
+	assert.Error(t, err)
+}
+
+func TestDkimSignerHonorsHeaderKeys(t *testing.T) {
+	signerCfg, _ := newTestDkimSigner(t)
+
+	for _, exp := range []struct {
+		dkimOpts   *config.DkimOpts
+		headerKeys string
+	}{
+		{
+			dkimOpts:   &config.DkimOpts{},
+			headerKeys: strings.Join(config.DefaultDkimHeaderKeys, ":"),
+		},
+		{
+			dkimOpts:   &config.DkimOpts{HeaderKeys: []string{"From", "Subject", "X-Custom"}},
+			headerKeys: "From:Subject:X-Custom",
+		},
+		{
+			// Listing From and Subject twice oversigns them
+			dkimOpts:   &config.DkimOpts{HeaderKeys: []string{"From", "From", "Subject", "Subject"}},
+			headerKeys: "From:From:Subject:Subject",
+		},
+	} {
+		processor := mustDkimSignerForKey(t, "example.com", exp.dkimOpts, signerCfg, exp.dkimOpts.SignedHeaderKeys())
+		msg, err := processor(&backend.ReceivedMessage{
+			From: "sender@example.com",
+			Body: []byte("From: sender@example.com\r\nSubject: Test\r\nX-Custom: foo\r\n\r\nbody\r\n"),
+		})
+		require.NoError(t, err)
+
+		parsedMsg, err := netmail.ReadMessage(bytes.NewReader(msg.Body))
+		require.NoError(t, err)
+		signature := parsedMsg.Header.Get("DKIM-Signature")
+		require.NotEmpty(t, signature)
+		tags := map[string]string{}
+		for _, tag := range strings.Split(signature, ";") {
+			key, value, _ := strings.Cut(tag, "=")
+			tags[strings.TrimSpace(key)] = strings.Join(strings.Fields(value), "")
+		}
+		assert.Equal(t, exp.headerKeys, tags["h"])
+		assert.Equal(t, "ed25519-sha256", tags["a"])
+	}
+}
+
+func TestDkimSignersHonorAlgorithms(t *testing.T) {
+	ed25519Signer, _ := newTestDkimSigner(t)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	rsaSigner := &config.DkimSigner{
+		Selector:   "rsa",
+		PrivateKey: &config.PrivateKey{Value: string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}))},
+	}
+	signer := map[string]*config.DkimSigner{"a-rsa": rsaSigner, "b-ed25519": ed25519Signer}
+
+	for _, exp := range []struct {
+		algorithms []string
+		signatures []string
+	}{
+		// Signatures are prepended, so the last one added comes first
+		{algorithms: nil, signatures: []string{"ed25519-sha256", "rsa-sha256"}},
+		{algorithms: []string{"ed25519"}, signatures: []string{"ed25519-sha256"}},
+		{algorithms: []string{"rsa"}, signatures: []string{"rsa-sha256"}},
+		{algorithms: []string{"ed25519", "rsa"}, signatures: []string{"rsa-sha256", "ed25519-sha256"}},
+	} {
+		dkimOpts := &config.DkimOpts{Signer: signer, Algorithms: exp.algorithms}
+		require.NoError(t, dkimOpts.IsValid())
+		processors, err := dkimSigners("example.com", dkimOpts, dkimOpts.SignedHeaderKeys())
+		require.NoError(t, err)
+		msg := &backend.ReceivedMessage{From: "sender@example.com", Body: []byte("From: sender@example.com\r\nSubject: Test\r\n\r\nbody\r\n")}
+		for _, processor := range processors {
+			msg, err = processor(msg)
+			require.NoError(t, err)
+		}
+
+		parsedMsg, err := netmail.ReadMessage(bytes.NewReader(msg.Body))
+		require.NoError(t, err)
+		signatures := []string{}
+		for _, signature := range parsedMsg.Header["Dkim-Signature"] {
+			for _, tag := range strings.Split(signature, ";") {
+				if key, value, _ := strings.Cut(tag, "="); strings.TrimSpace(key) == "a" {
+					signatures = append(signatures, strings.TrimSpace(value))
+				}
+			}
+		}
+		assert.Equal(t, exp.signatures, signatures, "algorithms %v", exp.algorithms)
+	}
+
+	_, err = dkimSigners("example.com", &config.DkimOpts{
+		Signer:     map[string]*config.DkimSigner{"ed25519": ed25519Signer},
+		Algorithms: []string{"rsa"},
+	}, config.DefaultDkimHeaderKeys)
+	assert.Error(t, err)
+}
+
+func TestDkimCanonicalization(t *testing.T) {
+	signerCfg, pubKey := newTestDkimSigner(t)
+	lookupTXT := func(domain string) ([]string, error) {
+		if domain != "test._domainkey.example.com" {
+			return nil, fmt.Errorf("unexpected lookup of %s", domain)
+		}
+		return []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pubKey)}, nil
+	}
+
+	for _, exp := range []struct {
+		dkimOpts *config.DkimOpts
+		valid    bool
+	}{
+		{dkimOpts: &config.DkimOpts{}, valid: true},
+		{dkimOpts: &config.DkimOpts{HeaderCanonicalization: "relaxed", BodyCanonicalization: "relaxed"}, valid: true},
+		{dkimOpts: &config.DkimOpts{HeaderCanonicalization: "simple", BodyCanonicalization: "simple"}, valid: false},
+	} {
+		processor := mustDkimSignerForKey(t, "example.com", exp.dkimOpts, signerCfg, exp.dkimOpts.SignedHeaderKeys())
+		msg, err := processor(&backend.ReceivedMessage{
+			From: "sender@example.com",
+			Body: []byte("From: sender@example.com\r\nSubject: Test message\r\n\r\nHello world\r\n"),
+		})
+		require.NoError(t, err)
+
+		verifications, err := dkim.VerifyWithOptions(bytes.NewReader(msg.Body), &dkim.VerifyOptions{LookupTXT: lookupTXT})
+		require.NoError(t, err)
+		require.Len(t, verifications, 1)
+		require.NoError(t, verifications[0].Err, "unmodified message must always validate")
+
+		// A relay normalizing whitespace in headers and body
+		relayed := bytes.Replace(msg.Body, []byte("Subject: Test message"), []byte("Subject:  Test   message "), 1)
+		relayed = bytes.Replace(relayed, []byte("Hello world\r\n"), []byte("Hello  world \r\n"), 1)
+		verifications, err = dkim.VerifyWithOptions(bytes.NewReader(relayed), &dkim.VerifyOptions{LookupTXT: lookupTXT})
+		require.NoError(t, err)
+		require.Len(t, verifications, 1)
+		if exp.valid {
+			assert.NoError(t, verifications[0].Err)
+		} else {
+			assert.Error(t, verifications[0].Err)
+		}
+	}
+}
+
+func TestSubmissionIdHeaderIsSigned(t *testing.T) {
+	signerCfg, pubKey := newTestDkimSigner(t)
+	dkimOpts := &config.DkimOpts{}
+	headerKeys := append(slices.Clone(dkimOpts.SignedHeaderKeys()), "X-Smolmailer-ID")
+
+	msg := &backend.ReceivedMessage{
+		From: "sender@example.com",
+		To:   []*backend.Rcpt{{To: "rcpt@example.org"}},
+		Body: []byte("From: sender@example.com\r\nSubject: Test message\r\n\r\nHello world\r\n"),
+	}
+	for _, processor := range []sender.ReceiveProcessor{
+		sender.SubmissionIDHeaderProcessor("X-Smolmailer-ID"),
+		mustDkimSignerForKey(t, "example.com", dkimOpts, signerCfg, headerKeys),
+	} {
+		var err error
+		msg, err = processor(msg)
+		require.NoError(t, err)
+	}
+
+	parsedMsg, err := netmail.ReadMessage(bytes.NewReader(msg.Body))
+	require.NoError(t, err)
+	submissionID := parsedMsg.Header.Get("X-Smolmailer-ID")
+	require.NotEmpty(t, submissionID)
+	assert.Contains(t, parsedMsg.Header.Get("DKIM-Signature"), "X-Smolmailer-ID")
+
+	lookupTXT := func(domain string) ([]string, error) {
+		return []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pubKey)}, nil
+	}
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(msg.Body), &dkim.VerifyOptions{LookupTXT: lookupTXT})
+	require.NoError(t, err)
+	require.Len(t, verifications, 1)
+	require.NoError(t, verifications[0].Err)
+
+	tampered := bytes.Replace(msg.Body, []byte(submissionID), []byte(strings.Repeat("0", len(submissionID))), 1)
+	verifications, err = dkim.VerifyWithOptions(bytes.NewReader(tampered), &dkim.VerifyOptions{LookupTXT: lookupTXT})
+	require.NoError(t, err)
+	require.Len(t, verifications, 1)
+	assert.Error(t, verifications[0].Err, "the submission ID header must be covered by the signature")
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "status.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	tracker, err := queue.NewDeliveryTracker(db)
+	require.NoError(t, err)
+	ctx := context.Background()
+	for _, queuedMsg := range msg.QueuedMessages() {
+		require.NoError(t, tracker.Track(ctx, queuedMsg))
+	}
+	submission, err := tracker.Submission(ctx, submissionID)
+	require.NoError(t, err)
+	require.Len(t, submission.Recipients, 1)
+	assert.Equal(t, "rcpt@example.org", submission.Recipients[0].Recipient)
+}
+
+func TestSubmittedMessagesAreProcessedExactlyOnce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db, err := queue.OpenDB(filepath.Join(t.TempDir(), "mail.queue"))
+	require.NoError(t, err)
+	defer db.Close()
+	jq, err := liteq.New(db)
+	require.NoError(t, err)
+	receiveQueue, sendQueues := newWorkQueues(slog.Default(), db, jq, sendQueueConfigs(&config.Config{
+		SendQueues: map[string]*config.SendQueue{queue.PriorityBulk: {}},
+	}))
+	require.Len(t, sendQueues, 2)
+
+	// Competing consumers, as if several instances shared the queue database
+	for range 2 {
+		_, err := sender.NewProcessorHandler(ctx, slog.Default(), receiveQueue,
+			sender.WithPreSendProcessors(sender.PriorityRoutingProcessor(ctx, sendQueues)))
+		require.NoError(t, err)
+	}
+	lock := sync.Mutex{}
+	delivered := map[string][]string{}
+	for class, sendQueue := range sendQueues {
+		for range 2 {
+			go sendQueue.Consume(ctx, func(ctx context.Context, msg *queue.QueuedMessage) error {
+				lock.Lock()
+				defer lock.Unlock()
+				delivered[msg.To] = append(delivered[msg.To], class)
+				return nil
+			})
+		}
+	}
+
+	const messageCount = 10
+	for i := range messageCount {
+		header := ""
+		if i%2 == 1 {
+			header = "Precedence: bulk\r\n"
+		}
+		require.NoError(t, receiveQueue.Queue(ctx, &backend.ReceivedMessage{
+			From: "sender@example.com",
+			To:   []*backend.Rcpt{{To: fmt.Sprintf("rcpt%d@example.org", i)}},
+			Body: []byte(header + "Subject: Test\r\n\r\nbody\r\n"),
+		}))
+	}
+
+	require.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(delivered) == messageCount
+	}, time.Second*10, time.Millisecond*50)
+	// Give duplicate deliveries a chance to show up
+	time.Sleep(time.Millisecond * 500)
+
+	lock.Lock()
+	defer lock.Unlock()
+	for i := range messageCount {
+		expectedClass := queue.PriorityTransactional
+		if i%2 == 1 {
+			expectedClass = queue.PriorityBulk
+		}
+		assert.Equal(t, []string{expectedClass}, delivered[fmt.Sprintf("rcpt%d@example.org", i)])
+	}
+}
+
+func TestQueueDbConnections(t *testing.T) {
+	sendQueueCfgs := sendQueueConfigs(&config.Config{
+		SendQueues: map[string]*config.SendQueue{queue.PriorityBulk: {PoolSize: 2}},
+	})
+	// 10 transactional and 2 bulk workers, one fetching connection per send queue, one receive worker,
+	// one connection fetching received messages and one for queueing submissions
+	assert.Equal(t, 17, queueDbConnections(&config.Config{}, sendQueueCfgs))
+	assert.Equal(t, 23, queueDbConnections(&config.Config{ReceivePoolSize: 3, SendPoolSize: 14}, sendQueueCfgs))
+
+	db, err := queue.OpenDB(filepath.Join(t.TempDir(), "mail.queue"), queueDbOpts(&config.Config{}, sendQueueCfgs)...)
+	require.NoError(t, err)
+	defer db.Close()
+	assert.Equal(t, 17, db.Stats().MaxOpenConnections)
+
+	db, err = queue.OpenDB(filepath.Join(t.TempDir(), "mail.queue"), queueDbOpts(&config.Config{
+		QueueDb: &config.QueueDb{JournalMode: "DELETE", MaxOpenConns: 3},
+	}, sendQueueCfgs)...)
+	require.NoError(t, err)
+	defer db.Close()
+	assert.Equal(t, 3, db.Stats().MaxOpenConnections)
+	var journalMode string
+	require.NoError(t, db.QueryRow("PRAGMA journal_mode").Scan(&journalMode))
+	assert.Equal(t, "delete", journalMode)
+}
+
+func TestShutdownQueuesReceivedMessages(t *testing.T) {
+	ctx := context.Background()
+	queuePath := filepath.Join(t.TempDir(), "mail.queue")
+	db, err := queue.OpenDB(queuePath)
+	require.NoError(t, err)
+	defer db.Close()
+	jq, err := liteq.New(db)
+	require.NoError(t, err)
+	receiveQueue, sendQueues := newWorkQueues(slog.Default(), db, jq, sendQueueConfigs(&config.Config{}))
+
+	processingStarted := make(chan struct{})
+	signed := atomic.Bool{}
+	slowSigner := func(msg *backend.ReceivedMessage) (*backend.ReceivedMessage, error) {
+		close(processingStarted)
+		time.Sleep(time.Millisecond * 300)
+		msg.Body = append([]byte("DKIM-Signature: test\r\n"), msg.Body...)
+		signed.Store(true)
+		return msg, nil
+	}
+	processorHandler, err := sender.NewProcessorHandler(ctx, slog.Default(), receiveQueue,
+		sender.WithReceiveProcessors(slowSigner),
+		sender.WithPreSendProcessors(sender.PriorityRoutingProcessor(ctx, sendQueues)))
+	require.NoError(t, err)
+	backendCtx, backendCancel := context.WithCancel(ctx)
+	defer backendCancel()
+	be, err := backend.NewBackend(backendCtx, slog.Default(), receiveQueue, nil, &config.Config{})
+	require.NoError(t, err)
+	s := &Server{
+		cancel:           func() {},
+		smtpServer:       smtp.NewServer(be),
+		receiveQueue:     receiveQueue,
+		sendQueues:       sendQueues,
+		processorHandler: processorHandler,
+		backendCtx:       backendCtx,
+		backendCancel:    backendCancel,
+		shutdownTracing:  func(context.Context) error { return nil },
+		cfg:              &config.Config{ShutdownTimeout: time.Second * 5},
+		logger:           slog.Default(),
+	}
+
+	// Submitted just before the shutdown
+	require.NoError(t, receiveQueue.Queue(ctx, &backend.ReceivedMessage{
+		From: "sender@example.com",
+		To:   []*backend.Rcpt{{To: "rcpt@example.org"}},
+		Body: []byte("Subject: Test\r\n\r\nbody\r\n"),
+	}))
+	select {
+	case <-processingStarted:
+	case <-time.After(time.Second * 5):
+		t.Fatal("message processing did not start")
+	}
+	require.NoError(t, s.Shutdown())
+	assert.True(t, signed.Load(), "shutdown must wait for messages in processing")
+
+	// The signed message must be waiting in the send queue after a restart
+	db, err = queue.OpenDB(queuePath)
+	require.NoError(t, err)
+	defer db.Close()
+	jq, err = liteq.New(db)
+	require.NoError(t, err)
+	_, sendQueues = newWorkQueues(slog.Default(), db, jq, sendQueueConfigs(&config.Config{}))
+	consumeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	queued := make(chan *queue.QueuedMessage, 1)
+	go sendQueues[queue.PriorityTransactional].Consume(consumeCtx, func(ctx context.Context, msg *queue.QueuedMessage) error {
+		queued <- msg
+		return nil
+	})
+	select {
+	case msg := <-queued:
+		assert.Equal(t, "rcpt@example.org", msg.To)
+		assert.True(t, bytes.HasPrefix(msg.Body, []byte("DKIM-Signature: test\r\n")))
+	case <-time.After(time.Second * 5):
+		t.Fatal("received message was lost on shutdown")
+	}
+}
+
+func TestBareLfIsFixedBeforeSigning(t *testing.T) {
+	signerCfg, pubKey := newTestDkimSigner(t)
+	dkimOpts := &config.DkimOpts{HeaderCanonicalization: "simple", BodyCanonicalization: "simple"}
+
+	q := queuemocks.NewGenericWorkQueueMock[*backend.ReceivedMessage](t)
+	var received *backend.ReceivedMessage
+	q.On("Queue", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		received = args.Get(1).(*backend.ReceivedMessage)
+	}).Return(nil)
+	usrSrv := backendmocks.NewUserServiceMock(t)
+	usrSrv.On("Authenticate", "user", "password").Return(nil)
+	usrSrv.On("IsValidSender", "user", "sender@example.com").Return(true)
+	sess := backend.NewSession(context.Background(), slog.Default(), q, usrSrv,
+		net.TCPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:50000")), backend.WithBareLfPolicy(config.BareLfPolicyFix))
+	authServer, err := sess.Auth(sasl.Plain)
+	require.NoError(t, err)
+	_, _, err = authServer.Next([]byte("\x00user\x00password"))
+	require.NoError(t, err)
+	require.NoError(t, sess.Mail("sender@example.com", &smtp.MailOptions{}))
+	require.NoError(t, sess.Rcpt("rcpt@example.org", &smtp.RcptOptions{}))
+	require.NoError(t, sess.Data(bytes.NewBufferString("From: sender@example.com\nSubject: Test\n\nHello\nworld\n")))
+	require.NotNil(t, received)
+
+	msg, err := mustDkimSignerForKey(t, "example.com", dkimOpts, signerCfg, dkimOpts.SignedHeaderKeys())(received)
+	require.NoError(t, err)
+	assert.NotContains(t, strings.ReplaceAll(string(msg.Body), "\r\n", ""), "\n", "transmitted body must not contain bare LF")
+
+	lookupTXT := func(domain string) ([]string, error) {
+		return []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pubKey)}, nil
+	}
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(msg.Body), &dkim.VerifyOptions{LookupTXT: lookupTXT})
+	require.NoError(t, err)
+	require.Len(t, verifications, 1)
+	assert.NoError(t, verifications[0].Err, "the transmitted body must match the signed body")
+}
+
+func TestDkimSignatureExpiration(t *testing.T) {
+	signerCfg, pubKey := newTestDkimSigner(t)
+	lookupTXT := func(domain string) ([]string, error) {
+		return []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pubKey)}, nil
+	}
+	sign := func(dkimOpts *config.DkimOpts) (string, *dkim.Verification) {
+		msg, err := mustDkimSignerForKey(t, "example.com", dkimOpts, signerCfg, dkimOpts.SignedHeaderKeys())(&backend.ReceivedMessage{
+			From: "sender@example.com",
+			Body: []byte("From: sender@example.com\r\nSubject: Test\r\n\r\nHello\r\n"),
+		})
+		require.NoError(t, err)
+		verifications, err := dkim.VerifyWithOptions(bytes.NewReader(msg.Body), &dkim.VerifyOptions{LookupTXT: lookupTXT})
+		require.NoError(t, err)
+		require.Len(t, verifications, 1)
+		require.NoError(t, verifications[0].Err)
+		return string(msg.Body), verifications[0]
+	}
+
+	body, verification := sign(&config.DkimOpts{})
+	assert.NotRegexp(t, `[;\s]x=`, body, "signatures don't expire by default")
+	assert.True(t, verification.Expiration.IsZero())
+
+	signed := time.Now()
+	body, verification = sign(&config.DkimOpts{SignatureValidity: time.Hour * 24})
+	expiration := regexp.MustCompile(`[;\s]x=(\d+)`).FindStringSubmatch(body)
+	require.Len(t, expiration, 2, "signature must carry the x= tag")
+	assert.Equal(t, strconv.FormatInt(verification.Expiration.Unix(), 10), expiration[1])
+	assert.WithinDuration(t, signed.Add(time.Hour*24), verification.Expiration, time.Second*2)
+	assert.WithinDuration(t, verification.Time.Add(time.Hour*24), verification.Expiration, time.Second,
+		"x= is relative to the signing time t=")
+}
+
+func TestNullSenderIsNotSigned(t *testing.T) {
+	signerCfg, _ := newTestDkimSigner(t)
+	dkimOpts := &config.DkimOpts{}
+	signer := mustDkimSignerForKey(t, "example.com", dkimOpts, signerCfg, dkimOpts.SignedHeaderKeys())
+	body := "From: MAILER-DAEMON@example.com\r\nSubject: Undelivered Mail\r\n\r\nHello\r\n"
+
+	msg, err := sender.UserDkimProcessor(func(string) *dkim.SignOptions { return nil }, 0, signer)(&backend.ReceivedMessage{
+		AuthUser: "sender",
+		Body:     []byte(body),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, body, string(msg.Body), "messages with the null sender are not signed")
+}
+
+func TestSMTPGreeting(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		cfg      *config.Config
+		greeting string
+	}{
+		{
+			name:     "mail domain",
+			cfg:      &config.Config{MailDomain: "example.com"},
+			greeting: "220 example.com ESMTP Service Ready",
+		},
+		{
+			name:     "public hostname",
+			cfg:      &config.Config{MailDomain: "example.com", PublicHostname: "mx.example.net"},
+			greeting: "220 mx.example.net ESMTP Service Ready",
+		},
+		{
+			name:     "banner",
+			cfg:      &config.Config{MailDomain: "example.com", PublicHostname: "mx.example.net", SMTPBanner: "relay"},
+			greeting: "220 mx.example.net relay ESMTP Service Ready",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			be, err := backend.NewBackend(ctx, slog.Default(), queuemocks.NewGenericWorkQueueMock[*backend.ReceivedMessage](t), nil, test.cfg)
+			require.NoError(t, err)
+			smtpServer := newSMTPServer(ctx, slog.Default(), test.cfg, be)
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			go smtpServer.Serve(l)
+			defer smtpServer.Close()
+
+			conn, err := net.Dial("tcp", l.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+			greeting, err := bufio.NewReader(conn).ReadString('\n')
+			require.NoError(t, err)
+			assert.Equal(t, test.greeting+"\r\n", greeting)
+		})
+	}
+}
+
+func TestSMTPServerAdvertisesMaxMessageSize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg := &config.Config{MailDomain: "example.com", MaxMessageBytes: 1024}
+	be, err := backend.NewBackend(ctx, slog.Default(), queuemocks.NewGenericWorkQueueMock[*backend.ReceivedMessage](t), nil, cfg)
+	require.NoError(t, err)
+	smtpServer := newSMTPServer(ctx, slog.Default(), cfg, be)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go smtpServer.Serve(l)
+	defer smtpServer.Close()
+
+	c, err := smtp.Dial(l.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.Hello("client.example.org"))
+	ok, size := c.Extension("SIZE")
+	assert.True(t, ok)
+	assert.Equal(t, "1024", size)
+	err = c.Mail("from@example.com", &smtp.MailOptions{Size: 2048})
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, err, &smtpErr)
+	assert.Equal(t, 552, smtpErr.Code)
+}
+
+func TestShutdownClosesQueueDb(t *testing.T) {
+	queuePath := t.TempDir()
+	userFile := filepath.Join(t.TempDir(), "users.yaml")
+	require.NoError(t, os.WriteFile(userFile, []byte("[]\n"), 0660))
+	cfg := &config.Config{
+		MailDomain: "example.com",
+		QueuePath:  queuePath,
+		UserFile:   userFile,
+		Dkim:       &config.DkimOpts{},
+	}
+
+	for i, stop := range []func(*Server) error{(*Server).Shutdown, (*Server).Close, (*Server).Shutdown, (*Server).Close} {
+		s, err := NewServer(context.Background(), slog.Default(), cfg)
+		require.NoError(t, err, "server %d", i)
+		require.NoError(t, s.queueDb.Ping())
+		require.NoError(t, stop(s))
+		assert.ErrorContains(t, s.queueDb.Ping(), "database is closed", "server %d", i)
+		// SQLite removes the WAL files once the last connection is closed
+		assert.NoFileExists(t, QueueDBPath(cfg)+"-wal", "server %d", i)
+		assert.NoFileExists(t, QueueDBPath(cfg)+"-shm", "server %d", i)
+	}
+}
+
+func TestFailedSetupClosesQueueDb(t *testing.T) {
+	userFile := filepath.Join(t.TempDir(), "users.yaml")
+	require.NoError(t, os.WriteFile(userFile, []byte("[]\n"), 0660))
+	cfg := &config.Config{
+		MailDomain: "example.com",
+		QueuePath:  t.TempDir(),
+		UserFile:   userFile,
+		Dkim:       &config.DkimOpts{},
+		// The audit log is opened after the queues are set up, so the setup fails late
+		AuditLog: filepath.Join(t.TempDir(), "missing", "audit.log"),
+	}
+
+	s, err := NewServer(context.Background(), slog.Default(), cfg)
+	require.ErrorContains(t, err, "audit log")
+	assert.Nil(t, s)
+	assert.FileExists(t, QueueDBPath(cfg))
+	// SQLite removes the WAL files once the last connection is closed
+	assert.NoFileExists(t, QueueDBPath(cfg)+"-wal")
+	assert.NoFileExists(t, QueueDBPath(cfg)+"-shm")
+}
+
+func TestUserDkimSigning(t *testing.T) {
+	globalSigner, globalPubKey := newTestDkimSigner(t)
+	userSigner, userPubKey := newTestDkimSigner(t)
+	userFile := filepath.Join(t.TempDir(), "users.yaml")
+	userYaml := "- username: tenant\n  from: tenant@tenant.example.net\n  dkimDomain: tenant.example.net\n  dkimSelector: tenant\n  dkimKey: |\n" +
+		"    " + strings.ReplaceAll(strings.TrimSpace(userSigner.PrivateKey.Value), "\n", "\n    ") + "\n" +
+		"- username: other\n  from: other@example.com\n"
+	require.NoError(t, os.WriteFile(userFile, []byte(userYaml), 0660))
+	userSrv, err := users.NewUserService(slog.Default(), userFile)
+	require.NoError(t, err)
+
+	dkimOpts := &config.DkimOpts{Signer: map[string]*config.DkimSigner{"ed25519": globalSigner}}
+	globalSigners, err := dkimSigners("example.com", dkimOpts, dkimOpts.SignedHeaderKeys())
+	require.NoError(t, err)
+	userOptions, err := userDkimSignOptions(userSrv, dkimOpts, dkimOpts.SignedHeaderKeys())
+	require.NoError(t, err)
+	processor := sender.UserDkimProcessor(userOptions, 0, globalSigners...)
+
+	lookupTXT := func(domain string) ([]string, error) {
+		switch domain {
+		case "test._domainkey.example.com":
+			return []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(globalPubKey)}, nil
+		case "tenant._domainkey.tenant.example.net":
+			return []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(userPubKey)}, nil
+		}
+		return nil, fmt.Errorf("no DKIM record at %s", domain)
+	}
+	for _, exp := range []struct {
+		authUser string
+		domain   string
+	}{
+		{authUser: "tenant", domain: "tenant.example.net"},
+		{authUser: "other", domain: "example.com"},
+		{authUser: "", domain: "example.com"},
+	} {
+		msg, err := processor(&backend.ReceivedMessage{
+			From:     "sender@example.com",
+			AuthUser: exp.authUser,
+			Body:     []byte("From: sender@example.com\r\nSubject: Test\r\n\r\nbody\r\n"),
+		})
+		require.NoError(t, err)
+		verifications, err := dkim.VerifyWithOptions(bytes.NewReader(msg.Body), &dkim.VerifyOptions{LookupTXT: lookupTXT})
+		require.NoError(t, err)
+		require.Len(t, verifications, 1, "user %q", exp.authUser)
+		assert.NoError(t, verifications[0].Err)
+		assert.Equal(t, exp.domain, verifications[0].Domain, "user %q", exp.authUser)
+	}
+}
+
+func TestIdleReportsPendingMessages(t *testing.T) {
+	ctx := context.Background()
+	db, err := queue.OpenDB(filepath.Join(t.TempDir(), "mail.queue"))
+	require.NoError(t, err)
+	defer db.Close()
+	jq, err := liteq.New(db)
+	require.NoError(t, err)
+	receiveQueue, sendQueues := newWorkQueues(slog.Default(), db, jq, sendQueueConfigs(&config.Config{}))
+	sendQueue := sendQueues[queue.PriorityTransactional]
+	snd, err := sender.NewSender(ctx, slog.Default(), &config.Config{Dkim: &config.DkimOpts{}}, sendQueue)
+	require.NoError(t, err)
+	defer snd.Close()
+	s := &Server{
+		receiveQueue: receiveQueue,
+		senders:      []*sender.Sender{snd},
+		logger:       slog.Default(),
+	}
+
+	idle := func() (int, string) {
+		rec := httptest.NewRecorder()
+		s.serveIdle(rec, httptest.NewRequest(http.MethodGet, "/idle", nil))
+		return rec.Code, rec.Body.String()
+	}
+	code, body := idle()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "0\n", body)
+
+	msg := &queue.QueuedMessage{From: "sender@example.com", To: "rcpt@example.org", DeliverAt: time.Now().Add(time.Hour)}
+	require.NoError(t, sendQueue.Queue(ctx, msg, msg.QueueOptions()...))
+	code, body = idle()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "1\n", body)
+
+	require.NoError(t, receiveQueue.Queue(ctx, &backend.ReceivedMessage{From: "sender@example.com"}))
+	code, body = idle()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "2\n", body, "received messages waiting for processing are pending as well")
+}
+
+func TestServerIdleOnceQueuesAreDrained(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db, err := queue.OpenDB(filepath.Join(t.TempDir(), "mail.queue"))
+	require.NoError(t, err)
+	defer db.Close()
+	jq, err := liteq.New(db)
+	require.NoError(t, err)
+	receiveQueue, _ := newWorkQueues(slog.Default(), db, jq, sendQueueConfigs(&config.Config{}))
+	s := &Server{
+		receiveQueue: receiveQueue,
+		logger:       slog.Default(),
+	}
+
+	require.NoError(t, receiveQueue.Queue(ctx, &backend.ReceivedMessage{From: "sender@example.com"}))
+	idle := s.Idle(ctx)
+	select {
+	case <-idle:
+		t.Fatal("server is idle with a pending received message")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	go receiveQueue.Consume(ctx, func(ctx context.Context, msg *backend.ReceivedMessage) error {
+		return nil
+	}, liteq.OnEmptySleep(time.Millisecond*10))
+	select {
+	case <-idle:
+	case <-time.After(time.Second * 5):
+		t.Fatal("server did not become idle after the received message was processed")
+	}
+}
@@ -0,0 +1,75 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName  = "github.com/dereulenspiegel/smolmailer"
+	serviceName = "smolmailer"
+)
+
+// TraceContext carries the trace context of a message through the queues
+type TraceContext map[string]string
+
+var propagator = propagation.TraceContext{}
+
+// Setup configures the global tracer provider to export spans via OTLP/HTTP to the given endpoint.
+// If no endpoint is configured tracing stays a no-op. The returned function flushes and stops the exporter.
+func Setup(ctx context.Context, otlpEndpoint string) (func(context.Context) error, error) {
+	if otlpEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(otlpEndpoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP trace exporter for %s: %w", otlpEndpoint, err)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(sdkresource.NewSchemaless(semconv.ServiceName(serviceName))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagator)
+	return tp.Shutdown, nil
+}
+
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// End records err, if any, on the span and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Inject captures the trace context of ctx so it can be stored together with a message
+func Inject(ctx context.Context) TraceContext {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return TraceContext(carrier)
+}
+
+// Extract returns a context continuing the trace stored with a message
+func Extract(ctx context.Context, tc TraceContext) context.Context {
+	if len(tc) == 0 {
+		return ctx
+	}
+	return propagator.Extract(ctx, propagation.MapCarrier(tc))
+}
@@ -0,0 +1,142 @@
+package users
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dereulenspiegel/smolmailer/internal/queue"
+)
+
+var (
+	ErrMessageQuotaExceeded   = errors.New("daily message quota exceeded")
+	ErrRecipientQuotaExceeded = errors.New("daily recipient quota exceeded")
+)
+
+const userQuotaSchema = `
+CREATE TABLE IF NOT EXISTS user_quota (
+	username TEXT NOT NULL,
+	day TEXT NOT NULL,
+	messages INTEGER NOT NULL DEFAULT 0,
+	recipients INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (username, day)
+);
+`
+
+const quotaDayLayout = "2006-01-02"
+
+// QuotaUsage is what a user has sent on a single day
+type QuotaUsage struct {
+	Messages   int
+	Recipients int
+}
+
+// QuotaTracker enforces the daily quotas of users. The usage is counted per day in the configured time zone
+// and persisted, so it survives restarts. Counting starts over at midnight.
+type QuotaTracker struct {
+	db       *sql.DB
+	quotas   func(username string) *Quota
+	location *time.Location
+	now      func() time.Time
+	// bind converts the placeholders of queries to the ones of the database
+	bind func(query string) string
+}
+
+func NewQuotaTracker(db *sql.DB, quotas func(username string) *Quota, location *time.Location) (*QuotaTracker, error) {
+	if _, err := db.Exec(userQuotaSchema); err != nil {
+		return nil, fmt.Errorf("failed to create user quota schema: %w", err)
+	}
+	return newQuotaTracker(db, quotas, location, func(query string) string { return query }), nil
+}
+
+// NewPostgresQuotaTracker keeps the quota usage in the Postgres database, so the quotas are enforced across
+// all instances sharing it instead of per instance
+func NewPostgresQuotaTracker(db *sql.DB, quotas func(username string) *Quota, location *time.Location) (*QuotaTracker, error) {
+	if err := queue.SetupPostgresSchema(db, userQuotaSchema); err != nil {
+		return nil, fmt.Errorf("failed to create user quota schema: %w", err)
+	}
+	return newQuotaTracker(db, quotas, location, queue.PostgresPlaceholders), nil
+}
+
+func newQuotaTracker(db *sql.DB, quotas func(username string) *Quota, location *time.Location, bind func(string) string) *QuotaTracker {
+	if location == nil {
+		location = time.UTC
+	}
+	return &QuotaTracker{
+		db:       db,
+		quotas:   quotas,
+		location: location,
+		now:      time.Now,
+		bind:     bind,
+	}
+}
+
+func (q *QuotaTracker) day() string {
+	return q.now().In(q.location).Format(quotaDayLayout)
+}
+
+// Usage returns what the user has sent today
+func (q *QuotaTracker) Usage(ctx context.Context, username string) (*QuotaUsage, error) {
+	usage := &QuotaUsage{}
+	err := q.db.QueryRowContext(ctx, q.bind(`SELECT messages, recipients FROM user_quota WHERE username = ? AND day = ?`),
+		username, q.day()).Scan(&usage.Messages, &usage.Recipients)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("failed to query quota usage of %s: %w", username, err)
+	}
+	return usage, nil
+}
+
+// CheckMessage returns ErrMessageQuotaExceeded if the user must not send another message today
+func (q *QuotaTracker) CheckMessage(ctx context.Context, username string) error {
+	quota := q.quotas(username)
+	if quota == nil || quota.MaxMessagesPerDay <= 0 {
+		return nil
+	}
+	usage, err := q.Usage(ctx, username)
+	if err != nil {
+		return err
+	}
+	if usage.Messages >= quota.MaxMessagesPerDay {
+		return fmt.Errorf("%w: %d messages", ErrMessageQuotaExceeded, quota.MaxMessagesPerDay)
+	}
+	return nil
+}
+
+// CheckRecipients returns ErrRecipientQuotaExceeded if the user must not send to this many more recipients today
+func (q *QuotaTracker) CheckRecipients(ctx context.Context, username string, recipients int) error {
+	quota := q.quotas(username)
+	if quota == nil || quota.MaxRecipientsPerDay <= 0 {
+		return nil
+	}
+	usage, err := q.Usage(ctx, username)
+	if err != nil {
+		return err
+	}
+	if usage.Recipients+recipients > quota.MaxRecipientsPerDay {
+		return fmt.Errorf("%w: %d recipients", ErrRecipientQuotaExceeded, quota.MaxRecipientsPerDay)
+	}
+	return nil
+}
+
+// Record counts a message to the given number of recipients against today's quota of the user and
+// removes the usage of previous days
+func (q *QuotaTracker) Record(ctx context.Context, username string, recipients int) error {
+	if quota := q.quotas(username); quota == nil {
+		return nil
+	}
+	day := q.day()
+	_, err := q.db.ExecContext(ctx, q.bind(
+		`INSERT INTO user_quota (username, day, messages, recipients) VALUES (?, ?, 1, ?)
+		ON CONFLICT (username, day) DO UPDATE SET messages = user_quota.messages + 1,
+		recipients = user_quota.recipients + excluded.recipients`),
+		username, day, recipients)
+	if err != nil {
+		return fmt.Errorf("failed to record quota usage of %s: %w", username, err)
+	}
+	if _, err := q.db.ExecContext(ctx, q.bind(`DELETE FROM user_quota WHERE username = ? AND day < ?`), username, day); err != nil {
+		return fmt.Errorf("failed to remove previous quota usage of %s: %w", username, err)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package users
+
+import (
+	"context"
+	"log"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dereulenspiegel/smolmailer/internal/queue"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/modules/postgres"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func newTestQuotaTracker(t *testing.T, path string, location *time.Location, now *time.Time) *QuotaTracker {
+	db, err := queue.OpenDB(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	quotas := map[string]*Quota{
+		"grafana": {MaxMessagesPerDay: 2, MaxRecipientsPerDay: 3},
+	}
+	tracker, err := NewQuotaTracker(db, func(username string) *Quota { return quotas[username] }, location)
+	require.NoError(t, err)
+	tracker.now = func() time.Time { return *now }
+	return tracker
+}
+
+func TestQuotaResetsAtMidnight(t *testing.T) {
+	ctx := context.Background()
+	dbPath := filepath.Join(t.TempDir(), "quota.db")
+	now := time.Date(2025, 3, 1, 23, 50, 0, 0, time.UTC)
+	tracker := newTestQuotaTracker(t, dbPath, time.UTC, &now)
+
+	require.NoError(t, tracker.CheckMessage(ctx, "grafana"))
+	require.NoError(t, tracker.CheckRecipients(ctx, "grafana", 2))
+	require.NoError(t, tracker.Record(ctx, "grafana", 2))
+
+	assert.ErrorIs(t, tracker.CheckRecipients(ctx, "grafana", 2), ErrRecipientQuotaExceeded)
+	require.NoError(t, tracker.CheckRecipients(ctx, "grafana", 1))
+	require.NoError(t, tracker.Record(ctx, "grafana", 1))
+	assert.ErrorIs(t, tracker.CheckMessage(ctx, "grafana"), ErrMessageQuotaExceeded)
+
+	// The usage survives a restart
+	restarted := newTestQuotaTracker(t, dbPath, time.UTC, &now)
+	assert.ErrorIs(t, restarted.CheckMessage(ctx, "grafana"), ErrMessageQuotaExceeded)
+
+	now = now.Add(time.Minute * 15)
+	assert.NoError(t, restarted.CheckMessage(ctx, "grafana"))
+	assert.NoError(t, restarted.CheckRecipients(ctx, "grafana", 3))
+	usage, err := restarted.Usage(ctx, "grafana")
+	require.NoError(t, err)
+	assert.Equal(t, &QuotaUsage{}, usage)
+
+	// Users without quota are never limited
+	for range 5 {
+		require.NoError(t, restarted.Record(ctx, "other", 10))
+	}
+	assert.NoError(t, restarted.CheckMessage(ctx, "other"))
+	assert.NoError(t, restarted.CheckRecipients(ctx, "other", 100))
+}
+
+func TestQuotaResetsInConfiguredTimezone(t *testing.T) {
+	ctx := context.Background()
+	location, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+	// 23:30 UTC is already the next day in Berlin
+	now := time.Date(2025, 3, 1, 23, 30, 0, 0, time.UTC)
+	tracker := newTestQuotaTracker(t, filepath.Join(t.TempDir(), "quota.db"), location, &now)
+
+	require.NoError(t, tracker.Record(ctx, "grafana", 1))
+	require.NoError(t, tracker.Record(ctx, "grafana", 1))
+	assert.ErrorIs(t, tracker.CheckMessage(ctx, "grafana"), ErrMessageQuotaExceeded)
+
+	// Midnight UTC does not reset the quota
+	now = time.Date(2025, 3, 2, 0, 30, 0, 0, time.UTC)
+	assert.ErrorIs(t, tracker.CheckMessage(ctx, "grafana"), ErrMessageQuotaExceeded)
+
+	now = time.Date(2025, 3, 2, 23, 0, 0, 0, time.UTC)
+	assert.NoError(t, tracker.CheckMessage(ctx, "grafana"))
+}
+
+func TestPostgresQuotaIsSharedByInstances(t *testing.T) {
+	testcontainers.SkipIfProviderIsNotHealthy(t)
+	ctx := context.Background()
+	pgContainer, err := postgres.Run(ctx, "postgres:17-alpine", postgres.BasicWaitStrategies())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		if err := testcontainers.TerminateContainer(pgContainer); err != nil {
+			log.Printf("failed to terminate container: %s", err)
+		}
+	})
+	dsn, err := pgContainer.ConnectionString(ctx, "sslmode=disable")
+	require.NoError(t, err)
+	db, err := queue.OpenPostgresDB(dsn)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	quotas := func(username string) *Quota { return &Quota{MaxMessagesPerDay: 2, MaxRecipientsPerDay: 3} }
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	instances := []*QuotaTracker{}
+	for range 2 {
+		tracker, err := NewPostgresQuotaTracker(db, quotas, time.UTC)
+		require.NoError(t, err)
+		tracker.now = func() time.Time { return now }
+		instances = append(instances, tracker)
+	}
+
+	require.NoError(t, instances[0].Record(ctx, "grafana", 2))
+	require.NoError(t, instances[1].Record(ctx, "grafana", 1))
+	assert.ErrorIs(t, instances[0].CheckMessage(ctx, "grafana"), ErrMessageQuotaExceeded)
+	assert.ErrorIs(t, instances[1].CheckRecipients(ctx, "grafana", 1), ErrRecipientQuotaExceeded)
+	usage, err := instances[1].Usage(ctx, "grafana")
+	require.NoError(t, err)
+	assert.Equal(t, &QuotaUsage{Messages: 2, Recipients: 3}, usage)
+
+	now = now.Add(time.Hour * 24)
+	require.NoError(t, instances[0].Record(ctx, "grafana", 1))
+	usage, err = instances[1].Usage(ctx, "grafana")
+	require.NoError(t, err)
+	assert.Equal(t, &QuotaUsage{Messages: 1, Recipients: 1}, usage)
+}
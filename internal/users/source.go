@@ -0,0 +1,75 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	userFileFetchTimeout = time.Second * 30
+	// maxUserFileBytes limits how much is read from remote user files
+	maxUserFileBytes = 10 * 1024 * 1024
+
+	secretScheme = "secret://"
+)
+
+// userFileContentTypes are accepted for remote user files. Some servers serve YAML as plain text.
+var userFileContentTypes = []string{
+	"application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml", "text/plain", "application/octet-stream",
+}
+
+// readUserFile reads the user file from source, which is either a local path, a http(s) URL or a
+// secret:// reference to the environment variable a secret manager exposes the user file in
+func readUserFile(ctx context.Context, source string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(source, "http://"), strings.HasPrefix(source, "https://"):
+		return fetchUserFile(ctx, source)
+	case strings.HasPrefix(source, secretScheme):
+		name := strings.TrimPrefix(source, secretScheme)
+		userFile, exists := os.LookupEnv(name)
+		if !exists || userFile == "" {
+			return nil, fmt.Errorf("environment variable %s of the user file secret is not set", name)
+		}
+		return []byte(userFile), nil
+	default:
+		return os.ReadFile(source)
+	}
+}
+
+func fetchUserFile(ctx context.Context, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, userFileFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create user file request: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch user file: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("user file server responded with status %d", resp.StatusCode)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || !slices.Contains(userFileContentTypes, mediaType) {
+			return nil, fmt.Errorf("user file has unexpected content type %s", contentType)
+		}
+	}
+	userFileBytes, err := io.ReadAll(io.LimitReader(resp.Body, maxUserFileBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read user file: %w", err)
+	}
+	if len(userFileBytes) > maxUserFileBytes {
+		return nil, fmt.Errorf("user file exceeds %d bytes", maxUserFileBytes)
+	}
+	return userFileBytes, nil
+}
@@ -1,11 +1,16 @@
 package users
 
 import (
+	"context"
+	"crypto"
 	"errors"
 	"fmt"
 	"log/slog"
+	"net/url"
 	"os"
+	"sync"
 
+	"github.com/dereulenspiegel/smolmailer/internal/utils"
 	"github.com/go-crypt/crypt"
 	yaml "gopkg.in/yaml.v3"
 )
@@ -14,12 +19,65 @@ type UserConfig struct {
 	Username string `mapstructure:"username" yaml:"username"`
 	Password string `mapstructure:"password" yaml:"password"` // Securely hashed password
 	FromAddr string `mapstructure:"from" yaml:"from"`
+	Quota    *Quota `mapstructure:"quota" yaml:"quota"`
+
+	// DkimDomain, DkimSelector and DkimKey sign the mail of the user with its own domain instead of the
+	// globally configured DKIM signers. DkimKey is the PEM encoded private key.
+	DkimDomain   string `mapstructure:"dkimDomain" yaml:"dkimDomain"`
+	DkimSelector string `mapstructure:"dkimSelector" yaml:"dkimSelector"`
+	DkimKey      string `mapstructure:"dkimKey" yaml:"dkimKey"`
+
+	dkimSigner crypto.Signer
+}
+
+// DkimSigning are the parameters the mail of a user is DKIM signed with
+type DkimSigning struct {
+	Domain   string
+	Selector string
+	Signer   crypto.Signer
+}
+
+// parseDkimKey parses the DKIM key of the user, if the user has its own DKIM signing parameters
+func (c *UserConfig) parseDkimKey() error {
+	if c.DkimDomain == "" && c.DkimSelector == "" && c.DkimKey == "" {
+		return nil
+	}
+	if c.DkimDomain == "" || c.DkimSelector == "" || c.DkimKey == "" {
+		return fmt.Errorf("dkimDomain, dkimSelector and dkimKey of user %s must be set together", c.Username)
+	}
+	privateKey, err := utils.ParseDkimKey(c.DkimKey)
+	if err != nil {
+		return fmt.Errorf("failed to parse the DKIM key of user %s: %w", c.Username, err)
+	}
+	c.dkimSigner = utils.Signer(privateKey)
+	return nil
+}
+
+// Quota limits how much a user may send per day. Limits of 0 or less are not enforced.
+type Quota struct {
+	MaxMessagesPerDay   int `mapstructure:"maxMessagesPerDay" yaml:"maxMessagesPerDay"`
+	MaxRecipientsPerDay int `mapstructure:"maxRecipientsPerDay" yaml:"maxRecipientsPerDay"`
 }
 
 type UserService struct {
+	// source is the path, URL or secret reference the users are read from
+	source        string
+	lock          sync.RWMutex
 	users         map[string]*UserConfig
 	passwdDecoder *crypt.Decoder
 	logger        *slog.Logger
+	// stripAddressDetail ignores the +detail of sender addresses
+	stripAddressDetail bool
+}
+
+type UserServiceOpt func(*UserService)
+
+// WithAddressDetailStripping lets users send with +detail addresses of their sender address, e.g. as
+// user+news@example.com if they may send as user@example.com
+func WithAddressDetailStripping(strip bool) UserServiceOpt {
+	return func(u *UserService) {
+		u.stripAddressDetail = strip
+	}
 }
 
 var (
@@ -27,30 +85,41 @@ var (
 	ErrInvalidCredentials = errors.New("invalid credentials")
 )
 
-func NewUserService(logger *slog.Logger, userFilePath string) (*UserService, error) {
-
-	userFileBytes, err := os.ReadFile(userFilePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read users from %s: %w", userFilePath, err)
-	}
-
+// NewUserService reads the users from userFile, which is either a local path, a http(s) URL or a secret://
+// reference to the environment variable holding the user file
+func NewUserService(logger *slog.Logger, userFile string, opts ...UserServiceOpt) (*UserService, error) {
 	passwdDecoder, err := argon2Decoder()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create password decoder: %w", err)
 	}
 
 	us := &UserService{
+		source:        userFile,
 		passwdDecoder: passwdDecoder,
 		logger:        logger,
 	}
-	err = us.unmarshalConfig(userFileBytes)
-	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
+	for _, opt := range opts {
+		opt(us)
+	}
+	if err := us.Reload(context.Background()); err != nil {
+		return nil, err
 	}
 
 	return us, nil
 }
 
+// Reload reads the users again from the user file. The current users are kept if the user file can't be read.
+func (u *UserService) Reload(ctx context.Context) error {
+	userFileBytes, err := readUserFile(ctx, u.source)
+	if err != nil {
+		return fmt.Errorf("failed to read users from %s: %w", redactUserFileSource(u.source), err)
+	}
+	if err := u.unmarshalConfig(userFileBytes); err != nil {
+		return fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+	return nil
+}
+
 func (u *UserService) unmarshalConfig(userFileBytes []byte) error {
 	userConfigs := []*UserConfig{}
 	if err := yaml.Unmarshal(userFileBytes, &userConfigs); err != nil {
@@ -59,9 +128,14 @@ func (u *UserService) unmarshalConfig(userFileBytes []byte) error {
 
 	userMap := make(map[string]*UserConfig)
 	for _, userCfg := range userConfigs {
+		if err := userCfg.parseDkimKey(); err != nil {
+			return err
+		}
 		userMap[userCfg.Username] = userCfg
 	}
+	u.lock.Lock()
 	u.users = userMap
+	u.lock.Unlock()
 	return nil
 }
 
@@ -70,9 +144,16 @@ func (u *UserService) passwdFromEnv(username string) string {
 	return os.Getenv(envKey)
 }
 
+func (u *UserService) user(username string) (*UserConfig, bool) {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	userCfg, exists := u.users[username]
+	return userCfg, exists
+}
+
 func (u *UserService) Authenticate(username, password string) error {
 	logger := u.logger.With("username", username)
-	if userCfg, exists := u.users[username]; !exists {
+	if userCfg, exists := u.user(username); !exists {
 		logger.Warn("user not found")
 		return ErrInvalidCredentials
 	} else {
@@ -105,9 +186,54 @@ func (u *UserService) Authenticate(username, password string) error {
 	return nil
 }
 
+// Quota returns the daily sending quota of the user, nil if the user may send without limit
+func (u *UserService) Quota(username string) *Quota {
+	if userCfg, exists := u.user(username); exists {
+		return userCfg.Quota
+	}
+	return nil
+}
+
+// DkimSigning returns the DKIM signing parameters of the user, nil if the mail of the user is signed by the
+// globally configured signers
+func (u *UserService) DkimSigning(username string) *DkimSigning {
+	if userCfg, exists := u.user(username); exists && userCfg.dkimSigner != nil {
+		return &DkimSigning{Domain: userCfg.DkimDomain, Selector: userCfg.DkimSelector, Signer: userCfg.dkimSigner}
+	}
+	return nil
+}
+
+// Sender is the address a user sends as and the domain its mail is DKIM signed with, empty if it is signed by
+// the globally configured signers
+type Sender struct {
+	FromAddr   string
+	DkimDomain string
+}
+
+// Senders returns the senders of all users
+func (u *UserService) Senders() []Sender {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	senders := make([]Sender, 0, len(u.users))
+	for _, userCfg := range u.users {
+		senders = append(senders, Sender{FromAddr: userCfg.FromAddr, DkimDomain: userCfg.DkimDomain})
+	}
+	return senders
+}
+
+// IsValidSender returns true if the user may send as from. The domains are compared case-insensitively and
+// the +detail of from is ignored if address detail stripping is enabled.
 func (u *UserService) IsValidSender(username, from string) bool {
-	if userCfg, exists := u.users[username]; exists {
-		return userCfg.FromAddr == from
+	if userCfg, exists := u.user(username); exists {
+		return utils.NormalizeAddress(userCfg.FromAddr, u.stripAddressDetail) == utils.NormalizeAddress(from, u.stripAddressDetail)
 	}
 	return false
 }
+
+// redactUserFileSource removes credentials from user file URLs, so they don't end up in logs
+func redactUserFileSource(source string) string {
+	if sourceUrl, err := url.Parse(source); err == nil && sourceUrl.User != nil {
+		return sourceUrl.Redacted()
+	}
+	return source
+}
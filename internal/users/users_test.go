@@ -1,7 +1,15 @@
 package users
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
 	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -44,4 +52,94 @@ func TestIsValidSender(t *testing.T) {
 
 	valid := us.IsValidSender("authelia", "authelia@example.com")
 	assert.True(t, valid)
+	assert.True(t, us.IsValidSender("authelia", "authelia@EXAMPLE.com"))
+	assert.False(t, us.IsValidSender("authelia", "Authelia@example.com"), "local parts are case-sensitive")
+	assert.False(t, us.IsValidSender("authelia", "authelia+news@example.com"))
+
+	WithAddressDetailStripping(true)(us)
+	assert.True(t, us.IsValidSender("authelia", "authelia+news@Example.com"))
+	assert.False(t, us.IsValidSender("authelia", "other+authelia@example.com"))
+}
+
+const testUserYaml = `
+- username: authelia
+  password: $argon2id$v=19$m=2097152,t=2,p=4$SdrcJ6rSDvgFp3LIbDDZYw$O/iJ19X9KA3OZlsxx7UNy/Rr4rbubKz6sp3G6s4D3AA
+  from: authelia@example.com
+`
+
+func TestUserServiceFromURL(t *testing.T) {
+	userYaml := testUserYaml
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write([]byte(userYaml))
+	}))
+	defer srv.Close()
+
+	us, err := NewUserService(slog.Default(), srv.URL+"/users.yaml")
+	require.NoError(t, err)
+	assert.True(t, us.IsValidSender("authelia", "authelia@example.com"))
+
+	userYaml = strings.ReplaceAll(testUserYaml, "authelia@example.com", "auth@example.com")
+	require.NoError(t, us.Reload(context.Background()))
+	assert.False(t, us.IsValidSender("authelia", "authelia@example.com"))
+	assert.True(t, us.IsValidSender("authelia", "auth@example.com"))
+}
+
+func TestUserServiceRefusesInvalidRemoteUserFiles(t *testing.T) {
+	for _, exp := range []struct {
+		name        string
+		status      int
+		contentType string
+	}{
+		{name: "not found", status: http.StatusNotFound, contentType: "text/plain"},
+		{name: "html error page", status: http.StatusOK, contentType: "text/html; charset=utf-8"},
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", exp.contentType)
+			w.WriteHeader(exp.status)
+			w.Write([]byte(testUserYaml))
+		}))
+		_, err := NewUserService(slog.Default(), srv.URL)
+		assert.Error(t, err, exp.name)
+		srv.Close()
+	}
+
+	_, err := NewUserService(slog.Default(), "http://127.0.0.1:1/users.yaml")
+	assert.Error(t, err)
+}
+
+func TestUserServiceFromSecret(t *testing.T) {
+	t.Setenv("SMOLMAILER_TEST_USERS", testUserYaml)
+	us, err := NewUserService(slog.Default(), "secret://SMOLMAILER_TEST_USERS")
+	require.NoError(t, err)
+	assert.True(t, us.IsValidSender("authelia", "authelia@example.com"))
+
+	_, err = NewUserService(slog.Default(), "secret://SMOLMAILER_TEST_MISSING_USERS")
+	assert.Error(t, err)
+}
+
+func TestUserDkimSigning(t *testing.T) {
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(privKey)
+	require.NoError(t, err)
+	keyPem := strings.TrimSpace(string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})))
+	dkimKeyYaml := "  dkimKey: |\n    " + strings.ReplaceAll(keyPem, "\n", "\n    ") + "\n"
+
+	us := &UserService{logger: slog.Default()}
+	require.NoError(t, us.unmarshalConfig([]byte("- username: tenant\n  dkimDomain: tenant.example.net\n  dkimSelector: mail\n"+dkimKeyYaml+
+		"- username: other\n  from: other@example.com\n")))
+	assert.ElementsMatch(t, []Sender{{DkimDomain: "tenant.example.net"}, {FromAddr: "other@example.com"}}, us.Senders())
+	signing := us.DkimSigning("tenant")
+	require.NotNil(t, signing)
+	assert.Equal(t, "tenant.example.net", signing.Domain)
+	assert.Equal(t, "mail", signing.Selector)
+	assert.Equal(t, privKey.Public(), signing.Signer.Public())
+	assert.Nil(t, us.DkimSigning("other"))
+	assert.Nil(t, us.DkimSigning("unknown"))
+
+	assert.Error(t, us.unmarshalConfig([]byte("- username: tenant\n  dkimDomain: tenant.example.net\n"+dkimKeyYaml)),
+		"the selector is missing")
+	assert.Error(t, us.unmarshalConfig([]byte("- username: tenant\n  dkimDomain: tenant.example.net\n  dkimSelector: mail\n  dkimKey: invalid\n")))
+	assert.NotNil(t, us.DkimSigning("tenant"), "invalid users must not replace the current ones")
 }
@@ -0,0 +1,30 @@
+package utils
+
+import "strings"
+
+// NormalizeAddress returns the form of addr addresses are compared in. The domain is lowercased, since
+// domains are case-insensitive, while the local part keeps its case (RFC 5321 section 2.4). If stripDetail is
+// set, the +detail of the local part is removed, so user+tag@example.com matches user@example.com. The
+// normalized address is only meant for matching and must never replace the transmitted address.
+func NormalizeAddress(addr string, stripDetail bool) string {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return addr
+	}
+	local := addr[:at]
+	if stripDetail && !strings.HasPrefix(local, `"`) {
+		if plus := strings.Index(local, "+"); plus > 0 {
+			local = local[:plus]
+		}
+	}
+	return local + "@" + strings.ToLower(addr[at+1:])
+}
+
+// AddressDomain returns the lowercased domain of addr, empty if addr has none
+func AddressDomain(addr string) string {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(addr[at+1:])
+}
@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeAddress(t *testing.T) {
+	for _, exp := range []struct {
+		addr        string
+		stripDetail bool
+		normalized  string
+	}{
+		{addr: "User@Example.COM", normalized: "User@example.com"},
+		{addr: "user+tag@Example.com", normalized: "user+tag@example.com"},
+		{addr: "user+tag@Example.com", stripDetail: true, normalized: "user@example.com"},
+		{addr: "User+a+b@example.com", stripDetail: true, normalized: "User@example.com"},
+		{addr: "+tag@example.com", stripDetail: true, normalized: "+tag@example.com"},
+		{addr: `"user+tag"@example.com`, stripDetail: true, normalized: `"user+tag"@example.com`},
+		{addr: "postmaster", stripDetail: true, normalized: "postmaster"},
+		{addr: "", normalized: ""},
+	} {
+		assert.Equal(t, exp.normalized, NormalizeAddress(exp.addr, exp.stripDetail), exp.addr)
+	}
+}
+
+func TestAddressDomain(t *testing.T) {
+	assert.Equal(t, "example.com", AddressDomain("User@EXAMPLE.com"))
+	assert.Equal(t, "example.com", AddressDomain(`"a@b"@Example.com`))
+	assert.Empty(t, AddressDomain("postmaster"))
+}
@@ -67,6 +67,16 @@ func dnsDkimKey(publicKey crypto.PublicKey) (string, string, error) {
 	return base64.StdEncoding.EncodeToString(pubkeyBytes), keyType, nil
 }
 
+// DkimKeyAlgorithm returns the DKIM key type (k= tag) of the private key, either ed25519 or rsa
+func DkimKeyAlgorithm(privateKey crypto.PrivateKey) (string, error) {
+	pubKey, err := pubKey(privateKey)
+	if err != nil {
+		return "", err
+	}
+	_, keyType, err := dnsDkimKey(pubKey)
+	return keyType, err
+}
+
 func DkimTxtRecordContent(privateKey crypto.PrivateKey) (string, error) {
 	pubKey, err := pubKey(privateKey)
 	if err != nil {
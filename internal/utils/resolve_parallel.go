@@ -1,22 +1,28 @@
 package utils
 
 import (
+	"context"
 	"errors"
 	"io"
 	"reflect"
 	"sync"
 )
 
-func ResolveParallel[T io.Closer](rfs ...func() (T, error)) (T, error) {
+// ResolveParallel runs all resolve functions concurrently and returns the first successful result. The
+// context passed to the resolve functions is cancelled as soon as a result is found, so the remaining ones
+// can abort. Results which are returned anyway are closed.
+func ResolveParallel[T io.Closer](ctx context.Context, rfs ...func(context.Context) (T, error)) (T, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	resChan := make(chan T, len(rfs))
 	errChan := make(chan error, len(rfs))
 	wg := &sync.WaitGroup{}
 	waitChan := make(chan struct{}, 1)
 	for _, rf := range rfs {
 		wg.Add(1)
-		go func(resChan chan T, errChan chan error, wg *sync.WaitGroup, rf func() (T, error)) {
+		go func(resChan chan T, errChan chan error, wg *sync.WaitGroup, rf func(context.Context) (T, error)) {
 			defer wg.Done()
-			res, err := rf()
+			res, err := rf(ctx)
 			if err != nil {
 				errChan <- err
 				return
@@ -38,6 +44,8 @@ func ResolveParallel[T io.Closer](rfs ...func() (T, error)) (T, error) {
 	var res T
 	select {
 	case res = <-resChan:
+		// Abort the remaining resolve functions, we already have a result
+		cancel()
 		go func(resChan chan T) {
 			defer func() {
 				// Recover and ignore possible panic when closing unused result
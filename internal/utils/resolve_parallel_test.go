@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"errors"
 	"io"
 	"testing"
@@ -19,8 +20,8 @@ func (m *mockCloser) Close() error {
 	return m.Called().Error(0)
 }
 
-func fabFail(delay time.Duration) func() (io.Closer, error) {
-	return func() (io.Closer, error) {
+func fabFail(delay time.Duration) func(context.Context) (io.Closer, error) {
+	return func(context.Context) (io.Closer, error) {
 		time.Sleep(delay)
 		return nil, errors.New("failed after sleep")
 	}
@@ -30,7 +31,7 @@ func TestResolveParallelSuccess(t *testing.T) {
 	unusedResult := new(mockCloser)
 	unusedResult.On("Close").Once().Return(nil)
 
-	fSlow := func() (io.Closer, error) {
+	fSlow := func(context.Context) (io.Closer, error) {
 		time.Sleep(time.Millisecond * 310)
 
 		return unusedResult, nil
@@ -38,7 +39,7 @@ func TestResolveParallelSuccess(t *testing.T) {
 
 	usedResult := new(mockCloser)
 
-	fSuccess := func() (io.Closer, error) {
+	fSuccess := func(context.Context) (io.Closer, error) {
 		time.Sleep(time.Millisecond * 300)
 		return usedResult, nil
 	}
@@ -48,7 +49,7 @@ func TestResolveParallelSuccess(t *testing.T) {
 	ff3 := fabFail(time.Millisecond * 400)
 
 	start := time.Now()
-	res, err := ResolveParallel(ff1, fSlow, fSuccess, ff2, ff3)
+	res, err := ResolveParallel(context.Background(), ff1, fSlow, fSuccess, ff2, ff3)
 	stop := time.Now()
 	runDuration := stop.Sub(start)
 	require.NoError(t, err)
@@ -67,7 +68,7 @@ func TestResolveParallelFail(t *testing.T) {
 	ff3 := fabFail(time.Millisecond * 400)
 
 	start := time.Now()
-	res, err := ResolveParallel(ff1, ff2, ff3)
+	res, err := ResolveParallel(context.Background(), ff1, ff2, ff3)
 	stop := time.Now()
 	runDuration := stop.Sub(start)
 	assert.Error(t, err)
@@ -75,3 +76,53 @@ func TestResolveParallelFail(t *testing.T) {
 	assert.LessOrEqual(t, time.Millisecond*400, runDuration)
 	assert.Less(t, runDuration, time.Millisecond*700)
 }
+
+func TestResolveParallelCancelsLosers(t *testing.T) {
+	usedResult := new(mockCloser)
+	fSuccess := func(context.Context) (io.Closer, error) {
+		time.Sleep(time.Millisecond * 50)
+		return usedResult, nil
+	}
+
+	loserErrs := make(chan error, 2)
+	fLoser := func(ctx context.Context) (io.Closer, error) {
+		select {
+		case <-ctx.Done():
+			loserErrs <- ctx.Err()
+			return nil, ctx.Err()
+		case <-time.After(time.Second * 5):
+			// Completing would mean the losing dial was not aborted
+			loserErrs <- nil
+			return new(mockCloser), nil
+		}
+	}
+
+	start := time.Now()
+	res, err := ResolveParallel(context.Background(), fLoser, fSuccess, fLoser)
+	require.NoError(t, err)
+	assert.Same(t, usedResult, res)
+
+	for range 2 {
+		select {
+		case loserErr := <-loserErrs:
+			assert.ErrorIs(t, loserErr, context.Canceled)
+		case <-time.After(time.Second):
+			t.Fatal("losing resolve function was not cancelled")
+		}
+	}
+	assert.Less(t, time.Since(start), time.Second)
+	usedResult.AssertNotCalled(t, "Close")
+}
+
+func TestResolveParallelParentCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	fBlocking := func(ctx context.Context) (io.Closer, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	time.AfterFunc(time.Millisecond*50, cancel)
+	res, err := ResolveParallel(ctx, fBlocking, fBlocking)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Nil(t, res)
+}